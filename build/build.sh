@@ -7,7 +7,7 @@
 
 DOCKERFILE="\
 # Build Stage
-FROM golang:1.13 AS build-stage
+FROM golang:1.22 AS build-stage
 ADD ./ /latte
 RUN cd /latte && env GOOS=linux GOARCH=amd64 go build {BUILD_TAGS} ./cmd/latte
 
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// benchResult is what a single benchmark worker saw.
+type benchResult struct {
+	latencies []time.Duration
+	statuses  map[int]int
+	// errors counts the requests that didn't get a response at all
+	errors int
+}
+
+// bench load tests a LaTTe server with a representative /generate request, reporting latency percentiles and error rates.
+func bench(args []string, errLog, infoLog *log.Logger) {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	server := fs.String("server", "http://localhost:27182", "URL of the LaTTe server")
+	payload := fs.String("payload", "", "path to a .json file holding the /generate request body")
+	query := fs.String("query", "", "query string of the /generate requests, e.g. tmpl=ID&dtls=ID")
+	apiKey := fs.String("api-key", "", "API key to authenticate with")
+	concurrency := fs.Int("concurrency", 16, "how many requests are in flight at once")
+	duration := fs.Duration("duration", 60*time.Second, "how long to keep sending requests for")
+	fs.Parse(args)
+
+	var body []byte
+	if *payload != "" {
+		var err error
+		if body, err = ioutil.ReadFile(*payload); err != nil {
+			errLog.Fatalf("error while reading payload %s: %v", *payload, err)
+		}
+	} else if *query == "" {
+		errLog.Fatal("need a payload and/or a query to send")
+	}
+	if *concurrency <= 0 {
+		errLog.Fatal("concurrency must be positive")
+	}
+	url := strings.TrimSuffix(*server, "/") + "/generate"
+	if *query != "" {
+		url += "?" + *query
+	}
+
+	infoLog.Printf("sending requests to %s from %d workers for %v", url, *concurrency, *duration)
+	ctx, cancel := context.WithTimeout(context.Background(), *duration)
+	defer cancel()
+	results := make([]benchResult, *concurrency)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := range results {
+		wg.Add(1)
+		go func(res *benchResult) {
+			defer wg.Done()
+			res.statuses = map[int]int{}
+			for ctx.Err() == nil {
+				req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+				if err != nil {
+					errLog.Fatal(err)
+				}
+				if body != nil {
+					req.Header.Set("Content-Type", "application/json")
+				}
+				if *apiKey != "" {
+					req.Header.Set("X-API-Key", *apiKey)
+				}
+				sent := time.Now()
+				resp, err := http.DefaultClient.Do(req)
+				if err == nil {
+					// Latencies include reading the whole PDF
+					_, err = io.Copy(ioutil.Discard, resp.Body)
+					resp.Body.Close()
+				}
+				if ctx.Err() != nil {
+					// Requests cut short by the end of the benchmark don't count
+					return
+				}
+				if err != nil {
+					res.errors++
+					continue
+				}
+				res.latencies = append(res.latencies, time.Since(sent))
+				res.statuses[resp.StatusCode]++
+			}
+		}(&results[i])
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	var latencies []time.Duration
+	statuses := map[int]int{}
+	errors := 0
+	for _, res := range results {
+		latencies = append(latencies, res.latencies...)
+		for code, n := range res.statuses {
+			statuses[code] += n
+		}
+		errors += res.errors
+	}
+	printBenchReport(os.Stdout, elapsed, latencies, statuses, errors)
+}
+
+func printBenchReport(w io.Writer, elapsed time.Duration, latencies []time.Duration, statuses map[int]int, errors int) {
+	total := len(latencies) + errors
+	failed := errors
+	for code, n := range statuses {
+		if code != http.StatusOK {
+			failed += n
+		}
+	}
+	fmt.Fprintf(w, "requests:    %d in %v (%.2f/s)\n", total, elapsed.Round(time.Millisecond), float64(total)/elapsed.Seconds())
+	if total == 0 {
+		return
+	}
+	fmt.Fprintf(w, "errors:      %d (%.2f%%)\n", failed, 100*float64(failed)/float64(total))
+	var codes []int
+	for code := range statuses {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		fmt.Fprintf(w, "  %d:        %d\n", code, statuses[code])
+	}
+	if errors > 0 {
+		fmt.Fprintf(w, "  no response: %d\n", errors)
+	}
+	if len(latencies) == 0 {
+		return
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	fmt.Fprintln(w, "latency:")
+	for _, p := range []float64{50, 90, 95, 99, 100} {
+		i := int(p/100*float64(len(latencies))+0.5) - 1
+		if i < 0 {
+			i = 0
+		}
+		if i >= len(latencies) {
+			i = len(latencies) - 1
+		}
+		label := fmt.Sprintf("p%g", p)
+		if p == 100 {
+			label = "max"
+		}
+		fmt.Fprintf(w, "  %-11s%v\n", label, latencies[i].Round(time.Millisecond))
+	}
+}
@@ -12,7 +12,7 @@ import (
 )
 
 func cli(cmd string, errLog, infoLog *log.Logger) {
-	t := flag.String("t", "", "path to template/tex file")
+	t := flag.String("t", "", "path to template/tex or typ file")
 	d := flag.String("d", "", "path to details json file")
 	flag.Parse()
 	p := os.Args[len(os.Args)-1]
@@ -44,8 +44,13 @@ func cli(cmd string, errLog, infoLog *log.Logger) {
 		}
 	}
 
-	if filepath.Ext(*t) != ".tex" {
-		errLog.Fatalf("%s must be a valid .tex file", *t)
+	var ts compile.Typesetter = &compile.TeX{Command: cmd}
+	switch filepath.Ext(*t) {
+	case ".tex":
+	case ".typ":
+		ts = &compile.Typst{Command: os.Getenv("LATTE_TYPST")}
+	default:
+		errLog.Fatalf("%s must be a valid .tex or .typ file", *t)
 	}
 	_, err := os.Stat(*t)
 	if err != nil {
@@ -81,9 +86,9 @@ func cli(cmd string, errLog, infoLog *log.Logger) {
 		errLog.Fatalf("error while decoding json file %s: %v", *t, err)
 	}
 
-	pdfPath, err := compile.Compile(context.Background(), tmpl, dtls, p, cmd)
+	res, err := ts.Render(context.Background(), compile.Job{Template: tmpl, Details: dtls, Dir: p})
 	if err != nil {
 		errLog.Fatalf("error while compiling pdf: %v", err)
 	}
-	infoLog.Printf("Successfully created PDF at location: %s", filepath.Join(p, pdfPath))
+	infoLog.Printf("Successfully created PDF at location: %s", filepath.Join(p, res.PDF))
 }
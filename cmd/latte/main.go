@@ -1,19 +1,30 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"github.com/gorilla/handlers"
+	"github.com/raphaelreyna/latte/internal/compile"
 	"github.com/raphaelreyna/latte/internal/server"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
 const (
 	// If cache sizes is not provided by environment, default to 15 for both
 	defaultTCS = 15
 	defaultRCS = 15
+	// defaultDrainTimeout is how long in-flight requests are given to finish on shutdown, unless set by LATTE_DRAIN_TIMEOUT
+	defaultDrainTimeout = 30 * time.Second
 )
 
 var db server.DB
@@ -23,9 +34,33 @@ func main() {
 	errLog := log.New(os.Stderr, "ERROR: ", log.Lshortfile|log.LstdFlags)
 	infoLog := log.New(os.Stdout, "INFO: ", log.Lshortfile|log.LstdFlags)
 
-	// Check for pdfLaTeX (pdfTex will do in a pinch)
+	// Load testing a server doesn't need a TeX installation
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		bench(os.Args[2:], errLog, infoLog)
+		os.Exit(0)
+	}
+
+	// Compilations dispatched to Kubernetes Jobs are run by the Jobs with the same binary, which is all they need
+	if len(os.Args) > 1 && os.Args[1] == "run-dispatched" {
+		if len(os.Args) != 3 {
+			errLog.Fatal("usage: latte run-dispatched DIR")
+		}
+		if err := compile.RunDispatched(context.Background(), os.Args[2]); err != nil {
+			errLog.Fatalf("error while running dispatched compilation: %v", err)
+		}
+		os.Exit(0)
+	}
+
+	// Check for pdfLaTeX (pdfTex will do in a pinch), unless another engine is used by default.
+	// Compilations run in containers use the TeX installation of their image instead.
 	cmd := "pdflatex"
-	if _, err := exec.LookPath(cmd); err != nil {
+	inContainers := strings.EqualFold(os.Getenv("LATTE_SANDBOX"), "docker") || os.Getenv("LATTE_KUBERNETES_IMAGE") != ""
+	if engine := os.Getenv("LATTE_ENGINE"); engine != "" {
+		if _, err := exec.LookPath(engine); err != nil && !inContainers {
+			errLog.Fatalf("%s binary not found: %v", engine, err)
+		}
+		cmd = engine
+	} else if _, err := exec.LookPath(cmd); err != nil && !inContainers {
 		errLog.Printf("error while searching checking pdflatex binary: %v\n\tchecking for pdftex binary", err)
 		if _, err := exec.LookPath("pdftex"); err != nil {
 			errLog.Fatal("neither pdflatex nor pdftex binary found in your $PATH")
@@ -45,7 +80,7 @@ func main() {
 	if root == "" {
 		root, err = os.UserCacheDir()
 		if err != nil {
-			errLog.Fatal("error creating root cache directory: %v", err)
+			errLog.Fatalf("error creating root cache directory: %v", err)
 		}
 	}
 	infoLog.Printf("root cache directory: %s", root)
@@ -62,15 +97,485 @@ func main() {
 		infoLog.Printf("couldn't pull resources cache size from environment: defaulting to %d", defaultRCS)
 		rcs = defaultRCS
 	}
-	s, err := server.NewServer(root, cmd, db, errLog, infoLog, tcs, rcs)
+	tMaxSize := os.Getenv("LATTE_TMPL_MAX_SIZE")
+	tms, err := strconv.Atoi(tMaxSize)
+	if err != nil && tMaxSize != "" {
+		infoLog.Printf("couldn't parse max template size from environment: templates of any size will be cached")
+	}
+	cfg := server.Config{
+		Cache: server.CacheConfig{
+			TmplSize:     tcs,
+			RscSize:      rcs,
+			TmplMaxBytes: tms,
+			Policy:       os.Getenv("LATTE_CACHE_POLICY"),
+		},
+		Placement:   os.Getenv("LATTE_RSC_PLACEMENT"),
+		Sunset:      os.Getenv("LATTE_UNVERSIONED_SUNSET"),
+		LibraryDir:  os.Getenv("LATTE_LIBRARY"),
+		MessagesDir: os.Getenv("LATTE_MESSAGES"),
+	}
+	if convert, err := strconv.ParseBool(os.Getenv("LATTE_CONVERT_IMAGES")); err == nil {
+		cfg.NoImageConversion = !convert
+	}
+	if maxDim, err := strconv.Atoi(os.Getenv("LATTE_IMAGE_MAX_DIM")); err == nil {
+		cfg.ImageMaxDim = maxDim
+	}
+	if quality, err := strconv.Atoi(os.Getenv("LATTE_IMAGE_QUALITY")); err == nil {
+		cfg.ImageQuality = quality
+	}
+	if require, err := strconv.ParseBool(os.Getenv("LATTE_REQUIRE_EMBEDDED_FONTS")); err == nil {
+		cfg.RequireEmbeddedFonts = require
+	}
+	if deterministic, err := strconv.ParseBool(os.Getenv("LATTE_DETERMINISTIC")); err == nil {
+		cfg.Deterministic = deterministic
+	}
+	if provenance, err := strconv.ParseBool(os.Getenv("LATTE_PROVENANCE")); err == nil {
+		cfg.Provenance = provenance
+	}
+	if rerun, err := strconv.ParseBool(os.Getenv("LATTE_RERUN")); err == nil {
+		cfg.Rerun = rerun
+	}
+	if max, err := strconv.Atoi(os.Getenv("LATTE_MAX_PASSES")); err == nil {
+		cfg.MaxPasses = max
+	}
+	cfg.Bibliography = os.Getenv("LATTE_BIBLIOGRAPHY")
+	cfg.Bibtex = os.Getenv("LATTE_BIBTEX")
+	cfg.Biber = os.Getenv("LATTE_BIBER")
+	cfg.Makeindex = os.Getenv("LATTE_MAKEINDEX")
+	cfg.Makeglossaries = os.Getenv("LATTE_MAKEGLOSSARIES")
+	cfg.ShellEscape, _ = strconv.ParseBool(os.Getenv("LATTE_SHELL_ESCAPE"))
+	if kind := os.Getenv("LATTE_SANDBOX"); kind != "" {
+		cfg.Sandbox = &server.SandboxConfig{
+			Kind:     kind,
+			Command:  os.Getenv("LATTE_SANDBOX_COMMAND"),
+			ReadOnly: splitList(os.Getenv("LATTE_SANDBOX_PATHS")),
+			Image:    os.Getenv("LATTE_SANDBOX_IMAGE"),
+			Network:  os.Getenv("LATTE_SANDBOX_NETWORK"),
+		}
+		// The user is given as UID or UID:GID, the group defaulting to the one of the same number
+		if user := os.Getenv("LATTE_SANDBOX_USER"); user != "" {
+			ids := strings.SplitN(user, ":", 2)
+			uid, err := strconv.ParseUint(ids[0], 10, 32)
+			gid := uid
+			if err == nil && len(ids) == 2 {
+				gid, err = strconv.ParseUint(ids[1], 10, 32)
+			}
+			if err != nil {
+				errLog.Fatalf("invalid sandbox user: %s", user)
+			}
+			cfg.Sandbox.UID, cfg.Sandbox.GID = uint32(uid), uint32(gid)
+		}
+	}
+	if image := os.Getenv("LATTE_KUBERNETES_IMAGE"); image != "" {
+		cfg.Kubernetes = &server.KubernetesConfig{
+			Image:     image,
+			Command:   strings.Fields(os.Getenv("LATTE_KUBERNETES_COMMAND")),
+			Namespace: os.Getenv("LATTE_KUBERNETES_NAMESPACE"),
+			Volume:    os.Getenv("LATTE_KUBERNETES_VOLUME"),
+			APIServer: os.Getenv("LATTE_KUBERNETES_API"),
+			Requests:  map[string]string{},
+			Limits:    map[string]string{},
+		}
+		// Resources are given as a comma separated list of RESOURCE=QUANTITY
+		for env, resources := range map[string]map[string]string{"LATTE_KUBERNETES_REQUESTS": cfg.Kubernetes.Requests, "LATTE_KUBERNETES_LIMITS": cfg.Kubernetes.Limits} {
+			for _, entry := range splitList(os.Getenv(env)) {
+				parts := strings.SplitN(entry, "=", 2)
+				if len(parts) != 2 {
+					errLog.Fatalf("invalid kubernetes resource: %s", entry)
+				}
+				resources[parts[0]] = parts[1]
+			}
+		}
+	}
+	switch cleanup := strings.ToLower(os.Getenv("LATTE_CLEANUP")); cleanup {
+	case "", "queued":
+	case "sync":
+		cfg.Cleanup.Sync = true
+	default:
+		errLog.Fatalf("unknown cleanup mode: %s", cleanup)
+	}
+	if shred, err := strconv.ParseBool(os.Getenv("LATTE_SHRED")); err == nil {
+		cfg.Cleanup.Shred = shred
+	}
+	if noPersist, err := strconv.ParseBool(os.Getenv("LATTE_NO_PERSIST")); err == nil {
+		cfg.NoPersist = noPersist
+	}
+	cfg.Typst = os.Getenv("LATTE_TYPST")
+	cfg.Engines = splitList(os.Getenv("LATTE_ENGINES"))
+	if timeout, err := time.ParseDuration(os.Getenv("LATTE_COMPILE_TIMEOUT")); err == nil {
+		cfg.CompileTimeout = timeout
+	}
+	if cpu, err := time.ParseDuration(os.Getenv("LATTE_COMPILE_CPU")); err == nil {
+		cfg.CompileCPU = cpu
+	}
+	if max, err := strconv.ParseInt(os.Getenv("LATTE_COMPILE_MEMORY"), 10, 64); err == nil {
+		cfg.CompileMemory = max
+	}
+	if cpus, err := strconv.ParseFloat(os.Getenv("LATTE_COMPILE_CPUS"), 64); err == nil {
+		cfg.CompileCPUs = cpus
+	}
+	cfg.Cgroup = os.Getenv("LATTE_CGROUP")
+	if max, err := strconv.Atoi(os.Getenv("LATTE_MAX_CONCURRENT")); err == nil {
+		cfg.MaxConcurrent = max
+	}
+	if max, err := strconv.Atoi(os.Getenv("LATTE_MAX_QUEUED")); err == nil {
+		cfg.MaxQueued = max
+	}
+	if max, err := strconv.ParseInt(os.Getenv("LATTE_MAX_BODY_SIZE"), 10, 64); err == nil {
+		cfg.MaxBodyBytes = max
+	}
+	if max, err := strconv.ParseInt(os.Getenv("LATTE_MAX_RESOURCE_SIZE"), 10, 64); err == nil {
+		cfg.MaxResourceBytes = max
+	}
+	if max, err := strconv.Atoi(os.Getenv("LATTE_MAX_RESOURCES")); err == nil {
+		cfg.MaxResources = max
+	}
+	cfg.WSOrigins = splitList(os.Getenv("LATTE_WS_ORIGINS"))
+	if allowed, set := os.LookupEnv("LATTE_COMPILE_ENV"); set {
+		cfg.CompileEnv = splitList(allowed)
+	}
+	// Scopes are mapped to permissions as a comma separated list of SCOPE=PERMISSION+PERMISSION
+	scopes := map[string][]string{}
+	for _, mapping := range splitList(os.Getenv("LATTE_OAUTH_SCOPES")) {
+		parts := strings.SplitN(mapping, "=", 2)
+		if len(parts) != 2 {
+			errLog.Fatalf("invalid scope mapping: %s", mapping)
+		}
+		scopes[parts[0]] = strings.Split(parts[1], "+")
+	}
+	if issuer, introspection := os.Getenv("LATTE_OAUTH_ISSUER"), os.Getenv("LATTE_OAUTH_INTROSPECTION_URL"); issuer != "" || introspection != "" {
+		cfg.OAuth = &server.OAuthConfig{
+			Issuer:           issuer,
+			IntrospectionURL: introspection,
+			ClientID:         os.Getenv("LATTE_OAUTH_CLIENT_ID"),
+			ClientSecret:     os.Getenv("LATTE_OAUTH_CLIENT_SECRET"),
+			Scopes:           scopes,
+		}
+	}
+	if issuer, jwks := os.Getenv("LATTE_JWT_ISSUER"), os.Getenv("LATTE_JWT_JWKS_URL"); issuer != "" || jwks != "" {
+		cfg.JWT = &server.JWTConfig{
+			JWKSURL:     jwks,
+			Issuer:      issuer,
+			Audience:    os.Getenv("LATTE_JWT_AUDIENCE"),
+			TenantClaim: os.Getenv("LATTE_JWT_TENANT_CLAIM"),
+			Scopes:      scopes,
+		}
+	}
+	if file, id := os.Getenv("LATTE_RBAC_FILE"), os.Getenv("LATTE_RBAC_ID"); file != "" || id != "" {
+		cfg.RBAC = &server.RBACConfig{File: file, ID: id}
+	}
+	if file := os.Getenv("LATTE_HMAC_FILE"); file != "" {
+		cfg.HMAC = &server.HMACConfig{File: file}
+		cfg.HMAC.Required, _ = strconv.ParseBool(os.Getenv("LATTE_HMAC_REQUIRED"))
+		if skew, err := strconv.Atoi(os.Getenv("LATTE_HMAC_MAX_SKEW")); err == nil {
+			cfg.HMAC.MaxSkew = time.Duration(skew) * time.Second
+		}
+	}
+	if periods := splitList(os.Getenv("LATTE_RETENTION")); len(periods) > 0 {
+		cfg.Retention = &server.RetentionConfig{Periods: map[string]time.Duration{}}
+		// Retention periods are given as a comma separated list of CATEGORY=DURATION
+		for _, period := range periods {
+			parts := strings.SplitN(period, "=", 2)
+			var d time.Duration
+			if len(parts) == 2 {
+				d, err = time.ParseDuration(parts[1])
+			}
+			if len(parts) != 2 || err != nil {
+				errLog.Fatalf("invalid retention period: %s", period)
+			}
+			cfg.Retention.Periods[parts[0]] = d
+		}
+		if interval, err := time.ParseDuration(os.Getenv("LATTE_RETENTION_INTERVAL")); err == nil {
+			cfg.Retention.Interval = interval
+		}
+	}
+	if max, err := strconv.ParseInt(os.Getenv("LATTE_ROOT_MAX_SIZE"), 10, 64); err == nil {
+		cfg.Janitor = &server.JanitorConfig{MaxBytes: max}
+	}
+	if age, err := time.ParseDuration(os.Getenv("LATTE_ROOT_MAX_AGE")); err == nil {
+		if cfg.Janitor == nil {
+			cfg.Janitor = &server.JanitorConfig{}
+		}
+		cfg.Janitor.MaxAge = age
+	}
+	if interval, err := time.ParseDuration(os.Getenv("LATTE_ROOT_SWEEP_INTERVAL")); err == nil && cfg.Janitor != nil {
+		cfg.Janitor.Interval = interval
+	}
+	if swagger, err := strconv.ParseBool(os.Getenv("LATTE_SWAGGER_UI")); err == nil {
+		cfg.SwaggerUI = swagger
+	}
+	if strict, err := strconv.ParseBool(os.Getenv("LATTE_STRICT")); err == nil {
+		cfg.Strict = strict
+	}
+	if slow, err := time.ParseDuration(os.Getenv("LATTE_SLOW_COMPILE")); err == nil {
+		cfg.SlowCompile = slow
+	}
+	if limit, err := strconv.Atoi(os.Getenv("LATTE_TEMPLATE_METRICS_LIMIT")); err == nil {
+		cfg.TemplateMetricsLimit = limit
+	}
+	cfg.Usage = server.UsageConfig{
+		ExportDir:    os.Getenv("LATTE_USAGE_EXPORT_DIR"),
+		ExportFormat: os.Getenv("LATTE_USAGE_EXPORT_FORMAT"),
+	}
+	if interval, err := time.ParseDuration(os.Getenv("LATTE_USAGE_EXPORT_INTERVAL")); err == nil {
+		cfg.Usage.ExportInterval = interval
+	}
+	cfg.Secrets = &server.SecretsConfig{
+		VaultAddr:      os.Getenv("LATTE_VAULT_ADDR"),
+		VaultToken:     os.Getenv("LATTE_VAULT_TOKEN"),
+		VaultNamespace: os.Getenv("LATTE_VAULT_NAMESPACE"),
+		VaultMounts:    splitList(os.Getenv("LATTE_VAULT_MOUNTS")),
+		Env:            splitList(os.Getenv("LATTE_SECRET_ENV")),
+	}
+	// Fall back to Vault's own variables
+	if cfg.Secrets.VaultAddr == "" {
+		cfg.Secrets.VaultAddr = os.Getenv("VAULT_ADDR")
+	}
+	if cfg.Secrets.VaultToken == "" {
+		cfg.Secrets.VaultToken = os.Getenv("VAULT_TOKEN")
+	}
+	if sources := splitList(os.Getenv("LATTE_DTLS_URL_SOURCES")); len(sources) > 0 {
+		cfg.RemoteDetails = &server.RemoteDetailsConfig{}
+		// Credentials are given as a comma separated list of PREFIX=AUTHORIZATION
+		auth := map[string]string{}
+		for _, entry := range splitList(os.Getenv("LATTE_DTLS_URL_AUTH")) {
+			if parts := strings.SplitN(entry, "=", 2); len(parts) == 2 {
+				auth[parts[0]] = parts[1]
+			}
+		}
+		for _, prefix := range sources {
+			cfg.RemoteDetails.Sources = append(cfg.RemoteDetails.Sources, server.RemoteSource{Prefix: prefix, Authorization: auth[prefix]})
+		}
+		if timeout, err := time.ParseDuration(os.Getenv("LATTE_DTLS_URL_TIMEOUT")); err == nil {
+			cfg.RemoteDetails.Timeout = timeout
+		}
+		if ttl, err := time.ParseDuration(os.Getenv("LATTE_DTLS_URL_CACHE_TTL")); err == nil {
+			cfg.RemoteDetails.CacheTTL = ttl
+		}
+	}
+	if dir := os.Getenv("LATTE_ARCHIVE_DIR"); dir != "" {
+		cfg.Archive = &server.ArchiveConfig{Dir: dir}
+	}
+	cfg.Jobs = &server.JobsConfig{}
+	if workers, err := strconv.Atoi(os.Getenv("LATTE_JOBS_WORKERS")); err == nil {
+		cfg.Jobs.Workers = workers
+	}
+	if queue, err := strconv.Atoi(os.Getenv("LATTE_JOBS_QUEUE")); err == nil {
+		cfg.Jobs.Queue = queue
+	}
+	if expiry, err := time.ParseDuration(os.Getenv("LATTE_JOBS_EXPIRY")); err == nil {
+		cfg.Jobs.Expiry = expiry
+	}
+	cfg.Jobs.Callbacks = splitList(os.Getenv("LATTE_JOBS_CALLBACK_URLS"))
+	cfg.Jobs.CallbackSecret = os.Getenv("LATTE_JOBS_CALLBACK_SECRET")
+	if retries, err := strconv.Atoi(os.Getenv("LATTE_JOBS_CALLBACK_RETRIES")); err == nil {
+		cfg.Jobs.CallbackRetries = retries
+	}
+	// Sinks are given as a comma separated list of NAME=URL
+	cfg.Sinks = map[string]string{}
+	for _, entry := range splitList(os.Getenv("LATTE_SINKS")) {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			errLog.Fatalf("invalid sink: %s", entry)
+		}
+		cfg.Sinks[parts[0]] = parts[1]
+	}
+	cfg.GCS = server.AWSConfig{
+		AccessKeyID:     os.Getenv("LATTE_GCS_HMAC_ACCESS_ID"),
+		SecretAccessKey: os.Getenv("LATTE_GCS_HMAC_SECRET"),
+	}
+	if addr := os.Getenv("LATTE_SMTP_ADDR"); addr != "" {
+		cfg.SMTP = &server.SMTPConfig{
+			Addr:     addr,
+			Username: os.Getenv("LATTE_SMTP_USERNAME"),
+			Password: os.Getenv("LATTE_SMTP_PASSWORD"),
+			From:     os.Getenv("LATTE_SMTP_FROM"),
+		}
+		cfg.SMTP.TLS, _ = strconv.ParseBool(os.Getenv("LATTE_SMTP_TLS"))
+	}
+	// Fall back to OpenTelemetry's own variables
+	endpoint := os.Getenv("LATTE_OTLP_ENDPOINT")
+	if endpoint == "" {
+		endpoint = os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	}
+	if base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); endpoint == "" && base != "" {
+		endpoint = strings.TrimSuffix(base, "/") + "/v1/traces"
+	}
+	if endpoint != "" {
+		cfg.Tracing = &server.TracingConfig{Endpoint: endpoint, ServiceName: os.Getenv("OTEL_SERVICE_NAME"), Headers: map[string]string{}}
+		// Headers are given as a comma separated list of NAME=VALUE
+		for _, header := range splitList(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS")) {
+			if parts := strings.SplitN(header, "=", 2); len(parts) == 2 {
+				cfg.Tracing.Headers[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+			}
+		}
+	}
+	if dir := os.Getenv("LATTE_WATCH_DIR"); dir != "" {
+		cfg.Watch = &server.WatchConfig{Dir: dir}
+		if interval, err := time.ParseDuration(os.Getenv("LATTE_WATCH_INTERVAL")); err == nil {
+			cfg.Watch.Interval = interval
+		}
+	}
+	if upstream := os.Getenv("LATTE_SYNC_UPSTREAM"); upstream != "" {
+		cfg.Sync = &server.SyncConfig{Upstream: upstream, Token: os.Getenv("LATTE_SYNC_TOKEN"), Templates: map[string]string{}}
+		// Templates are given as a comma separated list of ID or ID=VERSION
+		for _, tmpl := range splitList(os.Getenv("LATTE_SYNC_TEMPLATES")) {
+			parts := strings.SplitN(tmpl, "=", 2)
+			if len(parts) == 2 {
+				cfg.Sync.Templates[parts[0]] = parts[1]
+			} else {
+				cfg.Sync.Templates[tmpl] = ""
+			}
+		}
+		if interval, err := time.ParseDuration(os.Getenv("LATTE_SYNC_INTERVAL")); err == nil {
+			cfg.Sync.Interval = interval
+		}
+	}
+	cfg.AWS = server.AWSConfig{
+		Region:          os.Getenv("AWS_REGION"),
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		S3Endpoint:      os.Getenv("LATTE_S3_ENDPOINT"),
+	}
+	if bucket := os.Getenv("LATTE_S3_BUCKET"); bucket != "" {
+		if db != nil {
+			errLog.Fatal("LATTE_S3_BUCKET can't be used along with a database LaTTe was compiled with")
+		}
+		db, err = server.NewS3DB(cfg.AWS, server.S3Config{Bucket: bucket, Prefix: os.Getenv("LATTE_S3_PREFIX")})
+		if err != nil {
+			errLog.Fatal(err)
+		}
+	}
+	if u := os.Getenv("LATTE_REDIS_URL"); u != "" {
+		if db != nil {
+			errLog.Fatal("LATTE_REDIS_URL can't be used along with another database")
+		}
+		rcfg := server.RedisConfig{URL: u, Prefix: os.Getenv("LATTE_REDIS_PREFIX")}
+		// TTLs are given as a comma separated list of PATTERN=DURATION
+		for _, entry := range splitList(os.Getenv("LATTE_REDIS_TTL")) {
+			parts := strings.SplitN(entry, "=", 2)
+			if len(parts) != 2 {
+				errLog.Fatalf("invalid redis ttl: %s", entry)
+			}
+			ttl, err := time.ParseDuration(parts[1])
+			if err != nil {
+				errLog.Fatalf("invalid redis ttl: %s", entry)
+			}
+			rcfg.TTLs = append(rcfg.TTLs, server.RedisTTL{Pattern: parts[0], TTL: ttl})
+		}
+		db, err = server.NewRedisDB(rcfg)
+		if err != nil {
+			errLog.Fatal(err)
+		}
+	}
+	if dir := os.Getenv("LATTE_DB_DIR"); dir != "" {
+		if db != nil {
+			errLog.Fatal("LATTE_DB_DIR can't be used along with another database")
+		}
+		db, err = server.NewFileDB(dir)
+		if err != nil {
+			errLog.Fatal(err)
+		}
+	}
+	if queue := os.Getenv("LATTE_EVENTS_QUEUE_URL"); queue != "" {
+		cfg.Events = &server.EventsConfig{QueueURL: queue}
+		// Rules are given as a comma separated list of PREFIX=TEMPLATE=OUTPUT_PREFIX
+		for _, rule := range splitList(os.Getenv("LATTE_EVENTS_RULES")) {
+			parts := strings.SplitN(rule, "=", 3)
+			if len(parts) != 3 {
+				errLog.Fatalf("invalid event rule: %s", rule)
+			}
+			cfg.Events.Rules = append(cfg.Events.Rules, server.EventRule{Prefix: parts[0], Template: parts[1], OutputPrefix: parts[2]})
+		}
+	}
+	s, err := server.NewServer(root, cmd, db, errLog, infoLog, cfg)
 	if err != nil {
 		errLog.Fatal(err)
 	}
 
+	// Pre-warm the caches so the first requests after startup don't have to fetch and parse everything
+	tmplIDs := splitList(os.Getenv("LATTE_WARM_TMPLS"))
+	rscIDs := splitList(os.Getenv("LATTE_WARM_RSCS"))
+	if len(tmplIDs) > 0 || len(rscIDs) > 0 {
+		for id, err := range s.WarmCache(context.Background(), tmplIDs, rscIDs) {
+			errLog.Printf("error while warming cache with %s: %v", id, err)
+		}
+	}
+
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "27182"
 	}
-	infoLog.Printf("listening for HTTP traffic on port: %s ...", port)
-	errLog.Fatal(http.ListenAndServe(":"+port, handlers.CORS(handlers.AllowedHeaders([]string{"X-Requested-With", "Content-Type", "Authorization", "Access-Control-Allow-Origin"}), handlers.AllowedMethods([]string{"GET", "POST", "PUT", "HEAD", "OPTIONS"}), handlers.AllowedOrigins([]string{"*"}))(s)))
+	drainTimeout := defaultDrainTimeout
+	if timeout, err := time.ParseDuration(os.Getenv("LATTE_DRAIN_TIMEOUT")); err == nil {
+		drainTimeout = timeout
+	}
+	srv := &http.Server{
+		Addr:    ":" + port,
+		Handler: handlers.CORS(handlers.AllowedHeaders([]string{"X-Requested-With", "Content-Type", "Authorization", "X-API-Key", "X-Latte-Client", "X-Latte-Timestamp", "X-Latte-Signature", "X-Request-ID", "Access-Control-Allow-Origin"}), handlers.AllowedMethods([]string{"GET", "POST", "PUT", "DELETE", "HEAD", "OPTIONS"}), handlers.AllowedOrigins([]string{"*"}), handlers.ExposedHeaders(server.ExposedHeaders))(s),
+	}
+	// TLS is terminated by LaTTe itself when given a certificate, and clients must present certificates of their own when given a CA
+	cert, key := os.Getenv("LATTE_TLS_CERT"), os.Getenv("LATTE_TLS_KEY")
+	if (cert == "") != (key == "") {
+		errLog.Fatal("LATTE_TLS_CERT and LATTE_TLS_KEY must be set together")
+	}
+	if clientCA := os.Getenv("LATTE_TLS_CLIENT_CA"); clientCA != "" {
+		if cert == "" {
+			errLog.Fatal("LATTE_TLS_CLIENT_CA requires LATTE_TLS_CERT and LATTE_TLS_KEY")
+		}
+		pem, err := ioutil.ReadFile(clientCA)
+		if err != nil {
+			errLog.Fatal(err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			errLog.Fatalf("no certificates found in %s", clientCA)
+		}
+		srv.TLSConfig = &tls.Config{ClientCAs: pool, ClientAuth: tls.RequireAndVerifyClientCert}
+	}
+	if cert != "" {
+		if srv.TLSConfig == nil {
+			srv.TLSConfig = &tls.Config{}
+		}
+		srv.TLSConfig.MinVersion = tls.VersionTLS12
+	}
+	serveErr := make(chan error, 1)
+	go func() {
+		if cert != "" {
+			infoLog.Printf("listening for HTTPS traffic on port: %s ...", port)
+			serveErr <- srv.ListenAndServeTLS(cert, key)
+			return
+		}
+		infoLog.Printf("listening for HTTP traffic on port: %s ...", port)
+		serveErr <- srv.ListenAndServe()
+	}()
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-serveErr:
+		errLog.Fatal(err)
+	case sig := <-stop:
+		infoLog.Printf("received %v, draining in-flight requests for up to %v ...", sig, drainTimeout)
+	}
+	// Stop accepting requests and let the ones in flight finish, killing the compilations that don't in time,
+	// then remove whatever the requests left behind
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	go srv.Shutdown(context.Background())
+	if err := s.Shutdown(ctx); err != nil {
+		errLog.Printf("shut down before everything was drained: %v", err)
+	}
+	infoLog.Println("shut down")
+}
+
+// splitList splits a comma separated list, dropping any empty entries
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
 }
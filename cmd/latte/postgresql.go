@@ -1,10 +1,12 @@
+//go:build postgresql
 // +build postgresql
 
 package main
 
 import (
+	"bytes"
 	"context"
-	"errors"
+	"database/sql"
 	"fmt"
 	"github.com/jinzhu/gorm"
 	_ "github.com/lib/pq"
@@ -13,6 +15,7 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"strings"
 )
 
 type Database struct {
@@ -26,6 +29,9 @@ type Blob struct {
 }
 
 func init() {
+	if db != nil {
+		log.Fatal("LaTTe can only be compiled with one database")
+	}
 	var err error
 	db, err = newDB()
 	if err != nil {
@@ -33,20 +39,29 @@ func init() {
 	}
 }
 
-func newDB() (server.DB, error) {
-	host := os.Getenv("LATTE_DB_HOST")
-	port := os.Getenv("LATTE_DB_PORT")
-	name := os.Getenv("LATTE_DB_NAME")
-	username := os.Getenv("LATTE_DB_USERNAME")
-	password := os.Getenv("LATTE_DB_PASSWORD")
-	ssl := os.Getenv("LATTE_DB_SSL")
+// pgConnString returns the connection string for the given keywords and values, quoting the values so that
+// ones with spaces or quotes in them (e.g. passwords) don't break it. Empty values are left out, leaving them to libpq's defaults.
+func pgConnString(params [][2]string) string {
+	quote := strings.NewReplacer(`\`, `\\`, "'", `\'`)
+	var parts []string
+	for _, p := range params {
+		if p[1] != "" {
+			parts = append(parts, fmt.Sprintf("%s='%s'", p[0], quote.Replace(p[1])))
+		}
+	}
+	return strings.Join(parts, " ")
+}
 
-	connstr := "host=%s port=%s dbname=%s user=%s password=%s"
-	connstr = connstr + " sslmode=%s connect_timeout=10"
-	connstr = fmt.Sprintf(connstr,
-		host, port, name,
-		username, password, ssl,
-	)
+func newDB() (server.DB, error) {
+	connstr := pgConnString([][2]string{
+		{"host", os.Getenv("LATTE_DB_HOST")},
+		{"port", os.Getenv("LATTE_DB_PORT")},
+		{"dbname", os.Getenv("LATTE_DB_NAME")},
+		{"user", os.Getenv("LATTE_DB_USERNAME")},
+		{"password", os.Getenv("LATTE_DB_PASSWORD")},
+		{"sslmode", os.Getenv("LATTE_DB_SSL")},
+		{"connect_timeout", "10"},
+	})
 
 	var db Database
 	var err error
@@ -54,40 +69,88 @@ func newDB() (server.DB, error) {
 	if err != nil {
 		return nil, err
 	}
-	db.db.AutoMigrate(&Blob{})
+	// The blobs table is created, or brought up to date, on startup
+	if err = db.db.AutoMigrate(&Blob{}).Error; err != nil {
+		return nil, fmt.Errorf("error while migrating database: %v", err)
+	}
 	return &db, nil
 }
 
-func (db *Database) Store(ctx context.Context, uid string, i interface{}) error {
-	var err error
-	blob := Blob{UID: uid}
-	switch i.(type) {
-	case []byte:
-		blob.Bytes = i.([]byte)
-	case io.ReadCloser:
-		rc := i.(io.ReadCloser)
-		blob.Bytes, err = ioutil.ReadAll(rc)
-		if err != nil {
-			return err
-		}
-		if err = rc.Close(); err != nil {
-			return err
-		}
-	default:
-		return errors.New("can only store []byte or io.ReadCloser contents")
+// Store upserts the blob of the file; statements go through database/sql rather than gorm so that they're cancelled with ctx.
+func (db *Database) Store(ctx context.Context, uid string, data io.Reader) error {
+	contents, err := ioutil.ReadAll(data)
+	if err != nil {
+		return err
 	}
-	return db.db.Create(&blob).Error
+	// Anything already stored under the uid is replaced
+	_, err = db.db.DB().ExecContext(ctx,
+		"INSERT INTO blobs (uid, bytes) VALUES ($1, $2) ON CONFLICT (uid) DO UPDATE SET bytes = excluded.bytes",
+		uid, contents,
+	)
+	return err
 }
 
-func (db *Database) Fetch(ctx context.Context, uid string) (interface{}, error) {
-	var blob Blob
-	res := db.db.First(&blob, "uid = ?", uid)
-	if err := res.Error; res.RecordNotFound() {
+func (db *Database) Fetch(ctx context.Context, uid string) (io.ReadCloser, error) {
+	var contents []byte
+	err := db.db.DB().QueryRowContext(ctx, "SELECT bytes FROM blobs WHERE uid = $1", uid).Scan(&contents)
+	if err == sql.ErrNoRows {
 		return nil, &server.NotFoundError{}
 	} else if err != nil {
 		return nil, err
 	}
-	return blob.Bytes, nil
+	return ioutil.NopCloser(bytes.NewReader(contents)), nil
+}
+
+func (db *Database) List(ctx context.Context, prefix string) ([]string, error) {
+	// Wildcards in the prefix are matched literally
+	pattern := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(prefix) + "%"
+	rows, err := db.db.DB().QueryContext(ctx, `SELECT uid FROM blobs WHERE uid LIKE $1 ORDER BY uid`, pattern)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var uids []string
+	for rows.Next() {
+		var uid string
+		if err = rows.Scan(&uid); err != nil {
+			return nil, err
+		}
+		uids = append(uids, uid)
+	}
+	return uids, rows.Err()
+}
+
+func (db *Database) ListSizes(ctx context.Context, prefix string) (map[string]int64, error) {
+	// Wildcards in the prefix are matched literally
+	pattern := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(prefix) + "%"
+	rows, err := db.db.DB().QueryContext(ctx, `SELECT uid, octet_length(bytes) FROM blobs WHERE uid LIKE $1`, pattern)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sizes := map[string]int64{}
+	for rows.Next() {
+		var uid string
+		var size int64
+		if err = rows.Scan(&uid, &size); err != nil {
+			return nil, err
+		}
+		sizes[uid] = size
+	}
+	return sizes, rows.Err()
+}
+
+func (db *Database) Delete(ctx context.Context, uid string) error {
+	res, err := db.db.DB().ExecContext(ctx, "DELETE FROM blobs WHERE uid = $1", uid)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return &server.NotFoundError{}
+	}
+	return nil
 }
 
 func (db *Database) Ping(ctx context.Context) error {
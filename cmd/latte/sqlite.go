@@ -0,0 +1,156 @@
+//go:build sqlite
+// +build sqlite
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"github.com/raphaelreyna/latte/internal/server"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// SQLite keeps files in a single SQLite database file, for deployments that don't want to run a database server.
+type SQLite struct {
+	db *gorm.DB
+}
+
+type SQLiteBlob struct {
+	ID    int    `gorm:"primary_key"`
+	UID   string `gorm:"unique_index"`
+	Bytes []byte
+}
+
+func (SQLiteBlob) TableName() string {
+	return "blobs"
+}
+
+func init() {
+	if db != nil {
+		log.Fatal("LaTTe can only be compiled with one database")
+	}
+	var err error
+	db, err = newSQLite()
+	if err != nil {
+		log.Fatalf("fatal error occurred while opening sqlite database: %v", err)
+	}
+}
+
+// newSQLite opens the database file at LATTE_DB_PATH, creating it if needed; it defaults to latte.db in the root directory.
+func newSQLite() (server.DB, error) {
+	path := os.Getenv("LATTE_DB_PATH")
+	if path == "" {
+		root := os.Getenv("LATTE_ROOT")
+		if root == "" {
+			var err error
+			if root, err = os.UserCacheDir(); err != nil {
+				return nil, err
+			}
+		}
+		if err := os.MkdirAll(root, 0755); err != nil {
+			return nil, err
+		}
+		path = filepath.Join(root, "latte.db")
+	}
+	var db SQLite
+	var err error
+	db.db, err = gorm.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite only allows one writer at a time; sharing one connection queues writes rather than failing them with SQLITE_BUSY
+	db.db.DB().SetMaxOpenConns(1)
+	if err = db.db.AutoMigrate(&SQLiteBlob{}).Error; err != nil {
+		return nil, err
+	}
+	return &db, nil
+}
+
+// Store upserts the blob of the file; statements go through database/sql rather than gorm so that they're cancelled with ctx.
+func (db *SQLite) Store(ctx context.Context, uid string, data io.Reader) error {
+	contents, err := ioutil.ReadAll(data)
+	if err != nil {
+		return err
+	}
+	// Anything already stored under the uid is replaced
+	_, err = db.db.DB().ExecContext(ctx,
+		"INSERT INTO blobs (uid, bytes) VALUES (?, ?) ON CONFLICT (uid) DO UPDATE SET bytes = excluded.bytes",
+		uid, contents,
+	)
+	return err
+}
+
+func (db *SQLite) Fetch(ctx context.Context, uid string) (io.ReadCloser, error) {
+	var contents []byte
+	err := db.db.DB().QueryRowContext(ctx, "SELECT bytes FROM blobs WHERE uid = ?", uid).Scan(&contents)
+	if err == sql.ErrNoRows {
+		return nil, &server.NotFoundError{}
+	} else if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(contents)), nil
+}
+
+func (db *SQLite) List(ctx context.Context, prefix string) ([]string, error) {
+	// Wildcards in the prefix are matched literally
+	pattern := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(prefix) + "%"
+	rows, err := db.db.DB().QueryContext(ctx, `SELECT uid FROM blobs WHERE uid LIKE ? ESCAPE '\' ORDER BY uid`, pattern)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var uids []string
+	for rows.Next() {
+		var uid string
+		if err = rows.Scan(&uid); err != nil {
+			return nil, err
+		}
+		uids = append(uids, uid)
+	}
+	return uids, rows.Err()
+}
+
+func (db *SQLite) ListSizes(ctx context.Context, prefix string) (map[string]int64, error) {
+	// Wildcards in the prefix are matched literally
+	pattern := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(prefix) + "%"
+	rows, err := db.db.DB().QueryContext(ctx, `SELECT uid, length(bytes) FROM blobs WHERE uid LIKE ? ESCAPE '\'`, pattern)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sizes := map[string]int64{}
+	for rows.Next() {
+		var uid string
+		var size int64
+		if err = rows.Scan(&uid, &size); err != nil {
+			return nil, err
+		}
+		sizes[uid] = size
+	}
+	return sizes, rows.Err()
+}
+
+func (db *SQLite) Delete(ctx context.Context, uid string) error {
+	res, err := db.db.DB().ExecContext(ctx, "DELETE FROM blobs WHERE uid = ?", uid)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return &server.NotFoundError{}
+	}
+	return nil
+}
+
+func (db *SQLite) Ping(ctx context.Context) error {
+	return db.db.DB().PingContext(ctx)
+}
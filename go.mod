@@ -1,12 +1,16 @@
 module github.com/raphaelreyna/latte
 
-go 1.13
+go 1.22
 
 require (
 	github.com/gorilla/handlers v1.4.2
 	github.com/gorilla/mux v1.7.3
 	github.com/hashicorp/golang-lru v0.5.4
 	github.com/jinzhu/gorm v1.9.12
+	github.com/klauspost/compress v1.18.0
 	github.com/lib/pq v1.1.1
 	github.com/rs/cors v1.7.0
+	gopkg.in/yaml.v3 v3.0.1
 )
+
+require github.com/jinzhu/inflection v1.0.0 // indirect
@@ -0,0 +1,75 @@
+package compile
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// bibliography builds the bibliography of the job named jn with the tool it asks for, if there's a .bib file for it to be
+// built from, returning whether it was built. The tools output is added to the results output if it fails.
+func (t *TeX) bibliography(ctx context.Context, job Job, jn string, res *Result) (bool, error) {
+	if !hasBib(job.Dir) {
+		return false, nil
+	}
+	tool := job.Bibliography
+	if tool == "auto" {
+		// biblatex writes a .bcf file for biber, while \bibliography has bibtex read the .bib files named in the aux file
+		aux, _ := ioutil.ReadFile(filepath.Join(job.Dir, jn+".aux"))
+		switch _, err := os.Stat(filepath.Join(job.Dir, jn+".bcf")); {
+		case err == nil:
+			tool = "biber"
+		case bytes.Contains(aux, []byte(`\bibdata`)):
+			tool = "bibtex"
+		default:
+			return false, nil
+		}
+	}
+	var command string
+	switch tool {
+	case "bibtex":
+		command = t.Bibtex
+	case "biber":
+		command = t.Biber
+	default:
+		return false, fmt.Errorf("unknown bibliography tool: %s", tool)
+	}
+	if command == "" {
+		command = tool
+	}
+	cmd, err := job.command(ctx, t.env(job), command, jn)
+	if err != nil {
+		return false, err
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := res.execute(ctx, &job, tool, cmd)
+	// bibtex exits with 1 when it only has warnings, e.g. about an entry missing a field
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 && tool == "bibtex" {
+		err = nil
+	}
+	if err != nil {
+		res.Output += "\n" + out + stderr.String()
+		return false, err
+	}
+	return true, nil
+}
+
+// hasBib returns whether there's a .bib file anywhere under dir.
+func hasBib(dir string) bool {
+	found := errors.New("found")
+	err := filepath.Walk(dir, func(fpath string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && strings.EqualFold(filepath.Ext(fpath), ".bib") {
+			return found
+		}
+		return nil
+	})
+	return err == found
+}
@@ -1,34 +1,321 @@
 package compile
 
 import (
+	"bytes"
 	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"strings"
 	"text/template"
+	"time"
 )
 
-func Compile(ctx context.Context, tmpl *template.Template, dtls map[string]interface{}, dir, command string) (string, error) {
-	os.Chdir(dir)
-	// Prepare pdflatex and grab a pipe to its stdin
-	jn := filepath.Base(dir)
-	cmd := exec.CommandContext(ctx, command, "-halt-on-error", "-jobname="+jn)
-	cmdStdin, err := cmd.StdinPipe()
-	if err != nil {
-		return "", err
+// Phase is a step of a compilation, when it started and how long it took.
+type Phase struct {
+	Name     string
+	Start    time.Time
+	Duration time.Duration
+}
+
+// Result describes a compilation.
+type Result struct {
+	// PDF is the name of the pdf in the working directory.
+	PDF string
+	// Source is the name of the filled in template in the working directory.
+	Source string
+	// Output is what the command wrote to stdout, which for TeX engines is the gist of their log.
+	Output string
+	// CPU is the CPU time the command used.
+	CPU time.Duration
+	// Phases are the steps the compilation went through, in order.
+	Phases []Phase
+	// Errors are the errors the engine logged, if it failed.
+	Errors []LogError
+}
+
+// Passes returns how many times the command was run.
+func (r *Result) Passes() int {
+	n := 0
+	for _, p := range r.Phases {
+		if strings.HasPrefix(p.Name, "pass") {
+			n++
+		}
+	}
+	return n
+}
+
+func (r *Result) phase(name string, start time.Time) {
+	r.Phases = append(r.Phases, Phase{Name: name, Start: start, Duration: time.Since(start)})
+}
+
+// Job is a template to fill in and compile, along with everything it's filled in and compiled with.
+type Job struct {
+	// Template is filled in with Details, and the result compiled in Dir.
+	Template *template.Template
+	Details  map[string]interface{}
+	Dir      string
+	// Source, if there's no Template, is the document compiled as it is.
+	Source []byte
+	// Env holds variables (of the form NAME=VALUE) added on top of the environment of the current process for the command.
+	Env []string
+	// MaxPasses is how many times a TeX engine may be run to resolve cross-references, tables of contents and the like,
+	// stopping as soon as they've settled; it's only run once if this is less than 2.
+	MaxPasses int
+	// Bibliography is the tool run between the passes of a TeX engine to build the bibliography: bibtex, biber or
+	// auto (for whichever of them the document is set up for). It's only run if there's a .bib file in the directory.
+	Bibliography string
+	// Sandbox, if set, is what the commands compiling the job are run in.
+	Sandbox Sandbox
+	// Limits bound the resources each of the commands compiling the job may use.
+	Limits Limits
+	// Log, if set, is also written what the commands compiling the job write to stdout, as they write it.
+	Log io.Writer
+}
+
+// Typesetter turns filled in templates into PDFs.
+type Typesetter interface {
+	// Render fills in the template of the job and compiles the result, leaving the PDF in the jobs directory.
+	// The returned result describes as much of the compilation as was done, even if it failed.
+	Render(ctx context.Context, job Job) (*Result, error)
+	// Engine is the command doing the compiling, e.g. pdflatex.
+	Engine() string
+}
+
+// fill fills in the template of the job, or returns its source if it doesn't have a template.
+func (job *Job) fill() ([]byte, error) {
+	if job.Template == nil {
+		return job.Source, nil
+	}
+	var filled bytes.Buffer
+	if err := job.Template.Execute(&filled, job.Details); err != nil {
+		return nil, err
+	}
+	return filled.Bytes(), nil
+}
+
+// command returns the command running name with args in the jobs directory, with env (of the form NAME=VALUE) added
+// to its environment, inside of the jobs sandbox if it has one.
+func (job *Job) command(ctx context.Context, env []string, name string, args ...string) (*exec.Cmd, error) {
+	if d, ok := job.Sandbox.(*Docker); ok {
+		return d.exec(ctx, job.Dir, env, &job.Limits, name, args...)
 	}
-	// Write filled in template to pdflatex stdin
-	err = tmpl.Execute(cmdStdin, dtls)
+	if job.Sandbox != nil {
+		return job.Sandbox.Exec(ctx, job.Dir, env, name, args...)
+	}
+	cmd := exec.CommandContext(ctx, name, args...)
+	// The command runs in the jobs directory, rather than the process changing its own, so that jobs can be compiled concurrently
+	cmd.Dir = job.Dir
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	return cmd, nil
+}
+
+// Run runs name with args in the jobs directory, inside of its sandbox and within its limits like the commands compiling it,
+// returning what it wrote to stdout and stderr. It's for the tools run on a jobs files outside of compiling them, e.g. image converters.
+func (job Job) Run(ctx context.Context, name string, args ...string) ([]byte, error) {
+	cmd, err := job.command(ctx, job.Env, name, args...)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := (&Result{}).execute(ctx, &job, name, cmd)
+	return append([]byte(out), stderr.Bytes()...), err
+}
+
+// run runs cmd once, as the next pass of the compilation of job, keeping what it wrote to stdout as the output.
+func (res *Result) run(ctx context.Context, job *Job, cmd *exec.Cmd) error {
+	out, err := res.execute(ctx, job, fmt.Sprintf("pass%d", res.Passes()+1), cmd)
+	res.Output = out
+	return err
+}
+
+// execute runs cmd as the named phase of the compilation of job, returning what it wrote to stdout.
+// If ctx is done before the command finishes, it's killed along with everything it started, and ctx's error is returned.
+// If it's killed for going over one of the jobs limits, a *LimitError is returned.
+func (res *Result) execute(ctx context.Context, job *Job, name string, cmd *exec.Cmd) (string, error) {
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	if job.Log != nil {
+		cmd.Stdout = io.MultiWriter(&stdout, job.Log)
+	}
+	setProcessGroup(cmd)
+	// Containers are limited by the container runtime, see Docker
+	docker, _ := job.Sandbox.(*Docker)
+	limits := &job.Limits
+	var cg *cgroup
+	if docker == nil {
+		var err error
+		if cg, err = limits.prepare(); err != nil {
+			return "", err
+		}
+		defer cg.remove()
+		limits.wrap(cmd, cg)
+	}
+	start := time.Now()
+	err := cmd.Start()
+	if err == nil {
+		// Killing only the command would leave anything it started running, still holding onto its output and working directory
+		done := make(chan struct{})
+		go func() {
+			select {
+			case <-ctx.Done():
+				killProcessGroup(cmd)
+				if docker != nil {
+					docker.kill(cmd)
+				}
+			case <-done:
+			}
+		}()
+		err = cmd.Wait()
+		close(done)
+	}
+	res.phase(name, start)
+	if cmd.ProcessState != nil {
+		res.CPU += cmd.ProcessState.UserTime() + cmd.ProcessState.SystemTime()
 	}
-	cmdStdin.Close()
+	if err != nil && ctx.Err() != nil {
+		return stdout.String(), ctx.Err()
+	}
+	if docker != nil {
+		return stdout.String(), docker.exceeded(cmd, limits, err)
+	}
+	return stdout.String(), limits.exceeded(cmd, cg, stdout.String(), err)
+}
+
+// TeX compiles templates with a TeX engine, e.g. pdflatex or xelatex.
+type TeX struct {
+	Command string
+	// Bibtex and Biber are the commands bibliographies are built with; they default to bibtex and biber.
+	Bibtex string
+	Biber  string
+	// Makeindex and Makeglossaries are the commands indexes and glossaries are built with; they default to makeindex and makeglossaries.
+	Makeindex      string
+	Makeglossaries string
+	// ShellEscape lets documents run commands with \write18 (e.g. for minted), which lets them run anything at all, so it's only
+	// for deployments that trust every template they compile; otherwise the engine is run with -no-shell-escape.
+	ShellEscape bool
+}
+
+// restrictedWrites keeps TeX programs from writing files anywhere but the directory they're run in (and its subdirectories),
+// as well as from writing hidden files, whatever the installations texmf.cnf says.
+const restrictedWrites = "openout_any=p"
 
-	// Run command and grab its output and log it
-	result, err := cmd.Output()
+// env returns the environment variables the commands compiling the job are run with.
+func (t *TeX) env(job Job) []string {
+	// Restrictions come last so that the job can't lift them
+	env := make([]string, 0, len(job.Env)+1)
+	return append(append(env, job.Env...), restrictedWrites)
+}
+
+// Engine returns the TeX engines command.
+func (t *TeX) Engine() string {
+	return t.Command
+}
+
+// Render fills in the template of the job and compiles it with the TeX engine.
+func (t *TeX) Render(ctx context.Context, job Job) (*Result, error) {
+	res := &Result{}
+	// Fill in the template
+	start := time.Now()
+	doc, err := job.fill()
 	if err != nil {
-		return string(result), err
+		return res, err
+	}
+	if locale, ok := job.Details[LocaleKey].(string); ok && locale != "" {
+		setup, err := LanguageSetup(locale, t.Command)
+		if err != nil {
+			return res, err
+		}
+		doc = injectPreamble(doc, setup)
+	}
+	// The engine reads the document from stdin; it's only written out for those debugging it
+	jn := filepath.Base(job.Dir)
+	if err = ioutil.WriteFile(filepath.Join(job.Dir, jn+".tex"), doc, 0644); err != nil {
+		return res, err
+	}
+	res.Source = jn + ".tex"
+	res.phase("template", start)
+
+	// Run pdflatex on the filled in template and grab its output and log it, running it again while references are unresolved
+	aux := ""
+	maxPasses := job.MaxPasses
+	built := job.Bibliography == ""
+	indexed := map[string]string{}
+	for {
+		shellEscape := "-no-shell-escape"
+		if t.ShellEscape {
+			shellEscape = "-shell-escape"
+		}
+		cmd, err := job.command(ctx, t.env(job), t.Command, shellEscape, "-halt-on-error", "-jobname="+jn)
+		if err != nil {
+			return res, err
+		}
+		cmd.Stdin = bytes.NewReader(doc)
+		if err = res.run(ctx, &job, cmd); err != nil {
+			log, lerr := ioutil.ReadFile(filepath.Join(job.Dir, jn+".log"))
+			if lerr != nil {
+				log = []byte(res.Output)
+			}
+			// What the engine wrote to stdout before being killed may not have been flushed, but its log has
+			if ctx.Err() != nil && len(log) > len(res.Output) {
+				res.Output = string(log)
+			}
+			res.Errors = ParseLog(string(log), doc)
+			return res, err
+		}
+		// The bibliography is built from what the first pass wrote to the aux file, and needs two more passes to be cited
+		force := false
+		if !built {
+			built = true
+			if force, err = t.bibliography(ctx, job, jn, res); err != nil {
+				return res, err
+			}
+			if force && maxPasses < 3 {
+				maxPasses = 3
+			}
+		}
+		// Indexes and glossaries are typeset by the pass after the one that wrote their entries
+		indexes, err := t.indexes(ctx, job, jn, res, indexed)
+		if err != nil {
+			return res, err
+		}
+		if indexes && maxPasses < 2 {
+			maxPasses = 2
+		}
+		force = force || indexes
+		var rerun bool
+		if rerun, aux = needsRerun(job.Dir, jn, aux); !(rerun || force) || res.Passes() >= maxPasses {
+			break
+		}
+	}
+	res.PDF = jn + ".pdf"
+	return res, nil
+}
+
+// rerunWarning matches what LaTeX and packages (e.g. hyperref, longtable and rerunfilecheck) log when the document needs another pass.
+var rerunWarning = regexp.MustCompile(`(?i)rerun to get|label\(s\) may have changed|please rerun|please \(re\)run|rerun latex`)
+
+// needsRerun returns whether the last pass of the job named jn left references unresolved, along with the part of the
+// aux file the next pass reads back; aux is what it was after the pass before, and is empty before the first one.
+// Another pass is needed if the engine asked for one, or if the aux file changed, which is how tables of contents
+// (that LaTeX doesn't warn about) get filled in; this is what latexmk does, without needing it to be installed.
+func needsRerun(dir, jn, aux string) (bool, string) {
+	log, _ := ioutil.ReadFile(filepath.Join(dir, jn+".log"))
+	data, _ := ioutil.ReadFile(filepath.Join(dir, jn+".aux"))
+	// Every aux file starts with \relax, even those of documents with nothing to resolve
+	var lines []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" && line != `\relax` {
+			lines = append(lines, line)
+		}
 	}
-	os.Chdir("..")
-	return jn + ".pdf", nil
+	next := strings.Join(lines, "\n")
+	return rerunWarning.Match(log) || next != aux, next
 }
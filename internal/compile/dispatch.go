@@ -0,0 +1,132 @@
+package compile
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+)
+
+// dispatchFile and resultFile are where a dispatched compilation, and its result, are written in its working directory.
+// TeX engines aren't allowed to write hidden files, so documents can't tamper with them.
+const (
+	dispatchFile = ".latte-dispatch.json"
+	resultFile   = ".latte-result.json"
+)
+
+// dispatch is a compilation handed off to be run somewhere else that shares its working directory (e.g. a Kubernetes
+// Job mounting the same volume), with everything needed to run it there.
+type dispatch struct {
+	TeX          *TeX     `json:"tex,omitempty"`
+	Typst        *Typst   `json:"typst,omitempty"`
+	Source       []byte   `json:"source"`
+	Locale       string   `json:"locale,omitempty"`
+	Env          []string `json:"env,omitempty"`
+	MaxPasses    int      `json:"max_passes,omitempty"`
+	Bibliography string   `json:"bibliography,omitempty"`
+	Limits       Limits   `json:"limits"`
+}
+
+// dispatched is the result of a dispatched compilation.
+type dispatched struct {
+	Result *Result `json:"result"`
+	Error  string  `json:"error,omitempty"`
+	// Limit is the limit the compilation was killed for going over, if it was
+	Limit string `json:"limit,omitempty"`
+}
+
+// Dispatch fills in the template of the job and writes it to the jobs directory, along with everything else needed to
+// compile it with ts, for RunDispatched to compile somewhere else. The returned result describes the filling in.
+// Only TeX and Typst compilations can be dispatched, and they're run without the jobs sandbox.
+func Dispatch(ts Typesetter, job Job) (*Result, error) {
+	res := &Result{}
+	d := dispatch{Env: job.Env, MaxPasses: job.MaxPasses, Bibliography: job.Bibliography, Limits: job.Limits}
+	switch t := ts.(type) {
+	case *TeX:
+		d.TeX = t
+	case *Typst:
+		d.Typst = t
+	default:
+		return res, fmt.Errorf("can't dispatch compilations with %s", ts.Engine())
+	}
+	var err error
+	if d.Source, err = job.fill(); err != nil {
+		return res, err
+	}
+	d.Locale, _ = job.Details[LocaleKey].(string)
+	spec, err := json.Marshal(&d)
+	if err != nil {
+		return res, err
+	}
+	return res, ioutil.WriteFile(filepath.Join(job.Dir, dispatchFile), spec, 0644)
+}
+
+// RunDispatched runs the compilation dispatched to dir, writing its result there for DispatchResult.
+// The returned error is only about running it; whether the compilation itself succeeded is part of its result.
+func RunDispatched(ctx context.Context, dir string) error {
+	spec, err := ioutil.ReadFile(filepath.Join(dir, dispatchFile))
+	if err != nil {
+		return err
+	}
+	var d dispatch
+	if err = json.Unmarshal(spec, &d); err != nil {
+		return fmt.Errorf("invalid dispatched compilation: %v", err)
+	}
+	var ts Typesetter
+	switch {
+	case d.TeX != nil:
+		ts = d.TeX
+	case d.Typst != nil:
+		ts = d.Typst
+	default:
+		return errors.New("invalid dispatched compilation: no typesetter")
+	}
+	job := Job{
+		Source:       d.Source,
+		Details:      map[string]interface{}{LocaleKey: d.Locale},
+		Dir:          dir,
+		Env:          d.Env,
+		MaxPasses:    d.MaxPasses,
+		Bibliography: d.Bibliography,
+		Limits:       d.Limits,
+	}
+	res, err := ts.Render(ctx, job)
+	out := dispatched{Result: res}
+	if err != nil {
+		out.Error = err.Error()
+		var le *LimitError
+		if errors.As(err, &le) {
+			out.Limit = le.Limit
+		}
+	}
+	result, err := json.Marshal(&out)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, resultFile), result, 0644)
+}
+
+// DispatchResult returns the result of the compilation dispatched to dir, and the error it failed with, if it did.
+// A *LimitError is returned for compilations killed for going over their limits.
+func DispatchResult(dir string) (*Result, error) {
+	result, err := ioutil.ReadFile(filepath.Join(dir, resultFile))
+	if err != nil {
+		return &Result{}, fmt.Errorf("dispatched compilation left no result: %v", err)
+	}
+	var out dispatched
+	if err = json.Unmarshal(result, &out); err != nil {
+		return &Result{}, fmt.Errorf("invalid result of dispatched compilation: %v", err)
+	}
+	if out.Result == nil {
+		out.Result = &Result{}
+	}
+	switch {
+	case out.Limit != "":
+		return out.Result, &LimitError{Limit: out.Limit}
+	case out.Error != "":
+		return out.Result, errors.New(out.Error)
+	}
+	return out.Result, nil
+}
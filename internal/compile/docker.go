@@ -0,0 +1,137 @@
+package compile
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Docker runs each command in a short-lived container of its own, so that the TeX installation lives in the image
+// rather than on the server, and compilations are isolated from the server and each other. The working directory is
+// bind mounted into the container at the same path, and the container runs as the servers user so that the files
+// written there are the servers. Podman can be used in Dockers place.
+type Docker struct {
+	// Command is the docker binary; defaults to docker.
+	Command string
+	// Image is the image the containers are made from, which must have the commands compiling the jobs on its PATH.
+	Image string
+	// Network is the network the containers are attached to; defaults to none, cutting them off from the network.
+	Network string
+	// ReadOnly are paths on the server bind mounted (read only) into the containers at the same path, e.g. a shared library of class files.
+	ReadOnly []string
+}
+
+// Exec returns the command running name with args inside of a container.
+func (d *Docker) Exec(ctx context.Context, dir string, env []string, name string, args ...string) (*exec.Cmd, error) {
+	return d.exec(ctx, dir, env, nil, name, args...)
+}
+
+func (d *Docker) command() string {
+	if d.Command == "" {
+		return "docker"
+	}
+	return d.Command
+}
+
+// exec returns the command running name with args inside of a container, limited by limits (if any) through the
+// container runtime rather than on the host.
+func (d *Docker) exec(ctx context.Context, dir string, env []string, limits *Limits, name string, args ...string) (*exec.Cmd, error) {
+	if d.Image == "" {
+		return nil, errors.New("docker sandbox needs an image")
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	// Containers are named so that they can be killed; killing the docker client would leave them running
+	id := make([]byte, 8)
+	if _, err = rand.Read(id); err != nil {
+		return nil, err
+	}
+	network := d.Network
+	if network == "" {
+		network = "none"
+	}
+	docker := []string{
+		"run", "--rm", "--interactive", "--name", "latte-" + hex.EncodeToString(id),
+		"--network", network, "--read-only", "--tmpfs", "/tmp", "--cap-drop", "ALL", "--security-opt", "no-new-privileges",
+		"--volume", dir + ":" + dir, "--workdir", dir,
+		"--env", "HOME=" + dir, "--env", "TMPDIR=" + dir,
+	}
+	if uid, gid := os.Getuid(), os.Getgid(); uid >= 0 {
+		docker = append(docker, "--user", fmt.Sprintf("%d:%d", uid, gid))
+	}
+	for _, p := range d.ReadOnly {
+		if abs, err := filepath.Abs(p); err == nil {
+			if _, err = os.Stat(abs); err == nil {
+				docker = append(docker, "--volume", abs+":"+abs+":ro")
+			}
+		}
+	}
+	for _, kv := range env {
+		docker = append(docker, "--env", kv)
+	}
+	if limits != nil {
+		if limits.Memory > 0 {
+			// Swapping would only let the command go on for longer, much more slowly, before being killed anyway
+			memory := strconv.FormatInt(limits.Memory, 10)
+			docker = append(docker, "--memory", memory, "--memory-swap", memory)
+		}
+		if limits.CPUs > 0 {
+			docker = append(docker, "--cpus", strconv.FormatFloat(limits.CPUs, 'f', -1, 64))
+		}
+		if limits.CPU > 0 {
+			seconds := int64((limits.CPU + time.Second - 1) / time.Second)
+			docker = append(docker, "--ulimit", fmt.Sprintf("cpu=%d:%d", seconds, seconds+1))
+		}
+	}
+	docker = append(append(docker, d.Image, name), args...)
+	cmd := exec.CommandContext(ctx, d.command(), docker...)
+	cmd.Dir = dir
+	return cmd, nil
+}
+
+// container returns the name of the container cmd runs its command in.
+func container(cmd *exec.Cmd) string {
+	for i, arg := range cmd.Args[:len(cmd.Args)-1] {
+		if arg == "--name" {
+			return cmd.Args[i+1]
+		}
+	}
+	return ""
+}
+
+// kill kills the container cmd runs its command in, along with everything in it.
+func (d *Docker) kill(cmd *exec.Cmd) {
+	if name := container(cmd); name != "" {
+		exec.Command(d.command(), "kill", name).Run()
+	}
+}
+
+// exceeded returns the error the command cmd ran in a container, which failed with err, was killed with if it went
+// over one of its limits, and err otherwise. The docker client exits with 128 plus the number of the signal that
+// killed the command: SIGXCPU once it's used up its CPU time, or SIGKILL when it's run out of memory.
+func (d *Docker) exceeded(cmd *exec.Cmd, limits *Limits, err error) error {
+	var ee *exec.ExitError
+	if !errors.As(err, &ee) {
+		return err
+	}
+	switch ee.ExitCode() {
+	case 128 + 24:
+		if limits.CPU > 0 {
+			return &LimitError{Limit: "cpu"}
+		}
+	case 128 + 9:
+		if limits.Memory > 0 {
+			return &LimitError{Limit: "memory"}
+		}
+	}
+	return err
+}
@@ -0,0 +1,46 @@
+package compile
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+)
+
+// indexes runs makeindex on the index entries and makeglossaries on the glossary entries the last pass of the job named jn
+// wrote, i.e. those of \makeindex and \makeglossaries, if they've changed since they were last processed; seen holds what
+// they were then. It returns whether any were processed, in which case another pass is needed for them to be typeset.
+func (t *TeX) indexes(ctx context.Context, job Job, jn string, res *Result, seen map[string]string) (bool, error) {
+	tools := []struct {
+		ext, name, command string
+		args               []string
+	}{
+		{".idx", "makeindex", t.Makeindex, []string{jn + ".idx"}},
+		{".glo", "makeglossaries", t.Makeglossaries, []string{jn}},
+	}
+	processed := false
+	for _, tool := range tools {
+		entries, err := ioutil.ReadFile(filepath.Join(job.Dir, jn+tool.ext))
+		if err != nil || string(entries) == seen[tool.ext] {
+			continue
+		}
+		seen[tool.ext] = string(entries)
+		command := tool.command
+		if command == "" {
+			command = tool.name
+		}
+		cmd, err := job.command(ctx, t.env(job), command, tool.args...)
+		if err != nil {
+			return false, err
+		}
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		out, err := res.execute(ctx, &job, tool.name, cmd)
+		if err != nil {
+			res.Output += "\n" + out + stderr.String()
+			return false, err
+		}
+		processed = true
+	}
+	return processed, nil
+}
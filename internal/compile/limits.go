@@ -0,0 +1,59 @@
+package compile
+
+import (
+	"os/exec"
+	"regexp"
+	"time"
+)
+
+// Limits bound the resources each command of a compilation may use, so that runaway templates (e.g. infinite loops or
+// huge TikZ pictures) can't take the whole machine down with them. Limits are only supported on Linux.
+type Limits struct {
+	// CPU is how much CPU time each command may use before it's killed.
+	CPU time.Duration
+	// Memory is how many bytes of memory each command may use. Without a Cgroup, this bounds its address space, which is
+	// somewhat more than the memory it actually uses; with one, it bounds the memory (swap included) it and its children use.
+	Memory int64
+	// Cgroup is a cgroup v2 directory (e.g. /sys/fs/cgroup/latte) with the memory and cpu controllers enabled for its
+	// children, in which a cgroup of its own is made for each command.
+	Cgroup string
+	// CPUs bounds how many CPUs worth of time each command may use at once, e.g. 0.5; it needs Cgroup.
+	CPUs float64
+}
+
+// LimitError is returned when a command is killed for going over one of its limits.
+type LimitError struct {
+	// Limit is the limit that was exceeded: cpu or memory.
+	Limit string
+}
+
+func (e *LimitError) Error() string {
+	return "killed: resource limit exceeded (" + e.Limit + ")"
+}
+
+// set returns whether any of the limits are set.
+func (l *Limits) set() bool {
+	return l.CPU > 0 || l.Memory > 0 || l.CPUs > 0
+}
+
+// allocationFailure matches what TeX engines (and the tools they run) write when they can't get more memory, which is
+// the only sign of having gone over an address space limit.
+var allocationFailure = regexp.MustCompile(`(?i)memory exhausted|memory allocation failure|out of memory|cannot allocate memory|not enough memory|bad_alloc`)
+
+// exceeded returns the error a command that failed with err was killed with, if it went over one of its limits, and err otherwise.
+// The cgroup the command ran in, if any, is the surest sign; otherwise it's told from how the command died and what it wrote.
+func (l *Limits) exceeded(cmd *exec.Cmd, cg *cgroup, output string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if cg.oomKilled() {
+		return &LimitError{Limit: "memory"}
+	}
+	if l.CPU > 0 && cpuKilled(cmd, l.CPU) {
+		return &LimitError{Limit: "cpu"}
+	}
+	if l.Memory > 0 && cg == nil && allocationFailure.MatchString(output) {
+		return &LimitError{Limit: "memory"}
+	}
+	return err
+}
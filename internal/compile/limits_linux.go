@@ -0,0 +1,135 @@
+package compile
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// cgroup is the cgroup made for a command to run in.
+type cgroup struct {
+	dir string
+}
+
+// Check returns an error if the limits can't be applied, e.g. because Cgroup isn't a cgroup.
+func (l *Limits) Check() error {
+	if l.Cgroup == "" {
+		if l.CPUs > 0 {
+			return errors.New("limiting the CPUs compilations use needs a cgroup")
+		}
+		return nil
+	}
+	if _, err := os.Stat(filepath.Join(l.Cgroup, "cgroup.procs")); err != nil {
+		return fmt.Errorf("%s isn't a cgroup: %w", l.Cgroup, err)
+	}
+	return nil
+}
+
+// prepare makes the cgroup the command is to run in, if there's a cgroup to make it in.
+func (l *Limits) prepare() (*cgroup, error) {
+	if l.Cgroup == "" {
+		return nil, l.Check()
+	}
+	dir, err := ioutil.TempDir(l.Cgroup, "latte-")
+	if err != nil {
+		return nil, err
+	}
+	cg := &cgroup{dir: dir}
+	var settings [][2]string
+	if l.Memory > 0 {
+		// Swapping would only let the command go on for longer, much more slowly, before being killed anyway
+		settings = append(settings, [2]string{"memory.max", strconv.FormatInt(l.Memory, 10)}, [2]string{"memory.swap.max", "0"})
+	}
+	if l.CPUs > 0 {
+		const period = 100000
+		settings = append(settings, [2]string{"cpu.max", fmt.Sprintf("%d %d", int64(l.CPUs*period), period)})
+	}
+	for _, s := range settings {
+		if err = ioutil.WriteFile(filepath.Join(dir, s[0]), []byte(s[1]), 0644); err != nil {
+			// memory.swap.max is missing when swap accounting is off, in which case there's no swapping to turn off
+			if s[0] == "memory.swap.max" && os.IsNotExist(err) {
+				continue
+			}
+			cg.remove()
+			return nil, fmt.Errorf("error setting %s of cgroup: %w", s[0], err)
+		}
+	}
+	return cg, nil
+}
+
+// wrap has cmd apply the limits to itself, moving into its cgroup if it has one, before it starts the command it was to run;
+// whatever the command starts inherits them. Applying them once it's started would leave anything it started
+// straight away unlimited.
+func (l *Limits) wrap(cmd *exec.Cmd, cg *cgroup) {
+	var script, dir string
+	if cg != nil {
+		script, dir = `echo $$ > "$1/cgroup.procs" || exit 126; `, cg.dir
+	}
+	if l.CPU > 0 {
+		// The command gets SIGXCPU once it's used up its CPU time, and is killed a second later if it hasn't stopped
+		seconds := int64((l.CPU + time.Second - 1) / time.Second)
+		script += fmt.Sprintf("ulimit -S -t %d && ulimit -H -t %d || exit 126; ", seconds, seconds+1)
+	}
+	if l.Memory > 0 && cg == nil {
+		script += fmt.Sprintf("ulimit -v %d || exit 126; ", (l.Memory+1023)/1024)
+	}
+	if script == "" {
+		return
+	}
+	cmd.Args = append([]string{"sh", "-c", script + `shift; exec "$@"`, "sh", dir, cmd.Path}, cmd.Args[1:]...)
+	cmd.Path = "/bin/sh"
+}
+
+// cpuKilled returns whether the command was killed for using up its CPU time.
+func cpuKilled(cmd *exec.Cmd, limit time.Duration) bool {
+	if cmd.ProcessState == nil {
+		return false
+	}
+	ws, ok := cmd.ProcessState.Sys().(syscall.WaitStatus)
+	if !ok || !ws.Signaled() {
+		return false
+	}
+	used := cmd.ProcessState.UserTime() + cmd.ProcessState.SystemTime()
+	return ws.Signal() == syscall.SIGXCPU || (ws.Signal() == syscall.SIGKILL && used >= limit)
+}
+
+// oomKilled returns whether anything in the cgroup was killed for going over its memory limit.
+func (cg *cgroup) oomKilled() bool {
+	if cg == nil {
+		return false
+	}
+	events, err := ioutil.ReadFile(filepath.Join(cg.dir, "memory.events"))
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(events), "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 && fields[0] == "oom_kill" {
+			n, _ := strconv.Atoi(fields[1])
+			return n > 0
+		}
+	}
+	return false
+}
+
+// remove kills whatever's left in the cgroup and removes it.
+func (cg *cgroup) remove() {
+	if cg == nil {
+		return
+	}
+	// cgroup.kill is missing before Linux 5.14, where killing the process group is all that can be done
+	ioutil.WriteFile(filepath.Join(cg.dir, "cgroup.kill"), []byte("1"), 0644)
+	// The cgroup can only be removed once the kernel is done with the processes that were in it
+	for i := 0; i < 10; i++ {
+		if err := os.Remove(cg.dir); err == nil || os.IsNotExist(err) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
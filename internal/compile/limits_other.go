@@ -0,0 +1,37 @@
+//go:build !linux
+// +build !linux
+
+package compile
+
+import (
+	"errors"
+	"os/exec"
+	"time"
+)
+
+// cgroup stands in for the cgroups commands are run in on Linux.
+type cgroup struct{}
+
+// Check returns an error if any limits are set, since they're only supported on Linux.
+func (l *Limits) Check() error {
+	if l.set() || l.Cgroup != "" {
+		return errors.New("limiting the resources compilations use is only supported on linux")
+	}
+	return nil
+}
+
+func (l *Limits) prepare() (*cgroup, error) {
+	return nil, l.Check()
+}
+
+func (l *Limits) wrap(cmd *exec.Cmd, cg *cgroup) {}
+
+func cpuKilled(cmd *exec.Cmd, limit time.Duration) bool {
+	return false
+}
+
+func (cg *cgroup) oomKilled() bool {
+	return false
+}
+
+func (cg *cgroup) remove() {}
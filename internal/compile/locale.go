@@ -0,0 +1,82 @@
+package compile
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// LocaleKey is the field of the details naming the locale the document is written in (e.g. "de", "fr-CA" or "pl_PL").
+// When it's set, the language is set up in the preamble of the filled in template, unless the template already does so itself.
+const LocaleKey = "_locale"
+
+// language is how a language is named by babel and polyglossia.
+type language struct {
+	babel       string
+	polyglossia string
+	// variant is the polyglossia variant of the language, if any
+	variant string
+}
+
+// languages maps lowercase locales, and their language subtags, to the languages they're written in.
+var languages = map[string]language{
+	"cs":    {babel: "czech", polyglossia: "czech"},
+	"da":    {babel: "danish", polyglossia: "danish"},
+	"de":    {babel: "ngerman", polyglossia: "german"},
+	"de-at": {babel: "naustrian", polyglossia: "german", variant: "austrian"},
+	"de-ch": {babel: "nswissgerman", polyglossia: "german", variant: "swiss"},
+	"en":    {babel: "english", polyglossia: "english"},
+	"en-gb": {babel: "british", polyglossia: "english", variant: "british"},
+	"en-us": {babel: "american", polyglossia: "english", variant: "american"},
+	"es":    {babel: "spanish", polyglossia: "spanish"},
+	"fi":    {babel: "finnish", polyglossia: "finnish"},
+	"fr":    {babel: "french", polyglossia: "french"},
+	"it":    {babel: "italian", polyglossia: "italian"},
+	"nl":    {babel: "dutch", polyglossia: "dutch"},
+	"pl":    {babel: "polish", polyglossia: "polish"},
+	"pt":    {babel: "portuguese", polyglossia: "portuguese"},
+	"pt-br": {babel: "brazilian", polyglossia: "portuguese", variant: "brazilian"},
+	"sv":    {babel: "swedish", polyglossia: "swedish"},
+}
+
+// LanguageSetup returns the preamble lines that set up hyphenation, fonts and typographic conventions for the given locale.
+// Unicode engines (XeLaTeX and LuaLaTeX) get polyglossia and fontspec; everything else gets babel with T1 encoded fonts.
+func LanguageSetup(locale, command string) (string, error) {
+	tag := strings.ToLower(strings.Replace(locale, "_", "-", -1))
+	lang, ok := languages[tag]
+	if !ok {
+		lang, ok = languages[strings.SplitN(tag, "-", 2)[0]]
+	}
+	if !ok {
+		return "", fmt.Errorf("unsupported locale: %s", locale)
+	}
+	switch engine := filepath.Base(command); {
+	case strings.HasPrefix(engine, "xelatex"), strings.HasPrefix(engine, "lualatex"):
+		variant := ""
+		if lang.variant != "" {
+			variant = "[variant=" + lang.variant + "]"
+		}
+		return "\\usepackage{fontspec}\n\\usepackage{polyglossia}\n\\setdefaultlanguage" + variant + "{" + lang.polyglossia + "}\n", nil
+	default:
+		return "\\usepackage[T1]{fontenc}\n\\usepackage[utf8]{inputenc}\n\\usepackage{lmodern}\n\\usepackage[" + lang.babel + "]{babel}\n", nil
+	}
+}
+
+// languagePackages matches the preamble lines of documents that set up their language themselves.
+var languagePackages = regexp.MustCompile(`\\usepackage\s*(\[[^\]]*\])?\s*\{[^}]*\b(babel|polyglossia)\b[^}]*\}|\\setdefaultlanguage`)
+
+var beginDocument = []byte(`\begin{document}`)
+
+// injectPreamble inserts setup at the end of the preamble of doc, unless doc already sets up its language or has no preamble.
+func injectPreamble(doc []byte, setup string) []byte {
+	i := bytes.Index(doc, beginDocument)
+	if i < 0 || languagePackages.Match(doc[:i]) {
+		return doc
+	}
+	injected := make([]byte, 0, len(doc)+len(setup))
+	injected = append(injected, doc[:i]...)
+	injected = append(injected, setup...)
+	return append(injected, doc[i:]...)
+}
@@ -0,0 +1,24 @@
+//go:build !windows
+// +build !windows
+
+package compile
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup has cmd start a process group of its own, so that it can be killed along with its children.
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// killProcessGroup kills the process group cmd started.
+func killProcessGroup(cmd *exec.Cmd) {
+	if cmd.Process != nil {
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
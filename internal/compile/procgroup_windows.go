@@ -0,0 +1,13 @@
+package compile
+
+import "os/exec"
+
+// setProcessGroup does nothing on Windows, where only the command itself can be killed.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup kills the command.
+func killProcessGroup(cmd *exec.Cmd) {
+	if cmd.Process != nil {
+		cmd.Process.Kill()
+	}
+}
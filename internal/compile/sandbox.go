@@ -0,0 +1,140 @@
+package compile
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Sandbox runs the commands of compilations isolated from the rest of the system, for deployments compiling templates
+// they don't trust.
+type Sandbox interface {
+	// Exec returns the command running name with args inside of the sandbox, with dir as its working directory (and the
+	// only one it can write to) and env (of the form NAME=VALUE) added to the little of the servers environment it gets.
+	Exec(ctx context.Context, dir string, env []string, name string, args ...string) (*exec.Cmd, error)
+}
+
+// systemDirs are the directories sandboxed commands can read by default, which hold the TeX installation, the fonts
+// and the libraries and configuration they need; those that don't exist are skipped.
+var systemDirs = []string{
+	"/usr", "/bin", "/sbin", "/lib", "/lib32", "/lib64",
+	"/etc/alternatives", "/etc/fonts", "/etc/texmf", "/etc/ld.so.cache", "/etc/localtime",
+	"/var/lib/texmf", "/opt/texlive",
+}
+
+// sandboxedVars are the variables of the servers environment passed on to sandboxed commands; everything else, e.g.
+// the servers credentials, is left out. Variables starting with TEXMF are passed on as well.
+var sandboxedVars = map[string]bool{"PATH": true, "LANG": true, "LC_ALL": true, "TZ": true, "SOURCE_DATE_EPOCH": true}
+
+// sandboxEnv returns the environment of a command sandboxed in dir.
+func sandboxEnv(dir string, env []string) []string {
+	var out []string
+	for _, kv := range os.Environ() {
+		name := strings.SplitN(kv, "=", 2)[0]
+		if sandboxedVars[name] || strings.HasPrefix(name, "TEXMF") {
+			out = append(out, kv)
+		}
+	}
+	// Anything that'd be written to the home directory (e.g. font caches) goes in the working directory instead
+	out = append(out, "HOME="+dir, "TMPDIR="+dir)
+	return append(out, env...)
+}
+
+// readable returns those of the system directories and the given paths that exist, made absolute.
+func readable(paths []string) []string {
+	var out []string
+	for _, p := range append(append([]string{}, systemDirs...), paths...) {
+		if abs, err := filepath.Abs(p); err == nil {
+			if _, err = os.Stat(abs); err == nil {
+				out = append(out, abs)
+			}
+		}
+	}
+	return out
+}
+
+// Bubblewrap sandboxes commands with bubblewrap (bwrap), in namespaces of their own: they can't reach the network, see
+// other processes, or read anything but the TeX installation and ReadOnly, and can only write to their working directory.
+type Bubblewrap struct {
+	// Command is the bwrap binary; defaults to bwrap.
+	Command string
+	// ReadOnly are paths the commands can read besides the system directories, e.g. a shared library of class files.
+	ReadOnly []string
+}
+
+// Exec returns the command running name with args inside of a bubblewrap sandbox.
+func (b *Bubblewrap) Exec(ctx context.Context, dir string, env []string, name string, args ...string) (*exec.Cmd, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	command := b.Command
+	if command == "" {
+		command = "bwrap"
+	}
+	var bwrap []string
+	for _, p := range readable(b.ReadOnly) {
+		bwrap = append(bwrap, "--ro-bind", p, p)
+	}
+	// The working directory is bound last so that it's writable even if it's under a read only path
+	bwrap = append(bwrap,
+		"--bind", dir, dir, "--chdir", dir,
+		"--dev", "/dev", "--proc", "/proc", "--tmpfs", "/tmp",
+		"--unshare-all", "--die-with-parent", "--new-session",
+		"--", name)
+	cmd := exec.CommandContext(ctx, command, append(bwrap, args...)...)
+	cmd.Dir = dir
+	cmd.Env = sandboxEnv(dir, env)
+	return cmd, nil
+}
+
+// Nsjail sandboxes commands with nsjail, in namespaces of their own: they can't reach the network, see other processes,
+// or read anything but the TeX installation and ReadOnly, and can only write to their working directory.
+type Nsjail struct {
+	// Command is the nsjail binary; defaults to nsjail.
+	Command string
+	// ReadOnly are paths the commands can read besides the system directories, e.g. a shared library of class files.
+	ReadOnly []string
+}
+
+// Exec returns the command running name with args inside of an nsjail sandbox.
+func (n *Nsjail) Exec(ctx context.Context, dir string, env []string, name string, args ...string) (*exec.Cmd, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	command := n.Command
+	if command == "" {
+		command = "nsjail"
+	}
+	// nsjail's own limits are lifted as far as those the command was started with allow, since compilations are timed out
+	// (and limited) by the server
+	nsjail := []string{
+		"--mode", "o", "--quiet", "--keep_env", "--time_limit", "0",
+		"--rlimit_as", "hard", "--rlimit_cpu", "hard", "--rlimit_fsize", "inf", "--rlimit_nofile", "max",
+	}
+	for _, p := range readable(n.ReadOnly) {
+		nsjail = append(nsjail, "--bindmount_ro", p)
+	}
+	nsjail = append(nsjail,
+		"--bindmount", dir, "--cwd", dir,
+		"--bindmount", "/dev/null", "--bindmount_ro", "/dev/urandom", "--tmpfsmount", "/tmp",
+		"--", name)
+	// nsjail doesn't search the PATH for the command
+	if path, err := exec.LookPath(name); err == nil {
+		nsjail[len(nsjail)-1] = path
+	}
+	cmd := exec.CommandContext(ctx, command, append(nsjail, args...)...)
+	cmd.Dir = dir
+	cmd.Env = sandboxEnv(dir, env)
+	return cmd, nil
+}
+
+// User runs commands as another, unprivileged, user, so that they can't read the servers files or those of other
+// compilations (as long as their permissions don't let everyone read them). Unlike the other sandboxes, it doesn't cut
+// the commands off from the network. The server must be running as root to switch users.
+type User struct {
+	UID, GID uint32
+}
@@ -0,0 +1,12 @@
+package compile
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+)
+
+// Exec fails on Windows, where commands can't be run as another user without their password.
+func (u *User) Exec(ctx context.Context, dir string, env []string, name string, args ...string) (*exec.Cmd, error) {
+	return nil, errors.New("running compilations as another user isn't supported on windows")
+}
@@ -0,0 +1,103 @@
+package compile
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// LogError is an error logged by a TeX engine.
+type LogError struct {
+	// File is the file the error is in, as the engine opened it, or empty for the filled in template.
+	File string `json:"file,omitempty"`
+	// Line is the line of File the error is on, if the engine said.
+	Line int `json:"line,omitempty"`
+	// Message is the error itself, e.g. "Undefined control sequence."
+	Message string `json:"message"`
+	// Context is what the engine logged along with the error, e.g. the line up to where the error was noticed.
+	Context []string `json:"context,omitempty"`
+	// Source is the filled in template around Line, if the error is in it, with each line prefixed by its number.
+	Source []string `json:"source,omitempty"`
+}
+
+// sourceLines is how many lines of the filled in template are shown before and after the line an error is on.
+const sourceLines = 2
+
+// lineMarker matches the line TeX logs to say where an error was noticed, e.g. "l.12 \foo".
+var lineMarker = regexp.MustCompile(`^l\.(\d+) `)
+
+// fileName matches the name of a file TeX opened, following the parenthesis it logs when opening it.
+var fileName = regexp.MustCompile(`^[^\s()]+\.[A-Za-z]+`)
+
+// ParseLog returns the errors logged in log, the log of a TeX engine that compiled doc, in the order they were logged.
+// The file an error is in is worked out from the parentheses TeX logs around everything it reads from a file.
+func ParseLog(log string, doc []byte) []LogError {
+	var (
+		errs  []LogError
+		files []string
+	)
+	lines := strings.Split(strings.ReplaceAll(log, "\r\n", "\n"), "\n")
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		if !strings.HasPrefix(line, "! ") {
+			files = trackFiles(files, line)
+			continue
+		}
+		e := LogError{Message: strings.TrimSpace(strings.TrimPrefix(line, "! "))}
+		// The template is read from stdin, so it's the only file that's never named
+		for j := len(files) - 1; j >= 0 && e.File == ""; j-- {
+			e.File = files[j]
+		}
+		// The context runs up to the line number, which is followed by the rest of the line it's on
+		for j := i + 1; j < len(lines) && j <= i+20; j++ {
+			if strings.HasPrefix(lines[j], "! ") || strings.TrimSpace(lines[j]) == "" {
+				break
+			}
+			e.Context = append(e.Context, lines[j])
+			if m := lineMarker.FindStringSubmatch(lines[j]); m != nil {
+				e.Line, _ = strconv.Atoi(m[1])
+				if j+1 < len(lines) && strings.TrimSpace(lines[j+1]) != "" {
+					e.Context = append(e.Context, lines[j+1])
+				}
+				i = j
+				break
+			}
+		}
+		if e.File == "" && e.Line > 0 {
+			e.Source = sourceAround(doc, e.Line)
+		}
+		errs = append(errs, e)
+	}
+	return errs
+}
+
+// trackFiles updates files, the stack of files TeX is reading from, with the parentheses in line.
+// Parentheses that don't open files are pushed too, so that they're popped by the ones closing them.
+func trackFiles(files []string, line string) []string {
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '(':
+			files = append(files, fileName.FindString(line[i+1:]))
+		case ')':
+			if len(files) > 0 {
+				files = files[:len(files)-1]
+			}
+		}
+	}
+	return files
+}
+
+// sourceAround returns the lines of doc around the given line, numbered.
+func sourceAround(doc []byte, line int) []string {
+	lines := strings.Split(string(doc), "\n")
+	if line > len(lines) {
+		return nil
+	}
+	var source []string
+	for n := line - sourceLines; n <= line+sourceLines; n++ {
+		if n >= 1 && n <= len(lines) {
+			source = append(source, strconv.Itoa(n)+": "+lines[n-1])
+		}
+	}
+	return source
+}
@@ -0,0 +1,79 @@
+package compile
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Typst compiles templates with Typst, which is much faster than TeX for simpler documents.
+type Typst struct {
+	// Command is the typst binary; defaults to typst.
+	Command string
+}
+
+// Engine returns the typst binary.
+func (t *Typst) Engine() string {
+	if t.Command == "" {
+		return "typst"
+	}
+	return t.Command
+}
+
+// Render fills in the template of the job and compiles it with Typst.
+// Files in the jobs directory can be imported, included and read by the document, but nothing outside of it can.
+func (t *Typst) Render(ctx context.Context, job Job) (*Result, error) {
+	res := &Result{}
+	// Fill in the template
+	start := time.Now()
+	doc, err := job.fill()
+	if err != nil {
+		return res, err
+	}
+	if locale, ok := job.Details[LocaleKey].(string); ok && locale != "" {
+		setup, err := typstLanguageSetup(locale)
+		if err != nil {
+			return res, err
+		}
+		// Set rules at the top of the document are overridden by any of its own
+		doc = append([]byte(setup), doc...)
+	}
+	jn := filepath.Base(job.Dir)
+	if err = ioutil.WriteFile(filepath.Join(job.Dir, jn+".typ"), doc, 0644); err != nil {
+		return res, err
+	}
+	res.Source = jn + ".typ"
+	res.phase("template", start)
+
+	// Typst reports problems on stderr, which is kept as the output since there's no log
+	var stderr bytes.Buffer
+	cmd, err := job.command(ctx, job.Env, t.Engine(), "compile", "--root", ".", "--diagnostic-format", "short", jn+".typ", jn+".pdf")
+	if err != nil {
+		return res, err
+	}
+	cmd.Stderr = &stderr
+	err = res.run(ctx, &job, cmd)
+	res.Output += stderr.String()
+	if err != nil {
+		return res, err
+	}
+	res.PDF = jn + ".pdf"
+	return res, nil
+}
+
+// typstLanguageSetup returns the set rule that sets the language (and region, if any) of the text to the given locale.
+func typstLanguageSetup(locale string) (string, error) {
+	tag := strings.ToLower(strings.Replace(locale, "_", "-", -1))
+	parts := strings.SplitN(tag, "-", 2)
+	if _, ok := languages[parts[0]]; !ok {
+		return "", fmt.Errorf("unsupported locale: %s", locale)
+	}
+	if len(parts) == 2 && len(parts[1]) == 2 {
+		return fmt.Sprintf("#set text(lang: %q, region: %q)\n", parts[0], strings.ToUpper(parts[1])), nil
+	}
+	return fmt.Sprintf("#set text(lang: %q)\n", parts[0]), nil
+}
@@ -0,0 +1,106 @@
+package pdf
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+)
+
+// Issue is a problem found while checking a PDF.
+type Issue struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// AccessibilityReport describes how accessible a PDF is to assistive technology, e.g. screen readers.
+type AccessibilityReport struct {
+	// Tagged is whether the PDF has a structure tree marking up its contents
+	Tagged bool `json:"tagged"`
+	// Language is the natural language of the document, if one is declared
+	Language string `json:"language,omitempty"`
+	// Title is the title of the document, if it has one
+	Title string `json:"title,omitempty"`
+	// Images is the number of images in the PDF, not counting soft masks
+	Images int `json:"images"`
+	// Figures is the number of figures in the structure tree, and FiguresWithoutAlt is how many of them don't have alternate text
+	Figures           int     `json:"figures"`
+	FiguresWithoutAlt int     `json:"figures_without_alt"`
+	Issues            []Issue `json:"issues"`
+}
+
+var (
+	markedRe  = regexp.MustCompile(`/Marked\s+true`)
+	dcTitleRe = regexp.MustCompile(`(?s)<dc:title>.*?<rdf:li[^>]*>([^<]+)</rdf:li>`)
+)
+
+// Accessibility checks the PDF for the most basic accessibility issues: missing tags, no document language,
+// no title and images without alternate text.
+func Accessibility(data []byte) AccessibilityReport {
+	report := AccessibilityReport{Issues: []Issue{}}
+	var marked, structTree bool
+	var masks int
+	for _, sec := range sections(data) {
+		marked = marked || markedRe.Match(sec)
+		if m := dcTitleRe.FindSubmatch(sec); m != nil && report.Title == "" {
+			report.Title = string(bytes.TrimSpace(m[1]))
+		}
+		for _, d := range dicts(sec) {
+			switch {
+			case name(d, "Type") == "Catalog":
+				structTree = structTree || hasKey(d, "StructTreeRoot")
+				if lang, ok := str(d, "Lang"); ok {
+					report.Language = lang
+				}
+			case name(d, "Subtype") == "Image":
+				report.Images++
+				if hasKey(d, "SMask") {
+					masks++
+				}
+			case name(d, "S") == "Figure":
+				report.Figures++
+				if !hasKey(d, "Alt") && !hasKey(d, "ActualText") {
+					report.FiguresWithoutAlt++
+				}
+			case hasKey(d, "Title") && hasKey(d, "Producer"):
+				// The document information dictionary
+				if title, ok := str(d, "Title"); ok && title != "" {
+					report.Title = title
+				}
+			}
+		}
+	}
+	report.Images -= masks
+	report.Tagged = marked && structTree
+
+	if !report.Tagged {
+		report.Issues = append(report.Issues, Issue{
+			Code:    "untagged",
+			Message: "the document isn't tagged, so assistive technology can't tell its headings, lists, tables and reading order apart",
+		})
+	}
+	if report.Language == "" {
+		report.Issues = append(report.Issues, Issue{
+			Code:    "no_language",
+			Message: "the document doesn't declare its language, so screen readers may pronounce it incorrectly",
+		})
+	}
+	if report.Title == "" {
+		report.Issues = append(report.Issues, Issue{
+			Code:    "no_title",
+			Message: "the document doesn't have a title",
+		})
+	}
+	switch {
+	case !report.Tagged && report.Images > 0:
+		report.Issues = append(report.Issues, Issue{
+			Code:    "images_without_alt",
+			Message: fmt.Sprintf("none of the %d images have alternate text since the document isn't tagged", report.Images),
+		})
+	case report.FiguresWithoutAlt > 0:
+		report.Issues = append(report.Issues, Issue{
+			Code:    "images_without_alt",
+			Message: fmt.Sprintf("%d of the %d figures don't have alternate text", report.FiguresWithoutAlt, report.Figures),
+		})
+	}
+	return report
+}
@@ -0,0 +1,69 @@
+package pdf
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestStr(t *testing.T) {
+	tests := []struct {
+		dict string
+		want string
+		ok   bool
+	}{
+		{`<< /Title (Annual Report) >>`, "Annual Report", true},
+		{`<< /Title (Nested (parens) and \(escaped\) ones) >>`, "Nested (parens) and (escaped) ones", true},
+		{`<< /Title (Line\nbreak and \101\102C octal) >>`, "Line\nbreak and ABC octal", true},
+		{`<< /Title <416E6E75616C> >>`, "Annual", true},
+		{`<< /Title <FEFF00C90074006500CC> >>`, "ÉteÌ", true},
+		{`<< /Title (` + "\xfe\xff\x00R\x00\xe9" + `) >>`, "Ré", true},
+		{`<< /Title << /Nested 1 >> >>`, "", false},
+		{`<< /Author (Someone) >>`, "", false},
+	}
+	for _, tt := range tests {
+		got, ok := str([]byte(tt.dict), "Title")
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("%s: expected %q %v, got %q %v", tt.dict, tt.want, tt.ok, got, ok)
+		}
+	}
+}
+
+func issueCodes(r AccessibilityReport) []string {
+	codes := []string{}
+	for _, i := range r.Issues {
+		codes = append(codes, i.Code)
+	}
+	return codes
+}
+
+func TestAccessibility(t *testing.T) {
+	untagged := build([]string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [] /Count 0 >>",
+		"<< /Type /XObject /Subtype /Image /Width 1 /Height 1 /SMask 4 0 R /Length 0 >>\nstream\n\nendstream",
+		"<< /Type /XObject /Subtype /Image /Width 1 /Height 1 /Length 0 >>\nstream\n\nendstream",
+	}, "", false, 0)
+	r := Accessibility(untagged)
+	if r.Tagged || r.Language != "" || r.Title != "" || r.Images != 1 {
+		t.Errorf("unexpected report %+v", r)
+	}
+	if want := []string{"untagged", "no_language", "no_title", "images_without_alt"}; !reflect.DeepEqual(issueCodes(r), want) {
+		t.Errorf("expected issues %v, got %v", want, issueCodes(r))
+	}
+
+	tagged := build([]string{
+		"<< /Type /Catalog /Pages 2 0 R /MarkInfo << /Marked true >> /StructTreeRoot 3 0 R /Lang (en-GB) >>",
+		"<< /Type /Pages /Kids [] /Count 0 >>",
+		"<< /Type /StructTreeRoot /K [4 0 R 5 0 R] >>",
+		"<< /Type /StructElem /S /Figure /Alt (A chart of sales) >>",
+		"<< /Type /StructElem /S /Figure >>",
+		"<< /Title (Sales \\(2024\\)) /Producer (pdfTeX) >>",
+	}, "/Info 6 0 R", false, 0)
+	r = Accessibility(tagged)
+	if !r.Tagged || r.Language != "en-GB" || r.Title != "Sales (2024)" || r.Figures != 2 || r.FiguresWithoutAlt != 1 {
+		t.Errorf("unexpected report %+v", r)
+	}
+	if want := []string{"images_without_alt"}; !reflect.DeepEqual(issueCodes(r), want) {
+		t.Errorf("expected issues %v, got %v", want, issueCodes(r))
+	}
+}
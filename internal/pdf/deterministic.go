@@ -0,0 +1,40 @@
+package pdf
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+)
+
+var idRe = regexp.MustCompile(`/ID\s*\[\s*<([0-9A-Fa-f]*)>\s*<([0-9A-Fa-f]*)>\s*\]`)
+
+// FixID replaces the file identifiers in the trailer of the PDF with ones derived from the rest of its contents, in place.
+// TeX engines derive them from the time and name of the output file, which otherwise makes identical documents differ.
+// The identifiers keep their length so that the offsets in the cross-reference table stay valid.
+func FixID(data []byte) []byte {
+	matches := idRe.FindAllSubmatchIndex(data, -1)
+	if len(matches) == 0 {
+		return data
+	}
+	for _, m := range matches {
+		for i := m[2]; i < m[5]; i++ {
+			if isHex(data[i]) {
+				data[i] = '0'
+			}
+		}
+	}
+	sum := sha256.Sum256(data)
+	digest := []byte(hex.EncodeToString(sum[:]))
+	for _, m := range matches {
+		for _, g := range [][2]int{{m[2], m[3]}, {m[4], m[5]}} {
+			for i := g[0]; i < g[1]; i++ {
+				data[i] = digest[(i-g[0])%len(digest)]
+			}
+		}
+	}
+	return data
+}
+
+func isHex(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
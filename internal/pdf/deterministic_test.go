@@ -0,0 +1,30 @@
+package pdf
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestFixID(t *testing.T) {
+	objects := []string{"<< /Type /Catalog /Pages 2 0 R >>", "<< /Type /Pages /Kids [] /Count 0 >>"}
+	first := build(objects, "/ID [<0123456789ABCDEF0123456789ABCDEF> <0123456789ABCDEF0123456789ABCDEF>]", false, 0)
+	second := build(objects, "/ID [<FEDCBA9876543210FEDCBA9876543210> <00112233445566778899AABBCCDDEEFF>]", false, 0)
+	other := build(append(objects[:1:1], "<< /Type /Pages /Kids [] /Count 1 >>"), "/ID [<0123456789ABCDEF0123456789ABCDEF> <0123456789ABCDEF0123456789ABCDEF>]", false, 0)
+	n := len(first)
+	first, second, other = FixID(first), FixID(second), FixID(other)
+	if len(first) != n {
+		t.Fatalf("expected the length of the PDF to be kept, got %d bytes instead of %d", len(first), n)
+	}
+	if !bytes.Equal(first, second) {
+		t.Error("expected PDFs differing only in their identifiers to be made identical")
+	}
+	if bytes.Equal(idRe.Find(first), idRe.Find(other)) {
+		t.Error("expected PDFs with different contents to get different identifiers")
+	}
+	if !idRe.Match(first) {
+		t.Error("expected the identifiers to stay well formed")
+	}
+	if data := []byte("no identifiers"); !bytes.Equal(FixID(data), []byte("no identifiers")) {
+		t.Error("expected PDFs without identifiers to be left alone")
+	}
+}
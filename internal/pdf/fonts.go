@@ -0,0 +1,55 @@
+package pdf
+
+import (
+	"sort"
+)
+
+// Font describes a font used by a PDF.
+type Font struct {
+	Name     string `json:"name"`
+	Subtype  string `json:"subtype"`
+	Embedded bool   `json:"embedded"`
+}
+
+// Fonts lists the fonts used by the PDF, sorted by name.
+// Type 3 fonts are always considered embedded since their glyphs are drawn by the PDF itself.
+func Fonts(data []byte) []Font {
+	fonts := map[string]*Font{}
+	embedded := map[string]bool{}
+	for _, sec := range sections(data) {
+		for _, d := range dicts(sec) {
+			switch name(d, "Type") {
+			case "Font":
+				subtype := name(d, "Subtype")
+				fontName := name(d, "BaseFont")
+				if fontName == "" || subtype == "Type0" {
+					// Type0 fonts are embedded if their descendant CID font is, which is listed on its own
+					continue
+				}
+				fonts[fontName] = &Font{Name: fontName, Subtype: subtype, Embedded: subtype == "Type3"}
+			case "FontDescriptor":
+				if hasKey(d, "FontFile") || hasKey(d, "FontFile2") || hasKey(d, "FontFile3") {
+					embedded[name(d, "FontName")] = true
+				}
+			}
+		}
+	}
+	list := make([]Font, 0, len(fonts))
+	for fontName, f := range fonts {
+		f.Embedded = f.Embedded || embedded[fontName]
+		list = append(list, *f)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// UnembeddedFonts returns the names of the fonts used by the PDF that aren't embedded in it.
+func UnembeddedFonts(data []byte) []string {
+	var names []string
+	for _, f := range Fonts(data) {
+		if !f.Embedded {
+			names = append(names, f.Name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,33 @@
+package pdf
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFonts(t *testing.T) {
+	data := build([]string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [] /Count 0 >>",
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica >>",
+		"<< /Type /Font /Subtype /Type1 /BaseFont /ABCDEF+CMR10 /FontDescriptor 5 0 R >>",
+		"<< /Type /FontDescriptor /FontName /ABCDEF+CMR10 /FontFile 6 0 R >>",
+		"<< /Length 0 >>\nstream\n\nendstream",
+		"<< /Type /Font /Subtype /Type3 /BaseFont /Glyphs >>",
+		"<< /Type /Font /Subtype /Type0 /BaseFont /NotoSans /DescendantFonts [9 0 R] >>",
+		flateStream(t, "/Type /ObjStm /N 2 /First 8", "10 0 11 0 <</Type/Font/Subtype/CIDFontType2/BaseFont/NotoSans>> "+
+			"<</Type/FontDescriptor/FontName/NotoSans/FontFile2 12 0 R>>"),
+	}, "", false, 0)
+	want := []Font{
+		{Name: "ABCDEF+CMR10", Subtype: "Type1", Embedded: true},
+		{Name: "Glyphs", Subtype: "Type3", Embedded: true},
+		{Name: "Helvetica", Subtype: "Type1", Embedded: false},
+		{Name: "NotoSans", Subtype: "CIDFontType2", Embedded: true},
+	}
+	if got := Fonts(data); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected fonts %v, got %v", want, got)
+	}
+	if got := UnembeddedFonts(data); !reflect.DeepEqual(got, []string{"Helvetica"}) {
+		t.Errorf("expected only Helvetica not to be embedded, got %v", got)
+	}
+}
@@ -0,0 +1,33 @@
+package pdf
+
+import (
+	"regexp"
+	"strconv"
+)
+
+var countRe = regexp.MustCompile(`/Count\s+(\d+)`)
+
+// Pages returns the number of pages in the PDF, as recorded by the root of its page tree.
+// If the page tree can't be found, the page objects are counted instead.
+func Pages(data []byte) int {
+	if t, err := readTrailer(data); err == nil {
+		if catalog := object(data, t.root); catalog != nil {
+			if ref := value(catalog, "Pages"); ref != "" {
+				num, _ := strconv.Atoi(intRe.FindString(ref))
+				if m := countRe.FindSubmatch(object(data, num)); m != nil {
+					n, _ := strconv.Atoi(string(m[1]))
+					return n
+				}
+			}
+		}
+	}
+	var n int
+	for _, sec := range sections(data) {
+		for _, d := range dicts(sec) {
+			if name(d, "Type") == "Page" {
+				n++
+			}
+		}
+	}
+	return n
+}
@@ -0,0 +1,37 @@
+package pdf
+
+import (
+	"testing"
+)
+
+func TestPages(t *testing.T) {
+	classic := build([]string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R 4 0 R 5 0 R] /Count 3 >>",
+		"<< /Type /Page /Parent 2 0 R >>",
+		"<< /Type /Page /Parent 2 0 R >>",
+		"<< /Type /Page /Parent 2 0 R >>",
+	}, "", false, 0)
+	compressed := build([]string{
+		"<< /Type /Catalog /Pages 3 0 R >>",
+		objectStream(t, map[int]string{3: "<< /Type /Pages /Kids [4 0 R 5 0 R] /Count 2 >>", 4: "<< /Type /Page /Parent 3 0 R >>", 5: "<< /Type /Page /Parent 3 0 R >>"}),
+	}, "", true, 3)
+	// Without a trailer, the page objects are counted, wherever they are
+	broken := []byte("%PDF-1.5\n1 0 obj\n<< /Type /Page >>\nendobj\n2 0 obj\n<</Type/Page/Parent 4 0 R>>\nendobj\n3 0 obj\n" +
+		flateStream(t, "", "<< /Type /Page >> << /Type /Pages /Count 9 >>") + "\nendobj\n")
+	tests := []struct {
+		name string
+		data []byte
+		want int
+	}{
+		{"classic", classic, 3},
+		{"object streams", compressed, 2},
+		{"no trailer", broken, 3},
+		{"not a pdf", []byte("hello"), 0},
+	}
+	for _, tt := range tests {
+		if got := Pages(tt.data); got != tt.want {
+			t.Errorf("%s: expected %d pages, got %d", tt.name, tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+// Package pdf extracts the bits of information about PDF files that LaTTe needs to check the PDFs it generates.
+// It's not a general purpose PDF parser: it scans the raw objects of a file, along with the contents of its
+// Flate compressed streams (where object streams keep most of the objects in files written by pdfTeX).
+package pdf
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/hex"
+	"io/ioutil"
+	"regexp"
+	"unicode/utf16"
+)
+
+var streamRe = regexp.MustCompile(`(?s)<<(.*?)>>\s*stream\r?\n`)
+
+// sections returns the raw contents of the file followed by the decompressed contents of each of its Flate streams.
+func sections(data []byte) [][]byte {
+	secs := [][]byte{data}
+	for _, loc := range streamRe.FindAllSubmatchIndex(data, -1) {
+		dict := data[loc[2]:loc[3]]
+		if !bytes.Contains(dict, []byte("/FlateDecode")) {
+			continue
+		}
+		start := loc[1]
+		end := bytes.Index(data[start:], []byte("endstream"))
+		if end < 0 {
+			continue
+		}
+		zr, err := zlib.NewReader(bytes.NewReader(data[start : start+end]))
+		if err != nil {
+			continue
+		}
+		// Streams are allowed to have trailing garbage after the compressed data, so we keep whatever we managed to read
+		inflated, _ := ioutil.ReadAll(zr)
+		zr.Close()
+		if len(inflated) > 0 {
+			secs = append(secs, inflated)
+		}
+	}
+	return secs
+}
+
+// dicts returns every dictionary in the data, including nested ones, as its raw text.
+func dicts(data []byte) [][]byte {
+	var ds [][]byte
+	var stack []int
+	for i := 0; i < len(data)-1; i++ {
+		switch {
+		case data[i] == '(':
+			// Skip over string literals since they may contain unbalanced brackets
+			depth := 0
+			for ; i < len(data); i++ {
+				if data[i] == '\\' {
+					i++
+					continue
+				}
+				if data[i] == '(' {
+					depth++
+				} else if data[i] == ')' {
+					if depth--; depth == 0 {
+						break
+					}
+				}
+			}
+		case data[i] == '<' && data[i+1] == '<':
+			stack = append(stack, i)
+			i++
+		case data[i] == '>' && data[i+1] == '>' && len(stack) > 0:
+			start := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			ds = append(ds, data[start:i+2])
+			i++
+		}
+	}
+	return ds
+}
+
+// name returns the value of the dictionaries key if its value is a name, e.g. name(d, "Type") is Font for << /Type /Font >>.
+func name(dict []byte, key string) string {
+	re := regexp.MustCompile(`/` + key + `\s*/([^\s/<>\[\]()]+)`)
+	if m := re.FindSubmatch(dict); m != nil {
+		return string(m[1])
+	}
+	return ""
+}
+
+func hasKey(dict []byte, key string) bool {
+	return regexp.MustCompile(`/` + key + `[\s/<\[(\d]`).Match(dict)
+}
+
+// str returns the value of the dictionaries key if its value is a string, decoding hex and UTF-16 strings.
+func str(dict []byte, key string) (string, bool) {
+	loc := regexp.MustCompile(`/` + key + `\s*[(<]`).FindIndex(dict)
+	if loc == nil || (dict[loc[1]-1] == '<' && loc[1] < len(dict) && dict[loc[1]] == '<') {
+		return "", false
+	}
+	var raw []byte
+	if dict[loc[1]-1] == '<' {
+		end := bytes.IndexByte(dict[loc[1]:], '>')
+		if end < 0 {
+			return "", false
+		}
+		hexDigits := bytes.Map(func(r rune) rune {
+			if bytes.ContainsRune([]byte("0123456789abcdefABCDEF"), r) {
+				return r
+			}
+			return -1
+		}, dict[loc[1]:loc[1]+end])
+		if len(hexDigits)%2 == 1 {
+			hexDigits = append(hexDigits, '0')
+		}
+		raw = make([]byte, len(hexDigits)/2)
+		if _, err := hex.Decode(raw, hexDigits); err != nil {
+			return "", false
+		}
+	} else {
+		depth := 1
+		for i := loc[1]; i < len(dict) && depth > 0; i++ {
+			c := dict[i]
+			switch {
+			case c == '\\' && i+1 < len(dict):
+				i++
+				switch e := dict[i]; e {
+				case 'n':
+					raw = append(raw, '\n')
+				case 'r':
+					raw = append(raw, '\r')
+				case 't':
+					raw = append(raw, '\t')
+				case '\n', '\r':
+				default:
+					if e >= '0' && e <= '7' {
+						v := 0
+						for j := 0; j < 3 && i < len(dict) && dict[i] >= '0' && dict[i] <= '7'; j++ {
+							v = v*8 + int(dict[i]-'0')
+							i++
+						}
+						i--
+						raw = append(raw, byte(v))
+					} else {
+						raw = append(raw, e)
+					}
+				}
+				continue
+			case c == '(':
+				depth++
+			case c == ')':
+				if depth--; depth == 0 {
+					continue
+				}
+			}
+			raw = append(raw, c)
+		}
+	}
+	// Text strings starting with a byte order mark are UTF-16BE
+	if len(raw) >= 2 && raw[0] == 0xFE && raw[1] == 0xFF {
+		u := make([]uint16, 0, len(raw)/2)
+		for i := 2; i+1 < len(raw); i += 2 {
+			u = append(u, uint16(raw[i])<<8|uint16(raw[i+1]))
+		}
+		return string(utf16.Decode(u)), true
+	}
+	return string(raw), true
+}
@@ -0,0 +1,61 @@
+package pdf
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func build(objects []string, extra string, xrefStream bool, compressed int) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.5\n")
+	offsets := make([]int, len(objects))
+	for i, obj := range objects {
+		offsets[i] = buf.Len()
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+	xref := buf.Len()
+	size := len(objects) + compressed + 1
+	if xrefStream {
+		// The offsets aren't needed by anything under test, so the stream is left empty
+		fmt.Fprintf(&buf, "%d 0 obj\n<< /Type /XRef /Size %d /Root 1 0 R %s /W [1 4 2] /Length 0 >>\nstream\n\nendstream\nendobj\n", size, size+1, extra)
+	} else {
+		fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", size)
+		for _, off := range offsets {
+			fmt.Fprintf(&buf, "%010d 00000 n \n", off)
+		}
+		fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R %s >>\n", size, extra)
+	}
+	fmt.Fprintf(&buf, "startxref\n%d\n%%%%EOF\n", xref)
+	return buf.Bytes()
+}
+
+func flateStream(t *testing.T, extra, contents string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	// Padding keeps short contents from being stored uncompressed, where they'd be found without inflating them
+	zw.Write([]byte(contents + strings.Repeat(" ", 256)))
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return fmt.Sprintf("<< %s /Filter /FlateDecode /Length %d >>\nstream\n%s\nendstream", extra, buf.Len(), buf.Bytes())
+}
+
+func objectStream(t *testing.T, objects map[int]string) string {
+	t.Helper()
+	n := len(objects)
+	var header, body strings.Builder
+	for num := 1; len(objects) > 0; num++ {
+		obj, ok := objects[num]
+		if !ok {
+			continue
+		}
+		delete(objects, num)
+		fmt.Fprintf(&header, "%d %d ", num, body.Len())
+		body.WriteString(obj + "\n")
+	}
+	return flateStream(t, fmt.Sprintf("/Type /ObjStm /N %d /First %d", n, header.Len()), header.String()+body.String())
+}
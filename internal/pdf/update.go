@@ -0,0 +1,295 @@
+package pdf
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+var (
+	startxrefRe = regexp.MustCompile(`startxref\s+(\d+)`)
+	refRe       = regexp.MustCompile(`^\s*(\d+)\s+(\d+)\s+R`)
+	objRe       = regexp.MustCompile(`^\s*(\d+)\s+(\d+)\s+obj\s*`)
+	intRe       = regexp.MustCompile(`\d+`)
+	sizeRe      = regexp.MustCompile(`/Size\s+(\d+)`)
+	firstRe     = regexp.MustCompile(`/First\s+(\d+)`)
+)
+
+// trailer holds the parts of the last trailer (or cross-reference stream dictionary) of a PDF that an update must carry over.
+type trailer struct {
+	offset int
+	// stream is whether the cross-reference section is a stream rather than a table
+	stream bool
+	size   int
+	root   int
+	// info and id are copied over as is; they're empty if the PDF doesn't have them
+	info string
+	id   string
+}
+
+var arrayRe = regexp.MustCompile(`^\s*\[[^\]]*\]`)
+
+// value returns the raw text of the dictionaries key if its value is an indirect reference or array.
+func value(dict []byte, key string) string {
+	loc := regexp.MustCompile(`/` + key + `\b`).FindIndex(dict)
+	if loc == nil {
+		return ""
+	}
+	rest := dict[loc[1]:]
+	if m := refRe.Find(rest); m != nil {
+		return string(bytes.TrimSpace(m))
+	}
+	if m := arrayRe.Find(rest); m != nil {
+		return string(bytes.TrimSpace(m))
+	}
+	return ""
+}
+
+func readTrailer(data []byte) (*trailer, error) {
+	all := startxrefRe.FindAllSubmatch(data, -1)
+	if len(all) == 0 {
+		return nil, errors.New("pdf has no startxref")
+	}
+	offset, _ := strconv.Atoi(string(all[len(all)-1][1]))
+	if offset <= 0 || offset >= len(data) {
+		return nil, errors.New("pdf has an invalid startxref")
+	}
+	t := &trailer{offset: offset}
+	var dict []byte
+	rest := data[offset:]
+	if bytes.HasPrefix(rest, []byte("xref")) {
+		i := bytes.Index(rest, []byte("trailer"))
+		if i < 0 {
+			return nil, errors.New("pdf has no trailer")
+		}
+		ds := dicts(rest[i:])
+		if len(ds) == 0 {
+			return nil, errors.New("pdf has an empty trailer")
+		}
+		dict = ds[len(ds)-1]
+	} else if m := objRe.FindIndex(rest); m != nil {
+		t.stream = true
+		end := bytes.Index(rest, []byte("stream"))
+		if end < 0 {
+			return nil, errors.New("pdf has an invalid cross-reference stream")
+		}
+		ds := dicts(rest[m[1]:end])
+		if len(ds) == 0 {
+			return nil, errors.New("pdf has an invalid cross-reference stream")
+		}
+		dict = ds[len(ds)-1]
+	} else {
+		return nil, errors.New("pdf has an invalid startxref")
+	}
+	if m := sizeRe.FindSubmatch(dict); m != nil {
+		t.size, _ = strconv.Atoi(string(m[1]))
+	}
+	root := value(dict, "Root")
+	if root == "" || t.size == 0 {
+		return nil, errors.New("pdf trailer is missing its size or root")
+	}
+	t.root, _ = strconv.Atoi(intRe.FindString(root))
+	t.info = value(dict, "Info")
+	t.id = value(dict, "ID")
+	return t, nil
+}
+
+// leadingDict returns the dictionary that data starts with, if any.
+func leadingDict(data []byte) []byte {
+	if !bytes.HasPrefix(data, []byte("<<")) {
+		return nil
+	}
+	// Nested dictionaries end first, so look for the one starting where the data does
+	ds := dicts(data)
+	for i := len(ds) - 1; i >= 0; i-- {
+		if &ds[i][0] == &data[0] {
+			return ds[i]
+		}
+	}
+	return nil
+}
+
+// object returns the dictionary of the object with the given number, looking in object streams if need be.
+// If the object has been updated, its latest version is returned.
+func object(data []byte, num int) []byte {
+	re := regexp.MustCompile(`(?:^|[^\d])` + strconv.Itoa(num) + `\s+\d+\s+obj\s*`)
+	if locs := re.FindAllIndex(data, -1); len(locs) > 0 {
+		if d := leadingDict(data[locs[len(locs)-1][1]:]); d != nil {
+			return d
+		}
+	}
+	for _, loc := range streamRe.FindAllSubmatchIndex(data, -1) {
+		dict := data[loc[2]:loc[3]]
+		if name(dict, "Type") != "ObjStm" || !bytes.Contains(dict, []byte("/FlateDecode")) {
+			continue
+		}
+		end := bytes.Index(data[loc[1]:], []byte("endstream"))
+		if end < 0 {
+			continue
+		}
+		zr, err := zlib.NewReader(bytes.NewReader(data[loc[1] : loc[1]+end]))
+		if err != nil {
+			continue
+		}
+		content, _ := ioutil.ReadAll(zr)
+		zr.Close()
+		m := firstRe.FindSubmatch(dict)
+		if m == nil {
+			continue
+		}
+		first, _ := strconv.Atoi(string(m[1]))
+		if first <= 0 || first > len(content) {
+			continue
+		}
+		header := intRe.FindAll(content[:first], -1)
+		for i := 0; i+1 < len(header); i += 2 {
+			if n, _ := strconv.Atoi(string(header[i])); n != num {
+				continue
+			}
+			off, _ := strconv.Atoi(string(header[i+1]))
+			if first+off < len(content) {
+				return leadingDict(bytes.TrimLeft(content[first+off:], " \r\n\t"))
+			}
+		}
+	}
+	return nil
+}
+
+// insert adds the entries to the beginning of the dictionary.
+func insert(dict []byte, entries string) []byte {
+	out := append([]byte("<< "), entries...)
+	return append(out, dict[2:]...)
+}
+
+// update is an incremental update being appended to a PDF.
+type update struct {
+	data    []byte
+	offsets map[int]int
+}
+
+func (u *update) add(num int, body []byte) {
+	u.offsets[num] = len(u.data)
+	u.data = append(u.data, fmt.Sprintf("%d 0 obj\n", num)...)
+	u.data = append(u.data, body...)
+	u.data = append(u.data, "\nendobj\n"...)
+}
+
+// Attach embeds a file in the PDF with an incremental update, listing it in the PDF's attachments as well as its
+// associated files. It's left to the caller to make sure the name is a valid PDF string, e.g. by keeping it to ASCII letters,
+// digits, dashes and dots.
+func Attach(data []byte, fileName, mimeType, description string, contents []byte) ([]byte, error) {
+	t, err := readTrailer(data)
+	if err != nil {
+		return nil, err
+	}
+	catalog := object(data, t.root)
+	if catalog == nil {
+		return nil, errors.New("pdf catalog not found")
+	}
+	u := &update{data: append([]byte{}, data...), offsets: map[int]int{}}
+	if !bytes.HasSuffix(u.data, []byte("\n")) {
+		u.data = append(u.data, '\n')
+	}
+	file, spec, tree := t.size, t.size+1, t.size+2
+	size := t.size + 3
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "<< /Type /EmbeddedFile /Subtype /%s /Length %d /Params << /Size %d >> >>\nstream\n",
+		regexp.MustCompile(`[^A-Za-z0-9.\-+]`).ReplaceAllStringFunc(mimeType, func(c string) string {
+			return fmt.Sprintf("#%02X", c[0])
+		}), len(contents), len(contents))
+	buf.Write(contents)
+	buf.WriteString("\nendstream")
+	u.add(file, buf.Bytes())
+	u.add(spec, []byte(fmt.Sprintf("<< /Type /Filespec /F (%s) /UF (%s) /Desc %s /AFRelationship /Data /EF << /F %d 0 R /UF %d 0 R >> >>",
+		fileName, fileName, textString(description), file, file)))
+	u.add(tree, []byte(fmt.Sprintf("<< /Names [(%s) %d 0 R] >>", fileName, spec)))
+
+	// Point the catalog's name dictionary at the new tree of embedded files
+	embedded := fmt.Sprintf("/EmbeddedFiles %d 0 R ", tree)
+	switch names := value(catalog, "Names"); {
+	case names != "":
+		num, _ := strconv.Atoi(intRe.FindString(names))
+		namesDict := object(data, num)
+		if namesDict == nil {
+			return nil, errors.New("pdf name dictionary not found")
+		}
+		if hasKey(namesDict, "EmbeddedFiles") {
+			return nil, errors.New("pdf already has embedded files")
+		}
+		u.add(num, insert(namesDict, embedded))
+	case hasKey(catalog, "Names"):
+		loc := regexp.MustCompile(`/Names\s*<<`).FindIndex(catalog)
+		if loc == nil || bytes.Contains(catalog, []byte("/EmbeddedFiles")) {
+			return nil, errors.New("pdf already has embedded files")
+		}
+		catalog = append(append(append([]byte{}, catalog[:loc[1]]...), " "+embedded...), catalog[loc[1]:]...)
+	default:
+		catalog = insert(catalog, "/Names << "+embedded+">> ")
+	}
+	if !hasKey(catalog, "AF") {
+		catalog = insert(catalog, fmt.Sprintf("/AF [%d 0 R] ", spec))
+	}
+	u.add(t.root, catalog)
+
+	xrefOffset := len(u.data)
+	if t.stream {
+		// The cross-reference stream lists itself as well
+		u.offsets[size] = xrefOffset
+		size++
+	}
+	nums := make([]int, 0, len(u.offsets))
+	for num := range u.offsets {
+		nums = append(nums, num)
+	}
+	sort.Ints(nums)
+	trailerDict := fmt.Sprintf("/Size %d /Root %d 0 R /Prev %d", size, t.root, t.offset)
+	if t.info != "" {
+		trailerDict += " /Info " + t.info
+	}
+	if t.id != "" {
+		trailerDict += " /ID " + t.id
+	}
+	if t.stream {
+		var rows bytes.Buffer
+		var index []string
+		for _, num := range nums {
+			row := make([]byte, 7)
+			row[0] = 1
+			binary.BigEndian.PutUint32(row[1:5], uint32(u.offsets[num]))
+			rows.Write(row)
+			index = append(index, fmt.Sprintf("%d 1", num))
+		}
+		u.data = append(u.data, fmt.Sprintf("%d 0 obj\n<< /Type /XRef %s /W [1 4 2] /Index [%s] /Length %d >>\nstream\n",
+			size-1, trailerDict, strings.Join(index, " "), rows.Len())...)
+		u.data = append(u.data, rows.Bytes()...)
+		u.data = append(u.data, "\nendstream\nendobj\n"...)
+	} else {
+		u.data = append(u.data, "xref\n"...)
+		for _, num := range nums {
+			u.data = append(u.data, fmt.Sprintf("%d 1\n%010d 00000 n \n", num, u.offsets[num])...)
+		}
+		u.data = append(u.data, fmt.Sprintf("trailer\n<< %s >>\n", trailerDict)...)
+	}
+	u.data = append(u.data, fmt.Sprintf("startxref\n%d\n%%%%EOF\n", xrefOffset)...)
+	return u.data, nil
+}
+
+// textString encodes s as a PDF hex string, in UTF-16 so that any text survives.
+func textString(s string) string {
+	var buf bytes.Buffer
+	buf.WriteString("<FEFF")
+	for _, r := range utf16.Encode([]rune(s)) {
+		fmt.Fprintf(&buf, "%04X", r)
+	}
+	buf.WriteString(">")
+	return buf.String()
+}
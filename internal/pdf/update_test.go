@@ -0,0 +1,67 @@
+package pdf
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestAttach(t *testing.T) {
+	pages := "<< /Type /Pages /Kids [3 0 R] /Count 1 >>"
+	page := "<< /Type /Page /Parent 2 0 R >>"
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"classic", build([]string{"<< /Type /Catalog /Pages 2 0 R >>", pages, page}, "/ID [<AB> <AB>]", false, 0)},
+		{"xref stream", build([]string{"<< /Type /Catalog /Pages 2 0 R >>", pages, page}, "", true, 0)},
+		{"object streams", build([]string{"<< /Type /Catalog /Pages 3 0 R >>", objectStream(t, map[int]string{3: strings.Replace(pages, "3 0 R", "4 0 R", 1), 4: strings.Replace(page, "2 0 R", "3 0 R", 1)})}, "", true, 2)},
+		{"names dictionary", build([]string{"<< /Type /Catalog /Pages 2 0 R /Names 4 0 R >>", pages, page, "<< /Dests 5 0 R >>"}, "", false, 0)},
+		{"inline names", build([]string{"<< /Type /Catalog /Pages 2 0 R /Names << /Dests 5 0 R >> >>", pages, page}, "", false, 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before, err := readTrailer(tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out, err := Attach(tt.data, "invoice.xml", "text/xml", "Factur-X invoice", []byte("<Invoice/>"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.HasPrefix(out, tt.data) {
+				t.Fatal("expected the PDF to be updated incrementally, by appending to it")
+			}
+			after, err := readTrailer(out)
+			if err != nil {
+				t.Fatalf("expected the updated PDF to have a valid trailer: %v", err)
+			}
+			if after.root != before.root || after.stream != before.stream || after.id != before.id || after.size <= before.size {
+				t.Fatalf("unexpected trailer %+v after %+v", after, before)
+			}
+			if !bytes.Contains(out, []byte(fmt.Sprintf("/Prev %d", before.offset))) {
+				t.Error("expected the update to point back at the previous cross-reference section")
+			}
+			catalog := object(out, after.root)
+			if !hasKey(catalog, "AF") {
+				t.Errorf("expected the file to be listed as an associated file, got catalog %s", catalog)
+			}
+			if !bytes.Contains(out, []byte("/EmbeddedFiles")) || !bytes.Contains(out, []byte("<Invoice/>")) {
+				t.Error("expected the file to be embedded")
+			}
+			if !bytes.Contains(out, []byte("/Subtype /text#2Fxml")) {
+				t.Error("expected the mime type to be escaped as a name")
+			}
+			if n := Pages(out); n != 1 {
+				t.Errorf("expected the updated PDF to still have 1 page, got %d", n)
+			}
+			if _, err := Attach(out, "other.xml", "text/xml", "", nil); err == nil {
+				t.Error("expected attaching to a PDF that already has embedded files to fail")
+			}
+		})
+	}
+	if _, err := Attach([]byte("not a pdf"), "a.xml", "text/xml", "", nil); err == nil {
+		t.Error("expected attaching to something that isn't a PDF to fail")
+	}
+}
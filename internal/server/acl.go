@@ -0,0 +1,135 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Actions that may be restricted on a stored template.
+const (
+	aclRender = "render"
+	aclModify = "modify"
+)
+
+// templateACL restricts who may render or modify a stored template.
+// It's stored as a registered JSON file named TEMPLATE_ID.acl, and templates without one aren't restricted.
+// Entries are the names of API keys or OAuth2 subjects, "role:NAME" or "tenant:NAME"; an empty list doesn't restrict anyone.
+type templateACL struct {
+	Render []string `json:"render"`
+	Modify []string `json:"modify"`
+}
+
+// ForbiddenError is returned when a client isn't allowed to render or modify a template, or to use a file as a resource.
+type ForbiddenError struct {
+	ID     string
+	Action string
+}
+
+func (e *ForbiddenError) Error() string {
+	if e.Action == "use" {
+		return fmt.Sprintf("not allowed to use %s as a resource", e.ID)
+	}
+	return fmt.Sprintf("not allowed to %s template %s", e.Action, e.ID)
+}
+
+// matches returns whether any of the entries refer to the principal.
+func (p *principal) matches(entries []string) bool {
+	for _, entry := range entries {
+		switch {
+		case strings.HasPrefix(entry, "role:"):
+			for _, role := range p.roles {
+				if role == strings.TrimPrefix(entry, "role:") {
+					return true
+				}
+			}
+		case strings.HasPrefix(entry, "tenant:"):
+			if p.tenant != "" && p.tenant == strings.TrimPrefix(entry, "tenant:") {
+				return true
+			}
+		case entry == p.subject:
+			return true
+		}
+	}
+	return false
+}
+
+// sidecarExts are the extensions of the files stored alongside a template to configure it, e.g. TEMPLATE_ID.acl.
+var sidecarExts = []string{".acl", ".env", ".secrets", ".defaults", ".schema", ".bundle"}
+
+// aclSubject returns the id of the template that a registered file belongs to; sidecar files like TEMPLATE_ID.env and
+// TEMPLATE_ID.acl belong to their template, everything else belongs to itself.
+func aclSubject(id string) string {
+	for _, ext := range sidecarExts {
+		if strings.HasSuffix(id, ext) {
+			return strings.TrimSuffix(id, ext)
+		}
+	}
+	return id
+}
+
+// isSidecar returns whether the registered file with the given id configures a template, rather than being part of one.
+func isSidecar(id string) bool {
+	return aclSubject(id) != id
+}
+
+// templateACL loads the access control list of the template with the given id, returning nil if it doesn't have one.
+func (s *Server) templateACL(ctx context.Context, id string) (*templateACL, error) {
+	aclID := id + ".acl"
+	aclPath := filepath.Join(s.rootDir, aclID)
+	err := s.fetchToDisk(ctx, aclID, aclPath)
+	switch err.(type) {
+	case nil:
+	case *NotFoundError:
+		return nil, nil
+	default:
+		return nil, err
+	}
+	f, err := os.Open(aclPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var acl templateACL
+	if err = json.NewDecoder(f).Decode(&acl); err != nil {
+		return nil, fmt.Errorf("error while decoding access control list for template %s: %v", id, err)
+	}
+	return &acl, nil
+}
+
+// checkTemplateAccess makes sure the client that made the request may perform the action on the template (or sidecar file)
+// with the given id, returning an error of type *ForbiddenError if it may not.
+// Templates can't be restricted if requests aren't authenticated, and admins may do anything.
+func (s *Server) checkTemplateAccess(ctx context.Context, id, action string) error {
+	p := principalFrom(ctx)
+	if p == nil || p.can(PermAdmin) {
+		return nil
+	}
+	id = aclSubject(id)
+	acl, err := s.templateACL(ctx, id)
+	if err != nil || acl == nil {
+		return err
+	}
+	entries := acl.Render
+	if action == aclModify {
+		entries = acl.Modify
+	}
+	if len(entries) > 0 && !p.matches(entries) {
+		return &ForbiddenError{ID: id, Action: action}
+	}
+	return nil
+}
+
+// checkResourceAccess makes sure the client that made the request may have the registered file with the given id placed
+// in its working directory, whether it was asked for with ?rsc= or pulled in by a template: files that are restricted
+// templates are only available to those who may render them, and files configuring templates or the server (e.g. their
+// access control lists, environment variables or the roles and keys) aren't available to anyone.
+func (s *Server) checkResourceAccess(ctx context.Context, id string) error {
+	if isSidecar(id) || (s.rbacID != "" && id == s.rbacID) {
+		return &ForbiddenError{ID: id, Action: "use"}
+	}
+	return s.checkTemplateAccess(ctx, id, aclRender)
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// defaultArchivePage and maxArchivePage are how many archived documents are listed at once, unless asked otherwise and at most.
+const (
+	defaultArchivePage = 50
+	maxArchivePage     = 500
+)
+
+func (s *Server) handleArchiveList() http.HandlerFunc {
+	type response struct {
+		Documents []archivedDocument `json:"documents"`
+		// Total is how many documents match, across every page
+		Total int `json:"total"`
+		// NextOffset is the offset of the next page, if there is one
+		NextOffset int `json:"next_offset,omitempty"`
+	}
+	s.apiSchema("archiveListResponse", response{})
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.archive == nil {
+			s.fail(w, r, CodeNotFound, "the archive isn't enabled", http.StatusNotFound)
+			return
+		}
+		q := r.URL.Query()
+		f := archiveFilter{
+			template:      q.Get("template"),
+			tenant:        q.Get("tenant"),
+			tags:          q["tag"],
+			sha256:        q.Get("sha256"),
+			detailsSHA256: q.Get("details_sha256"),
+		}
+		for param, t := range map[string]*time.Time{"from": &f.from, "to": &f.to} {
+			if v := q.Get(param); v != "" {
+				parsed, err := time.Parse(time.RFC3339, v)
+				if err != nil {
+					s.fail(w, r, CodeBadRequest, fmt.Sprintf("invalid %s time: %v", param, err), http.StatusBadRequest)
+					return
+				}
+				*t = parsed
+			}
+		}
+		// Clients that aren't admins only get to see their own tenants documents
+		if p := principalFrom(r.Context()); p != nil && !p.can(PermAdmin) {
+			f.tenant = p.tenant
+		}
+		offset, limit := 0, defaultArchivePage
+		for param, n := range map[string]*int{"offset": &offset, "limit": &limit} {
+			if v := q.Get(param); v != "" {
+				parsed, err := strconv.Atoi(v)
+				if err != nil || parsed < 0 {
+					s.fail(w, r, CodeBadRequest, fmt.Sprintf("invalid %s: %s", param, v), http.StatusBadRequest)
+					return
+				}
+				*n = parsed
+			}
+		}
+		if limit == 0 {
+			limit = defaultArchivePage
+		} else if limit > maxArchivePage {
+			limit = maxArchivePage
+		}
+		docs, total := s.archive.find(f, offset, limit)
+		resp := response{Documents: docs, Total: total}
+		if resp.Documents == nil {
+			resp.Documents = []archivedDocument{}
+		}
+		if next := offset + len(docs); next < total {
+			resp.NextOffset = next
+		}
+		w.Header().Set("Content-Type", "application/json")
+		s.respond(w, &resp, http.StatusOK)
+	}
+}
+
+func (s *Server) handleArchiveGet() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.archive == nil {
+			s.fail(w, r, CodeNotFound, "the archive isn't enabled", http.StatusNotFound)
+			return
+		}
+		id := mux.Vars(r)["id"]
+		doc := s.archive.get(id)
+		// Documents of other tenants are treated as if they don't exist
+		if p := principalFrom(r.Context()); doc != nil && p != nil && !p.can(PermAdmin) && doc.Tenant != p.tenant {
+			doc = nil
+		}
+		if doc == nil {
+			s.fail(w, r, CodeNotFound, "no archived document with id "+id, http.StatusNotFound)
+			return
+		}
+		data, err := ioutil.ReadFile(s.archive.path(doc.ID))
+		if err != nil {
+			s.errLog.Println(err)
+			s.fail(w, r, CodeStorageUnavailable, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Header().Set("X-Latte-SHA256", doc.SHA256)
+		w.Header().Set("X-Latte-Pages", strconv.Itoa(doc.Pages))
+		s.respond(w, data, http.StatusOK)
+	}
+}
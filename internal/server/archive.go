@@ -0,0 +1,262 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ArchiveConfig configures keeping every generated PDF, so that it can be found and downloaded again later.
+type ArchiveConfig struct {
+	// Dir is where archived PDFs and their index are kept, e.g. a mounted volume.
+	Dir string
+}
+
+// archiveIndexName is the file in the archive directory its index is kept in, one JSON record per line.
+const archiveIndexName = "index.jsonl"
+
+// archivedDocument is the index record of an archived PDF.
+type archivedDocument struct {
+	ID       string `json:"id"`
+	Template string `json:"template,omitempty"`
+	Tenant   string `json:"tenant,omitempty"`
+	Key      string `json:"key,omitempty"`
+	// DetailsSHA256 is the hash of the details the PDF was generated with, so that documents generated from the same data can be found
+	DetailsSHA256 string    `json:"details_sha256"`
+	SHA256        string    `json:"sha256"`
+	Size          int       `json:"size"`
+	Pages         int       `json:"pages"`
+	Tags          []string  `json:"tags,omitempty"`
+	RequestID     string    `json:"request_id,omitempty"`
+	Created       time.Time `json:"created"`
+}
+
+// archive keeps generated PDFs in a directory, named after their id, with an index of them held in memory and appended to a file.
+type archive struct {
+	dir  string
+	docs []archivedDocument
+	sync.RWMutex
+}
+
+// archiveFilter selects archived documents; empty fields match everything.
+type archiveFilter struct {
+	template      string
+	tenant        string
+	tags          []string
+	sha256        string
+	detailsSHA256 string
+	from, to      time.Time
+}
+
+// setupArchive loads the index of the archive, if one was configured, and registers it for retention.
+func (s *Server) setupArchive(cfg *ArchiveConfig) error {
+	if cfg == nil || cfg.Dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		return err
+	}
+	a := &archive{dir: cfg.Dir}
+	f, err := os.Open(filepath.Join(cfg.Dir, archiveIndexName))
+	switch {
+	case err == nil:
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var doc archivedDocument
+			if err := json.Unmarshal(scanner.Bytes(), &doc); err != nil {
+				// A line cut short by a crash is skipped, rather than making the whole archive unusable
+				s.errLog.Printf("skipping invalid archive record: %v", err)
+				continue
+			}
+			a.docs = append(a.docs, doc)
+		}
+		if err = scanner.Err(); err != nil {
+			return err
+		}
+	case !os.IsNotExist(err):
+		return err
+	}
+	s.archive = a
+	s.retain(RetainOutputs, a)
+	return nil
+}
+
+// detailsHash returns the hex encoded SHA-256 hash of the details, as JSON with sorted keys.
+func detailsHash(details map[string]interface{}) string {
+	data, _ := json.Marshal(details)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// archiveOutput archives a PDF generated by the request.
+func (s *Server) archiveOutput(r *http.Request, tmplID string, details map[string]interface{}, tags []string, pdf []byte, pages int) (*archivedDocument, error) {
+	doc := archivedDocument{
+		Template:      tmplID,
+		DetailsSHA256: detailsHash(details),
+		SHA256:        sha256Hex(pdf),
+		Size:          len(pdf),
+		Pages:         pages,
+		Tags:          tags,
+		RequestID:     requestID(r),
+		Created:       time.Now().UTC(),
+	}
+	if p := principalFrom(r.Context()); p != nil {
+		doc.Tenant, doc.Key = p.tenant, p.subject
+	}
+	return s.archive.add(doc, pdf)
+}
+
+// add stores the PDF in the archive, recording it in the index.
+func (a *archive) add(doc archivedDocument, pdf []byte) (*archivedDocument, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	doc.ID = hex.EncodeToString(b)
+	if err := ioutil.WriteFile(a.path(doc.ID), pdf, 0644); err != nil {
+		return nil, err
+	}
+	line, err := json.Marshal(&doc)
+	if err != nil {
+		return nil, err
+	}
+	a.Lock()
+	defer a.Unlock()
+	f, err := os.OpenFile(filepath.Join(a.dir, archiveIndexName), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err = f.Write(append(line, '\n')); err != nil {
+		return nil, err
+	}
+	a.docs = append(a.docs, doc)
+	return &doc, nil
+}
+
+func (a *archive) path(id string) string {
+	return filepath.Join(a.dir, id+".pdf")
+}
+
+// get returns the record of the archived document with the given id, or nil if there isn't one.
+func (a *archive) get(id string) *archivedDocument {
+	a.RLock()
+	defer a.RUnlock()
+	for i := range a.docs {
+		if a.docs[i].ID == id {
+			doc := a.docs[i]
+			return &doc
+		}
+	}
+	return nil
+}
+
+// find returns the archived documents matching the filter, newest first, along with how many there are in total.
+func (a *archive) find(f archiveFilter, offset, limit int) ([]archivedDocument, int) {
+	a.RLock()
+	var matched []archivedDocument
+	for _, doc := range a.docs {
+		if f.matches(&doc) {
+			matched = append(matched, doc)
+		}
+	}
+	a.RUnlock()
+	sort.SliceStable(matched, func(i, j int) bool {
+		return matched[i].Created.After(matched[j].Created)
+	})
+	total := len(matched)
+	if offset > total {
+		offset = total
+	}
+	matched = matched[offset:]
+	if len(matched) > limit {
+		matched = matched[:limit]
+	}
+	return matched, total
+}
+
+func (f *archiveFilter) matches(doc *archivedDocument) bool {
+	if (f.template != "" && doc.Template != f.template) || (f.tenant != "" && doc.Tenant != f.tenant) ||
+		(f.sha256 != "" && doc.SHA256 != f.sha256) || (f.detailsSHA256 != "" && doc.DetailsSHA256 != f.detailsSHA256) {
+		return false
+	}
+	if (!f.from.IsZero() && doc.Created.Before(f.from)) || (!f.to.IsZero() && !doc.Created.Before(f.to)) {
+		return false
+	}
+	for _, tag := range f.tags {
+		found := false
+		for _, t := range doc.Tags {
+			found = found || t == tag
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// remove deletes the archived documents for which drop returns true, rewriting the index without them.
+func (a *archive) remove(drop func(*archivedDocument) bool) (int, error) {
+	a.Lock()
+	defer a.Unlock()
+	var kept, dropped []archivedDocument
+	for _, doc := range a.docs {
+		if drop(&doc) {
+			dropped = append(dropped, doc)
+		} else {
+			kept = append(kept, doc)
+		}
+	}
+	if len(dropped) == 0 {
+		return 0, nil
+	}
+	// The new index replaces the old one in one go, so that a crash can't lose the records being kept
+	tmp, err := ioutil.TempFile(a.dir, archiveIndexName+".")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	enc := json.NewEncoder(tmp)
+	for i := range kept {
+		if err = enc.Encode(&kept[i]); err != nil {
+			tmp.Close()
+			return 0, err
+		}
+	}
+	if err = tmp.Close(); err != nil {
+		return 0, err
+	}
+	if err = os.Rename(tmp.Name(), filepath.Join(a.dir, archiveIndexName)); err != nil {
+		return 0, err
+	}
+	a.docs = kept
+	for _, doc := range dropped {
+		if err := os.Remove(a.path(doc.ID)); err != nil && !os.IsNotExist(err) {
+			return len(dropped), err
+		}
+	}
+	return len(dropped), nil
+}
+
+func (a *archive) expire(ctx context.Context, cutoff time.Time) (int, error) {
+	return a.remove(func(doc *archivedDocument) bool {
+		return doc.Created.Before(cutoff)
+	})
+}
+
+func (a *archive) erase(ctx context.Context, tenant, sha256 string) (int, error) {
+	return a.remove(func(doc *archivedDocument) bool {
+		return (tenant != "" && doc.Tenant == tenant) || (sha256 != "" && doc.SHA256 == sha256)
+	})
+}
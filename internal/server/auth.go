@@ -0,0 +1,224 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Permissions that may be granted to the clients of a Server.
+const (
+	// PermGenerate allows generating PDFs, comparing them and checking them.
+	PermGenerate = "generate"
+	// PermRegister allows registering files, either in one go or in chunks.
+	PermRegister = "register"
+	// PermCache allows warming and evicting from the caches.
+	PermCache = "cache"
+	// PermLibrary allows adding and removing class and style files from the library.
+	PermLibrary = "library"
+	// PermRead allows reading cache statistics, the library listing and querying GraphQL.
+	PermRead = "read"
+	// PermAdmin allows everything.
+	PermAdmin = "admin"
+)
+
+// Permissions lists every permission.
+var Permissions = []string{PermGenerate, PermRegister, PermCache, PermLibrary, PermRead, PermAdmin}
+
+// routePermissions maps each versioned route to the permission needed to use it, or each method of it as "METHOD /route"
+// for routes whose methods need different permissions. Routes that aren't listed need PermAdmin.
+var routePermissions = map[string]string{
+	"/generate":                        PermGenerate,
+	"/generate/ws":                     PermGenerate,
+	"/batch":                           PermGenerate,
+	"/diff":                            PermGenerate,
+	"/profile":                         PermGenerate,
+	"/check/accessibility":             PermGenerate,
+	"/validate":                        PermGenerate,
+	"/register":                        PermRegister,
+	"/uploads":                         PermRegister,
+	"/uploads/{upload}/chunks/{chunk}": PermRegister,
+	"/uploads/{upload}/commit":         PermRegister,
+	"/uploads/{upload}":                PermRegister,
+	"/bundles":                         PermRegister,
+	"/bundles/{template}":              PermRead,
+	"/bundles/{template}/archive":      PermRead,
+	"/cache/warm":                      PermCache,
+	"/cache":                           PermCache,
+	"/cache/templates/{id:.+}":         PermCache,
+	"/cache/resources/{id:.+}":         PermCache,
+	"/cache/stats":                     PermRead,
+	"GET /admin/cache":                 PermRead,
+	"DELETE /admin/cache":              PermCache,
+	"/admin/cache/templates/{id:.+}":   PermCache,
+	"/admin/cache/resources/{id:.+}":   PermCache,
+	"/library":                         PermRead,
+	"/library/{name}":                  PermLibrary,
+	"/graphql":                         PermRead,
+	"/usage":                           PermRead,
+	"/archive":                         PermRead,
+	"/archive/{id}":                    PermRead,
+	"/jobs/{id}":                       PermGenerate,
+	"/jobs/{id}/pdf":                   PermGenerate,
+	"/jobs/{id}/events":                PermGenerate,
+	"/stats/templates":                 PermRead,
+	"/stats":                           PermRead,
+	"GET /templates":                   PermRead,
+	"POST /templates":                  PermRegister,
+	"GET /templates/{id}":              PermRead,
+	"PUT /templates/{id}":              PermRegister,
+	"DELETE /templates/{id}":           PermRegister,
+	"/resources":                       PermRead,
+	"/resources/{id}":                  PermRegister,
+}
+
+// routePermission returns the permission needed to use the route at path with the given method.
+func routePermission(method, path string) string {
+	if perm, ok := routePermissions[method+" "+path]; ok {
+		return perm
+	}
+	if perm, ok := routePermissions[path]; ok {
+		return perm
+	}
+	return PermAdmin
+}
+
+// principal is the client a request was authenticated as.
+type principal struct {
+	subject     string
+	tenant      string
+	roles       []string
+	permissions map[string]bool
+}
+
+func (p *principal) can(perm string) bool {
+	return p.permissions[PermAdmin] || p.permissions[perm]
+}
+
+// authenticator verifies the bearer tokens sent with requests, returning who they were issued to.
+// Tokens that aren't valid result in an error of type *AuthError.
+type authenticator interface {
+	authenticate(ctx context.Context, token string) (*principal, error)
+}
+
+// AuthError is returned when a bearer token isn't valid.
+type AuthError struct {
+	reason string
+}
+
+func (e *AuthError) Error() string {
+	return "invalid token: " + e.reason
+}
+
+type principalKey struct{}
+
+// principalFrom returns the principal the request was authenticated as, or nil if authentication is disabled.
+func principalFrom(ctx context.Context) *principal {
+	p, _ := ctx.Value(principalKey{}).(*principal)
+	return p
+}
+
+// scopePermissions maps the scopes of a token to the permissions they grant, along with the roles they stand for.
+// By default each permission or role is granted by a scope of the same name prefixed with "latte:",
+// e.g. latte:generate or latte:renderer.
+func scopePermissions(scopes, roles map[string][]string, granted []string) ([]string, map[string]bool) {
+	var grantedRoles []string
+	perms := map[string]bool{}
+	for _, scope := range granted {
+		mapped, ok := scopes[scope]
+		if !ok {
+			name := strings.TrimPrefix(scope, "latte:")
+			if name == scope {
+				continue
+			}
+			mapped = []string{name}
+		}
+		for _, name := range mapped {
+			if rolePerms, isRole := roles[name]; isRole {
+				grantedRoles = append(grantedRoles, name)
+				for _, perm := range rolePerms {
+					perms[perm] = true
+				}
+				continue
+			}
+			perms[name] = true
+		}
+	}
+	return grantedRoles, perms
+}
+
+// setupAuth sets up authenticating requests with API keys, JWTs and/or OAuth2 access tokens, if any are configured.
+func (s *Server) setupAuth(ctx context.Context, rbac *RBACConfig, jwt *JWTConfig, oauth *OAuthConfig) error {
+	var as authenticators
+	keys, err := s.loadRBAC(ctx, rbac)
+	if err != nil {
+		return fmt.Errorf("error while loading roles and keys: %v", err)
+	}
+	if keys != nil {
+		as = append(as, keys)
+	}
+	// JWTs are checked before asking the authorization server about tokens, since checking them doesn't take a request
+	if jwt != nil {
+		v, err := newJWTVerifier(ctx, jwt, s.roles)
+		if err != nil {
+			return fmt.Errorf("error while setting up jwt: %v", err)
+		}
+		as = append(as, v)
+	}
+	if oauth != nil {
+		i, err := newIntrospector(ctx, oauth, s.roles)
+		if err != nil {
+			return fmt.Errorf("error while setting up oauth: %v", err)
+		}
+		as = append(as, i)
+	}
+	if len(as) > 0 {
+		s.auth = as
+	}
+	return nil
+}
+
+// authorize wraps the handler for the route at path so that it can only be used with a bearer token granting the
+// permission the route needs. If the server doesn't authenticate requests, the handler is returned as is.
+func (s *Server) authorize(path string, h http.HandlerFunc) http.HandlerFunc {
+	if s.auth == nil {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		perm := routePermission(r.Method, path)
+		// API keys may be sent as bearer tokens as well
+		token := r.Header.Get("X-API-Key")
+		if header := r.Header.Get("Authorization"); token == "" && strings.HasPrefix(header, "Bearer ") {
+			token = strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+		}
+		// Browsers can't send headers when opening WebSocket connections
+		if token == "" && headerHas(r.Header, "Upgrade", "websocket") {
+			token = r.URL.Query().Get("access_token")
+		}
+		if token == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="latte"`)
+			s.fail(w, r, CodeUnauthorized, "missing bearer token or api key", http.StatusUnauthorized)
+			return
+		}
+		p, err := s.auth.authenticate(r.Context(), token)
+		var ae *AuthError
+		switch {
+		case errors.As(err, &ae):
+			w.Header().Set("WWW-Authenticate", `Bearer realm="latte", error="invalid_token"`)
+			s.fail(w, r, CodeUnauthorized, err.Error(), http.StatusUnauthorized)
+			return
+		case err != nil:
+			s.errLog.Println(err)
+			s.fail(w, r, CodeAuthUnavailable, "error while verifying token", http.StatusBadGateway)
+			return
+		}
+		if !p.can(perm) {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="latte", error="insufficient_scope", scope="latte:%s"`, perm))
+			s.fail(w, r, CodeForbidden, fmt.Sprintf("token does not grant the %s permission", perm), http.StatusForbidden)
+			return
+		}
+		h(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+	}
+}
@@ -0,0 +1,196 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// AWSConfig holds the credentials and region LaTTe talks to AWS (or an S3 compatible service) with.
+type AWSConfig struct {
+	Region          string
+	AccessKeyID     string
+	SecretAccessKey string
+	// SessionToken is only needed with temporary credentials.
+	SessionToken string
+	// S3Endpoint is the endpoint of an S3 compatible service (e.g. http://minio:9000) to use instead of AWS; its buckets are addressed by path.
+	S3Endpoint string
+}
+
+// awsClient makes requests to AWS, signing them with version 4 of its signature scheme.
+type awsClient struct {
+	cfg    AWSConfig
+	client *http.Client
+}
+
+func newAWSClient(cfg AWSConfig) *awsClient {
+	return &awsClient{cfg: cfg, client: &http.Client{Timeout: time.Minute}}
+}
+
+// awsEscape percent-encodes everything but the characters AWS leaves alone when signing, and slashes if keepSlashes is set.
+func awsEscape(s string, keepSlashes bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '.', c == '_', c == '~':
+			b.WriteByte(c)
+		case c == '/' && keepSlashes:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// sign adds the headers AWS needs to authenticate the request made at the given time, whose body hashes to payloadHash, to the given service.
+func (c *awsClient) sign(req *http.Request, service, payloadHash string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if c.cfg.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.cfg.SessionToken)
+	}
+
+	// Host, and every header AWS defines, is signed
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-amz-") || lower == "content-type" {
+			headers[lower] = strings.TrimSpace(req.Header.Get(name))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	query := req.URL.Query()
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var params []string
+	for _, k := range keys {
+		vs := query[k]
+		sort.Strings(vs)
+		for _, v := range vs {
+			params = append(params, awsEscape(k, false)+"="+awsEscape(v, false))
+		}
+	}
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonical := strings.Join([]string{req.Method, path, strings.Join(params, "&"), canonicalHeaders.String(), signedHeaders, payloadHash}, "\n")
+	scope := date + "/" + c.cfg.Region + "/" + service + "/aws4_request"
+	hash := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+c.cfg.SecretAccessKey), date)
+	key = hmacSHA256(key, c.cfg.Region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.cfg.AccessKeyID, scope, signedHeaders, signature))
+}
+
+// do signs and sends a request to the given service, returning the body of the response if it was successful.
+func (c *awsClient) do(ctx context.Context, service, method, u string, header http.Header, body []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	hash := sha256.Sum256(body)
+	c.sign(req, service, hex.EncodeToString(hash[:]), time.Now())
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound && service == "s3" {
+		return nil, &NotFoundError{}
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("%s %s: %s: %s", method, u, resp.Status, bytes.TrimSpace(data))
+	}
+	return data, nil
+}
+
+// s3URL returns the URL of the object with the given key.
+func (c *awsClient) s3URL(bucket, key string) string {
+	key = awsEscape(strings.TrimPrefix(key, "/"), true)
+	if c.cfg.S3Endpoint != "" {
+		return strings.TrimSuffix(c.cfg.S3Endpoint, "/") + "/" + bucket + "/" + key
+	}
+	return "https://" + bucket + ".s3." + c.cfg.Region + ".amazonaws.com/" + key
+}
+
+// getObject returns the contents of an object in S3, or an error of type *NotFoundError if there's no such object.
+func (c *awsClient) getObject(ctx context.Context, bucket, key string) ([]byte, error) {
+	return c.do(ctx, "s3", "GET", c.s3URL(bucket, key), nil, nil)
+}
+
+// putObject stores data as an object in S3.
+func (c *awsClient) putObject(ctx context.Context, bucket, key, contentType string, data io.Reader) error {
+	body, err := ioutil.ReadAll(data)
+	if err != nil {
+		return err
+	}
+	_, err = c.do(ctx, "s3", "PUT", c.s3URL(bucket, key), http.Header{"Content-Type": {contentType}}, body)
+	return err
+}
+
+// sqsCall calls an action of the SQS JSON API on the queue with the given URL, decoding its response into out.
+func (c *awsClient) sqsCall(ctx context.Context, queueURL, action string, in interface{}, out interface{}) error {
+	u, err := url.Parse(queueURL)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	header := http.Header{
+		"Content-Type": {"application/x-amz-json-1.0"},
+		"X-Amz-Target": {"AmazonSQS." + action},
+	}
+	data, err := c.do(ctx, "sqs", "POST", u.Scheme+"://"+u.Host+"/", header, body)
+	if err != nil || out == nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
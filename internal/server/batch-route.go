@@ -0,0 +1,234 @@
+package server
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"text/template"
+)
+
+// maxBatchDocuments bounds how many documents a batch may generate.
+const maxBatchDocuments = 50
+
+// defaultBatchConcurrency is how many documents of a batch are generated at once, unless the request says otherwise.
+const defaultBatchConcurrency = 4
+
+func (s *Server) handleBatch() http.HandlerFunc {
+	// batchDocument is one of the documents of a batch, generated from a /generate request
+	type batchDocument struct {
+		// Name is the name of the PDF in the ZIP
+		Name string `json:"name"`
+		// Generate is a /generate request body, and Query the query string of its URL (e.g. "tmpl=ID&dtls=ID")
+		Generate map[string]interface{} `json:"generate,omitempty"`
+		Query    string                 `json:"query,omitempty"`
+	}
+	// mailMerge generates a document for each row, with the same request, using the row as its details
+	type mailMerge struct {
+		// Generate is a /generate request body, and Query the query string of its URL; any details it has are overridden by the rows
+		Generate map[string]interface{}   `json:"generate,omitempty"`
+		Query    string                   `json:"query,omitempty"`
+		Rows     []map[string]interface{} `json:"rows"`
+		// Name is a Go template for the name of each rows PDF, e.g. "invoice-{{.number}}.pdf"; defaults to document-N.pdf
+		Name string `json:"name,omitempty"`
+	}
+	type request struct {
+		Documents []batchDocument `json:"documents"`
+		// Merge adds a document for every one of its rows, e.g. to email an invoice to each customer
+		Merge *mailMerge `json:"merge,omitempty"`
+		// Concurrency is how many documents are generated at once; defaults to 4
+		Concurrency int `json:"concurrency,omitempty"`
+		// Output sends every document to a sink, under Prefix followed by its name, instead of returning them in a ZIP
+		Output *struct {
+			Sink   string `json:"sink"`
+			Prefix string `json:"prefix,omitempty"`
+		} `json:"output,omitempty"`
+	}
+	// outputDocument is where a document sent to a sink went
+	type outputDocument struct {
+		Name string `json:"name"`
+		outputResult
+	}
+	type outputResponse struct {
+		Documents []outputDocument `json:"documents"`
+	}
+	generate := s.handleGenerate()
+	s.apiSchema("batchRequest", request{})
+	s.apiSchema("batchOutputResponse", outputResponse{})
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req request
+		if err := s.decode(r.Body, &req); err != nil {
+			msg := "error while parsing json body: " + err.Error()
+			s.errLog.Println(msg)
+			s.fail(w, r, CodeInvalidJSON, msg, http.StatusBadRequest)
+			return
+		}
+		r.Body.Close()
+		if m := req.Merge; m != nil {
+			if len(m.Rows) > maxBatchDocuments {
+				s.fail(w, r, CodeBadRequest, "can't generate more than "+strconv.Itoa(maxBatchDocuments)+" documents at once", http.StatusBadRequest)
+				return
+			}
+			var name *template.Template
+			if m.Name != "" {
+				var err error
+				if name, err = template.New("name").Option("missingkey=zero").Parse(m.Name); err != nil {
+					s.fail(w, r, CodeBadRequest, "invalid document name: "+err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+			// Each row is laid over the details of the shared request
+			base, _ := m.Generate["details"].(map[string]interface{})
+			for i, row := range m.Rows {
+				details := map[string]interface{}{}
+				for k, v := range base {
+					details[k] = v
+				}
+				for k, v := range row {
+					details[k] = v
+				}
+				generate := map[string]interface{}{}
+				for k, v := range m.Generate {
+					generate[k] = v
+				}
+				generate["details"] = details
+				doc := batchDocument{Name: fmt.Sprintf("document-%d.pdf", i+1), Generate: generate, Query: m.Query}
+				if name != nil {
+					var buf bytes.Buffer
+					if err := name.Execute(&buf, details); err != nil {
+						s.fail(w, r, CodeBadRequest, fmt.Sprintf("invalid name for row %d: %v", i+1, err), http.StatusBadRequest)
+						return
+					}
+					doc.Name = buf.String()
+				}
+				req.Documents = append(req.Documents, doc)
+			}
+		}
+		if len(req.Documents) == 0 {
+			s.fail(w, r, CodeBadRequest, "no documents provided", http.StatusBadRequest)
+			return
+		}
+		if len(req.Documents) > maxBatchDocuments {
+			s.fail(w, r, CodeBadRequest, "can't generate more than "+strconv.Itoa(maxBatchDocuments)+" documents at once", http.StatusBadRequest)
+			return
+		}
+		// Names become the names of files in the ZIP, so they can't lead anywhere else
+		names := map[string]bool{}
+		for _, doc := range req.Documents {
+			if doc.Name == "" || doc.Name != filepath.Base(doc.Name) || doc.Name == "." || doc.Name == ".." {
+				s.fail(w, r, CodeBadRequest, fmt.Sprintf("invalid document name: %q", doc.Name), http.StatusBadRequest)
+				return
+			}
+			if names[doc.Name] {
+				s.fail(w, r, CodeBadRequest, "duplicate document name: "+doc.Name, http.StatusBadRequest)
+				return
+			}
+			names[doc.Name] = true
+		}
+		if req.Concurrency <= 0 {
+			req.Concurrency = defaultBatchConcurrency
+		}
+		if req.Output != nil {
+			if _, ok := s.sinks[req.Output.Sink]; !ok {
+				s.fail(w, r, CodeBadRequest, "no such sink: "+req.Output.Sink, http.StatusBadRequest)
+				return
+			}
+			for i, doc := range req.Documents {
+				generate := map[string]interface{}{}
+				for k, v := range doc.Generate {
+					generate[k] = v
+				}
+				generate["output"] = outputOptions{Sink: req.Output.Sink, Name: path.Join(req.Output.Prefix, doc.Name)}
+				req.Documents[i].Generate = generate
+			}
+		}
+
+		// Generate every document, a few at a time
+		results := make([]*responseBuffer, len(req.Documents))
+		sem := make(chan struct{}, req.Concurrency)
+		var wg sync.WaitGroup
+		for i, doc := range req.Documents {
+			body, err := json.Marshal(doc.Generate)
+			if err != nil {
+				s.fail(w, r, CodeBadRequest, fmt.Sprintf("document %s: %v", doc.Name, err), http.StatusBadRequest)
+				return
+			}
+			gr := r.Clone(r.Context())
+			gr.URL = &url.URL{Path: "/generate", RawQuery: doc.Query}
+			gr.Header = http.Header{"Content-Type": {"application/json"}}
+			gr.Body = ioutil.NopCloser(bytes.NewReader(body))
+			gr.ContentLength = int64(len(body))
+			results[i] = &responseBuffer{header: http.Header{}}
+			wg.Add(1)
+			go func(rb *responseBuffer) {
+				defer wg.Done()
+				sem <- struct{}{}
+				defer func() { <-sem }()
+				generate(rb, gr)
+			}(results[i])
+		}
+		wg.Wait()
+
+		// The batch fails with the first document that did
+		for i, rb := range results {
+			if rb.code == http.StatusOK {
+				continue
+			}
+			er := apiError{
+				Code:  errorCode(rb.body.Bytes(), CodeCompileFailed),
+				Error: s.localize(r, "error while generating pdf %s", req.Documents[i].Name),
+				Data:  rb.body.String(),
+			}
+			if ra := rb.header.Get("Retry-After"); ra != "" {
+				w.Header().Set("Retry-After", ra)
+			}
+			s.failWith(w, r, &er, rb.code)
+			return
+		}
+
+		if req.Output != nil {
+			resp := outputResponse{Documents: make([]outputDocument, len(results))}
+			for i, rb := range results {
+				resp.Documents[i].Name = req.Documents[i].Name
+				if err := json.Unmarshal(rb.body.Bytes(), &resp.Documents[i].outputResult); err != nil {
+					s.errLog.Println(err)
+					s.fail(w, r, CodeInternal, err.Error(), http.StatusInternalServerError)
+					return
+				}
+			}
+			w.Header().Set("Content-Type", "application/json")
+			s.respond(w, &resp, http.StatusOK)
+			return
+		}
+
+		var zipped bytes.Buffer
+		zw := zip.NewWriter(&zipped)
+		for i, rb := range results {
+			f, err := zw.Create(req.Documents[i].Name)
+			if err == nil {
+				_, err = f.Write(rb.body.Bytes())
+			}
+			if err != nil {
+				s.errLog.Println(err)
+				s.fail(w, r, CodeInternal, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		if err := zw.Close(); err != nil {
+			s.errLog.Println(err)
+			s.fail(w, r, CodeInternal, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", `attachment; filename="documents.zip"`)
+		w.Header().Set("Content-Length", strconv.Itoa(zipped.Len()))
+		s.respond(w, zipped.Bytes(), http.StatusOK)
+	}
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"net/http"
+	"os"
+)
+
+func (s *Server) handleBundleInstall() http.HandlerFunc {
+	type response struct {
+		Template string `json:"template"`
+		Version  string `json:"version"`
+		// Installed lists the ids of the files that were registered, including derived ones
+		Installed []string `json:"installed"`
+		// Replaced is the version of the bundle that was installed before, if any
+		Replaced string `json:"replaced,omitempty"`
+	}
+	s.apiSchema("bundleResponse", response{})
+	return func(w http.ResponseWriter, r *http.Request) {
+		dir, err := ioutil.TempDir(s.rootDir, bundleDirPrefix)
+		if err != nil {
+			s.errLog.Println(err)
+			s.fail(w, r, CodeInternal, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer os.RemoveAll(dir)
+		m, err := extractBundle(r.Body, dir)
+		if err == nil {
+			err = drainBody(r.Body)
+		}
+		r.Body.Close()
+		var files []bundleFile
+		if err == nil {
+			files, err = m.files(dir)
+		}
+		switch err.(type) {
+		case nil:
+		case *BundleError:
+			s.fail(w, r, CodeBadRequest, err.Error(), http.StatusBadRequest)
+			return
+		default:
+			s.errLog.Println(err)
+			s.fail(w, r, CodeInternal, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, f := range files {
+			err = s.checkTemplateAccess(r.Context(), f.id, aclModify)
+			switch err.(type) {
+			case nil:
+				continue
+			case *ForbiddenError:
+				s.fail(w, r, CodeForbidden, err.Error(), http.StatusForbidden)
+			default:
+				s.errLog.Println(err)
+				s.fail(w, r, CodeStorageUnavailable, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		// Only one bundle is installed at a time, so that two releases of the same template can't interleave
+		s.bundles.Lock()
+		defer s.bundles.Unlock()
+		prev, err := s.installedBundle(r.Context(), m.Template)
+		if err != nil {
+			s.errLog.Println(err)
+			s.fail(w, r, CodeStorageUnavailable, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		resp := response{Template: m.Template, Version: m.Version}
+		if prev != nil {
+			if prev.Version == m.Version {
+				msg := fmt.Sprintf("version %s of template %s is already installed", m.Version, m.Template)
+				s.fail(w, r, CodeConflict, msg, http.StatusConflict)
+				return
+			}
+			resp.Replaced = prev.Version
+		}
+		if resp.Installed, err = s.installBundle(r.Context(), m, files, dir); err != nil {
+			s.errLog.Println(err)
+			s.fail(w, r, CodeStorageUnavailable, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		s.infoLog.Printf("installed bundle %s@%s", m.Template, m.Version)
+		w.Header().Set("Content-Type", "application/json")
+		s.respond(w, &resp, http.StatusOK)
+	}
+}
+
+func (s *Server) handleBundleGet() http.HandlerFunc {
+	s.apiSchema("bundleManifest", bundleManifest{})
+	return func(w http.ResponseWriter, r *http.Request) {
+		m, ok := s.requestedBundle(w, r)
+		if !ok {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		s.respond(w, m, http.StatusOK)
+	}
+}
+
+func (s *Server) handleBundleArchive() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		m, ok := s.requestedBundle(w, r)
+		if !ok {
+			return
+		}
+		// The bundle holds the templates source, so only those who may modify the template may download it
+		if err := s.checkTemplateAccess(r.Context(), m.Template, aclModify); err != nil {
+			s.fail(w, r, CodeForbidden, err.Error(), http.StatusForbidden)
+			return
+		}
+		var buf bytes.Buffer
+		if err := s.writeBundle(r.Context(), &buf, m); err != nil {
+			s.errLog.Println(err)
+			s.fail(w, r, CodeStorageUnavailable, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/gzip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-%s.tar.gz"`, m.Template, m.Version))
+		s.respond(w, buf.Bytes(), http.StatusOK)
+	}
+}
+
+// requestedBundle returns the manifest of the installed bundle the request is for, responding with an error if there isn't one.
+func (s *Server) requestedBundle(w http.ResponseWriter, r *http.Request) (*bundleManifest, bool) {
+	id := mux.Vars(r)["template"]
+	m, err := s.installedBundle(r.Context(), id)
+	if err != nil {
+		s.errLog.Println(err)
+		s.fail(w, r, CodeStorageUnavailable, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	if m == nil {
+		s.fail(w, r, CodeNotFound, fmt.Sprintf("template %s wasn't installed from a bundle", id), http.StatusNotFound)
+		return nil, false
+	}
+	return m, true
+}
@@ -0,0 +1,378 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// bundleManifestName is the name of the manifest at the top of every bundle.
+const bundleManifestName = "manifest.yaml"
+
+// Subdirectories of the directory a bundle is staged in while its installed.
+const (
+	// bundleFilesDir holds the contents of the bundle
+	bundleFilesDir = "files"
+	// bundleSidecarsDir holds the sidecar files made from its manifest, e.g. TEMPLATE_ID.defaults
+	bundleSidecarsDir = "sidecars"
+	// bundleBackupDir holds the files the bundle replaced, until its done being installed
+	bundleBackupDir = "backup"
+)
+
+// maxBundleBytes bounds the total size of the files in a bundle once its been decompressed.
+const maxBundleBytes = 256 << 20
+
+// bundleManifest describes a template release: the template, along with everything it needs, packaged as a gzipped tarball.
+// Once installed, the manifest is stored as the registered JSON file TEMPLATE_ID.bundle.
+type bundleManifest struct {
+	// Template is the id the template is registered as
+	Template string `yaml:"template" json:"template"`
+	Version  string `yaml:"version" json:"version"`
+	// Source is the path of the template in the bundle; defaults to the id of the template
+	Source string `yaml:"source,omitempty" json:"source,omitempty"`
+	// Resources are the paths in the bundle of the files registered along with the template, which are used as their ids
+	Resources []string `yaml:"resources,omitempty" json:"resources,omitempty"`
+	// Schema is the path in the bundle of a JSON schema describing the details the template expects
+	Schema string `yaml:"schema,omitempty" json:"schema,omitempty"`
+	// Defaults are used for any top-level details that requests don't set
+	Defaults map[string]interface{} `yaml:"defaults,omitempty" json:"defaults,omitempty"`
+	// Env is stored as the templates environment variables, see templateEnv
+	Env       map[string]string `yaml:"env,omitempty" json:"env,omitempty"`
+	Installed time.Time         `yaml:"-" json:"installed"`
+}
+
+// BundleError is returned when a bundle is malformed or its manifest refers to files it doesn't have.
+type BundleError struct {
+	err error
+}
+
+func (e *BundleError) Error() string {
+	return "invalid bundle: " + e.err.Error()
+}
+
+// extractBundle unpacks the gzipped tarball into the staging directory dir, returning the manifest found at its top.
+func extractBundle(r io.Reader, dir string) (*bundleManifest, error) {
+	dir = filepath.Join(dir, bundleFilesDir)
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, &BundleError{err}
+	}
+	defer zr.Close()
+	tr := tar.NewReader(zr)
+	var size int64
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, &BundleError{err}
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			// Directories are implied by the files in them, and links could lead outside of dir
+			continue
+		}
+		name, err := bundlePath(hdr.Name)
+		if err != nil {
+			return nil, err
+		}
+		if size += hdr.Size; size > maxBundleBytes {
+			return nil, &BundleError{fmt.Errorf("contents are larger than %d bytes", maxBundleBytes)}
+		}
+		fpath := filepath.Join(dir, filepath.FromSlash(name))
+		if err = os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
+			return nil, err
+		}
+		if _, err = streamToFile(fpath, io.LimitReader(tr, hdr.Size)); err != nil {
+			return nil, err
+		}
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, bundleManifestName))
+	if os.IsNotExist(err) {
+		return nil, &BundleError{errors.New("missing " + bundleManifestName)}
+	} else if err != nil {
+		return nil, err
+	}
+	var m bundleManifest
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err = dec.Decode(&m); err != nil {
+		return nil, &BundleError{fmt.Errorf("error while parsing %s: %v", bundleManifestName, err)}
+	}
+	return &m, nil
+}
+
+// bundlePath cleans up the path of a file in a bundle, making sure it stays inside of the bundle.
+func bundlePath(name string) (string, error) {
+	clean := path.Clean(strings.TrimPrefix(name, "./"))
+	if clean == "." || path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", &BundleError{fmt.Errorf("invalid path: %s", name)}
+	}
+	return clean, nil
+}
+
+// bundleFile is a file of a bundle being installed, staged at path until its registered under id.
+type bundleFile struct {
+	id   string
+	path string
+}
+
+// files checks that the manifest is complete and that every file it refers to is in the bundle staged in dir,
+// returning the files to register in the order they should be registered in.
+// Sidecar files made from the manifest (e.g. the templates defaults) are staged along with the bundle.
+func (m *bundleManifest) files(dir string) ([]bundleFile, error) {
+	if m.Template == "" || m.Version == "" {
+		return nil, &BundleError{errors.New("manifest needs both a template and a version")}
+	}
+	if m.Source == "" {
+		m.Source = m.Template
+	}
+	var files []bundleFile
+	add := func(id, name string) error {
+		name, err := bundlePath(name)
+		if err != nil {
+			return err
+		}
+		p := filepath.Join(dir, bundleFilesDir, filepath.FromSlash(name))
+		if info, err := os.Stat(p); err != nil || !info.Mode().IsRegular() {
+			return &BundleError{fmt.Errorf("missing %s", name)}
+		}
+		files = append(files, bundleFile{id: id, path: p})
+		return nil
+	}
+	sidecar := func(id string, v interface{}) error {
+		p := filepath.Join(dir, bundleSidecarsDir, id)
+		data, err := json.Marshal(v)
+		if err == nil {
+			err = os.MkdirAll(filepath.Dir(p), 0755)
+		}
+		if err == nil {
+			err = ioutil.WriteFile(p, data, 0644)
+		}
+		files = append(files, bundleFile{id: id, path: p})
+		return err
+	}
+	for _, rsc := range m.Resources {
+		if err := add(rsc, rsc); err != nil {
+			return nil, err
+		}
+	}
+	if m.Schema != "" {
+		if err := add(m.Template+".schema", m.Schema); err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadFile(files[len(files)-1].path)
+		if err != nil {
+			return nil, err
+		}
+		if !json.Valid(data) {
+			return nil, &BundleError{fmt.Errorf("schema %s isn't valid json", m.Schema)}
+		}
+	}
+	if m.Defaults != nil {
+		if err := sidecar(m.Template+".defaults", m.Defaults); err != nil {
+			return nil, err
+		}
+	}
+	if m.Env != nil {
+		if err := sidecar(m.Template+".env", m.Env); err != nil {
+			return nil, err
+		}
+	}
+	// The template goes in after everything it needs
+	if err := add(m.Template, m.Source); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// installedBundle returns the manifest of the bundle the template with the given id was installed from, or nil if it wasn't installed from one.
+func (s *Server) installedBundle(ctx context.Context, id string) (*bundleManifest, error) {
+	bundleID := id + ".bundle"
+	manifestPath := filepath.Join(s.rootDir, bundleID)
+	err := s.fetchToDisk(ctx, bundleID, manifestPath)
+	switch err.(type) {
+	case nil:
+	case *NotFoundError:
+		return nil, nil
+	default:
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+	var m bundleManifest
+	if err = json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("error while decoding bundle manifest of template %s: %v", id, err)
+	}
+	return &m, nil
+}
+
+// installBundle registers the files of a bundle staged in dir, replacing any earlier versions of them, and then records its manifest.
+// If registering any of the files fails, the files that were replaced are put back.
+// It returns the ids of the files that were registered, including derived ones.
+func (s *Server) installBundle(ctx context.Context, m *bundleManifest, files []bundleFile, dir string) ([]string, error) {
+	m.Installed = time.Now().UTC()
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	manifestPath := filepath.Join(dir, bundleSidecarsDir, m.Template+".bundle")
+	if err = os.MkdirAll(filepath.Dir(manifestPath), 0755); err == nil {
+		err = ioutil.WriteFile(manifestPath, data, 0644)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Recording the manifest comes last, so that only complete installs are recorded
+	files = append(files, bundleFile{id: m.Template + ".bundle", path: manifestPath})
+
+	backupDir := filepath.Join(dir, bundleBackupDir)
+	var replaced, added, installed []string
+	rollback := func() {
+		for _, id := range added {
+			if err := os.Remove(filepath.Join(s.rootDir, id)); err != nil && !os.IsNotExist(err) {
+				s.errLog.Printf("error while rolling back bundle %s@%s: %v", m.Template, m.Version, err)
+			}
+		}
+		for _, id := range replaced {
+			fpath := filepath.Join(s.rootDir, id)
+			err := os.Rename(filepath.Join(backupDir, id), fpath)
+			s.forgetSource(id)
+			if err == nil && s.db != nil {
+				var f *os.File
+				if f, err = os.Open(fpath); err == nil {
+					err = s.db.Store(ctx, id, f)
+					f.Close()
+				}
+			}
+			if err != nil {
+				s.errLog.Printf("error while rolling back bundle %s@%s: %v", m.Template, m.Version, err)
+			}
+		}
+	}
+	for _, f := range files {
+		fpath := filepath.Join(s.rootDir, f.id)
+		// Set aside the version being replaced, pulling it from the db if it isn't on local disk
+		err := s.fetchToDisk(ctx, f.id, fpath)
+		switch err.(type) {
+		case nil:
+			backup := filepath.Join(backupDir, f.id)
+			if err = os.MkdirAll(filepath.Dir(backup), 0755); err == nil {
+				err = os.Rename(fpath, backup)
+			}
+			if err == nil {
+				replaced = append(replaced, f.id)
+			}
+		case *NotFoundError:
+			err = nil
+			added = append(added, f.id)
+		}
+		if err == nil {
+			if f.id == m.Template {
+				_, err = s.evictTemplate(f.id)
+			} else {
+				_, err = s.evictResource(f.id)
+			}
+		}
+		if err == nil {
+			if err = os.MkdirAll(filepath.Dir(fpath), 0755); err == nil {
+				err = os.Rename(f.path, fpath)
+			}
+		}
+		var derived []string
+		if err == nil {
+			derived, err = s.ingest(ctx, f.id, fpath)
+		}
+		if err != nil {
+			rollback()
+			return nil, fmt.Errorf("error while installing %s: %v", f.id, err)
+		}
+		installed = append(append(installed, f.id), derived...)
+		s.infoLog.Printf("installed %s from bundle %s@%s", f.id, m.Template, m.Version)
+	}
+	return installed, nil
+}
+
+// templateDefaults returns the default details of the template with the given id, or nil if it doesn't have any.
+func (s *Server) templateDefaults(ctx context.Context, id string) (map[string]interface{}, error) {
+	defaultsID := id + ".defaults"
+	defaultsPath := filepath.Join(s.rootDir, defaultsID)
+	err := s.fetchToDisk(ctx, defaultsID, defaultsPath)
+	switch err.(type) {
+	case nil:
+	case *NotFoundError:
+		return nil, nil
+	default:
+		return nil, err
+	}
+	f, err := os.Open(defaultsPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var defaults map[string]interface{}
+	if err = json.NewDecoder(f).Decode(&defaults); err != nil {
+		return nil, fmt.Errorf("error while decoding default details for template %s: %v", id, err)
+	}
+	return defaults, nil
+}
+
+// writeBundle packs the installed files of the bundle described by m back into a bundle, so that it can be installed elsewhere.
+func (s *Server) writeBundle(ctx context.Context, w io.Writer, m *bundleManifest) error {
+	zw := gzip.NewWriter(w)
+	tw := tar.NewWriter(zw)
+	add := func(name string, data []byte) error {
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: m.Installed, Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := tw.Write(data)
+		return err
+	}
+	manifest, err := yaml.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if err = add(bundleManifestName, manifest); err != nil {
+		return err
+	}
+	// Files are stored under their ids, and put back where the manifest says they are in the bundle
+	names := map[string]string{m.Template: m.Source}
+	for _, rsc := range m.Resources {
+		names[rsc] = rsc
+	}
+	if m.Schema != "" {
+		names[m.Template+".schema"] = m.Schema
+	}
+	for id, name := range names {
+		fpath := filepath.Join(s.rootDir, id)
+		if err := s.fetchToDisk(ctx, id, fpath); err != nil {
+			return fmt.Errorf("error while fetching %s: %v", id, err)
+		}
+		data, err := ioutil.ReadFile(fpath)
+		if err == nil {
+			err = add(name, data)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err = tw.Close(); err != nil {
+		return err
+	}
+	return zw.Close()
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"github.com/gorilla/mux"
+	"net/http"
+	"sort"
+)
+
+func (s *Server) handleCacheWarm() http.HandlerFunc {
+	type request struct {
+		Templates  []string    `json:"templates"`
+		Resources  []string    `json:"resources"`
+		Delimiters *delimiters `json:"delimiters,omitempty"`
+	}
+	type response struct {
+		Templates []string          `json:"templates"`
+		Resources []string          `json:"resources"`
+		Errors    map[string]string `json:"errors,omitempty"`
+	}
+	s.apiSchema("cacheWarmRequest", request{})
+	s.apiSchema("cacheWarmResponse", response{})
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req request
+		if err := s.decode(r.Body, &req); err != nil {
+			msg := "error while parsing json body: " + err.Error()
+			s.errLog.Println(msg)
+			s.fail(w, r, CodeInvalidJSON, msg, http.StatusBadRequest)
+			return
+		}
+		r.Body.Close()
+		delims := defaultDelims
+		if d := req.Delimiters; d != nil {
+			if d.Left == "" || d.Right == "" {
+				s.fail(w, r, CodeBadRequest, "only received one delimiter; need none or both", http.StatusBadRequest)
+				return
+			}
+			delims = *d
+		}
+		errs := s.warmCache(r.Context(), req.Templates, req.Resources, delims)
+		resp := response{Templates: []string{}, Resources: []string{}}
+		for _, id := range req.Templates {
+			if _, failed := errs[id]; !failed {
+				resp.Templates = append(resp.Templates, id)
+			}
+		}
+		for _, id := range req.Resources {
+			if _, failed := errs[id]; !failed {
+				resp.Resources = append(resp.Resources, id)
+			}
+		}
+		code := http.StatusOK
+		if len(errs) > 0 {
+			resp.Errors = map[string]string{}
+			for id, err := range errs {
+				resp.Errors[id] = err.Error()
+			}
+			code = http.StatusMultiStatus
+		}
+		w.Header().Set("Content-Type", "application/json")
+		s.respond(w, &resp, code)
+	}
+}
+
+func (s *Server) handleCacheStats() http.HandlerFunc {
+	type response struct {
+		Templates cacheStats `json:"templates"`
+		Resources cacheStats `json:"resources"`
+		Disk      diskStats  `json:"disk"`
+	}
+	s.apiSchema("cacheStatsResponse", response{})
+	return func(w http.ResponseWriter, r *http.Request) {
+		var resp response
+		s.tmpls.Lock()
+		resp.Templates = s.tmpls.stats(s.tmpls.t.Len(), s.tCacheSize)
+		s.tmpls.Unlock()
+		s.rscs.Lock()
+		resp.Resources = s.rscs.stats(s.rscs.r.Len(), s.rCacheSize)
+		s.rscs.Unlock()
+		var err error
+		resp.Disk, err = s.diskUsage()
+		if err != nil {
+			s.errLog.Println(err)
+			s.fail(w, r, CodeInternal, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		s.respond(w, &resp, http.StatusOK)
+	}
+}
+
+// handleAdminCache reports the same statistics as handleCacheStats, along with the ids of what's cached in memory.
+func (s *Server) handleAdminCache() http.HandlerFunc {
+	type entries struct {
+		cacheStats
+		IDs []string `json:"ids"`
+	}
+	type response struct {
+		Templates entries   `json:"templates"`
+		Resources entries   `json:"resources"`
+		Disk      diskStats `json:"disk"`
+	}
+	s.apiSchema("adminCacheResponse", response{})
+	return func(w http.ResponseWriter, r *http.Request) {
+		resp := response{Templates: entries{IDs: []string{}}, Resources: entries{IDs: []string{}}}
+		s.tmpls.Lock()
+		resp.Templates.cacheStats = s.tmpls.stats(s.tmpls.t.Len(), s.tCacheSize)
+		// Templates are cached by the hash of their source, so the same id may be cached more than once
+		seen := map[string]bool{}
+		for key, id := range s.tmpls.ids {
+			if !seen[id] && s.tmpls.t.Contains(key) {
+				seen[id] = true
+				resp.Templates.IDs = append(resp.Templates.IDs, id)
+			}
+		}
+		s.tmpls.Unlock()
+		s.rscs.Lock()
+		resp.Resources.cacheStats = s.rscs.stats(s.rscs.r.Len(), s.rCacheSize)
+		for _, key := range s.rscs.r.Keys() {
+			resp.Resources.IDs = append(resp.Resources.IDs, key.(string))
+		}
+		s.rscs.Unlock()
+		sort.Strings(resp.Templates.IDs)
+		sort.Strings(resp.Resources.IDs)
+		var err error
+		resp.Disk, err = s.diskUsage()
+		if err != nil {
+			s.errLog.Println(err)
+			s.fail(w, r, CodeInternal, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		s.respond(w, &resp, http.StatusOK)
+	}
+}
+
+func (s *Server) handleCachePurge() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := s.purgeCache(r.Context()); err != nil {
+			s.errLog.Println(err)
+			s.fail(w, r, CodeInternal, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		s.infoLog.Println("purged template and resource caches")
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *Server) handleCacheEvictTemplate() http.HandlerFunc {
+	type response struct {
+		ID      string `json:"id"`
+		Evicted int    `json:"evicted"`
+	}
+	s.apiSchema("cacheEvictTemplateResponse", response{})
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		n, err := s.evictTemplate(id)
+		if _, ok := err.(*NameError); ok {
+			s.fail(w, r, CodeBadRequest, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			s.errLog.Println(err)
+			s.fail(w, r, CodeInternal, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		s.infoLog.Printf("evicted template from cache: %s", id)
+		w.Header().Set("Content-Type", "application/json")
+		s.respond(w, &response{ID: id, Evicted: n}, http.StatusOK)
+	}
+}
+
+func (s *Server) handleCacheEvictResource() http.HandlerFunc {
+	type response struct {
+		ID      string `json:"id"`
+		Evicted bool   `json:"evicted"`
+	}
+	s.apiSchema("cacheEvictResourceResponse", response{})
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		evicted, err := s.evictResource(id)
+		if _, ok := err.(*NameError); ok {
+			s.fail(w, r, CodeBadRequest, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			s.errLog.Println(err)
+			s.fail(w, r, CodeInternal, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		s.infoLog.Printf("evicted resource from cache: %s", id)
+		w.Header().Set("Content-Type", "application/json")
+		s.respond(w, &response{ID: id, Evicted: evicted}, http.StatusOK)
+	}
+}
@@ -0,0 +1,570 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/hashicorp/golang-lru"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+type delimiters struct {
+	Left  string `json:"left"`
+	Right string `json:"right"`
+}
+
+var defaultDelims = delimiters{Left: "#!", Right: "!#"}
+
+// CacheConfig configures the in-memory template and resource caches.
+type CacheConfig struct {
+	// TmplSize and RscSize are how many templates and resources are kept in memory.
+	TmplSize int
+	RscSize  int
+	// TmplMaxBytes is the size of the largest template that will be kept in memory; zero means there's no limit.
+	TmplMaxBytes int
+	// Policy is the eviction policy used by both caches; one of "lru" (the default), "2q" or "arc".
+	Policy string
+}
+
+// cache is the subset of the golang-lru caches that we use, letting the eviction policy be chosen at startup.
+type cache interface {
+	Add(key, value interface{})
+	Get(key interface{}) (interface{}, bool)
+	Contains(key interface{}) bool
+	Remove(key interface{})
+	Purge()
+	Len() int
+	Keys() []interface{}
+}
+
+// lruCache adapts lru.Cache to the cache interface.
+type lruCache struct {
+	*lru.Cache
+}
+
+func (c lruCache) Add(key, value interface{}) {
+	c.Cache.Add(key, value)
+}
+
+func (c lruCache) Remove(key interface{}) {
+	c.Cache.Remove(key)
+}
+
+func newCache(policy string, size int) (cache, error) {
+	switch strings.ToLower(policy) {
+	case "", "lru":
+		c, err := lru.New(size)
+		return lruCache{c}, err
+	case "2q":
+		return lru.New2Q(size)
+	case "arc":
+		return lru.NewARC(size)
+	}
+	return nil, fmt.Errorf("unknown cache policy: %s", policy)
+}
+
+// cacheCounters keeps track of how well a cache is performing; it should only be touched while holding the caches lock.
+type cacheCounters struct {
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+// add adds the value to the cache, returning whether doing so evicted another entry.
+func (cc *cacheCounters) add(c cache, key, value interface{}) bool {
+	n := c.Len()
+	replaced := c.Contains(key)
+	c.Add(key, value)
+	if !replaced && c.Len() <= n {
+		cc.evictions++
+		return true
+	}
+	return false
+}
+
+// templates is the in-memory tier of the template cache, see loadTemplate.
+type templates struct {
+	t cache
+	// ids maps cache keys back to the id of the template they were loaded from
+	ids map[string]string
+	// sources remembers the sources of the cached templates by id, so that they're only read and hashed once
+	sources map[string]*templateSource
+	// reads are the reads of sources in progress by id, see templateSource
+	reads map[string]*templateRead
+	// gen is bumped whenever templates are evicted, so that sources read from before then aren't remembered
+	gen uint64
+	cacheCounters
+	sync.Mutex
+}
+
+// templateSource is the source of a template as read from local disk, along with its hash.
+type templateSource struct {
+	src  []byte
+	hash string
+	gen  uint64
+}
+
+// templateRead is a read of a template's source in progress, which other requests for the same template wait on.
+type templateRead struct {
+	done chan struct{}
+	ts   *templateSource
+	err  error
+}
+
+type resources struct {
+	r cache
+	cacheCounters
+	sync.Mutex
+}
+
+// dbCopies keeps track of the files in the root directory known to be copies of what's in the db: those downloaded
+// from it or sent to it since the server started.
+type dbCopies struct {
+	ids map[string]bool
+	sync.Mutex
+}
+
+func (c *dbCopies) add(id string) {
+	c.Lock()
+	c.ids[id] = true
+	c.Unlock()
+}
+
+func (c *dbCopies) has(id string) bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.ids[id]
+}
+
+func (c *dbCopies) remove(id string) {
+	c.Lock()
+	delete(c.ids, id)
+	c.Unlock()
+}
+
+func (s *Server) newCaches() error {
+	s.tmpls = &templates{ids: map[string]string{}, sources: map[string]*templateSource{}, reads: map[string]*templateRead{}}
+	s.rscs = &resources{}
+	s.copies = &dbCopies{ids: map[string]bool{}}
+	var err error
+	s.tmpls.t, err = newCache(s.cachePolicy, s.tCacheSize)
+	if err != nil {
+		return err
+	}
+	s.rscs.r, err = newCache(s.cachePolicy, s.rCacheSize)
+	return err
+}
+
+// addTemplate caches the parsed template under the given key, unless its source is too large to be kept in memory.
+func (s *Server) addTemplate(key, id string, t *template.Template, size int) {
+	if s.tMaxBytes > 0 && size > s.tMaxBytes {
+		return
+	}
+	if s.tmpls.add(s.tmpls.t, key, t) {
+		// Forget about the ids and sources of any templates that were just evicted
+		for k := range s.tmpls.ids {
+			if !s.tmpls.t.Contains(k) {
+				delete(s.tmpls.ids, k)
+			}
+		}
+		cached := make(map[string]bool, len(s.tmpls.ids))
+		for _, id := range s.tmpls.ids {
+			cached[id] = true
+		}
+		for id := range s.tmpls.sources {
+			if !cached[id] {
+				delete(s.tmpls.sources, id)
+			}
+		}
+	}
+	if id != "" {
+		s.tmpls.ids[key] = id
+	}
+}
+
+// fetchToDisk makes sure the file with the given id exists in the root directory, downloading it from the db if needed.
+// If the file can't be found anywhere, the returned error is of type NotFoundError.
+func (s *Server) fetchToDisk(ctx context.Context, id, path string) error {
+	if err := checkName(id); err != nil {
+		return err
+	}
+	_, err := os.Stat(path)
+	if err == nil {
+		s.janitor.touch(id)
+		return nil
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if s.db == nil {
+		return &NotFoundError{}
+	}
+	ctx, sp := s.startSpan(ctx, "storage.fetch")
+	sp.set("latte.file_id", id)
+	data, err := s.db.Fetch(ctx, id)
+	sp.fail(err)
+	sp.finish()
+	if err != nil {
+		return err
+	}
+	// IDs may contain slashes (e.g. sections/terms.tex)
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err = toDisk(data, path); err != nil {
+		return fmt.Errorf("error while writing to %s: %v", path, err)
+	}
+	s.copies.add(id)
+	s.janitor.touch(id)
+	return nil
+}
+
+// templateKey returns the key a template whose source has the given hash is cached under in memory.
+// We include the template delimiters to account for the same file being used with different delimiters, prefixing
+// them with the length of the left one so that e.g. "<<" and "<>>" don't share a key with "<<<" and ">>".
+func templateKey(hash string, delims delimiters) string {
+	return hash + ":" + strconv.Itoa(len(delims.Left)) + ":" + delims.Left + delims.Right
+}
+
+func sourceHash(src []byte) string {
+	hash := sha256.Sum256(src)
+	return hex.EncodeToString(hash[:])
+}
+
+// ParseError is returned when a template can't be parsed.
+type ParseError struct {
+	err error
+}
+
+func (e *ParseError) Error() string {
+	return "error while parsing template: " + e.err.Error()
+}
+
+// parseTemplate returns the parsed template for the given source, parsing it and caching the results if needed,
+// along with whether it was already cached. The id of the template, if it has one, is recorded so that it can later be evicted by id.
+func (s *Server) parseTemplate(src []byte, delims delimiters, id string) (*template.Template, bool, error) {
+	key := templateKey(sourceHash(src), delims)
+	s.tmpls.Lock()
+	defer s.tmpls.Unlock()
+	return s.parseTemplateLocked(key, src, delims, id)
+}
+
+func (s *Server) parseTemplateLocked(key string, src []byte, delims delimiters, id string) (*template.Template, bool, error) {
+	if ti, exists := s.tmpls.t.Get(key); exists {
+		s.tmpls.hits++
+		if id != "" {
+			s.tmpls.ids[key] = id
+		}
+		return ti.(*template.Template), true, nil
+	}
+	s.tmpls.misses++
+	t, err := template.New(key).Delims(delims.Left, delims.Right).Parse(string(src))
+	if err != nil {
+		return nil, false, &ParseError{err: err}
+	}
+	s.addTemplate(key, id, t, len(src))
+	return t, false, nil
+}
+
+// loadTemplate returns the parsed template with the given id, along with its source and whether it was already parsed and cached in memory.
+// Templates are cached in two tiers: their source lives on local disk under the root directory, named after their id,
+// and the parsed template lives in memory keyed by the hash of its source and its delimiters.
+// Sources not on local disk are downloaded from the db.
+func (s *Server) loadTemplate(ctx context.Context, id string, delims delimiters) (*template.Template, []byte, bool, error) {
+	ts, err := s.templateSource(ctx, id)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	s.tmpls.Lock()
+	defer s.tmpls.Unlock()
+	key := templateKey(ts.hash, delims)
+	t, cached, err := s.parseTemplateLocked(key, ts.src, delims, id)
+	// The source is remembered for as long as the template is cached, unless it was evicted while the source was being read
+	if err == nil && ts.gen == s.tmpls.gen && s.tmpls.t.Contains(key) {
+		s.tmpls.sources[id] = ts
+	}
+	return t, ts.src, cached, err
+}
+
+// templateSource returns the source of the template with the given id, reading it from local disk (downloading it from
+// the db if needed) unless it's remembered. The cache isn't locked while reading, so only requests for the same template
+// wait on each other, and they share a single read.
+func (s *Server) templateSource(ctx context.Context, id string) (*templateSource, error) {
+	for {
+		s.tmpls.Lock()
+		if ts, ok := s.tmpls.sources[id]; ok {
+			s.tmpls.Unlock()
+			s.janitor.touch(id)
+			return ts, nil
+		}
+		tr, reading := s.tmpls.reads[id]
+		if !reading {
+			tr = &templateRead{done: make(chan struct{})}
+			s.tmpls.reads[id] = tr
+			gen := s.tmpls.gen
+			s.tmpls.Unlock()
+			tr.ts, tr.err = s.readTemplate(ctx, id, gen)
+			s.tmpls.Lock()
+			delete(s.tmpls.reads, id)
+			s.tmpls.Unlock()
+			close(tr.done)
+			return tr.ts, tr.err
+		}
+		s.tmpls.Unlock()
+		select {
+		case <-tr.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		// The request that was reading the source went away before it was done, which says nothing about this one
+		if errors.Is(tr.err, context.Canceled) || errors.Is(tr.err, context.DeadlineExceeded) {
+			continue
+		}
+		return tr.ts, tr.err
+	}
+}
+
+// readTemplate reads the source of the template with the given id from local disk, downloading it from the db if needed.
+func (s *Server) readTemplate(ctx context.Context, id string, gen uint64) (*templateSource, error) {
+	tmplPath := filepath.Join(s.rootDir, id)
+	if err := s.fetchToDisk(ctx, id, tmplPath); err != nil {
+		return nil, err
+	}
+	src, err := ioutil.ReadFile(tmplPath)
+	if err != nil {
+		return nil, err
+	}
+	return &templateSource{src: src, hash: sourceHash(src), gen: gen}, nil
+}
+
+// loadResource returns the path on local disk of the resource with the given id, downloading it from the db if needed.
+// It returns an error of type *ForbiddenError if the client that made the request may not use it, see checkResourceAccess.
+func (s *Server) loadResource(ctx context.Context, id string) (string, error) {
+	if err := s.checkResourceAccess(ctx, id); err != nil {
+		return "", err
+	}
+	// Prevent other routines from downloading this resource if we're already downloading it.
+	s.rscs.Lock()
+	defer s.rscs.Unlock()
+	if rscPathi, exists := s.rscs.r.Get(id); exists {
+		rscPath := rscPathi.(string)
+		// Lets double check the file hasn't been removed from local disk
+		if _, err := os.Stat(rscPath); err == nil {
+			s.rscs.hits++
+			s.janitor.touch(id)
+			return rscPath, nil
+		}
+	}
+	s.rscs.misses++
+	rscPath := filepath.Join(s.rootDir, id)
+	if err := s.fetchToDisk(ctx, id, rscPath); err != nil {
+		return "", err
+	}
+	s.rscs.add(s.rscs.r, id, rscPath)
+	return rscPath, nil
+}
+
+// WarmCache fetches, parses and caches the given templates (using the default delimiters) and resources.
+// It returns the errors encountered, keyed by the id of the template or resource that caused them.
+func (s *Server) WarmCache(ctx context.Context, tmplIDs, rscIDs []string) map[string]error {
+	return s.warmCache(ctx, tmplIDs, rscIDs, defaultDelims)
+}
+
+func (s *Server) warmCache(ctx context.Context, tmplIDs, rscIDs []string, delims delimiters) map[string]error {
+	errs := map[string]error{}
+	for _, id := range tmplIDs {
+		if _, _, _, err := s.loadTemplate(ctx, id, delims); err != nil {
+			errs[id] = err
+			continue
+		}
+		s.infoLog.Printf("warmed template cache: %s", id)
+	}
+	for _, id := range rscIDs {
+		if _, err := s.loadResource(ctx, id); err != nil {
+			errs[id] = err
+			continue
+		}
+		s.infoLog.Printf("warmed resource cache: %s", id)
+	}
+	return errs
+}
+
+type cacheStats struct {
+	Entries   int     `json:"entries"`
+	Capacity  int     `json:"capacity"`
+	Hits      uint64  `json:"hits"`
+	Misses    uint64  `json:"misses"`
+	HitRatio  float64 `json:"hit_ratio"`
+	Evictions uint64  `json:"evictions"`
+}
+
+func (cc *cacheCounters) stats(entries, capacity int) cacheStats {
+	cs := cacheStats{
+		Entries:   entries,
+		Capacity:  capacity,
+		Hits:      cc.hits,
+		Misses:    cc.misses,
+		Evictions: cc.evictions,
+	}
+	if total := cc.hits + cc.misses; total > 0 {
+		cs.HitRatio = float64(cc.hits) / float64(total)
+	}
+	return cs
+}
+
+type diskStats struct {
+	Files int   `json:"files"`
+	Bytes int64 `json:"bytes"`
+}
+
+// diskUsage reports the number and total size of the files cached in the root directory.
+// Working directories of in-flight requests are not counted.
+func (s *Server) diskUsage() (diskStats, error) {
+	var ds diskStats
+	infos, err := ioutil.ReadDir(s.rootDir)
+	if err != nil {
+		return ds, err
+	}
+	for _, info := range infos {
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		ds.Files++
+		ds.Bytes += info.Size()
+	}
+	return ds, nil
+}
+
+// removeCached deletes the file with the given id from the root directory if it's known to be a copy of what's in the
+// db (see dbCopies). Anything else, e.g. a file registered without a db or one yet to be stored, may be the only copy
+// of the file, and so is left alone.
+func (s *Server) removeCached(id string) error {
+	if !s.copies.has(id) {
+		return nil
+	}
+	return s.removeCopy(id)
+}
+
+// removeCopy deletes the file with the given id, a copy of what's in the db, from the root directory.
+func (s *Server) removeCopy(id string) error {
+	fpath, err := joinName(s.rootDir, id)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(fpath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	s.copies.remove(id)
+	s.removeEmptyDirs(id)
+	return nil
+}
+
+// purgeCache empties the template and resource caches, along with the copies of what's in the db cached on local disk.
+// Only files known to be in the db are removed, those downloaded from it since the server started along with those it
+// lists if it can, since anything else in the root directory (e.g. an access list yet to be stored) may be the only copy.
+func (s *Server) purgeCache(ctx context.Context) error {
+	s.tmpls.Lock()
+	s.tmpls.t.Purge()
+	s.tmpls.ids = map[string]string{}
+	s.tmpls.sources = map[string]*templateSource{}
+	s.tmpls.gen++
+	s.tmpls.Unlock()
+
+	s.rscs.Lock()
+	defer s.rscs.Unlock()
+	s.rscs.r.Purge()
+
+	if s.db == nil {
+		return nil
+	}
+	s.copies.Lock()
+	ids := make([]string, 0, len(s.copies.ids))
+	for id := range s.copies.ids {
+		ids = append(ids, id)
+	}
+	s.copies.Unlock()
+	if lister, ok := s.db.(ListDB); ok {
+		listed, err := lister.List(ctx, "")
+		if err != nil {
+			return err
+		}
+		ids = append(ids, listed...)
+	}
+	for _, id := range ids {
+		if checkName(id) != nil {
+			continue
+		}
+		if err := s.removeCopy(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeEmptyDirs removes the directories left empty by removing the file with the given id, for ids with slashes in
+// them (e.g. sections/terms.tex).
+func (s *Server) removeEmptyDirs(id string) {
+	for dir := path.Dir(id); dir != "."; dir = path.Dir(dir) {
+		if os.Remove(filepath.Join(s.rootDir, filepath.FromSlash(dir))) != nil {
+			break
+		}
+	}
+}
+
+// evictTemplate removes every parsed version of the template with the given id from memory, along with its source on local
+// disk if it's a copy of what's in the db (see removeCached).
+// It returns the number of cache entries that were removed.
+func (s *Server) evictTemplate(id string) (int, error) {
+	s.tmpls.Lock()
+	defer s.tmpls.Unlock()
+	var n int
+	for key, tmplID := range s.tmpls.ids {
+		if tmplID != id {
+			continue
+		}
+		if s.tmpls.t.Contains(key) {
+			s.tmpls.t.Remove(key)
+			n++
+		}
+		delete(s.tmpls.ids, key)
+	}
+	s.forgetSourceLocked(id)
+	if err := checkName(id); err != nil {
+		return n, err
+	}
+	return n, s.removeCached(id)
+}
+
+// forgetSource forgets the remembered source of the template with the given id, if any, so that it's read again once
+// its file has been replaced.
+func (s *Server) forgetSource(id string) {
+	s.tmpls.Lock()
+	defer s.tmpls.Unlock()
+	s.forgetSourceLocked(id)
+}
+
+func (s *Server) forgetSourceLocked(id string) {
+	delete(s.tmpls.sources, id)
+	s.tmpls.gen++
+}
+
+// evictResource removes the resource with the given id from memory, and from local disk if it's a copy of what's in the db.
+// It returns whether the resource was cached in memory.
+func (s *Server) evictResource(id string) (bool, error) {
+	s.rscs.Lock()
+	defer s.rscs.Unlock()
+	removed := s.rscs.r.Contains(id)
+	s.rscs.r.Remove(id)
+	if err := checkName(id); err != nil {
+		return removed, err
+	}
+	return removed, s.removeCached(id)
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestEvictKeepsLocalFiles checks that evicting files only removes them from local disk if they're copies of what's in
+// the db, since anything else is the only copy.
+func TestEvictKeepsLocalFiles(t *testing.T) {
+	db, err := NewFileDB(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Store(context.Background(), "sections/remote.tex", strings.NewReader("remote"))
+	l := log.New(ioutil.Discard, "", 0)
+	s, err := NewServer(t.TempDir(), "pdflatex", db, l, l, Config{Cache: CacheConfig{TmplSize: 5, RscSize: 5}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"local.tex", "local.tex.acl"} {
+		if err := ioutil.WriteFile(filepath.Join(s.rootDir, id), []byte("local"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.fetchToDisk(context.Background(), "sections/remote.tex", filepath.Join(s.rootDir, "sections", "remote.tex")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, target := range []string{"/cache/templates/local.tex", "/cache/resources/local.tex", "/cache/templates/sections/remote.tex"} {
+		if w := serve(s, "DELETE", target, nil, nil); w.Code != 200 {
+			t.Fatalf("%s: expected a 200, got %d: %s", target, w.Code, w.Body)
+		}
+	}
+	exists := func(id string) bool {
+		_, err := os.Stat(filepath.Join(s.rootDir, filepath.FromSlash(id)))
+		return err == nil
+	}
+	if !exists("local.tex") {
+		t.Error("expected a file that isn't in the db to be kept")
+	}
+	if exists("sections/remote.tex") || exists("sections") {
+		t.Error("expected the copy of a file in the db to be removed, along with its directory")
+	}
+
+	if w := serve(s, "DELETE", "/cache", nil, nil); w.Code != 204 {
+		t.Fatalf("expected a 204, got %d: %s", w.Code, w.Body)
+	}
+	if !exists("local.tex") || !exists("local.tex.acl") {
+		t.Error("expected purging the cache to keep files that aren't in the db")
+	}
+}
+
+func TestTemplateKeyDelimiters(t *testing.T) {
+	hash := sourceHash([]byte("<<<.name>>>"))
+	a := templateKey(hash, delimiters{Left: "<<", Right: "<>>"})
+	b := templateKey(hash, delimiters{Left: "<<<", Right: ">>"})
+	if a == b {
+		t.Errorf("expected different delimiters to have different keys, both got %s", a)
+	}
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// callbackTimeout bounds how long each attempt at delivering a callback may take.
+const callbackTimeout = 10 * time.Second
+
+// jobCallback is where the status of a job is sent once it's finished, and how that went.
+type jobCallback struct {
+	URL string `json:"url"`
+	// WithPDF is whether the PDF itself is sent along with the status, rather than only where to download it from
+	WithPDF   bool   `json:"with_pdf,omitempty"`
+	Attempts  int    `json:"attempts"`
+	Delivered bool   `json:"delivered"`
+	Error     string `json:"error,omitempty"`
+}
+
+// callbackPayload is the body of the request a callback is delivered with.
+type callbackPayload struct {
+	*asyncJob
+	// Data is the base64 encoded PDF, if it was asked for
+	Data string `json:"data,omitempty"`
+}
+
+// setupCallbacks validates the URLs callbacks may be sent to.
+func (js *jobs) setupCallbacks(cfg *JobsConfig) error {
+	for _, prefix := range cfg.Callbacks {
+		u, err := url.Parse(prefix)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid callback url: %s", prefix)
+		}
+	}
+	js.callbacks = cfg.Callbacks
+	js.callbackSecret = []byte(cfg.CallbackSecret)
+	js.callbackRetries = cfg.CallbackRetries
+	if js.callbackRetries <= 0 {
+		js.callbackRetries = 5
+	}
+	js.client = &http.Client{
+		Timeout: callbackTimeout,
+		// Redirects can't lead anywhere callbacks aren't allowed to go either
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 5 {
+				return errors.New("too many redirects")
+			}
+			if !js.callbackAllowed(req.URL.String()) {
+				return errors.New("redirected to a URL callbacks may not be sent to: " + req.URL.String())
+			}
+			return nil
+		},
+	}
+	return nil
+}
+
+// callbackAllowed returns whether callbacks may be sent to the URL, which they may if it starts with one of the allowed prefixes.
+func (js *jobs) callbackAllowed(u string) bool {
+	for _, prefix := range js.callbacks {
+		if strings.HasPrefix(u, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// callbackFor returns the callback the request asks for with its callback query parameter, if any.
+func (js *jobs) callbackFor(r *http.Request) (*jobCallback, error) {
+	q := r.URL.Query()
+	u := q.Get("callback")
+	if u == "" {
+		return nil, nil
+	}
+	if len(js.callbacks) == 0 {
+		return nil, errors.New("callbacks aren't enabled")
+	}
+	if !js.callbackAllowed(u) {
+		return nil, fmt.Errorf("callbacks may not be sent to %s", u)
+	}
+	withPDF, _ := strconv.ParseBool(q.Get("callback_pdf"))
+	return &jobCallback{URL: u, WithPDF: withPDF}, nil
+}
+
+// notify sends the status of the finished job to its callback, retrying with exponential backoff until it's delivered or
+// the retries run out. Deliveries are signed with the callback secret, if there is one, the same way clients sign requests.
+func (s *Server) notify(id string) {
+	job := s.jobs.get(id)
+	if job == nil || job.Callback == nil {
+		return
+	}
+	cb := *job.Callback
+	job.Callback = nil
+	payload := callbackPayload{asyncJob: job}
+	if cb.WithPDF && job.PDF != "" {
+		data, err := ioutil.ReadFile(s.jobs.path(id))
+		if err != nil {
+			s.errLog.Printf("error while reading PDF of job %s for its callback: %v", id, err)
+		}
+		payload.Data = base64.StdEncoding.EncodeToString(data)
+	}
+	body, err := json.Marshal(&payload)
+	if err != nil {
+		s.errLog.Printf("error while encoding callback of job %s: %v", id, err)
+		return
+	}
+	backoff := time.Second
+	for attempt := 1; attempt <= s.jobs.callbackRetries+1; attempt++ {
+		if attempt > 1 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		err = s.jobs.deliver(cb.URL, body)
+		s.jobs.update(id, func(j *asyncJob) {
+			j.Callback.Attempts = attempt
+			j.Callback.Delivered = err == nil
+			j.Callback.Error = ""
+			if err != nil {
+				j.Callback.Error = err.Error()
+			}
+		})
+		if err == nil {
+			s.infoLog.Printf("delivered callback of job %s to %s", id, cb.URL)
+			return
+		}
+		s.errLog.Printf("error while delivering callback of job %s (attempt %d): %v", id, attempt, err)
+	}
+}
+
+// deliver makes a single attempt at sending the body to the callback URL.
+func (js *jobs) deliver(u string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(js.callbackSecret) > 0 {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set("X-Latte-Timestamp", timestamp)
+		req.Header.Set("X-Latte-Signature", "sha256="+sign(js.callbackSecret, timestamp, req.Method, req.URL.RequestURI(), body))
+	}
+	resp, err := js.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("callback responded with %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package server
+
+import (
+	"bytes"
+	"github.com/raphaelreyna/latte/internal/pdf"
+	"io/ioutil"
+	"net/http"
+)
+
+// readPDF reads a PDF sent as the body of the request, responding with a 400 if the body isn't a PDF.
+func (s *Server) readPDF(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	data, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		s.errLog.Println(err)
+		s.fail(w, r, CodeInternal, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	if !bytes.HasPrefix(data, []byte("%PDF-")) {
+		s.fail(w, r, CodeBadRequest, "request body is not a pdf", http.StatusBadRequest)
+		return nil, false
+	}
+	return data, true
+}
+
+func (s *Server) handleCheckAccessibility() http.HandlerFunc {
+	s.apiSchema("accessibilityReport", pdf.AccessibilityReport{})
+	return func(w http.ResponseWriter, r *http.Request) {
+		data, ok := s.readPDF(w, r)
+		if !ok {
+			return
+		}
+		report := pdf.Accessibility(data)
+		w.Header().Set("Content-Type", "application/json")
+		s.respond(w, &report, http.StatusOK)
+	}
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Prefixes of the directories made in the root directory for the duration of a request, upload or bundle install.
+// They let the directories left behind by a crash be told apart from registered files.
+const (
+	workDirPrefix   = "work-"
+	uploadDirPrefix = "upload-"
+	bundleDirPrefix = "bundle-"
+)
+
+const (
+	// cleanupAttempts is how many times removing a directory is attempted before giving up on it
+	cleanupAttempts = 3
+	// cleanupBackoff is how long to wait before the first retry; it doubles with every retry after that
+	cleanupBackoff = 100 * time.Millisecond
+	// cleanupQueueSize is how many directories may be waiting to be removed before they're removed synchronously instead
+	cleanupQueueSize = 256
+)
+
+// CleanupConfig configures how working directories are removed once they're no longer needed.
+type CleanupConfig struct {
+	// Sync removes working directories before responding, rather than queueing them to be removed in the background.
+	Sync bool
+	// Shred overwrites the files in working directories with zeros before removing them, see shred.
+	Shred bool
+}
+
+type cleanup struct {
+	sync  bool
+	shred bool
+	queue chan string
+}
+
+// setupCleanup removes the working directories left behind by a previous run that didn't get to remove them (e.g. because it crashed),
+// then starts removing queued working directories in the background.
+func (s *Server) setupCleanup(cfg CleanupConfig) error {
+	s.cleanup = &cleanup{sync: cfg.Sync, shred: cfg.Shred, queue: make(chan string, cleanupQueueSize)}
+	if _, err := ioutil.ReadDir(s.rootDir); err != nil {
+		return err
+	}
+	s.removeOrphans()
+	go func() {
+		for dir := range s.cleanup.queue {
+			if err := s.removeDir(dir, s.cleanup.shred); err != nil {
+				s.errLog.Printf("giving up on removing %s: %v", dir, err)
+			}
+		}
+	}()
+	return nil
+}
+
+// removeOrphans removes the directories made for requests, uploads and bundle installs that are still in the root directory.
+func (s *Server) removeOrphans() {
+	infos, err := ioutil.ReadDir(s.rootDir)
+	if err != nil {
+		s.errLog.Printf("error while looking for orphaned directories: %v", err)
+		return
+	}
+	for _, info := range infos {
+		name := info.Name()
+		if !info.IsDir() || !(strings.HasPrefix(name, workDirPrefix) || strings.HasPrefix(name, uploadDirPrefix) || strings.HasPrefix(name, bundleDirPrefix)) {
+			continue
+		}
+		if err := s.removeDir(filepath.Join(s.rootDir, name), s.cleanup.shred); err != nil {
+			s.errLog.Printf("error while removing orphaned directory %s: %v", name, err)
+			continue
+		}
+		s.infoLog.Printf("removed orphaned directory: %s", name)
+	}
+}
+
+// newWorkDir creates a working directory for a request in the root directory.
+func (s *Server) newWorkDir() (string, error) {
+	return ioutil.TempDir(s.rootDir, workDirPrefix)
+}
+
+// removeWorkDir removes the working directory dir, either right away or by queueing it depending on how the server is configured.
+// Sensitive directories are always shredded before this returns.
+func (s *Server) removeWorkDir(dir string, sensitive bool) {
+	if !sensitive && !s.cleanup.sync {
+		select {
+		case s.cleanup.queue <- dir:
+			return
+		default:
+			// The queue is backed up; don't let directories pile up on disk as well
+		}
+	}
+	if err := s.removeDir(dir, sensitive || s.cleanup.shred); err != nil {
+		s.errLog.Printf("giving up on removing %s: %v", dir, err)
+	}
+}
+
+// removeDir removes dir, shredding it first if asked to, and retrying with backoff if that fails.
+func (s *Server) removeDir(dir string, shred bool) error {
+	backoff := cleanupBackoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		if shred {
+			err = s.shred(dir)
+		} else {
+			err = os.RemoveAll(dir)
+		}
+		if err == nil || attempt == cleanupAttempts {
+			return err
+		}
+		s.errLog.Printf("error while removing %s (attempt %d of %d): %v", dir, attempt, cleanupAttempts, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
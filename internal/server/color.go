@@ -0,0 +1,118 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// colorOptions are the print oriented post-processing steps that may be applied to a generated PDF.
+type colorOptions struct {
+	// CMYK converts every color in the PDF to CMYK
+	CMYK bool `json:"cmyk,omitempty"`
+	// ICCProfile is the id of a registered ICC profile to attach to the PDF as its output intent
+	ICCProfile string `json:"icc_profile,omitempty"`
+	// OutputCondition describes the intended printing condition, e.g. "Coated FOGRA39"; defaults to the profiles file name
+	OutputCondition string `json:"output_condition,omitempty"`
+}
+
+// ghostscript is the binary used to post-process PDFs.
+const ghostscript = "gs"
+
+// iccComponents returns the number of color components of the ICC profile at path, as read from its header.
+func iccComponents(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	header := make([]byte, 20)
+	if _, err = f.Read(header); err != nil {
+		return 0, err
+	}
+	switch string(header[16:20]) {
+	case "GRAY":
+		return 1, nil
+	case "RGB ":
+		return 3, nil
+	case "CMYK":
+		return 4, nil
+	}
+	return 0, fmt.Errorf("%s is not an ICC profile for a gray, RGB or CMYK color space", filepath.Base(path))
+}
+
+// psString escapes s for use as a PostScript string literal.
+func psString(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `(`, `\(`, `)`, `\)`)
+	return "(" + r.Replace(s) + ")"
+}
+
+// outputIntent writes the pdfmarks that attach the ICC profile at iccPath as the output intent of a PDF into dir,
+// returning the path of the PostScript file holding them.
+func outputIntent(dir, iccPath, condition string) (string, error) {
+	n, err := iccComponents(iccPath)
+	if err != nil {
+		return "", err
+	}
+	if condition == "" {
+		condition = strings.TrimSuffix(filepath.Base(iccPath), filepath.Ext(iccPath))
+	}
+	ps := fmt.Sprintf(`[/_objdef {icc_profile} /type /stream /OBJ pdfmark
+[{icc_profile} << /N %d >> /PUT pdfmark
+[{icc_profile} %s (r) file /PUT pdfmark
+[/_objdef {output_intent} /type /dict /OBJ pdfmark
+[{output_intent} << /Type /OutputIntent /S /GTS_PDFX /OutputCondition %s /OutputConditionIdentifier (Custom) /Info %s /DestOutputProfile {icc_profile} >> /PUT pdfmark
+[{Catalog} << /OutputIntents [ {output_intent} ] >> /PUT pdfmark
+`, n, psString(iccPath), psString(condition), psString(condition))
+	psPath := filepath.Join(dir, "output-intent.ps")
+	return psPath, ioutil.WriteFile(psPath, []byte(ps), 0644)
+}
+
+// convertColor post-processes the PDF at pdfPath with Ghostscript, replacing it with a version whose colors have been
+// converted to CMYK and/or which carries an ICC output intent, as per opts.
+// Deterministic output leaves out the dates and ids Ghostscript would otherwise add.
+func (s *Server) convertColor(ctx context.Context, pdfPath string, opts colorOptions, deterministic bool) error {
+	if !opts.CMYK && opts.ICCProfile == "" {
+		return nil
+	}
+	if _, err := exec.LookPath(ghostscript); err != nil {
+		return errors.New("ghostscript is required for color conversion but is not installed")
+	}
+	dir := filepath.Dir(pdfPath)
+	out := filepath.Join(dir, "color-"+filepath.Base(pdfPath))
+	args := []string{"-dSAFER", "-dBATCH", "-dNOPAUSE", "-dQUIET", "-sDEVICE=pdfwrite"}
+	if opts.CMYK {
+		args = append(args, "-sColorConversionStrategy=CMYK", "-sProcessColorModel=DeviceCMYK")
+	}
+	if deterministic {
+		args = append(args, "-dOmitInfoDate", "-dOmitID", "-dOmitXMP")
+	}
+	var intent string
+	if opts.ICCProfile != "" {
+		iccPath, err := s.loadResource(ctx, opts.ICCProfile)
+		if err != nil {
+			return err
+		}
+		if intent, err = outputIntent(dir, iccPath, opts.OutputCondition); err != nil {
+			return err
+		}
+		args = append(args, "--permit-file-read="+iccPath)
+		if opts.CMYK {
+			args = append(args, "-sOutputICCProfile="+iccPath)
+		}
+	}
+	args = append(args, "-o", out)
+	if intent != "" {
+		args = append(args, intent)
+	}
+	args = append(args, pdfPath)
+	if output, err := exec.CommandContext(ctx, ghostscript, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("error while converting colors: %v: %s", err, output)
+	}
+	return os.Rename(out, pdfPath)
+}
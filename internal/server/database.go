@@ -2,51 +2,49 @@ package server
 
 import (
 	"context"
-	"fmt"
 	"io"
-	"io/ioutil"
-	"os"
 )
 
+// DB is where registered files are kept beyond LaTTe's local disk, e.g. so that they're shared between instances.
+// Every method is given the context of the request it's called for, and should give up once that's done.
 type DB interface {
-	// Store should be capable of storing a given []byte or contents of an io.ReadCloser
-	Store(ctx context.Context, uid string, i interface{}) error
-	// Fetch should return either a []byte, or io.ReadCloser.
+	// Store should store everything read from data, replacing anything already stored under uid.
+	// Closing data, if it needs closing, is left to the caller.
+	Store(ctx context.Context, uid string, data io.Reader) error
+	// Fetch should return the contents stored under uid, which the caller closes.
 	// If the requested resource could not be found, error should be of type NotFoundError
-	Fetch(ctx context.Context, uid string) (interface{}, error)
+	Fetch(ctx context.Context, uid string) (io.ReadCloser, error)
 	// Ping should check if the databases is reachable, if return error should be nil and non-nil otherwise.
 	Ping(ctx context.Context) error
 }
 
+// ListDB is implemented by databases that can list what they hold.
+type ListDB interface {
+	// List returns the uids of everything stored whose uid starts with prefix.
+	List(ctx context.Context, prefix string) ([]string, error)
+}
+
+// SizeDB is implemented by databases that can list what they hold along with how large each file is, without fetching it.
+type SizeDB interface {
+	// ListSizes returns the size in bytes of everything stored whose uid starts with prefix, by uid.
+	ListSizes(ctx context.Context, prefix string) (map[string]int64, error)
+}
+
+// DeleteDB is implemented by databases that can delete what they hold.
+type DeleteDB interface {
+	// Delete removes whatever is stored under uid; if nothing is, error should be of type NotFoundError
+	Delete(ctx context.Context, uid string) error
+}
+
 type NotFoundError struct{}
 
 func (nfe *NotFoundError) Error() string {
 	return "blob not found in database"
 }
 
-func toDisk(i interface{}, path string) error {
-	switch t := i.(type) {
-	case []byte:
-		bytes := i.([]byte)
-		if bytes == nil {
-			return fmt.Errorf("received nil pointer to []byte")
-		}
-		return ioutil.WriteFile(path, i.([]byte), os.ModePerm)
-	case io.ReadCloser:
-		f, err := os.Create(path)
-		if err != nil {
-			return err
-		}
-		rc := i.(io.ReadCloser)
-		if rc == nil {
-			return fmt.Errorf("received nil pointer to io.ReadCloser")
-		}
-		if _, err = io.Copy(f, rc); err != nil {
-			return err
-		}
-
-	default:
-		return fmt.Errorf("received interface of unexpected type: %v", t)
-	}
-	return nil
+// toDisk writes the contents fetched from the db to the file at path, closing them.
+func toDisk(rc io.ReadCloser, path string) error {
+	defer rc.Close()
+	_, err := streamToFile(path, rc)
+	return err
 }
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+)
+
+// maxDepDepth bounds how deeply nested \input files are followed, guarding against files that include each other.
+const maxDepDepth = 8
+
+var inputRe = regexp.MustCompile(`\\(?:input|include|subfile)\s*\{\s*([^{}\s]+)\s*\}`)
+
+// texDependencies returns the names of the files a .tex source pulls in with \input, \include or \subfile.
+// Names that can't refer to a registered file, such as absolute paths, those leaving the working directory or those
+// built with macros (e.g. \jobname.aux), are skipped.
+func texDependencies(src []byte) []string {
+	var names []string
+	for _, m := range inputRe.FindAllSubmatch(src, -1) {
+		name := path.Clean(string(m[1]))
+		if checkName(name) != nil {
+			continue
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// resolveDependencies pulls the files that src (and, recursively, those files) \input from storage into workDir.
+// Files already in workDir (e.g. sent as resources) are left alone, as are those that aren't registered since they
+// might well be part of the TeX installation.
+func (s *Server) resolveDependencies(ctx context.Context, src []byte, workDir string) error {
+	return s.resolveDeps(ctx, src, workDir, map[string]bool{}, 0)
+}
+
+func (s *Server) resolveDeps(ctx context.Context, src []byte, workDir string, seen map[string]bool, depth int) error {
+	if depth >= maxDepDepth {
+		return nil
+	}
+	for _, name := range texDependencies(src) {
+		// TeX adds the .tex extension when the name doesn't have one
+		candidates := []string{name}
+		if path.Ext(name) != ".tex" {
+			candidates = append([]string{name + ".tex"}, candidates...)
+		}
+		for _, id := range candidates {
+			if seen[id] {
+				break
+			}
+			dst := filepath.Join(workDir, filepath.FromSlash(id))
+			if _, err := os.Lstat(dst); err == nil {
+				seen[id] = true
+				break
+			}
+			rscPath, err := s.loadResource(ctx, id)
+			if _, notFound := err.(*NotFoundError); notFound {
+				continue
+			} else if err != nil {
+				return err
+			}
+			seen[id] = true
+			if err = os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+				return err
+			}
+			if err = s.placeResource(rscPath, dst); err != nil {
+				return err
+			}
+			s.infoLog.Printf("pulled dependency into working directory: %s", id)
+			depSrc, err := ioutil.ReadFile(rscPath)
+			if err != nil {
+				return err
+			}
+			if err = s.resolveDeps(ctx, depSrc, workDir, seen, depth+1); err != nil {
+				return err
+			}
+			break
+		}
+	}
+	return nil
+}
@@ -0,0 +1,17 @@
+package server
+
+import (
+	"strings"
+)
+
+// deterministicEnv sets up the compilers environment so that identical inputs produce byte-identical PDFs:
+// SOURCE_DATE_EPOCH fixes the creation and modification dates of the PDF (defaulting to the Unix epoch if the request
+// or template didn't set it) and FORCE_SOURCE_DATE makes \today and friends use it as well.
+func deterministicEnv(env []string) []string {
+	for _, v := range env {
+		if strings.HasPrefix(v, "SOURCE_DATE_EPOCH=") {
+			return append(env, "FORCE_SOURCE_DATE=1")
+		}
+	}
+	return append(env, "SOURCE_DATE_EPOCH=0", "FORCE_SOURCE_DATE=1")
+}
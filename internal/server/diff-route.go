@@ -0,0 +1,264 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+// pageDiff describes how a page of one PDF differs from the same page of another.
+type pageDiff struct {
+	Page int `json:"page"`
+	// Width and Height are those of the larger of the two rendered pages, in pixels
+	Width  int `json:"width"`
+	Height int `json:"height"`
+	// DifferentPixels counts the pixels that differ, including those that only one of the pages covers
+	DifferentPixels int     `json:"different_pixels"`
+	Difference      float64 `json:"difference"`
+	// OnlyIn is set to "a" or "b" if only one of the PDFs has this page
+	OnlyIn string `json:"only_in,omitempty"`
+	// Image is a base64 encoded PNG of the first page, faded, with the differing pixels in red
+	Image string `json:"image,omitempty"`
+}
+
+func loadPNG(path string) (image.Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return png.Decode(f)
+}
+
+// diffImages compares two rendered pages pixel by pixel; pixels differ if any of their channels differ by more than threshold.
+func diffImages(a, b image.Image, threshold int, withImage bool) (pageDiff, error) {
+	ab, bb := a.Bounds(), b.Bounds()
+	pd := pageDiff{Width: ab.Dx(), Height: ab.Dy()}
+	if bb.Dx() > pd.Width {
+		pd.Width = bb.Dx()
+	}
+	if bb.Dy() > pd.Height {
+		pd.Height = bb.Dy()
+	}
+	var out *image.RGBA
+	if withImage {
+		out = image.NewRGBA(image.Rect(0, 0, pd.Width, pd.Height))
+	}
+	red := color.RGBA{R: 0xff, A: 0xff}
+	for y := 0; y < pd.Height; y++ {
+		for x := 0; x < pd.Width; x++ {
+			pa := image.Point{X: ab.Min.X + x, Y: ab.Min.Y + y}
+			pb := image.Point{X: bb.Min.X + x, Y: bb.Min.Y + y}
+			inA, inB := pa.In(ab), pb.In(bb)
+			different := inA != inB
+			var grey uint8 = 0xff
+			if inA && inB {
+				r1, g1, b1, _ := a.At(pa.X, pa.Y).RGBA()
+				r2, g2, b2, _ := b.At(pb.X, pb.Y).RGBA()
+				different = channelDiff(r1, r2) > threshold || channelDiff(g1, g2) > threshold || channelDiff(b1, b2) > threshold
+				// Fade the original page so that the differences stand out
+				grey = uint8(0xc0 + (((r1+g1+b1)/3)>>8)/4)
+			}
+			if different {
+				pd.DifferentPixels++
+			}
+			if out != nil {
+				if different {
+					out.SetRGBA(x, y, red)
+				} else {
+					out.SetRGBA(x, y, color.RGBA{R: grey, G: grey, B: grey, A: 0xff})
+				}
+			}
+		}
+	}
+	if total := pd.Width * pd.Height; total > 0 {
+		pd.Difference = float64(pd.DifferentPixels) / float64(total)
+	}
+	if out != nil {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, out); err != nil {
+			return pd, err
+		}
+		pd.Image = base64.StdEncoding.EncodeToString(buf.Bytes())
+	}
+	return pd, nil
+}
+
+// channelDiff returns the difference between two 16 bit color channels, scaled down to 8 bits.
+func channelDiff(a, b uint32) int {
+	d := int(a>>8) - int(b>>8)
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+// responseBuffer is an http.ResponseWriter that keeps the response in memory, letting handlers be reused internally.
+type responseBuffer struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (rb *responseBuffer) Header() http.Header {
+	return rb.header
+}
+
+func (rb *responseBuffer) Write(p []byte) (int, error) {
+	if rb.code == 0 {
+		rb.code = http.StatusOK
+	}
+	return rb.body.Write(p)
+}
+
+func (rb *responseBuffer) WriteHeader(code int) {
+	if rb.code == 0 {
+		rb.code = code
+	}
+}
+
+func (s *Server) handleDiff() http.HandlerFunc {
+	// diffSide is one of the two PDFs being compared; either sent as is or generated from a /generate request
+	type diffSide struct {
+		// PDF is a base64 encoded PDF
+		PDF string `json:"pdf,omitempty"`
+		// Generate is a /generate request body, and Query the query string of its URL (e.g. "tmpl=ID&dtls=ID")
+		Generate map[string]interface{} `json:"generate,omitempty"`
+		Query    string                 `json:"query,omitempty"`
+	}
+	type request struct {
+		A diffSide `json:"a"`
+		B diffSide `json:"b"`
+		// DPI is the resolution pages are rendered at before being compared; defaults to 72
+		DPI int `json:"dpi,omitempty"`
+		// Threshold is how much (0-255) a color channel may differ by before the pixel is counted as different
+		Threshold int `json:"threshold,omitempty"`
+		// Images includes an image highlighting the differences for each page that differs
+		Images bool `json:"images,omitempty"`
+	}
+	type response struct {
+		Identical bool       `json:"identical"`
+		PagesA    int        `json:"pages_a"`
+		PagesB    int        `json:"pages_b"`
+		Pages     []pageDiff `json:"pages"`
+	}
+	generate := s.handleGenerate()
+	s.apiSchema("diffRequest", request{})
+	s.apiSchema("diffResponse", response{})
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req request
+		if err := s.decode(r.Body, &req); err != nil {
+			msg := "error while parsing json body: " + err.Error()
+			s.errLog.Println(msg)
+			s.fail(w, r, CodeInvalidJSON, msg, http.StatusBadRequest)
+			return
+		}
+		r.Body.Close()
+		if req.DPI <= 0 {
+			req.DPI = 72
+		}
+		workDir, err := s.newWorkDir()
+		if err != nil {
+			s.errLog.Println(err)
+			s.fail(w, r, CodeInternal, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer s.removeWorkDir(workDir, false)
+
+		// Get a hold of both PDFs, generating them if needed
+		pdfs := map[string]diffSide{"a": req.A, "b": req.B}
+		pages := map[string][]string{}
+		for name, side := range pdfs {
+			var data []byte
+			switch {
+			case side.PDF != "":
+				data, err = base64.StdEncoding.DecodeString(side.PDF)
+			case side.Generate != nil || side.Query != "":
+				var body []byte
+				if body, err = json.Marshal(side.Generate); err != nil {
+					break
+				}
+				gr := r.Clone(r.Context())
+				gr.URL = &url.URL{Path: "/generate", RawQuery: side.Query}
+				gr.Header = http.Header{"Content-Type": {"application/json"}}
+				gr.Body = ioutil.NopCloser(bytes.NewReader(body))
+				gr.ContentLength = int64(len(body))
+				rb := &responseBuffer{header: http.Header{}}
+				generate(rb, gr)
+				if rb.code != http.StatusOK {
+					er := apiError{
+						Code:  errorCode(rb.body.Bytes(), CodeCompileFailed),
+						Error: s.localize(r, "error while generating pdf %s", name),
+						Data:  rb.body.String(),
+					}
+					s.failWith(w, r, &er, rb.code)
+					return
+				}
+				data = rb.body.Bytes()
+			default:
+				err = errors.New("need either a pdf or a generate request")
+			}
+			if err != nil {
+				s.fail(w, r, CodeBadRequest, fmt.Sprintf("pdf %s: %v", name, err), http.StatusBadRequest)
+				return
+			}
+			pdfPath := filepath.Join(workDir, name+".pdf")
+			if err = ioutil.WriteFile(pdfPath, data, 0644); err == nil {
+				pages[name], err = rasterize(r.Context(), pdfPath, workDir, req.DPI)
+			}
+			if err != nil {
+				s.errLog.Println(err)
+				s.failWith(w, r, &apiError{Code: CodeInternal, Error: s.localize(r, "error while rendering pdf %s", name), Data: err.Error()}, http.StatusInternalServerError)
+				return
+			}
+		}
+
+		resp := response{Identical: true, PagesA: len(pages["a"]), PagesB: len(pages["b"]), Pages: []pageDiff{}}
+		n := resp.PagesA
+		if resp.PagesB > n {
+			n = resp.PagesB
+		}
+		for i := 0; i < n; i++ {
+			pd := pageDiff{Page: i + 1}
+			switch {
+			case i >= resp.PagesA:
+				pd.OnlyIn, pd.Difference = "b", 1
+			case i >= resp.PagesB:
+				pd.OnlyIn, pd.Difference = "a", 1
+			default:
+				var a, b image.Image
+				a, err = loadPNG(pages["a"][i])
+				if err == nil {
+					b, err = loadPNG(pages["b"][i])
+				}
+				if err == nil {
+					pd, err = diffImages(a, b, req.Threshold, req.Images)
+					pd.Page = i + 1
+				}
+				if err != nil {
+					s.errLog.Println(err)
+					s.fail(w, r, CodeInternal, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				if pd.DifferentPixels == 0 {
+					// Don't bother sending images with nothing highlighted in them
+					pd.Image = ""
+				}
+			}
+			resp.Identical = resp.Identical && pd.Difference == 0
+			resp.Pages = append(resp.Pages, pd)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		s.respond(w, &resp, http.StatusOK)
+	}
+}
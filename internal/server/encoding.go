@@ -0,0 +1,74 @@
+package server
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// zstdMaxWindow bounds the memory that decompressing zstd takes, regardless of the window size the data asks for.
+// It's the limit RFC 8878 sets for zstd as an HTTP content encoding.
+const zstdMaxWindow = 8 << 20
+
+// decompress wraps r so that it reads the decompressed contents of data compressed with the given encoding.
+// Supported encodings are gzip, deflate (zlib wrapped, as in HTTP) and zstd; an empty encoding or identity means no compression.
+func decompress(encoding string, r io.Reader) (io.ReadCloser, error) {
+	switch strings.ToLower(encoding) {
+	case "", "identity":
+		return ioutil.NopCloser(r), nil
+	case "gzip", "x-gzip":
+		return gzip.NewReader(r)
+	case "deflate":
+		return zlib.NewReader(r)
+	case "zstd":
+		d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxWindow(zstdMaxWindow))
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	}
+	return nil, fmt.Errorf("unsupported content encoding: %s", encoding)
+}
+
+// encodedFile is a base64 encoded file sent in a JSON body.
+// It may either be given as a plain string, or as an object if the file was compressed before being encoded:
+//
+//	{ "data": "BASE_64_ENCODED_STRING", "encoding": "gzip" }
+type encodedFile struct {
+	Data     string `json:"data"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+func (ef *encodedFile) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '"' {
+		ef.Encoding = ""
+		return json.Unmarshal(b, &ef.Data)
+	}
+	type plain encodedFile
+	return json.Unmarshal(b, (*plain)(ef))
+}
+
+// writeTo decodes and decompresses the file, writing its raw contents to path.
+// If max is positive, it fails with a *TooLargeError if the raw contents are larger than max bytes.
+func (ef *encodedFile) writeTo(path string, max int64) error {
+	return writeDecoded(path, base64.NewDecoder(base64.StdEncoding, strings.NewReader(ef.Data)), ef.Encoding, max)
+}
+
+// writeDecoded streams src, decompressed as given by encoding, to path, so that neither the compressed nor the raw
+// contents are held in memory. If max is positive, it fails with a *TooLargeError if the raw contents are larger than max bytes.
+func writeDecoded(path string, src io.Reader, encoding string, max int64) error {
+	rc, err := decompress(encoding, src)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	_, err = streamToFile(path, limitFile(rc, filepath.Base(path), max))
+	return err
+}
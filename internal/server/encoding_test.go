@@ -0,0 +1,66 @@
+package server
+
+import (
+	"bytes"
+	"compress/zlib"
+	"github.com/klauspost/compress/zstd"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func zstded(t *testing.T, data []byte, opts ...zstd.EOption) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw, err := zstd.NewWriter(&buf, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw.Write(data)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecompress(t *testing.T) {
+	data := bytes.Repeat([]byte("\\section{Terms}\n"), 1000)
+	var deflated bytes.Buffer
+	zw := zlib.NewWriter(&deflated)
+	zw.Write(data)
+	zw.Close()
+	for encoding, compressed := range map[string][]byte{
+		"":        data,
+		"gzip":    gzipped(t, data),
+		"deflate": deflated.Bytes(),
+		"zstd":    zstded(t, data),
+	} {
+		rc, err := decompress(encoding, bytes.NewReader(compressed))
+		if err != nil {
+			t.Errorf("%q: %v", encoding, err)
+			continue
+		}
+		out, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil || !bytes.Equal(out, data) {
+			t.Errorf("%q: expected the data back, got %d bytes (%v)", encoding, len(out), err)
+		}
+	}
+	if _, err := decompress("br", bytes.NewReader(data)); err == nil {
+		t.Error("expected unsupported encodings to be rejected")
+	}
+}
+
+func TestDecompressZstdLimits(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bomb.tex")
+	err := writeDecoded(path, bytes.NewReader(zstded(t, make([]byte, 1<<20))), "zstd", 1<<10)
+	if !isTooLarge(err) {
+		t.Errorf("expected a *TooLargeError, got %T: %v", err, err)
+	}
+	// Frames asking for more memory than is allowed aren't decompressed
+	big := zstded(t, make([]byte, 2*zstdMaxWindow), zstd.WithWindowSize(4*zstdMaxWindow), zstd.WithSingleSegment(false))
+	err = writeDecoded(path, bytes.NewReader(big), "zstd", 0)
+	if err == nil {
+		t.Error("expected frames with windows larger than zstdMaxWindow to be rejected")
+	}
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// defaultCompileEnv lists the environment variables that requests and templates may set for the compiler by default.
+var defaultCompileEnv = []string{"TEXINPUTS", "BSTINPUTS", "SOURCE_DATE_EPOCH", "max_print_line"}
+
+// compileEnv validates the requested environment variables against the servers allow list,
+// returning them in the NAME=VALUE form expected by exec.Cmd.
+func (s *Server) compileEnv(vars map[string]string) ([]string, error) {
+	var env []string
+	for name, value := range vars {
+		if !s.envAllowed[name] {
+			return nil, fmt.Errorf("setting environment variable %s is not allowed", name)
+		}
+		env = append(env, name+"="+value)
+	}
+	sort.Strings(env)
+	return env, nil
+}
+
+// templateEnv loads the environment variables stored alongside the template with the given id.
+// These live in a registered JSON file named TEMPLATE_ID.env; templates without one get an empty environment.
+func (s *Server) templateEnv(ctx context.Context, id string) (map[string]string, error) {
+	envID := id + ".env"
+	envPath := filepath.Join(s.rootDir, envID)
+	err := s.fetchToDisk(ctx, envID, envPath)
+	switch err.(type) {
+	case nil:
+	case *NotFoundError:
+		return nil, nil
+	default:
+		return nil, err
+	}
+	f, err := os.Open(envPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var vars map[string]string
+	if err = json.NewDecoder(f).Decode(&vars); err != nil {
+		return nil, fmt.Errorf("error while decoding environment for template %s: %v", id, err)
+	}
+	return vars, nil
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// zeros is an endless stream of zero bytes.
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// shred overwrites the files in the working directory dir with zeros and removes it, so that nothing a request sent or produced
+// can be recovered from disk once its done. Resources placed from the root directory, be they symlinked or hardlinked, are only
+// unlinked; their contents belong to registered files.
+func (s *Server) shred(dir string) error {
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		// Walk doesn't follow symlinks, so those aren't regular files
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if registered, err := os.Stat(filepath.Join(s.rootDir, rel)); err == nil && os.SameFile(info, registered) {
+			return nil
+		}
+		return overwrite(path, info.Size())
+	})
+	if rmErr := os.RemoveAll(dir); err == nil {
+		err = rmErr
+	}
+	return err
+}
+
+// overwrite replaces the first size bytes of the file at path with zeros, flushing them to disk.
+func overwrite(path string, size int64) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(f, zeros{}, size)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	return err
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/raphaelreyna/latte/internal/compile"
+)
+
+// Error codes are sent with every error response, so that clients can tell errors apart without parsing their messages.
+// They're part of the API: once released, a code keeps its meaning.
+const (
+	CodeBadRequest         = "BAD_REQUEST"
+	CodeInvalidJSON        = "INVALID_JSON"
+	CodeInvalidEncoding    = "INVALID_ENCODING"
+	CodeTemplateParseError = "TEMPLATE_PARSE_ERROR"
+	CodeTemplateExecError  = "TEMPLATE_EXECUTION_ERROR"
+	CodeMissingTemplate    = "MISSING_TEMPLATE"
+	CodeMissingResource    = "MISSING_RESOURCE"
+	CodeMissingDetails     = "MISSING_DETAILS"
+	CodeInvalidDetails     = "INVALID_DETAILS"
+	CodeResourceMismatch   = "RESOURCE_MISMATCH"
+	CodeSecretUnavailable  = "SECRET_UNAVAILABLE"
+	CodeCompileFailed      = "COMPILE_FAILED"
+	CodeEngineTimeout      = "ENGINE_TIMEOUT"
+	CodeResourceLimit      = "RESOURCE_LIMIT_EXCEEDED"
+	CodePostprocessFailed  = "POSTPROCESS_FAILED"
+	CodeUnembeddedFonts    = "UNEMBEDDED_FONTS"
+	CodeStorageUnavailable = "STORAGE_UNAVAILABLE"
+	CodeDeliveryFailed     = "DELIVERY_FAILED"
+	CodeDetailsUnavailable = "DETAILS_UNAVAILABLE"
+	CodeUnauthorized       = "UNAUTHORIZED"
+	CodeInvalidSignature   = "INVALID_SIGNATURE"
+	CodeAuthUnavailable    = "AUTH_UNAVAILABLE"
+	CodeForbidden          = "FORBIDDEN"
+	CodeNotFound           = "NOT_FOUND"
+	CodeConflict           = "CONFLICT"
+	CodeQueueFull          = "QUEUE_FULL"
+	CodeTooLarge           = "PAYLOAD_TOO_LARGE"
+	CodeInternal           = "INTERNAL_ERROR"
+)
+
+// titles are the short, human readable summaries of each type of error.
+var titles = map[string]string{
+	CodeBadRequest:         "Bad request",
+	CodeInvalidJSON:        "Invalid JSON body",
+	CodeInvalidEncoding:    "Invalid base64 encoding",
+	CodeTemplateParseError: "Template could not be parsed",
+	CodeTemplateExecError:  "Template could not be executed",
+	CodeMissingTemplate:    "Template not found",
+	CodeMissingResource:    "Resource not found",
+	CodeMissingDetails:     "Details not found",
+	CodeInvalidDetails:     "Invalid details",
+	CodeResourceMismatch:   "Resource does not match its hash",
+	CodeSecretUnavailable:  "Secret unavailable",
+	CodeCompileFailed:      "Compilation failed",
+	CodeEngineTimeout:      "Compilation timed out",
+	CodeResourceLimit:      "Resource limit exceeded",
+	CodePostprocessFailed:  "Post-processing failed",
+	CodeUnembeddedFonts:    "Fonts not embedded",
+	CodeStorageUnavailable: "Storage unavailable",
+	CodeDeliveryFailed:     "Delivery failed",
+	CodeDetailsUnavailable: "Details unavailable",
+	CodeUnauthorized:       "Unauthorized",
+	CodeInvalidSignature:   "Invalid signature",
+	CodeAuthUnavailable:    "Authorization server unavailable",
+	CodeForbidden:          "Forbidden",
+	CodeNotFound:           "Not found",
+	CodeConflict:           "Conflict",
+	CodeQueueFull:          "Queue full",
+	CodeTooLarge:           "Payload too large",
+	CodeInternal:           "Internal error",
+}
+
+// errorTypePrefix is prepended to an errors code to get the URI identifying its type.
+const errorTypePrefix = "urn:latte:error:"
+
+// apiError is the body of every error response, an RFC 7807 problem details object.
+type apiError struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail"`
+	// Instance identifies the request that failed; see requestID
+	Instance  string `json:"instance,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+	Code      string `json:"code"`
+	// Error is the same as Detail; it's only sent to v1 clients, which predate problem details.
+	Error string `json:"error,omitempty"`
+	// Data holds more information about the error, if there is any, e.g. the compilers output
+	Data string `json:"data,omitempty"`
+	// Errors are the errors the compiler logged, if it failed, so that clients can point at the lines that broke
+	Errors []compile.LogError `json:"errors,omitempty"`
+}
+
+// fail responds with an error with the given code and message.
+func (s *Server) fail(w http.ResponseWriter, r *http.Request, code, msg string, status int) []byte {
+	return s.failWith(w, r, &apiError{Code: code, Error: msg}, status)
+}
+
+// failWith responds with the given error, filling in the rest of its problem details from its code and message, and returns the JSON it was sent as.
+// v1 clients get it as application/json, so that they keep working; everyone else gets it as application/problem+json.
+func (s *Server) failWith(w http.ResponseWriter, r *http.Request, e *apiError, status int) []byte {
+	// A body cut off at the servers limit is why reading it failed, whatever the handler made of that
+	if err := bodyTooLarge(r); err != nil {
+		e, status = &apiError{Code: CodeTooLarge, Error: err.Error()}, http.StatusRequestEntityTooLarge
+	}
+	e.Type = errorTypePrefix + e.Code
+	e.Title = titles[e.Code]
+	if e.Title == "" {
+		e.Title = http.StatusText(status)
+	}
+	e.Status = status
+	e.Detail = e.Error
+	if id := requestID(r); id != "" {
+		e.RequestID = id
+		e.Instance = requestIDPrefix + id
+	}
+	if apiVersion(r) > 1 {
+		e.Error = ""
+		w.Header().Set("Content-Type", "application/problem+json")
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	return s.respond(w, e, status)
+}
+
+// errorCode returns the code of the error in the given response body, or fallback if it doesn't hold one.
+// It's used to pass along the errors of requests made internally, e.g. by /diff, without losing their code.
+func errorCode(body []byte, fallback string) string {
+	var e apiError
+	if err := json.Unmarshal(body, &e); err != nil || e.Code == "" {
+		return fallback
+	}
+	return e.Code
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// EventsConfig configures generating PDFs for the objects uploaded to S3, as announced by the events S3 sends to an SQS queue.
+type EventsConfig struct {
+	// QueueURL is the URL of the SQS queue the bucket sends its object created events to.
+	QueueURL string
+	// Rules map the keys of uploaded objects to the template used to render them; the first rule whose prefix matches a key is used.
+	Rules []EventRule
+}
+
+// EventRule renders the details JSON files uploaded under Prefix with Template, writing the PDFs under OutputPrefix.
+type EventRule struct {
+	Prefix       string
+	Template     string
+	OutputPrefix string
+}
+
+// s3Event is the part of an S3 event notification LaTTe cares about.
+type s3Event struct {
+	Records []struct {
+		EventName string `json:"eventName"`
+		S3        struct {
+			Bucket struct {
+				Name string `json:"name"`
+			} `json:"bucket"`
+			Object struct {
+				Key string `json:"key"`
+			} `json:"object"`
+		} `json:"s3"`
+	} `json:"Records"`
+}
+
+// setupEvents starts consuming S3 events from the configured queue, if there is one.
+func (s *Server) setupEvents(cfg *EventsConfig) error {
+	if cfg == nil || cfg.QueueURL == "" {
+		return nil
+	}
+	if s.aws.cfg.Region == "" || s.aws.cfg.AccessKeyID == "" {
+		return errors.New("consuming S3 events requires AWS credentials and a region")
+	}
+	if len(cfg.Rules) == 0 {
+		return errors.New("consuming S3 events requires at least one rule")
+	}
+	for _, rule := range cfg.Rules {
+		if rule.Template == "" {
+			return fmt.Errorf("event rule for prefix %q has no template", rule.Prefix)
+		}
+		// Writing PDFs under the prefix being watched would have them rendered in turn
+		if strings.HasPrefix(rule.OutputPrefix, rule.Prefix) {
+			return fmt.Errorf("event rule for prefix %q writes its output under the prefix it watches", rule.Prefix)
+		}
+	}
+	generate := s.handleGenerate()
+	go func() {
+		for {
+			if err := s.receiveEvents(context.Background(), cfg, generate); err != nil {
+				s.errLog.Printf("error while receiving S3 events: %v", err)
+				time.Sleep(5 * time.Second)
+			}
+		}
+	}()
+	return nil
+}
+
+// receiveEvents waits for a batch of messages from the queue and handles them.
+// Messages are only deleted once they've been handled, so that those that failed are delivered again (or moved to a dead letter queue).
+func (s *Server) receiveEvents(ctx context.Context, cfg *EventsConfig, generate http.HandlerFunc) error {
+	var received struct {
+		Messages []struct {
+			MessageID     string `json:"MessageId"`
+			ReceiptHandle string `json:"ReceiptHandle"`
+			Body          string `json:"Body"`
+		} `json:"Messages"`
+	}
+	in := map[string]interface{}{"QueueUrl": cfg.QueueURL, "MaxNumberOfMessages": 10, "WaitTimeSeconds": 20}
+	if err := s.aws.sqsCall(ctx, cfg.QueueURL, "ReceiveMessage", in, &received); err != nil {
+		return err
+	}
+	for _, msg := range received.Messages {
+		if err := s.handleEvent(ctx, cfg.Rules, msg.MessageID, msg.Body, generate); err != nil {
+			s.errLog.Printf("error while handling S3 event %s: %v", msg.MessageID, err)
+			continue
+		}
+		in := map[string]interface{}{"QueueUrl": cfg.QueueURL, "ReceiptHandle": msg.ReceiptHandle}
+		if err := s.aws.sqsCall(ctx, cfg.QueueURL, "DeleteMessage", in, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleEvent renders every object the event announces, skipping those that no rule matches.
+func (s *Server) handleEvent(ctx context.Context, rules []EventRule, id, body string, generate http.HandlerFunc) error {
+	var event s3Event
+	if err := json.Unmarshal([]byte(body), &event); err != nil {
+		return err
+	}
+	// Test events sent when notifications are configured have no records, and are simply dropped
+	for _, record := range event.Records {
+		if !strings.HasPrefix(record.EventName, "ObjectCreated:") {
+			continue
+		}
+		// Keys are URL encoded in events
+		key, err := url.QueryUnescape(record.S3.Object.Key)
+		if err != nil {
+			return err
+		}
+		for _, rule := range rules {
+			if !strings.HasPrefix(key, rule.Prefix) {
+				continue
+			}
+			if err = s.renderObject(ctx, rule, id, record.S3.Bucket.Name, key, generate); err != nil {
+				return fmt.Errorf("%s/%s: %v", record.S3.Bucket.Name, key, err)
+			}
+			break
+		}
+	}
+	return nil
+}
+
+// renderObject renders the details JSON stored at key with the rules template, writing the PDF back to the same bucket.
+func (s *Server) renderObject(ctx context.Context, rule EventRule, id, bucket, key string, generate http.HandlerFunc) error {
+	details, err := s.aws.getObject(ctx, bucket, key)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(map[string]json.RawMessage{"details": details})
+	if err != nil {
+		return fmt.Errorf("details aren't valid JSON: %v", err)
+	}
+	r, err := http.NewRequestWithContext(ctx, "POST", "/generate?tmpl="+url.QueryEscape(rule.Template), nil)
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set(requestIDHeader, id)
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	rb := &responseBuffer{header: http.Header{}}
+	generate(rb, withRequestID(rb, r))
+	if rb.code != http.StatusOK {
+		return fmt.Errorf("error while generating pdf: %s", bytes.TrimSpace(rb.body.Bytes()))
+	}
+
+	name := strings.TrimPrefix(key, rule.Prefix)
+	name = strings.TrimSuffix(name, path.Ext(name)) + ".pdf"
+	out := rule.OutputPrefix + name
+	if err = s.aws.putObject(ctx, bucket, out, "application/pdf", &rb.body); err != nil {
+		return err
+	}
+	s.infoLog.Printf("rendered s3://%s/%s to s3://%s/%s", bucket, key, bucket, out)
+	return nil
+}
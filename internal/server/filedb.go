@@ -0,0 +1,176 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// fileDBTempPrefix starts the names of files being written, which aren't listed.
+const fileDBTempPrefix = ".latte-"
+
+// FileDB is a DB that keeps files in a directory, e.g. one on an NFS mount shared by several LaTTe instances.
+type FileDB struct {
+	dir string
+}
+
+// NewFileDB returns a DB keeping files in dir, creating it if it doesn't exist.
+func NewFileDB(dir string) (*FileDB, error) {
+	if dir == "" {
+		return nil, errors.New("filesystem database needs a directory")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &FileDB{dir: dir}, nil
+}
+
+// path returns the path of the file with the given id, which may have slashes in it (e.g. sections/terms.tex)
+// but mustn't lead outside of the directory.
+func (db *FileDB) path(uid string) (string, error) {
+	if uid == "" || uid == "." || path.IsAbs(uid) || path.Clean(uid) != uid || uid == ".." || strings.HasPrefix(uid, "../") {
+		return "", fmt.Errorf("invalid file id: %s", uid)
+	}
+	for _, part := range strings.Split(uid, "/") {
+		if strings.HasPrefix(part, fileDBTempPrefix) {
+			return "", fmt.Errorf("invalid file id: %s", uid)
+		}
+	}
+	return filepath.Join(db.dir, filepath.FromSlash(uid)), nil
+}
+
+// Store writes the file next to where it belongs then moves it there, so that other instances never see it half written.
+func (db *FileDB) Store(ctx context.Context, uid string, data io.Reader) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	fpath, err := db.path(uid)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(fpath), fileDBTempPrefix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), fpath)
+}
+
+// Fetch opens the file, which is read as it's copied rather than all at once.
+func (db *FileDB) Fetch(ctx context.Context, uid string) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	fpath, err := db.path(uid)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(fpath)
+	if os.IsNotExist(err) {
+		return nil, &NotFoundError{}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Ping checks that the directory is still there, e.g. that its mount hasn't gone away.
+func (db *FileDB) Ping(ctx context.Context) error {
+	info, err := os.Stat(db.dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("not a directory: %s", db.dir)
+	}
+	return nil
+}
+
+// List returns the ids of the files under the directory that start with prefix.
+func (db *FileDB) List(ctx context.Context, prefix string) ([]string, error) {
+	var uids []string
+	err := db.walk(ctx, prefix, func(uid string, info os.FileInfo) {
+		uids = append(uids, uid)
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(uids)
+	return uids, nil
+}
+
+// ListSizes returns the sizes of the files under the directory that start with prefix.
+func (db *FileDB) ListSizes(ctx context.Context, prefix string) (map[string]int64, error) {
+	sizes := map[string]int64{}
+	err := db.walk(ctx, prefix, func(uid string, info os.FileInfo) {
+		sizes[uid] = info.Size()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sizes, nil
+}
+
+// walk calls found with the id of each file under the directory that starts with prefix, skipping temporary files.
+func (db *FileDB) walk(ctx context.Context, prefix string, found func(uid string, info os.FileInfo)) error {
+	return filepath.Walk(db.dir, func(fpath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		// Walking a large directory over NFS can take a while
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		if strings.HasPrefix(info.Name(), fileDBTempPrefix) || !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(db.dir, fpath)
+		if err != nil {
+			return err
+		}
+		if uid := filepath.ToSlash(rel); strings.HasPrefix(uid, prefix) {
+			found(uid, info)
+		}
+		return nil
+	})
+}
+
+// Delete removes the file.
+func (db *FileDB) Delete(ctx context.Context, uid string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	fpath, err := db.path(uid)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(fpath)
+	if os.IsNotExist(err) {
+		return &NotFoundError{}
+	}
+	return err
+}
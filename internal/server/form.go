@@ -0,0 +1,151 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// FormError is returned when a multipart/form-data request is malformed, or one of its parts is invalid.
+type FormError struct {
+	// Part names the part that's invalid, if it's one of them
+	Part string
+	err  error
+}
+
+func (e *FormError) Error() string {
+	if e.Part == "" {
+		return "invalid form: " + e.err.Error()
+	}
+	return fmt.Sprintf("invalid %s part: %v", e.Part, e.err)
+}
+
+// isForm returns whether contentType is that of a multipart/form-data body.
+func isForm(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mt == "multipart/form-data"
+}
+
+// generateForm is what was sent as the parts of a multipart/form-data request to generate a PDF.
+type generateForm struct {
+	template []byte
+	details  map[string]interface{}
+	// resources are the paths of the resources written to the working directory
+	resources []string
+}
+
+// partName returns the name of the form field of the part, and its file name as it was sent, directories and all;
+// multipart.Part.FileName drops directories, which the names of resources may have.
+func partName(p *multipart.Part) (string, string) {
+	_, params, err := mime.ParseMediaType(p.Header.Get("Content-Disposition"))
+	if err != nil {
+		return p.FormName(), ""
+	}
+	return params["name"], params["filename"]
+}
+
+// readForm reads a multipart/form-data request to generate a PDF, whose parts may be any of:
+//   - request: the JSON body that would have been sent otherwise, which is decoded into req
+//   - template: the template, as it is
+//   - details: the details JSON object
+//   - resources: a file named by its file name (e.g. images/logo.png), which may be repeated
+//
+// Parts may be compressed, as given by their Content-Encoding. Resources are streamed into dir as they're read
+// rather than held in memory, so that files needn't be base64 encoded and buffered by either side.
+func (s *Server) readForm(r *http.Request, dir string, req interface{}) (*generateForm, error) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, &FormError{err: err}
+	}
+	form := &generateForm{}
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			// Anything after the last part is read too, see drainBody
+			if err = drainBody(r.Body); err != nil {
+				return nil, err
+			}
+			return form, nil
+		}
+		if err != nil {
+			return nil, &FormError{err: err}
+		}
+		name, filename := partName(p)
+		data, err := decompress(p.Header.Get("Content-Encoding"), p)
+		if err != nil {
+			return nil, &FormError{Part: name, err: err}
+		}
+		switch name {
+		case "request":
+			err = s.decode(data, req)
+		case "template":
+			form.template, err = ioutil.ReadAll(data)
+		case "details":
+			err = json.NewDecoder(data).Decode(&form.details)
+		case "resources":
+			var path string
+			if path, err = s.readFormResource(data, dir, filename, len(form.resources)); err == nil {
+				form.resources = append(form.resources, path)
+			}
+		default:
+			err = fmt.Errorf("unknown part: %s", name)
+			name = ""
+		}
+		data.Close()
+		switch err.(type) {
+		case nil:
+		case *TooLargeError, *os.PathError:
+			return nil, err
+		default:
+			return nil, &FormError{Part: name, err: err}
+		}
+	}
+}
+
+// readFormResource streams the resource with the given name into dir, given how many have already been, and returns its path.
+func (s *Server) readFormResource(data io.Reader, dir, name string, read int) (string, error) {
+	if s.maxResources > 0 && read >= s.maxResources {
+		return "", &TooLargeError{msg: fmt.Sprintf("can't send more than %d resources", s.maxResources)}
+	}
+	// Names are relative to the working directory, and so can't climb out of it
+	path, err := joinName(dir, name)
+	if err != nil {
+		return "", err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	_, err = streamToFile(path, limitFile(data, name, s.maxRscBytes))
+	return path, err
+}
+
+// formRequest returns the JSON request sent as part of a multipart/form-data body, if there's one.
+func formRequest(contentType string, body []byte) []byte {
+	_, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil
+	}
+	mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if err != nil {
+			return nil
+		}
+		if name, _ := partName(p); name == "request" {
+			data, err := decompress(p.Header.Get("Content-Encoding"), p)
+			if err != nil {
+				return nil
+			}
+			defer data.Close()
+			req, _ := ioutil.ReadAll(data)
+			return req
+		}
+	}
+}
@@ -1,413 +1,811 @@
 package server
 
 import (
-	"crypto/md5"
+	"bytes"
+	"context"
 	"encoding/base64"
-	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/hashicorp/golang-lru"
 	"github.com/raphaelreyna/latte/internal/compile"
+	"github.com/raphaelreyna/latte/internal/pdf"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"path/filepath"
-	"sync"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"text/template"
+	"time"
 )
 
-func (s *Server) handleGenerate() (http.HandlerFunc, error) {
-	type delimiters struct {
-		Left  string `json:"left"`
-		Right string `json:"right"`
-	}
+func (s *Server) handleGenerate() http.HandlerFunc {
 	type request struct {
-		// Template is base64 encoded .tex file
+		// Template is base64 encoded .tex file (or .typ file, when compiled with Typst)
 		Template string `json:"template"`
+		// Typesetter is what the template is compiled with: tex or typst; defaults to typst for registered templates ending in .typ, and tex otherwise
+		Typesetter string `json:"typesetter,omitempty"`
+		// Engine is the TeX engine the template is compiled with, e.g. xelatex; it must be one the server allows
+		Engine string `json:"engine,omitempty"`
 		// Details must be a json object
 		Details map[string]interface{} `json:"details"`
-		// Resources must be a json object whose keys are the resources file names and value is the base64 encoded string of the file
-		Resources  map[string]string `json:"resources"`
-		Delimiters *delimiters       `json:"delimiters, omitempty"`
-	}
-	type errorResponse struct {
-		Error string `json:"error"`
-		Data  string `json:"data,omitempty"`
+		// Resources must be a json object whose keys are the resources file names and value is the base64 encoded string of the file,
+		// or an object holding the base64 encoded string of the compressed file and its encoding.
+		Resources  map[string]encodedFile `json:"resources"`
+		Delimiters *delimiters            `json:"delimiters,omitempty"`
+		// Env holds environment variables to set for the compiler; only those on the servers allow list may be set
+		Env map[string]string `json:"env,omitempty"`
+		// RequireEmbeddedFonts fails the request if the output uses any fonts that aren't embedded in it
+		RequireEmbeddedFonts bool `json:"require_embedded_fonts,omitempty"`
+		// Color optionally converts the output to CMYK and/or attaches an ICC output intent to it, for print workflows
+		Color *colorOptions `json:"color,omitempty"`
+		// Deterministic makes identical inputs produce byte-identical PDFs
+		Deterministic bool `json:"deterministic,omitempty"`
+		// Provenance attaches a record of how the PDF was made to it
+		Provenance bool `json:"provenance,omitempty"`
+		// Rerun runs TeX again until cross-references, tables of contents and the like are resolved
+		Rerun bool `json:"rerun,omitempty"`
+		// Bibliography builds the bibliography from the .bib resources between passes with bibtex, biber or auto (for whichever the template uses)
+		Bibliography string `json:"bibliography,omitempty"`
+		// NoPersist guarantees nothing derived from the request outlives it, see Config.NoPersist
+		NoPersist bool `json:"no_persist,omitempty"`
+		// DetailsURL is a URL the details are fetched from, if they aren't sent; see RemoteDetailsConfig
+		DetailsURL string `json:"details_url,omitempty"`
+		// Email emails the PDF to the given recipients, besides responding with it
+		Email *emailDelivery `json:"email,omitempty"`
+		// Output sends the PDF to one of the servers sinks instead of responding with it
+		Output *outputOptions `json:"output,omitempty"`
+		// Tags are recorded along with the PDF in the archive, so that it can be found by them
+		Tags []string `json:"tags,omitempty"`
+		// Timeout bounds how long the compiler may run (e.g. 30s); it can't be longer than the servers own timeout
+		Timeout string `json:"timeout,omitempty"`
 	}
 	type job struct {
 		tmpl    *template.Template
+		src     []byte
 		details map[string]interface{}
 		dir     string
+		env     map[string]string
+		// requireFonts is whether the output must have all of its fonts embedded
+		requireFonts bool
+		color        *colorOptions
+		// deterministic is whether the output must only depend on the inputs, see deterministicEnv
+		deterministic bool
+		provenance    bool
+		// rerun is whether TeX is run again until references are resolved
+		rerun bool
+		// bibliography is the tool the bibliography is built with, if any
+		bibliography string
+		// tmplID and dtlsID are the ids of the registered template and details used, if any
+		tmplID string
+		dtlsID string
+		// cached is whether the template was already parsed and cached in memory
+		cached bool
+		// noPersist is whether the working directory must be shredded before responding and nothing derived from the request be cached or logged
+		noPersist bool
+		email     *emailDelivery
+		// dtlsURL is the URL the details are fetched from, if any
+		dtlsURL string
+		output  *outputOptions
+		tags    []string
+		// typesetter names what the template is compiled with, if the request chose
+		typesetter string
+		// engine names the TeX engine the template is compiled with, if the request chose
+		engine string
+		// timeout bounds how long the compiler may run, if it's positive
+		timeout time.Duration
 	}
-	type templates struct {
-		t *lru.Cache
-		sync.Mutex
-	}
-	type resources struct {
-		r *lru.Cache
-		sync.Mutex
-	}
-	tmplsCache, err := lru.New(s.tCacheSize)
-	if err != nil {
-		return nil, err
-	}
-	rscsCache, err := lru.New(s.rCacheSize)
-	if err != nil {
-		return nil, err
-	}
-	tmpls := &templates{t: tmplsCache}
-	rscs := &resources{r: rscsCache}
+	s.apiSchema("generateRequest", request{})
+	s.apiSchema("generateForm", struct {
+		Request   *request               `json:"request,omitempty"`
+		Template  *formFile              `json:"template,omitempty"`
+		Details   map[string]interface{} `json:"details,omitempty"`
+		Resources []formFile             `json:"resources,omitempty"`
+	}{})
+	s.apiSchema("outputResult", outputResult{})
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Create temporary directory into which we'll copy all of the required resource files
 		// and eventually run pdflatex in.
-		workDir, err := ioutil.TempDir(s.rootDir, "")
+		workDir, err := s.newWorkDir()
 		if err != nil {
 			s.errLog.Println(err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			s.fail(w, r, CodeInternal, err.Error(), http.StatusInternalServerError)
 			return
 		}
 		s.infoLog.Printf("created new temp directory: %s", workDir)
+		j := job{dir: workDir, details: map[string]interface{}{}, env: map[string]string{}, requireFonts: s.requireFonts, deterministic: s.deterministic, provenance: s.provenance, rerun: s.rerun, bibliography: s.bibliography, noPersist: s.noPersist, timeout: s.timeout}
+		// Working directories of requests that mustn't persist anything are shredded before responding
 		defer func() {
-			go func() {
-				if err = os.RemoveAll(workDir); err != nil {
-					s.errLog.Println(err)
-				}
-			}()
+			s.removeWorkDir(workDir, j.noPersist)
 		}()
-		j := job{dir: workDir, details: map[string]interface{}{}}
-		delims := delimiters{Left: "#!", Right: "!#"}
-		// Grab any data sent as JSON
-		if r.Header.Get("Content-Type") == "application/json" {
-			var req request
-			err := json.NewDecoder(r.Body).Decode(&req)
+		delims := defaultDelims
+		var req request
+		// tBytes is the template sent with the request, if any, and rscPaths are the resources sent with it
+		var tBytes []byte
+		var rscPaths []string
+		sent := false
+		// Grab any data sent as JSON, or as a form whose files are streamed into the working directory
+		if ct := r.Header.Get("Content-Type"); ct == "application/json" {
+			// Resources are streamed into the working directory as they're read, and the rest of the body decoded as usual
+			body, paths, err := streamResources(r.Body, workDir, s.maxRscBytes, s.maxResources)
+			rscPaths = paths
+			if err == nil {
+				err = s.decode(bytes.NewReader(body), &req)
+			}
+			var nameErr *NameError
 			switch {
+			case errors.As(err, new(*TooLargeError)):
+				s.fail(w, r, CodeTooLarge, err.Error(), http.StatusRequestEntityTooLarge)
+				return
+			case errors.As(err, &nameErr):
+				s.fail(w, r, CodeBadRequest, err.Error(), http.StatusBadRequest)
+				return
+			case isEncodingError(err):
+				s.fail(w, r, CodeInvalidEncoding, err.Error(), http.StatusBadRequest)
+				return
+			case errors.As(err, new(*os.PathError)):
+				s.errLog.Println(err)
+				s.fail(w, r, CodeInternal, err.Error(), http.StatusInternalServerError)
+				return
 			case err == io.EOF:
-				s.respond(w, "request header Content-Type set to application/json; received empty body", http.StatusBadRequest)
+				s.fail(w, r, CodeInvalidJSON, "request header Content-Type set to application/json; received empty body", http.StatusBadRequest)
+				return
+			case isStrictError(err):
+				s.fail(w, r, CodeInvalidJSON, err.Error(), http.StatusBadRequest)
 				return
 			case err != nil:
 				s.errLog.Println(err)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				s.fail(w, r, CodeInvalidJSON, err.Error(), http.StatusBadRequest)
 				return
 			}
 			r.Body.Close()
+			sent = true
+		} else if isForm(ct) {
+			form, err := s.readForm(r, workDir, &req)
+			switch e := err.(type) {
+			case nil:
+			case *TooLargeError:
+				s.fail(w, r, CodeTooLarge, err.Error(), http.StatusRequestEntityTooLarge)
+				return
+			case *FormError:
+				code := CodeBadRequest
+				if e.Part == "request" || e.Part == "details" {
+					code = CodeInvalidJSON
+				}
+				s.fail(w, r, code, err.Error(), http.StatusBadRequest)
+				return
+			default:
+				s.errLog.Println(err)
+				s.fail(w, r, CodeInternal, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			r.Body.Close()
+			sent = true
+			tBytes, rscPaths = form.template, form.resources
+			// Details sent as a part of their own take precedence over any in the request part
+			if len(form.details) > 0 {
+				req.Details = form.details
+			}
+		}
+		if sent {
+			j.noPersist = j.noPersist || req.NoPersist
 			if req.Delimiters != nil {
 				d := req.Delimiters
 				if d.Left == "" || d.Right == "" {
-					s.respond(w, "only received one delimiter; need none or both", http.StatusBadRequest)
+					s.fail(w, r, CodeBadRequest, "only received one delimiter; need none or both", http.StatusBadRequest)
 					return
 				}
 				delims = *req.Delimiters
 			}
-			if req.Template != "" {
+			if tBytes == nil && req.Template != "" {
+				tBytes, err = base64.StdEncoding.DecodeString(req.Template)
+				if err != nil {
+					s.errLog.Println(err)
+					s.fail(w, r, CodeInvalidEncoding, err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+			if len(tBytes) > 0 {
 				// Check if we've already parsed this template; if not, parse it and cache the results
-				tHash := md5.Sum([]byte(req.Template))
-				// We append template delimiters to account for the same file being uploaded with different delimiters.
-				// This would really only happen on accident but not taking it into account leads to unexpected caching behavior.
-				cid := hex.EncodeToString(tHash[:]) + delims.Left + delims.Right
-				tmpls.Lock()
-				ti, exists := tmpls.t.Get(cid)
-				var t *template.Template
-				if !exists {
-					tBytes, err := base64.StdEncoding.DecodeString(req.Template)
-					if err != nil {
-						tmpls.Unlock()
-						s.errLog.Println(err)
-						http.Error(w, err.Error(), http.StatusInternalServerError)
-						return
-					}
-					t = template.New(cid).Delims(delims.Left, delims.Right)
-					t, err = t.Parse(string(tBytes))
-					if err != nil {
-						tmpls.Unlock()
-						s.errLog.Println(err)
-						http.Error(w, err.Error(), http.StatusInternalServerError)
-						return
-					}
-
-					tmpls.t.Add(cid, t)
+				if j.noPersist {
+					j.tmpl, err = template.New("").Delims(delims.Left, delims.Right).Parse(string(tBytes))
 				} else {
-					t = ti.(*template.Template)
+					j.tmpl, j.cached, err = s.parseTemplate(tBytes, delims, "")
+				}
+				j.src = tBytes
+				if err != nil {
+					s.errLog.Println(err)
+					s.fail(w, r, CodeTemplateParseError, err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+			j.requireFonts = j.requireFonts || req.RequireEmbeddedFonts
+			j.color = req.Color
+			j.deterministic = j.deterministic || req.Deterministic
+			j.provenance = j.provenance || req.Provenance
+			j.rerun = j.rerun || req.Rerun
+			if req.Bibliography != "" {
+				if !validBibliography(req.Bibliography) {
+					s.fail(w, r, CodeBadRequest, "unknown bibliography tool: "+req.Bibliography, http.StatusBadRequest)
+					return
+				}
+				j.bibliography = req.Bibliography
+			}
+			if req.Email != nil && s.smtp == nil {
+				s.fail(w, r, CodeBadRequest, "email delivery isn't configured", http.StatusBadRequest)
+				return
+			}
+			j.email = req.Email
+			j.dtlsURL = req.DetailsURL
+			if req.Output != nil {
+				if _, ok := s.sinks[req.Output.Sink]; !ok {
+					s.fail(w, r, CodeBadRequest, "no such sink: "+req.Output.Sink, http.StatusBadRequest)
+					return
+				}
+			}
+			j.output = req.Output
+			j.tags = req.Tags
+			if req.Typesetter != "" {
+				if _, ok := s.typesetters[req.Typesetter]; !ok {
+					s.fail(w, r, CodeBadRequest, "unknown typesetter: "+req.Typesetter, http.StatusBadRequest)
+					return
+				}
+			}
+			j.typesetter = req.Typesetter
+			if req.Engine != "" {
+				if _, ok := s.engines[req.Engine]; !ok {
+					s.fail(w, r, CodeBadRequest, "engine not allowed: "+req.Engine, http.StatusBadRequest)
+					return
+				}
+			}
+			j.engine = req.Engine
+			if req.Timeout != "" {
+				timeout, err := time.ParseDuration(req.Timeout)
+				if err != nil || timeout <= 0 {
+					s.fail(w, r, CodeBadRequest, "invalid timeout: "+req.Timeout, http.StatusBadRequest)
+					return
+				}
+				if s.timeout > 0 && timeout > s.timeout {
+					s.fail(w, r, CodeBadRequest, fmt.Sprintf("timeout can't be longer than %v", s.timeout), http.StatusBadRequest)
+					return
 				}
-				j.tmpl = t
-				tmpls.Unlock()
+				j.timeout = timeout
+			}
+			for name, value := range req.Env {
+				j.env[name] = value
 			}
 			// Grab details if they were provided
 			if len(req.Details) > 0 {
 				j.details = req.Details
 			}
+			if s.maxResources > 0 && len(req.Resources)+len(rscPaths) > s.maxResources {
+				s.fail(w, r, CodeTooLarge, fmt.Sprintf("can't send more than %d resources", s.maxResources), http.StatusRequestEntityTooLarge)
+				return
+			}
 			// Write resources files into working directory
 			for name, data := range req.Resources {
-				fname := filepath.Join(workDir, name)
-				bytes, err := base64.StdEncoding.DecodeString(data)
+				// Names are relative to the working directory, and so can't climb out of it
+				fname, err := joinName(workDir, name)
+				if err != nil {
+					s.fail(w, r, CodeBadRequest, err.Error(), http.StatusBadRequest)
+					return
+				}
+				if err = os.MkdirAll(filepath.Dir(fname), 0755); err == nil {
+					err = data.writeTo(fname, s.maxRscBytes)
+				}
+				if _, ok := err.(*TooLargeError); ok {
+					s.fail(w, r, CodeTooLarge, err.Error(), http.StatusRequestEntityTooLarge)
+					return
+				}
+				if isEncodingError(err) {
+					s.fail(w, r, CodeInvalidEncoding, err.Error(), http.StatusBadRequest)
+					return
+				}
 				if err != nil {
 					s.errLog.Println(err)
-					http.Error(w, err.Error(), http.StatusInternalServerError)
+					s.fail(w, r, CodeInternal, err.Error(), http.StatusInternalServerError)
 					return
 				}
-				err = ioutil.WriteFile(fname, bytes, os.ModePerm)
+				rscPaths = append(rscPaths, fname)
+			}
+			for _, fname := range rscPaths {
+				converted, err := s.convertImage(r.Context(), fname)
+				if err == nil {
+					_, err = s.optimizeImage(fname)
+				}
+				if err == nil && converted != "" {
+					_, err = s.optimizeImage(converted)
+				}
 				if err != nil {
 					s.errLog.Println(err)
-					http.Error(w, err.Error(), http.StatusInternalServerError)
+					s.fail(w, r, CodeInternal, err.Error(), http.StatusInternalServerError)
 					return
 				}
 			}
 		}
 		// Grab any ids sent over the URL
 		q := r.URL.Query()
+		om, err := parseOutputMode(q)
+		if err != nil {
+			s.fail(w, r, CodeBadRequest, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if om.mode != "" && om.mode != outputPDF && j.output != nil {
+			s.fail(w, r, CodeBadRequest, "only PDFs can be sent to sinks", http.StatusBadRequest)
+			return
+		}
+		for _, id := range []string{q.Get("tmpl"), q.Get("dtls")} {
+			if err := checkName(id); id != "" && err != nil {
+				s.fail(w, r, CodeBadRequest, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
 		// Grab template being requested in the URL
 		if tmplID := q.Get("tmpl"); j.tmpl == nil && tmplID != "" {
-			tmplID = tmplID + delims.Left + delims.Right
-			tmpls.Lock()
-			ti, exists := tmpls.t.Get(tmplID)
-			var t *template.Template
-			if !exists {
-				// Try loading the template file from local disk, downloading it if it doesn't exist
-				tmplPath := filepath.Join(s.rootDir, tmplID)
-				var tmplBytes []byte
-				_, err := os.Stat(tmplPath)
-				if os.IsNotExist(err) {
-					if s.db == nil {
-						tmpls.Unlock()
-						msg := fmt.Sprintf("template with id %s not found", tmplID)
-						s.respond(w, msg, http.StatusBadRequest)
-						return
-					}
-					rawData, err := s.db.Fetch(r.Context(), tmplID)
-					switch err.(type) {
-					case *NotFoundError:
-						tmpls.Unlock()
-						msg := fmt.Sprintf("template with id %s not found", tmplID)
-						http.Error(w, msg, http.StatusInternalServerError)
-						return
-					default:
-						if err != nil {
-							tmpls.Unlock()
-							s.errLog.Println(err)
-							http.Error(w, err.Error(), http.StatusInternalServerError)
-							return
-						}
-					}
-					err = toDisk(rawData, tmplPath)
-					if err != nil {
-						tmpls.Unlock()
-						s.errLog.Printf("error while writing to %s: %v", tmplPath, err)
-						http.Error(w, err.Error(), http.StatusInternalServerError)
-						return
-					}
-				} else if err != nil {
-					tmpls.Unlock()
-					s.errLog.Println(err)
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
-				}
-				if tmplBytes == nil {
-					tmplBytes, err = ioutil.ReadFile(tmplPath)
-					if err != nil {
-						tmpls.Unlock()
-						s.errLog.Println(err)
-						http.Error(w, err.Error(), http.StatusInternalServerError)
-						return
+			err = s.checkTemplateAccess(r.Context(), tmplID, aclRender)
+			if err == nil {
+				j.tmpl, j.src, j.cached, err = s.loadTemplate(r.Context(), tmplID, delims)
+				j.tmplID = tmplID
+			}
+			if err == nil {
+				// Variables set in the request take precedence over those stored with the template
+				var tmplEnv map[string]string
+				tmplEnv, err = s.templateEnv(r.Context(), tmplID)
+				for name, value := range tmplEnv {
+					if _, set := j.env[name]; !set {
+						j.env[name] = value
 					}
 				}
-				t = template.New(tmplID).Delims(delims.Left, delims.Right)
-				t, err = t.Parse(string(tmplBytes))
-				if err != nil {
-					tmpls.Unlock()
-					s.errLog.Println(err)
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
-				}
-				tmpls.t.Add(tmplID, t)
-			} else {
-				t = ti.(*template.Template)
 			}
-			j.tmpl = t
-			tmpls.Unlock()
+			switch err.(type) {
+			case nil:
+			case *NotFoundError:
+				msg := fmt.Sprintf("template with id %s not found", tmplID)
+				s.fail(w, r, CodeMissingTemplate, msg, http.StatusBadRequest)
+				return
+			case *ForbiddenError:
+				s.fail(w, r, CodeForbidden, err.Error(), http.StatusForbidden)
+				return
+			case *ParseError:
+				s.errLog.Println(err)
+				s.fail(w, r, CodeTemplateParseError, err.Error(), http.StatusUnprocessableEntity)
+				return
+			default:
+				s.errLog.Println(err)
+				s.fail(w, r, CodeStorageUnavailable, err.Error(), http.StatusInternalServerError)
+				return
+			}
 		} else if j.tmpl == nil {
 			err = errors.New("no template provided")
 			s.errLog.Println(err)
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			s.fail(w, r, CodeMissingTemplate, err.Error(), http.StatusBadRequest)
 			return
 		}
-		// Symlink resources into the working directory, downloading those that aren't in the root directory
-		rscsIDs := q["rsc"]
-		for _, rscID := range rscsIDs {
-			// Prevent other routines from downloading this resource if its not found and we're already downloading it.
-			rscs.Lock()
-			rscPathi, exists := rscs.r.Get(rscID)
-			var rscPath string
-			if _, err = os.Stat(rscPath); os.IsNotExist(err) || !exists {
-				if s.db == nil {
-					rscs.Unlock()
-					msg := fmt.Sprintf("resource with id %s not found", rscID)
-					s.respond(w, msg, http.StatusBadRequest)
-					return
-				}
-				// If path not in memory, then file doesn't exit on local disk (but lets double check) and we need to download it.
-				rscData, err := s.db.Fetch(r.Context(), rscID)
-				switch err.(type) {
-				case *NotFoundError:
-					rscs.Unlock()
-					msg := fmt.Sprintf("resource with id %s not found", rscID)
-					http.Error(w, msg, http.StatusInternalServerError)
-					return
-				default:
-					if err != nil {
-						rscs.Unlock()
-						s.errLog.Println(err)
-						http.Error(w, err.Error(), http.StatusInternalServerError)
-						return
-					}
-				}
-				rscPath = filepath.Join(s.rootDir, rscID)
-				err = toDisk(rscData, rscPath)
-				if err != nil {
-					tmpls.Unlock()
-					s.errLog.Printf("error while writing to %s: %v", rscPath, err)
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
+		// Place resources into the working directory, downloading those that aren't in the root directory
+		// Resources may be pinned to the hash of their contents, e.g. ?rsc=logo.png@sha256:HEX_ENCODED_DIGEST
+		for _, ref := range q["rsc"] {
+			rr, err := parseResourceRef(ref)
+			if err != nil {
+				s.fail(w, r, CodeBadRequest, err.Error(), http.StatusBadRequest)
+				return
+			}
+			rscPath, err := s.loadResource(r.Context(), rr.ID)
+			switch err.(type) {
+			case nil:
+			case *NotFoundError:
+				msg := fmt.Sprintf("resource with id %s not found", rr.ID)
+				s.fail(w, r, CodeMissingResource, msg, http.StatusBadRequest)
+				return
+			case *ForbiddenError:
+				s.fail(w, r, CodeForbidden, err.Error(), http.StatusForbidden)
+				return
+			default:
+				s.errLog.Println(err)
+				s.fail(w, r, CodeStorageUnavailable, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			dst := filepath.Join(workDir, rr.ID)
+			if err = os.MkdirAll(filepath.Dir(dst), 0755); err == nil {
+				if rr.Digest == "" {
+					err = s.placeResource(rscPath, dst)
+				} else {
+					err = rr.place(rscPath, dst)
 				}
-				rscs.r.Add(rscID, rscPath)
-			} else {
-				rscPath = rscPathi.(string)
 			}
-			rscs.Unlock()
-			err = os.Symlink(rscPath, filepath.Join(workDir, rscID))
+			if _, ok := err.(*MismatchError); ok {
+				s.errLog.Println(err)
+				s.fail(w, r, CodeResourceMismatch, err.Error(), http.StatusConflict)
+				return
+			}
 			if err != nil {
 				s.errLog.Println(err)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				s.fail(w, r, CodeInternal, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		// Fetch details from a URL, if the request refers to one
+		if j.dtlsURL == "" {
+			j.dtlsURL = q.Get("dtls_url")
+		}
+		if len(j.details) == 0 && j.dtlsURL != "" {
+			if s.remoteDetails == nil || s.remoteDetails.source(j.dtlsURL) == nil {
+				s.fail(w, r, CodeForbidden, "details may not be fetched from "+j.dtlsURL, http.StatusForbidden)
+				return
+			}
+			j.details, err = s.remoteDetails.fetch(r.Context(), j.dtlsURL)
+			switch err.(type) {
+			case nil:
+			case *RemoteDetailsError:
+				s.fail(w, r, CodeInvalidDetails, err.Error(), http.StatusUnprocessableEntity)
+				return
+			default:
+				s.errLog.Println(err)
+				s.fail(w, r, CodeDetailsUnavailable, err.Error(), http.StatusBadGateway)
 				return
 			}
 		}
 		// Load and parse details json from local disk, downloading it from the db if not found on local disk
 		if dtID := q.Get("dtls"); len(j.details) == 0 && dtID != "" {
+			j.dtlsID = dtID
 			dtlsPath := filepath.Join(s.rootDir, dtID)
 			_, err = os.Stat(dtlsPath)
 			if os.IsNotExist(err) {
 				if s.db == nil {
-					msg := fmt.Sprintf("details json with id %s not found", dtID)
-					er := errorResponse{Error: msg}
-					w.Header().Set("Content-Type", "application/json")
-					payload := s.respond(w, &er, http.StatusInternalServerError)
-					s.errLog.Println("%s", payload)
+					msg := s.localize(r, "details json with id %s not found", dtID)
+					er := apiError{Code: CodeMissingDetails, Error: msg}
+					payload := s.failWith(w, r, &er, http.StatusBadRequest)
+					s.errLog.Printf("%s", payload)
 					return
 				}
 				dtlsData, err := s.db.Fetch(r.Context(), dtID)
 				switch err.(type) {
 				case *NotFoundError:
-					msg := fmt.Sprintf("details json with id %s not found", dtID)
-					er := errorResponse{Error: msg}
-					w.Header().Set("Content-Type", "application/json")
-					payload := s.respond(w, &er, http.StatusInternalServerError)
-					s.errLog.Println("%s", payload)
+					msg := s.localize(r, "details json with id %s not found", dtID)
+					er := apiError{Code: CodeMissingDetails, Error: msg}
+					payload := s.failWith(w, r, &er, http.StatusBadRequest)
+					s.errLog.Printf("%s", payload)
 					return
 				default:
 					if err != nil {
-						er := errorResponse{
-							Error: "error while getting json file info",
+						er := apiError{
+							Code:  CodeStorageUnavailable,
+							Error: s.localize(r, "error while getting json file info"),
 							Data:  err.Error(),
 						}
-						w.Header().Set("Content-Type", "application/json")
-						payload := s.respond(w, &er, http.StatusInternalServerError)
-						s.errLog.Println("%s", payload)
+						payload := s.failWith(w, r, &er, http.StatusInternalServerError)
+						s.errLog.Printf("%s", payload)
 						return
 					}
 				}
 				err = toDisk(dtlsData, dtlsPath)
 				if err != nil {
-					er := errorResponse{
-						Error: "error while writing json file to disk",
+					er := apiError{
+						Code:  CodeInternal,
+						Error: s.localize(r, "error while writing json file to disk"),
 						Data:  err.Error(),
 					}
-					w.Header().Set("Content-Type", "application/json")
-					payload := s.respond(w, &er, http.StatusInternalServerError)
-					s.errLog.Println("%s", payload)
+					payload := s.failWith(w, r, &er, http.StatusInternalServerError)
+					s.errLog.Printf("%s", payload)
 					return
 				}
-				switch dtlsData.(type) {
-				case []byte:
-					err = json.Unmarshal(dtlsData.([]byte), &j.details)
-					if err != nil {
-						er := errorResponse{
-							Error: "error while decoding json",
-							Data:  err.Error(),
-						}
-						w.Header().Set("Content-Type", "application/json")
-						payload := s.respond(w, &er, http.StatusInternalServerError)
-						s.errLog.Println("%s", payload)
-						return
-					}
-				case io.ReadCloser:
-					rc := dtlsData.(io.ReadCloser)
-					err = json.NewDecoder(rc).Decode(&j.details)
-					if err != nil {
-						er := errorResponse{
-							Error: "error while decoding json",
-							Data:  err.Error(),
-						}
-						w.Header().Set("Content-Type", "application/json")
-						payload := s.respond(w, &er, http.StatusInternalServerError)
-						s.errLog.Println("%s", payload)
-						return
-					}
-					rc.Close()
-				}
+				// The details are decoded from disk below, now that they're there
 			} else if err != nil {
-				er := errorResponse{
-					Error: "error while getting json file info",
+				er := apiError{
+					Code:  CodeInternal,
+					Error: s.localize(r, "error while getting json file info"),
 					Data:  err.Error(),
 				}
-				w.Header().Set("Content-Type", "application/json")
-				payload := s.respond(w, &er, http.StatusInternalServerError)
-				s.errLog.Println("%s", payload)
+				payload := s.failWith(w, r, &er, http.StatusInternalServerError)
+				s.errLog.Printf("%s", payload)
 				return
 			}
 			if len(j.details) == 0 {
 				f, err := os.Open(dtlsPath)
 				if err != nil {
-					er := errorResponse{
-						Error: "error while opening json file",
+					er := apiError{
+						Code:  CodeInternal,
+						Error: s.localize(r, "error while opening json file"),
 						Data:  err.Error(),
 					}
-					w.Header().Set("Content-Type", "application/json")
-					payload := s.respond(w, &er, http.StatusInternalServerError)
-					s.errLog.Println("%s", payload)
+					payload := s.failWith(w, r, &er, http.StatusInternalServerError)
+					s.errLog.Printf("%s", payload)
 					return
 				}
 				err = json.NewDecoder(f).Decode(&j.details)
 				if err != nil {
-					er := errorResponse{
-						Error: "error while decoding json",
+					er := apiError{
+						Code:  CodeInvalidDetails,
+						Error: s.localize(r, "error while decoding json"),
 						Data:  err.Error(),
 					}
-					w.Header().Set("Content-Type", "application/json")
-					payload := s.respond(w, &er, http.StatusInternalServerError)
-					s.errLog.Println("%s", payload)
+					payload := s.failWith(w, r, &er, http.StatusUnprocessableEntity)
+					s.errLog.Printf("%s", payload)
 					return
 				}
 				f.Close()
 			}
 		}
-		// Compile pdf
-		pdfPath, err := compile.Compile(r.Context(), j.tmpl, j.details, j.dir, s.cmd)
+		// Templates installed from bundles may have defaults for details the request didn't set
+		if j.tmplID != "" {
+			defaults, err := s.templateDefaults(r.Context(), j.tmplID)
+			if err != nil {
+				s.errLog.Println(err)
+				s.fail(w, r, CodeStorageUnavailable, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			for name, value := range defaults {
+				if _, set := j.details[name]; !set {
+					j.details[name] = value
+				}
+			}
+		}
+		// Work out who the PDF is emailed to before compiling it, so that a delivery that can't be made fails early
+		var delivery *email
+		if j.email != nil {
+			if delivery, err = j.email.prepare(j.details); err != nil {
+				s.fail(w, r, CodeBadRequest, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		// Pull in any files the template \input's from storage that weren't explicitly requested
+		if err = s.resolveDependencies(r.Context(), j.src, workDir); err != nil {
+			if _, ok := err.(*ForbiddenError); ok {
+				s.fail(w, r, CodeForbidden, err.Error(), http.StatusForbidden)
+				return
+			}
+			s.errLog.Println(err)
+			s.fail(w, r, CodeStorageUnavailable, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		env, err := s.compileEnv(j.env)
 		if err != nil {
-			er := &errorResponse{Error: err.Error(), Data: string(pdfPath)}
-			w.Header().Set("Content-Type", "application/json")
-			payload := s.respond(w, er, http.StatusInternalServerError)
+			s.fail(w, r, CodeBadRequest, err.Error(), http.StatusBadRequest)
+			return
+		}
+		env = s.libraryEnv(env)
+		if j.deterministic {
+			env = deterministicEnv(env)
+		}
+		// Resolve any secrets the details refer to; only registered templates may use them, and only those stored with
+		// them, so that callers can't get a hold of them by sending or picking a template that prints them
+		details := j.details
+		if hasSecrets(details) {
+			if j.tmplID == "" {
+				s.fail(w, r, CodeBadRequest, "secrets may only be used with registered templates", http.StatusBadRequest)
+				return
+			}
+			var allowed map[string]bool
+			allowed, err = s.templateSecrets(r.Context(), j.tmplID)
+			if err == nil {
+				details, err = s.resolveSecrets(r.Context(), details, allowed)
+			}
+			switch err.(type) {
+			case nil:
+			case *SecretError:
+				s.fail(w, r, CodeSecretUnavailable, err.Error(), http.StatusBadRequest)
+				return
+			default:
+				s.errLog.Println(err)
+				s.fail(w, r, CodeSecretUnavailable, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		ts, err := s.typesetterFor(j.tmplID, j.typesetter, j.engine)
+		if err != nil {
+			s.fail(w, r, CodeBadRequest, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// Theres no point starting a compilation no one is waiting for
+		if errors.Is(r.Context().Err(), context.Canceled) {
+			s.infoLog.Printf("not compiling %s: client went away", filepath.Base(workDir))
+			return
+		}
+		// Wait for a slot to compile in; asynchronous jobs already waited in a queue of their own, so they aren't turned away
+		release, err := s.pool.acquire(r.Context(), r.Context().Value(asyncJobKey{}) == nil)
+		switch {
+		case err == errPoolFull:
+			w.Header().Set("Retry-After", strconv.Itoa(s.pool.retryAfter()))
+			s.fail(w, r, CodeQueueFull, err.Error(), http.StatusTooManyRequests)
+			return
+		case err != nil:
+			s.infoLog.Printf("not compiling %s: client went away", filepath.Base(workDir))
+			return
+		}
+		defer release()
+		// Compile pdf; the compiler is killed if the client goes away or the request times out
+		start := time.Now()
+		compileCtx := r.Context()
+		if j.timeout > 0 {
+			var cancel context.CancelFunc
+			compileCtx, cancel = context.WithTimeout(compileCtx, j.timeout)
+			defer cancel()
+		}
+		atomic.AddInt64(&s.stats.compiling, 1)
+		cj := compile.Job{Template: j.tmpl, Details: details, Dir: j.dir, Env: env, Bibliography: j.bibliography, Sandbox: s.sandbox, Limits: s.limits}
+		if j.rerun {
+			cj.MaxPasses = s.maxPasses
+		}
+		// Those following asynchronous jobs, and WebSocket clients, see the compiler output as it's written
+		var cl *lineLog
+		if send, ok := r.Context().Value(compileLogKey{}).(func(string)); ok {
+			cl = &lineLog{send: send}
+		} else if id, ok := r.Context().Value(asyncJobKey{}).(string); ok && !j.noPersist {
+			cl = &lineLog{send: func(line string) { s.jobs.log(id, line) }}
+		}
+		if cl != nil {
+			cj.Log = cl
+		}
+		// Compilations still running when the server gives up on draining them on shutdown are killed
+		compileCtx, cancelCompile := s.compileContext(compileCtx)
+		defer cancelCompile()
+		compileCtx, sp := s.startSpan(compileCtx, "compile")
+		sp.set("latte.engine", filepath.Base(ts.Engine()))
+		sp.set("latte.template_id", j.tmplID)
+		res, err := ts.Render(compileCtx, cj)
+		if cl != nil {
+			cl.flush()
+		}
+		atomic.AddInt64(&s.stats.compiling, -1)
+		compileTime := time.Since(start)
+		s.tracePhases(compileCtx, res.Phases)
+		sp.set("latte.passes", res.Passes())
+		sp.fail(err)
+		sp.finish()
+		if errors.Is(err, context.Canceled) {
+			// The client went away, so there's no one left to respond to
+			s.recordUsage(r.Context(), 0, res.CPU, true)
+			s.infoLog.Printf("stopped compiling %s after %v: client went away", filepath.Base(workDir), compileTime)
+			return
+		}
+		s.tmplMetrics.record(j.tmplID, compileTime, res.Passes(), err != nil)
+		if err != nil {
+			s.recordUsage(r.Context(), 0, res.CPU, true)
+			w.Header().Set("Server-Timing", serverTiming(res.Phases))
+			s.logSlowCompile(j.tmplID, j.details, workDir, res, true)
+			code, status := CodeCompileFailed, http.StatusInternalServerError
+			switch {
+			case errors.Is(err, context.DeadlineExceeded):
+				// The output is as much of the log as was written before the compiler was killed
+				code, status = CodeEngineTimeout, http.StatusGatewayTimeout
+			case errors.As(err, new(*compile.LimitError)):
+				// The template (or the details it was filled in with) asked for more than the compiler is allowed
+				code, status = CodeResourceLimit, http.StatusUnprocessableEntity
+			case len(res.Phases) == 0:
+				// The template couldn't even be filled in with the details
+				code, status = CodeTemplateExecError, http.StatusUnprocessableEntity
+			}
+			er := &apiError{Code: code, Error: err.Error(), Data: res.Output, Errors: res.Errors}
+			payload := s.failWith(w, r, er, status)
+			// The compilers output quotes the filled in template
+			if j.noPersist {
+				s.errLog.Printf("error while compiling: %v", err)
+				return
+			}
 			s.errLog.Printf("%s", payload)
 			return
 		}
-		pdf, err := os.Open(filepath.Join(workDir, pdfPath))
+		postStart := time.Now()
+		if j.color != nil {
+			err = s.convertColor(r.Context(), filepath.Join(workDir, res.PDF), *j.color, j.deterministic)
+			switch err.(type) {
+			case nil:
+			case *NotFoundError:
+				msg := fmt.Sprintf("icc profile with id %s not found", j.color.ICCProfile)
+				s.fail(w, r, CodeMissingResource, msg, http.StatusBadRequest)
+				return
+			case *ForbiddenError:
+				s.fail(w, r, CodeForbidden, err.Error(), http.StatusForbidden)
+				return
+			default:
+				er := &apiError{Code: CodePostprocessFailed, Error: s.localize(r, "error while converting colors"), Data: err.Error()}
+				payload := s.failWith(w, r, er, http.StatusInternalServerError)
+				s.errLog.Printf("%s", payload)
+				return
+			}
+		}
+		output, err := ioutil.ReadFile(filepath.Join(workDir, res.PDF))
 		if err != nil {
-			w.Header().Set("Content-Type", "application/json")
-			payload := s.respond(w, &errorResponse{Error: "encountered an error"}, http.StatusInternalServerError)
+			payload := s.failWith(w, r, &apiError{Code: CodeInternal, Error: s.localize(r, "encountered an error")}, http.StatusInternalServerError)
 			s.errLog.Printf("%s", payload)
 			return
 		}
+		if j.provenance {
+			var record []byte
+			record, err = s.newProvenance(ts.Engine(), j.tmplID, j.src, j.dtlsID, j.details, env)
+			if err == nil {
+				output, err = pdf.Attach(output, provenanceFile, "application/json", "How this PDF was made", record)
+			}
+			if err != nil {
+				er := &apiError{Code: CodePostprocessFailed, Error: s.localize(r, "error while attaching provenance"), Data: err.Error()}
+				payload := s.failWith(w, r, er, http.StatusInternalServerError)
+				s.errLog.Printf("%s", payload)
+				return
+			}
+		}
+		if j.deterministic {
+			output = pdf.FixID(output)
+		}
+		// Report any fonts that will have to be substituted by whoever ends up viewing or printing the pdf
+		if missing := pdf.UnembeddedFonts(output); len(missing) > 0 {
+			fonts := strings.Join(missing, ", ")
+			if j.requireFonts {
+				er := &apiError{Code: CodeUnembeddedFonts, Error: s.localize(r, "output uses fonts that aren't embedded"), Data: fonts}
+				payload := s.failWith(w, r, er, http.StatusUnprocessableEntity)
+				s.errLog.Printf("%s", payload)
+				return
+			}
+			s.infoLog.Printf("output uses fonts that aren't embedded: %s", fonts)
+			w.Header().Set("X-Latte-Unembedded-Fonts", fonts)
+		}
+		res.Phases = append(res.Phases, compile.Phase{Name: "postprocess", Start: postStart, Duration: time.Since(postStart)})
+		if delivery != nil {
+			deliverStart := time.Now()
+			if err = s.sendEmail(delivery, output); err != nil {
+				er := &apiError{Code: CodeDeliveryFailed, Error: s.localize(r, "error while emailing pdf"), Data: err.Error()}
+				payload := s.failWith(w, r, er, http.StatusBadGateway)
+				s.errLog.Printf("%s", payload)
+				return
+			}
+			res.Phases = append(res.Phases, compile.Phase{Name: "deliver", Start: deliverStart, Duration: time.Since(deliverStart)})
+			s.infoLog.Printf("emailed %s to %d recipients", filepath.Base(workDir), len(delivery.to)+len(delivery.cc)+len(delivery.bcc))
+		}
+		timing := serverTiming(res.Phases)
+		s.infoLog.Printf("compiled %s: %s", filepath.Base(workDir), timing)
+		s.logSlowCompile(j.tmplID, j.details, workDir, res, false)
+		w.Header().Set("Server-Timing", timing)
+		// Archiving is best effort; failing to keep a copy doesn't fail the request that generated it
+		if s.archive != nil && !j.noPersist {
+			doc, err := s.archiveOutput(r, j.tmplID, j.details, j.tags, output, pdf.Pages(output))
+			if err != nil {
+				s.errLog.Printf("error while archiving %s: %v", filepath.Base(workDir), err)
+			} else {
+				w.Header().Set("X-Latte-Archive-ID", doc.ID)
+			}
+		}
+		// PDFs sent to a sink aren't sent back; the response only says where they went
+		if j.output != nil {
+			result, err := s.sendOutput(r.Context(), j.output, output)
+			switch err.(type) {
+			case nil:
+			case *DeliveryError:
+				s.fail(w, r, CodeBadRequest, err.Error(), http.StatusBadRequest)
+				return
+			default:
+				er := &apiError{Code: CodeDeliveryFailed, Error: s.localize(r, "error while sending pdf to %s", j.output.Sink), Data: err.Error()}
+				payload := s.failWith(w, r, er, http.StatusBadGateway)
+				s.errLog.Printf("%s", payload)
+				return
+			}
+			result.Pages = pdf.Pages(output)
+			s.infoLog.Printf("sent %s to %s", filepath.Base(workDir), result.Location)
+			s.recordUsage(r.Context(), len(output), res.CPU, false)
+			w.Header().Set("Content-Type", "application/json")
+			s.respond(w, result, http.StatusOK)
+			return
+		}
+		w.Header().Set("X-Latte-SHA256", sha256Hex(output))
+		w.Header().Set("X-Latte-Pages", strconv.Itoa(pdf.Pages(output)))
+		w.Header().Set("X-Latte-Compile-Ms", strconv.FormatInt(compileTime.Milliseconds(), 10))
+		w.Header().Set("X-Latte-Engine", filepath.Base(ts.Engine()))
+		w.Header().Set("X-Latte-Passes", strconv.Itoa(res.Passes()))
+		if j.cached {
+			w.Header().Set("X-Latte-Cache", "hit")
+		} else {
+			w.Header().Set("X-Latte-Cache", "miss")
+		}
+		s.recordUsage(r.Context(), len(output), res.CPU, false)
+		switch om.mode {
+		case outputBundle:
+			s.sendFiles(w, r, "document.zip", debugFiles(workDir, res, output))
+			return
+		case outputPNG, outputJPEG, outputSVG:
+			s.sendImages(w, r, workDir, res, om, pdf.Pages(output))
+			return
+		}
 		w.Header().Set("Content-Type", "application/pdf")
-		io.Copy(w, pdf)
-		pdf.Close()
-	}, nil
+		w.Header().Set("Content-Length", strconv.Itoa(len(output)))
+		w.Write(output)
+	}
 }
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+)
+
+// wsMessage is a text message telling a WebSocket client how the compilation of what it sent is going.
+type wsMessage struct {
+	// Type is log for each line the compiler writes, done right before the binary message holding the PDF, error if
+	// generating it failed, or canceled if it was superseded by the next request sent before it finished.
+	Type        string `json:"type"`
+	Line        string `json:"line,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Size        int    `json:"size,omitempty"`
+	SHA256      string `json:"sha256,omitempty"`
+	Pages       int    `json:"pages,omitempty"`
+	// Error is the error response /generate would have responded with
+	Error json.RawMessage `json:"error,omitempty"`
+}
+
+// handleGenerateWS generates PDFs over a WebSocket connection, for interactive editors: each message the client sends is
+// a /generate request body, which is answered with the lines the compiler writes as it writes them, and then the PDF as
+// a binary message. The query string of the connection's URL applies to every request (e.g. tmpl=ID). Requests sent
+// while another is compiling supersede it, since editors only care about the latest version of what's being edited.
+func (s *Server) handleGenerateWS() http.HandlerFunc {
+	generate := s.handleGenerate()
+	s.apiSchema("wsMessage", wsMessage{})
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.checkOrigin(r) {
+			s.fail(w, r, CodeForbidden, "websocket connections aren't allowed from "+r.Header.Get("Origin"), http.StatusForbidden)
+			return
+		}
+		c, err := upgradeWebSocket(w, r)
+		if err != nil {
+			if _, ok := err.(*UpgradeError); ok {
+				s.fail(w, r, CodeBadRequest, err.Error(), http.StatusBadRequest)
+				return
+			}
+			s.errLog.Println(err)
+			s.fail(w, r, CodeInternal, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer c.Close()
+		q := r.URL.Query()
+		for _, param := range []string{"access_token", "async", "callback", "callback_pdf"} {
+			q.Del(param)
+		}
+		max := int64(wsMaxMessage)
+		if s.maxBodyBytes > 0 && s.maxBodyBytes < max {
+			max = s.maxBodyBytes
+		}
+		// The connection's context is only done once the client goes away
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		// latest counts the requests sent, so that those superseded before they've started aren't started at all
+		var mu sync.Mutex
+		latest := 0
+		cancelRunning := context.CancelFunc(func() {})
+		type request struct {
+			n    int
+			body []byte
+		}
+		next := make(chan request, 1)
+		go func() {
+			defer close(next)
+			defer cancel()
+			for {
+				_, msg, err := c.read(max)
+				if err != nil {
+					if err != errWSClosed {
+						s.infoLog.Printf("websocket connection closed: %v", err)
+					}
+					return
+				}
+				mu.Lock()
+				latest++
+				n := latest
+				cancelRunning()
+				mu.Unlock()
+				// Only the latest request is worth compiling
+				select {
+				case <-next:
+					c.send(&wsMessage{Type: "canceled"})
+				default:
+				}
+				next <- request{n: n, body: msg}
+			}
+		}()
+		for {
+			select {
+			case <-s.draining.stop.Done():
+				c.closeWith(wsGoingAway, "server is shutting down")
+				return
+			case req, ok := <-next:
+				if !ok {
+					return
+				}
+				jctx, jcancel := context.WithCancel(ctx)
+				mu.Lock()
+				if req.n != latest {
+					jcancel()
+				}
+				cancelRunning = jcancel
+				mu.Unlock()
+				err := s.generateWS(jctx, c, r, generate, q, req.body)
+				jcancel()
+				if err != nil {
+					// The client stopped taking messages
+					if ctx.Err() == nil {
+						s.infoLog.Printf("websocket connection closed: %v", err)
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+// generateWS generates the PDF for a request sent over a WebSocket connection, sending the client its compiler output,
+// and then the PDF, or the error the request failed with.
+func (s *Server) generateWS(ctx context.Context, c *wsConn, r *http.Request, generate http.HandlerFunc, q url.Values, body []byte) error {
+	ctx = context.WithValue(ctx, compileLogKey{}, func(line string) {
+		c.send(&wsMessage{Type: "log", Line: line})
+	})
+	gr := r.Clone(ctx)
+	gr.Method = "POST"
+	gr.URL = &url.URL{Path: "/generate", RawQuery: q.Encode()}
+	gr.Header = http.Header{"Content-Type": {"application/json"}}
+	if lang := r.Header.Get("Accept-Language"); lang != "" {
+		gr.Header.Set("Accept-Language", lang)
+	}
+	gr.Body = ioutil.NopCloser(bytes.NewReader(body))
+	gr.ContentLength = int64(len(body))
+	rb := &responseBuffer{header: http.Header{}}
+	generate(rb, gr)
+	switch {
+	case rb.code == 0:
+		// Generate doesn't respond to requests that went away
+		return c.send(&wsMessage{Type: "canceled"})
+	case rb.code >= 300:
+		msg := &wsMessage{Type: "error", Error: rb.body.Bytes()}
+		if !json.Valid(msg.Error) {
+			msg.Error, _ = json.Marshal(&apiError{Code: CodeInternal, Status: rb.code, Error: rb.body.String()})
+		}
+		return c.send(msg)
+	}
+	pages, _ := strconv.Atoi(rb.header.Get("X-Latte-Pages"))
+	msg := &wsMessage{
+		Type:        "done",
+		ContentType: rb.header.Get("Content-Type"),
+		Size:        rb.body.Len(),
+		SHA256:      rb.header.Get("X-Latte-SHA256"),
+		Pages:       pages,
+	}
+	if err := c.send(msg); err != nil {
+		return err
+	}
+	return c.write(wsBinary, rb.body.Bytes())
+}
+
+// send sends the message as JSON in a text message.
+func (c *wsConn) send(msg *wsMessage) error {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return c.write(wsText, b)
+}
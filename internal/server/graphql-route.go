@@ -0,0 +1,231 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// toGraphQL converts a JSON encodable value into the maps and slices that GraphQL selection sets are applied to.
+func toGraphQL(v interface{}) (interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var out interface{}
+	err = json.Unmarshal(b, &out)
+	return out, err
+}
+
+func fileSHA256(path string) gqlLazy {
+	return func() (interface{}, error) {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		h := sha256.New()
+		if _, err = io.Copy(h, f); err != nil {
+			return nil, err
+		}
+		return hex.EncodeToString(h.Sum(nil)), nil
+	}
+}
+
+func (s *Server) gqlFile(id string, info os.FileInfo) map[string]interface{} {
+	return map[string]interface{}{
+		"id":       id,
+		"size":     info.Size(),
+		"modified": info.ModTime().UTC().Format(time.RFC3339),
+		"sha256":   fileSHA256(filepath.Join(s.rootDir, id)),
+	}
+}
+
+// gqlVisible returns whether the client that made the request may see the registered file with the given id, see
+// checkResourceAccess: files configuring templates or the server are hidden, as are templates it may not render.
+func (s *Server) gqlVisible(ctx context.Context, id string) (bool, error) {
+	err := s.checkResourceAccess(ctx, id)
+	if _, ok := err.(*ForbiddenError); ok {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *Server) gqlResolvers(ctx context.Context) map[string]gqlResolver {
+	return map[string]gqlResolver{
+		// files lists the registered files on local disk, optionally only those whose id starts with prefix
+		"files": func(args map[string]interface{}) (interface{}, error) {
+			prefix, _ := args["prefix"].(string)
+			infos, err := ioutil.ReadDir(s.rootDir)
+			if err != nil {
+				return nil, err
+			}
+			files := []map[string]interface{}{}
+			for _, info := range infos {
+				if !info.Mode().IsRegular() || !strings.HasPrefix(info.Name(), prefix) || checkName(info.Name()) != nil {
+					continue
+				}
+				visible, err := s.gqlVisible(ctx, info.Name())
+				if err != nil {
+					return nil, err
+				}
+				if visible {
+					files = append(files, s.gqlFile(info.Name(), info))
+				}
+			}
+			return files, nil
+		},
+		"file": func(args map[string]interface{}) (interface{}, error) {
+			id, _ := args["id"].(string)
+			if id == "" {
+				return nil, fmt.Errorf("argument id is required")
+			}
+			if err := checkName(id); err != nil {
+				return nil, err
+			}
+			if visible, err := s.gqlVisible(ctx, id); !visible {
+				return nil, err
+			}
+			info, err := os.Stat(filepath.Join(s.rootDir, id))
+			if os.IsNotExist(err) || (err == nil && !info.Mode().IsRegular()) {
+				return nil, nil
+			} else if err != nil {
+				return nil, err
+			}
+			return s.gqlFile(id, info), nil
+		},
+		// templates lists the templates parsed and cached in memory that the client may render
+		"templates": func(args map[string]interface{}) (interface{}, error) {
+			s.tmpls.Lock()
+			tmpls := []map[string]interface{}{}
+			for _, ki := range s.tmpls.t.Keys() {
+				key := ki.(string)
+				tmpls = append(tmpls, map[string]interface{}{"id": s.tmpls.ids[key], "key": key})
+			}
+			s.tmpls.Unlock()
+			visible := tmpls[:0]
+			for _, t := range tmpls {
+				err := s.checkTemplateAccess(ctx, t["id"].(string), aclRender)
+				switch err.(type) {
+				case nil:
+					visible = append(visible, t)
+				case *ForbiddenError:
+				default:
+					return nil, err
+				}
+			}
+			sort.Slice(visible, func(i, j int) bool { return visible[i]["key"].(string) < visible[j]["key"].(string) })
+			return visible, nil
+		},
+		// resources lists the resources cached in memory that the client may use
+		"resources": func(args map[string]interface{}) (interface{}, error) {
+			s.rscs.Lock()
+			var ids []string
+			for _, ki := range s.rscs.r.Keys() {
+				ids = append(ids, ki.(string))
+			}
+			s.rscs.Unlock()
+			sort.Strings(ids)
+			rscs := []map[string]interface{}{}
+			for _, id := range ids {
+				visible, err := s.gqlVisible(ctx, id)
+				if err != nil {
+					return nil, err
+				}
+				if visible {
+					rscs = append(rscs, map[string]interface{}{"id": id, "sha256": fileSHA256(filepath.Join(s.rootDir, id))})
+				}
+			}
+			return rscs, nil
+		},
+		// jobs lists the asynchronous jobs, oldest first, and job gets the one with the given id; clients only see
+		// those of their tenant, like at "/jobs/{id}"
+		"jobs": func(args map[string]interface{}) (interface{}, error) {
+			if s.jobs == nil {
+				return []interface{}{}, nil
+			}
+			p := principalFrom(ctx)
+			return toGraphQL(s.jobs.list(func(j *asyncJob) bool { return jobVisible(p, j) }))
+		},
+		"job": func(args map[string]interface{}) (interface{}, error) {
+			id, _ := args["id"].(string)
+			if id == "" {
+				return nil, fmt.Errorf("argument id is required")
+			}
+			if s.jobs == nil {
+				return nil, nil
+			}
+			job := s.jobs.get(id)
+			if job == nil || !jobVisible(principalFrom(ctx), job) {
+				return nil, nil
+			}
+			return toGraphQL(job)
+		},
+		"cache": func(args map[string]interface{}) (interface{}, error) {
+			s.tmpls.Lock()
+			tStats := s.tmpls.stats(s.tmpls.t.Len(), s.tCacheSize)
+			s.tmpls.Unlock()
+			s.rscs.Lock()
+			rStats := s.rscs.stats(s.rscs.r.Len(), s.rCacheSize)
+			s.rscs.Unlock()
+			disk, err := s.diskUsage()
+			if err != nil {
+				return nil, err
+			}
+			return toGraphQL(map[string]interface{}{"templates": tStats, "resources": rStats, "disk": disk})
+		},
+	}
+}
+
+func (s *Server) handleGraphQL() http.HandlerFunc {
+	type request struct {
+		Query     string                 `json:"query"`
+		Variables map[string]interface{} `json:"variables,omitempty"`
+	}
+	type response struct {
+		Data   map[string]interface{} `json:"data"`
+		Errors []map[string]string    `json:"errors,omitempty"`
+	}
+	s.apiSchema("graphqlRequest", request{})
+	s.apiSchema("graphqlResponse", response{})
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req request
+		if r.Method == http.MethodGet {
+			req.Query = r.URL.Query().Get("query")
+			if vars := r.URL.Query().Get("variables"); vars != "" {
+				if err := json.Unmarshal([]byte(vars), &req.Variables); err != nil {
+					s.fail(w, r, CodeBadRequest, "error while parsing variables: "+err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+		} else if err := s.decode(r.Body, &req); err != nil {
+			msg := "error while parsing json body: " + err.Error()
+			s.errLog.Println(msg)
+			s.fail(w, r, CodeInvalidJSON, msg, http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		sel, err := parseGraphQL(req.Query, req.Variables)
+		if err != nil {
+			s.respond(w, &response{Errors: []map[string]string{{"message": err.Error()}}}, http.StatusBadRequest)
+			return
+		}
+		var resp response
+		var errs []string
+		resp.Data, errs = executeGraphQL(sel, s.gqlResolvers(r.Context()))
+		for _, e := range errs {
+			resp.Errors = append(resp.Errors, map[string]string{"message": e})
+		}
+		s.respond(w, &resp, http.StatusOK)
+	}
+}
@@ -0,0 +1,314 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// This file implements the small subset of GraphQL needed by the read-only /graphql endpoint:
+// queries made of (optionally aliased) fields with arguments, variables and nested selection sets.
+// Fragments, directives and mutations are not supported.
+
+type gqlField struct {
+	alias string
+	name  string
+	args  map[string]interface{}
+	sel   []gqlField
+}
+
+type gqlParser struct {
+	src  string
+	pos  int
+	vars map[string]interface{}
+}
+
+func parseGraphQL(src string, vars map[string]interface{}) ([]gqlField, error) {
+	p := &gqlParser{src: src, vars: vars}
+	p.skip()
+	// Skip over the operation type and name (and variable definitions) if present
+	if p.peek() != '{' {
+		if op := p.name(); op != "query" {
+			return nil, fmt.Errorf("unsupported operation: %s", op)
+		}
+		p.skip()
+		if isNameStart(p.peek()) {
+			p.name()
+			p.skip()
+		}
+		if p.peek() == '(' {
+			if i := strings.IndexByte(p.src[p.pos:], ')'); i >= 0 {
+				p.pos += i + 1
+			}
+			p.skip()
+		}
+	}
+	sel, err := p.selectionSet()
+	if err != nil {
+		return nil, err
+	}
+	if p.skip(); p.pos < len(p.src) {
+		return nil, p.errorf("unexpected %q after query", p.src[p.pos])
+	}
+	return sel, nil
+}
+
+func (p *gqlParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("graphql syntax error at offset %d: %s", p.pos, fmt.Sprintf(format, args...))
+}
+
+// skip advances past whitespace, commas and comments.
+func (p *gqlParser) skip() {
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		switch {
+		case c == '#':
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' {
+				p.pos++
+			}
+		case c == ',' || unicode.IsSpace(rune(c)):
+			p.pos++
+		default:
+			return
+		}
+	}
+}
+
+func (p *gqlParser) peek() byte {
+	if p.pos < len(p.src) {
+		return p.src[p.pos]
+	}
+	return 0
+}
+
+func (p *gqlParser) expect(c byte) error {
+	p.skip()
+	if p.peek() != c {
+		return p.errorf("expected %q", c)
+	}
+	p.pos++
+	return nil
+}
+
+func isNameStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func (p *gqlParser) name() string {
+	start := p.pos
+	for p.pos < len(p.src) && (isNameStart(p.src[p.pos]) || (p.src[p.pos] >= '0' && p.src[p.pos] <= '9')) {
+		p.pos++
+	}
+	return p.src[start:p.pos]
+}
+
+func (p *gqlParser) selectionSet() ([]gqlField, error) {
+	if err := p.expect('{'); err != nil {
+		return nil, err
+	}
+	var fields []gqlField
+	for {
+		p.skip()
+		if p.peek() == '}' {
+			p.pos++
+			break
+		}
+		if !isNameStart(p.peek()) {
+			return nil, p.errorf("expected field name")
+		}
+		f := gqlField{name: p.name()}
+		p.skip()
+		if p.peek() == ':' {
+			p.pos++
+			p.skip()
+			f.alias = f.name
+			if f.name = p.name(); f.name == "" {
+				return nil, p.errorf("expected field name after alias")
+			}
+			p.skip()
+		}
+		if p.peek() == '(' {
+			p.pos++
+			f.args = map[string]interface{}{}
+			for {
+				p.skip()
+				if p.peek() == ')' {
+					p.pos++
+					break
+				}
+				arg := p.name()
+				if arg == "" {
+					return nil, p.errorf("expected argument name")
+				}
+				if err := p.expect(':'); err != nil {
+					return nil, err
+				}
+				p.skip()
+				v, err := p.value()
+				if err != nil {
+					return nil, err
+				}
+				f.args[arg] = v
+			}
+			p.skip()
+		}
+		if p.peek() == '{' {
+			sel, err := p.selectionSet()
+			if err != nil {
+				return nil, err
+			}
+			f.sel = sel
+		}
+		fields = append(fields, f)
+	}
+	if len(fields) == 0 {
+		return nil, p.errorf("empty selection set")
+	}
+	return fields, nil
+}
+
+func (p *gqlParser) value() (interface{}, error) {
+	c := p.peek()
+	switch {
+	case c == '$':
+		p.pos++
+		name := p.name()
+		v, ok := p.vars[name]
+		if !ok {
+			return nil, fmt.Errorf("variable $%s was not provided", name)
+		}
+		return v, nil
+	case c == '"':
+		start := p.pos
+		p.pos++
+		for p.pos < len(p.src) && p.src[p.pos] != '"' {
+			if p.src[p.pos] == '\\' {
+				p.pos++
+			}
+			p.pos++
+		}
+		if p.pos >= len(p.src) {
+			return nil, p.errorf("unterminated string")
+		}
+		p.pos++
+		return strconv.Unquote(p.src[start:p.pos])
+	case c == '-' || (c >= '0' && c <= '9'):
+		start := p.pos
+		p.pos++
+		for p.pos < len(p.src) && strings.IndexByte("0123456789.eE+-", p.src[p.pos]) >= 0 {
+			p.pos++
+		}
+		return strconv.ParseFloat(p.src[start:p.pos], 64)
+	case isNameStart(c):
+		switch n := p.name(); n {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "null":
+			return nil, nil
+		default:
+			// Enum values are passed along as strings
+			return n, nil
+		}
+	}
+	return nil, p.errorf("unsupported value")
+}
+
+// gqlResolver resolves a root field given its arguments.
+// The returned value should be made of maps, slices and scalars; selection sets are applied to it afterwards.
+type gqlResolver func(args map[string]interface{}) (interface{}, error)
+
+func executeGraphQL(sel []gqlField, resolvers map[string]gqlResolver) (map[string]interface{}, []string) {
+	data := map[string]interface{}{}
+	var errs []string
+	for _, f := range sel {
+		key := f.alias
+		if key == "" {
+			key = f.name
+		}
+		resolve, ok := resolvers[f.name]
+		if !ok {
+			errs = append(errs, fmt.Sprintf("cannot query field %q on type Query", f.name))
+			continue
+		}
+		v, err := resolve(f.args)
+		if err == nil {
+			v, err = project(v, f)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", key, err))
+			data[key] = nil
+			continue
+		}
+		data[key] = v
+	}
+	return data, errs
+}
+
+// gqlLazy is a value that is only computed if it's selected.
+type gqlLazy func() (interface{}, error)
+
+// project applies the fields selection set to the resolved value.
+func project(v interface{}, f gqlField) (interface{}, error) {
+	if lazy, ok := v.(gqlLazy); ok {
+		var err error
+		if v, err = lazy(); err != nil {
+			return nil, err
+		}
+	}
+	switch t := v.(type) {
+	case nil:
+		// Fields that resolved to nothing are null whatever is selected of them
+		return nil, nil
+	case []map[string]interface{}:
+		list := make([]interface{}, len(t))
+		for i, item := range t {
+			var err error
+			if list[i], err = project(item, f); err != nil {
+				return nil, err
+			}
+		}
+		return list, nil
+	case []interface{}:
+		list := make([]interface{}, len(t))
+		for i, item := range t {
+			var err error
+			if list[i], err = project(item, f); err != nil {
+				return nil, err
+			}
+		}
+		return list, nil
+	case map[string]interface{}:
+		if len(f.sel) == 0 {
+			fields := make([]string, 0, len(t))
+			for k := range t {
+				fields = append(fields, k)
+			}
+			sort.Strings(fields)
+			return nil, fmt.Errorf("field %q must have a selection of subfields: %s", f.name, strings.Join(fields, ", "))
+		}
+		out := map[string]interface{}{}
+		for _, sf := range f.sel {
+			key := sf.alias
+			if key == "" {
+				key = sf.name
+			}
+			sv, ok := t[sf.name]
+			if !ok {
+				return nil, fmt.Errorf("cannot query field %q on %q", sf.name, f.name)
+			}
+			var err error
+			if out[key], err = project(sv, sf); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	}
+	if len(f.sel) > 0 {
+		return nil, fmt.Errorf("field %q is a scalar and can't have a selection of subfields", f.name)
+	}
+	return v, nil
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestGraphQLScopesToClient(t *testing.T) {
+	s := newTestServer(t, Config{})
+	files := map[string]string{
+		"public.tex":     "public",
+		"secret.tex":     "secret",
+		"secret.tex.acl": `{"render": ["tenant:other"]}`,
+		"public.tex.env": `{"TOKEN": "hunter2"}`,
+	}
+	for id, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(s.rootDir, id), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.jobs.jobs["mine"] = &asyncJob{ID: "mine", Created: time.Now(), tenant: "acme"}
+	s.jobs.jobs["theirs"] = &asyncJob{ID: "theirs", Created: time.Now(), tenant: "other"}
+
+	p := &principal{subject: "alice", tenant: "acme", permissions: map[string]bool{PermRead: true}}
+	ctx := context.WithValue(context.Background(), principalKey{}, p)
+	sel, err := parseGraphQL(`{ files { id } file(id: "secret.tex") { id } jobs { id } job(id: "theirs") { id } }`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, errs := executeGraphQL(sel, s.gqlResolvers(ctx))
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	expected := map[string]interface{}{
+		"files": []interface{}{map[string]interface{}{"id": "public.tex"}},
+		"file":  nil,
+		"jobs":  []interface{}{map[string]interface{}{"id": "mine"}},
+		"job":   nil,
+	}
+	for field, want := range expected {
+		if got := data[field]; !reflect.DeepEqual(normalizeGraphQL(t, got), want) {
+			t.Errorf("expected %s to be %v, got %v", field, want, got)
+		}
+	}
+}
+
+// normalizeGraphQL turns typed slices and maps into the generic ones the expectations are written with.
+func normalizeGraphQL(t *testing.T, v interface{}) interface{} {
+	t.Helper()
+	out, err := toGraphQL(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
@@ -0,0 +1,277 @@
+package server
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HMACConfig configures verifying requests signed with a secret shared between LaTTe and each of its clients.
+type HMACConfig struct {
+	// File is the path of a JSON file mapping client ids to their secrets.
+	File string
+	// Required rejects requests that aren't signed; otherwise only the signatures of signed requests are verified.
+	Required bool
+	// MaxSkew is how far the timestamp of a request may be from the servers clock. Defaults to 5 minutes.
+	MaxSkew time.Duration
+}
+
+// signatures verifies request signatures and keeps track of those it has seen, so that requests can't be replayed.
+type signatures struct {
+	secrets  map[string][]byte
+	required bool
+	maxSkew  time.Duration
+	// seen maps the signatures of recent requests to when they can be forgotten, which is once their timestamp is too old to be accepted
+	seen map[string]time.Time
+	sync.Mutex
+}
+
+func (s *Server) loadHMAC(cfg *HMACConfig) error {
+	if cfg == nil || cfg.File == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(cfg.File)
+	if err != nil {
+		return err
+	}
+	var secrets map[string]string
+	if err = json.Unmarshal(data, &secrets); err != nil {
+		return fmt.Errorf("error while decoding hmac secrets: %v", err)
+	}
+	s.signatures = &signatures{
+		secrets:  map[string][]byte{},
+		required: cfg.Required,
+		maxSkew:  cfg.MaxSkew,
+		seen:     map[string]time.Time{},
+	}
+	if s.signatures.maxSkew <= 0 {
+		s.signatures.maxSkew = 5 * time.Minute
+	}
+	for client, secret := range secrets {
+		s.signatures.secrets[client] = []byte(secret)
+	}
+	return nil
+}
+
+// sign returns the hex encoded signature of a request; the timestamp, method and path (with its query) of the request are
+// signed along with its body so that a signed body can't be sent to a different route.
+func sign(secret []byte, timestamp, method, uri string, body []byte) string {
+	mac := signer(secret, timestamp, method, uri)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signer returns the HMAC of a request that's yet to be written its body, see sign.
+func signer(secret []byte, timestamp, method, uri string) hash.Hash {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n", timestamp, method, uri)
+	return mac
+}
+
+// SignatureError is returned when reading the body of a signed request that doesn't match its signature.
+type SignatureError struct {
+	msg string
+}
+
+func (e *SignatureError) Error() string {
+	return e.msg
+}
+
+// signedBody is the body of a signed request, which is hashed as it's read rather than being held in memory to be verified.
+// Once it's been read to the end, reading it fails with a *SignatureError rather than io.EOF if the request doesn't match
+// its signature, or has already been received.
+type signedBody struct {
+	io.ReadCloser
+	sigs      *signatures
+	mac       hash.Hash
+	signature string
+	sent      time.Time
+	checked   bool
+	err       error
+}
+
+func (b *signedBody) Read(p []byte) (int, error) {
+	if b.checked {
+		if b.err != nil {
+			return 0, b.err
+		}
+		return 0, io.EOF
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.mac.Write(p[:n])
+	if err == io.EOF {
+		b.checked = true
+		if b.err = b.sigs.match(b.signature, hex.EncodeToString(b.mac.Sum(nil)), b.sent); b.err != nil {
+			err = b.err
+		}
+	}
+	return n, err
+}
+
+// finish reads whatever's left of the body, returning why the request isn't valid if it isn't.
+func (b *signedBody) finish() error {
+	if _, err := io.Copy(ioutil.Discard, b); err != nil {
+		return err
+	}
+	return b.err
+}
+
+// drainBody reads the rest of r, so that the signature of a signed request is checked before what was read of its body is acted upon.
+func drainBody(r io.Reader) error {
+	_, err := io.Copy(ioutil.Discard, r)
+	return err
+}
+
+// open checks the headers of a signed request, returning its body wrapped so that it's checked against the signature as it's read.
+func (sigs *signatures) open(r *http.Request) (*signedBody, error) {
+	client := r.Header.Get("X-Latte-Client")
+	timestamp := r.Header.Get("X-Latte-Timestamp")
+	secret, ok := sigs.secrets[client]
+	if !ok {
+		return nil, fmt.Errorf("unknown client: %s", client)
+	}
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timestamp: %s", timestamp)
+	}
+	now := time.Now()
+	sent := time.Unix(ts, 0)
+	if sent.Before(now.Add(-sigs.maxSkew)) || sent.After(now.Add(sigs.maxSkew)) {
+		return nil, fmt.Errorf("timestamp is more than %s away from the servers time", sigs.maxSkew)
+	}
+	return &signedBody{
+		ReadCloser: r.Body,
+		sigs:       sigs,
+		mac:        signer(secret, timestamp, r.Method, r.URL.RequestURI()),
+		signature:  strings.TrimPrefix(r.Header.Get("X-Latte-Signature"), "sha256="),
+		sent:       sent,
+	}, nil
+}
+
+// match checks the signature of a request against the expected one, and that it hasn't been received before.
+func (sigs *signatures) match(signature, expected string, sent time.Time) error {
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return &SignatureError{msg: "signature does not match"}
+	}
+	sigs.Lock()
+	defer sigs.Unlock()
+	now := time.Now()
+	for sig, expires := range sigs.seen {
+		if now.After(expires) {
+			delete(sigs.seen, sig)
+		}
+	}
+	if _, replayed := sigs.seen[signature]; replayed {
+		return &SignatureError{msg: "request has already been received"}
+	}
+	sigs.seen[signature] = sent.Add(sigs.maxSkew)
+	return nil
+}
+
+// signedResponse holds back the response to a signed request until its body has been checked against the signature,
+// reading whatever the handler left of it first, so that handlers that don't read the whole body of a request (or any
+// of it) can't respond to one that isn't signed properly.
+type signedResponse struct {
+	http.ResponseWriter
+	s        *Server
+	r        *http.Request
+	body     *signedBody
+	checked  bool
+	rejected bool
+}
+
+// check checks the body against the signature, if it hasn't been already, failing the request if it doesn't match.
+// It returns whether the handler may respond.
+func (sr *signedResponse) check() bool {
+	if sr.checked {
+		return !sr.rejected
+	}
+	sr.checked = true
+	err := sr.body.finish()
+	switch err.(type) {
+	case nil:
+		return true
+	case *TooLargeError:
+		sr.s.fail(sr.ResponseWriter, sr.r, CodeTooLarge, err.Error(), http.StatusRequestEntityTooLarge)
+	default:
+		sr.s.fail(sr.ResponseWriter, sr.r, CodeInvalidSignature, "invalid signature: "+err.Error(), http.StatusUnauthorized)
+	}
+	sr.rejected = true
+	return false
+}
+
+func (sr *signedResponse) WriteHeader(code int) {
+	if sr.check() {
+		sr.ResponseWriter.WriteHeader(code)
+	}
+}
+
+func (sr *signedResponse) Write(p []byte) (int, error) {
+	if !sr.check() {
+		return 0, errors.New("response withheld: request isn't signed properly")
+	}
+	return sr.ResponseWriter.Write(p)
+}
+
+func (sr *signedResponse) Flush() {
+	if !sr.check() {
+		return
+	}
+	if f, ok := sr.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack lets handlers take over the connection, e.g. for WebSockets.
+func (sr *signedResponse) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if !sr.check() {
+		return nil, nil, errors.New("request isn't signed properly")
+	}
+	hj, ok := sr.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("taking over connections isn't supported")
+	}
+	return hj.Hijack()
+}
+
+// verifySignature wraps the handler so that signed requests have their signature verified, and unsigned requests
+// are rejected if signatures are required. If the server doesn't verify signatures, the handler is returned as is.
+// The body is verified as it's read, see signedBody and signedResponse.
+func (s *Server) verifySignature(h http.HandlerFunc) http.HandlerFunc {
+	if s.signatures == nil {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Latte-Signature") == "" {
+			if s.signatures.required {
+				s.fail(w, r, CodeInvalidSignature, "request is not signed", http.StatusUnauthorized)
+				return
+			}
+			h(w, r)
+			return
+		}
+		body, err := s.signatures.open(r)
+		if err != nil {
+			s.fail(w, r, CodeInvalidSignature, "invalid signature: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+		r.Body = body
+		sr := &signedResponse{ResponseWriter: w, s: s, r: r, body: body}
+		h(sr, r)
+		// Handlers that don't write anything are responded to with a 200 all the same
+		sr.check()
+	}
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// newTestServer returns a server rooted in a temporary directory, without a db.
+func newTestServer(t *testing.T, cfg Config) *Server {
+	t.Helper()
+	if cfg.Cache.TmplSize == 0 {
+		cfg.Cache.TmplSize, cfg.Cache.RscSize = 5, 5
+	}
+	l := log.New(ioutil.Discard, "", 0)
+	s, err := NewServer(t.TempDir(), "pdflatex", nil, l, l, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func newHMACServer(t *testing.T, required bool) *Server {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "hmac.json")
+	if err := ioutil.WriteFile(file, []byte(`{"ci": "s3cret"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return newTestServer(t, Config{HMAC: &HMACConfig{File: file, Required: required}})
+}
+
+// signedRequest returns a request signed by the client with the secret, as of the given time.
+func signedRequest(client, secret, method, uri string, body []byte, at time.Time) *http.Request {
+	r := httptest.NewRequest(method, uri, bytes.NewReader(body))
+	ts := strconv.FormatInt(at.Unix(), 10)
+	r.Header.Set("X-Latte-Client", client)
+	r.Header.Set("X-Latte-Timestamp", ts)
+	r.Header.Set("X-Latte-Signature", "sha256="+sign([]byte(secret), ts, method, r.URL.RequestURI(), body))
+	return r
+}
+
+func TestVerifySignature(t *testing.T) {
+	body := []byte(`{"template": "aGk="}`)
+	// reads echoes the body back, like handlers that act on what they've read
+	reads := func(w http.ResponseWriter, r *http.Request) {
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return
+		}
+		w.Write(data)
+	}
+	// ignores responds without reading the body at all
+	ignores := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}
+	tampered := func(r *http.Request) *http.Request {
+		r.Body = ioutil.NopCloser(bytes.NewReader([]byte(`{"template": "ZXZpbA=="}`)))
+		return r
+	}
+	now := time.Now()
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		req     *http.Request
+		status  int
+	}{
+		{"valid", reads, signedRequest("ci", "s3cret", "POST", "/generate?tmpl=a", body, now), http.StatusOK},
+		{"valid unread", ignores, signedRequest("ci", "s3cret", "POST", "/generate?tmpl=a", body, now), http.StatusOK},
+		{"within skew", reads, signedRequest("ci", "s3cret", "POST", "/generate", body, now.Add(-time.Minute)), http.StatusOK},
+		{"tampered", reads, tampered(signedRequest("ci", "s3cret", "POST", "/generate", body, now)), http.StatusUnauthorized},
+		{"tampered unread", ignores, tampered(signedRequest("ci", "s3cret", "POST", "/generate", body, now)), http.StatusUnauthorized},
+		{"wrong secret", reads, signedRequest("ci", "guess", "POST", "/generate", body, now), http.StatusUnauthorized},
+		{"unknown client", reads, signedRequest("eve", "s3cret", "POST", "/generate", body, now), http.StatusUnauthorized},
+		{"stale", reads, signedRequest("ci", "s3cret", "POST", "/generate", body, now.Add(-time.Hour)), http.StatusUnauthorized},
+		{"future", reads, signedRequest("ci", "s3cret", "POST", "/generate", body, now.Add(time.Hour)), http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newHMACServer(t, true)
+			w := httptest.NewRecorder()
+			s.verifySignature(tt.handler)(w, tt.req)
+			if w.Code != tt.status {
+				t.Fatalf("expected status %d, got %d: %s", tt.status, w.Code, w.Body)
+			}
+			if tt.status == http.StatusOK && w.Body.Len() == 0 {
+				t.Error("expected the handler's response to be sent")
+			}
+			if tt.status != http.StatusOK && bytes.Contains(w.Body.Bytes(), []byte("ZXZpbA")) {
+				t.Error("expected the handler's response to be withheld")
+			}
+		})
+	}
+}
+
+func TestVerifySignatureRoute(t *testing.T) {
+	s := newHMACServer(t, true)
+	h := s.verifySignature(func(w http.ResponseWriter, r *http.Request) {})
+	// The signature covers the method and path, so a signed body can't be sent elsewhere
+	r := signedRequest("ci", "s3cret", "POST", "/generate", []byte("{}"), time.Now())
+	r.URL.Path = "/templates/a"
+	r.RequestURI = "/templates/a"
+	w := httptest.NewRecorder()
+	h(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected request sent to another route to be rejected, got %d", w.Code)
+	}
+}
+
+func TestVerifySignatureReplay(t *testing.T) {
+	s := newHMACServer(t, true)
+	h := s.verifySignature(func(w http.ResponseWriter, r *http.Request) {})
+	now := time.Now()
+	for i, want := range []int{http.StatusOK, http.StatusUnauthorized} {
+		w := httptest.NewRecorder()
+		h(w, signedRequest("ci", "s3cret", "POST", "/generate", []byte("{}"), now))
+		if w.Code != want {
+			t.Fatalf("request %d: expected status %d, got %d", i, want, w.Code)
+		}
+	}
+}
+
+func TestVerifySignatureUnsigned(t *testing.T) {
+	for _, required := range []bool{true, false} {
+		s := newHMACServer(t, required)
+		called := false
+		w := httptest.NewRecorder()
+		s.verifySignature(func(w http.ResponseWriter, r *http.Request) { called = true })(w, httptest.NewRequest("GET", "/templates", nil))
+		if called == required {
+			t.Errorf("required %v: expected handler to be called %v", required, !required)
+		}
+		if required && w.Code != http.StatusUnauthorized {
+			t.Errorf("expected unsigned request to be rejected with a 401, got %d", w.Code)
+		}
+	}
+}
+
+func TestSignedBody(t *testing.T) {
+	s := newHMACServer(t, true)
+	r := signedRequest("ci", "s3cret", "POST", "/generate", []byte("signed"), time.Now())
+	r.Body = ioutil.NopCloser(bytes.NewReader([]byte("forged")))
+	body, err := s.signatures.open(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(body); err == nil {
+		t.Fatal("expected reading a body that doesn't match its signature to fail")
+	} else if _, ok := err.(*SignatureError); !ok {
+		t.Fatalf("expected a *SignatureError, got %T: %v", err, err)
+	}
+	// The body keeps failing once it's been read to the end
+	if _, err := body.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expected reading past the end to keep failing")
+	}
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/raphaelreyna/latte/internal/compile"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// imageConversion converts images in formats pdfLaTeX can't include into ones it can.
+type imageConversion struct {
+	from []string
+	to   string
+	// commands are tried in order, the first one whose binary is installed is used.
+	// Arguments that are exactly IN or OUT are replaced with the names of the input and output files.
+	commands [][]string
+}
+
+// imageConversionTimeout bounds how long converting an image may take if compilations aren't given a timeout.
+const imageConversionTimeout = 2 * time.Minute
+
+var imageConversions = []imageConversion{
+	{
+		from: []string{".svg"},
+		to:   ".pdf",
+		commands: [][]string{
+			{"rsvg-convert", "-f", "pdf", "-o", "OUT", "IN"},
+			{"inkscape", "--export-filename", "OUT", "IN"},
+		},
+	},
+	{
+		from: []string{".webp", ".heic", ".heif"},
+		to:   ".png",
+		commands: [][]string{
+			{"magick", "IN", "OUT"},
+			{"convert", "IN", "OUT"},
+		},
+	},
+	{
+		// pdfLaTeX can't include TIFFs at all; going through PDF keeps CMYK images in CMYK
+		from: []string{".tif", ".tiff"},
+		to:   ".pdf",
+		commands: [][]string{
+			{"magick", "IN", "OUT"},
+			{"convert", "IN", "OUT"},
+		},
+	},
+}
+
+// convertImage converts the image at path (if its in a format that needs converting), writing the result alongside it
+// with the extension swapped, e.g. logo.svg becomes logo.pdf so that \includegraphics{logo} just works.
+// It returns the path of the converted image, or an empty string if no conversion was needed or possible.
+func (s *Server) convertImage(ctx context.Context, path string) (string, error) {
+	if !s.convertImages {
+		return "", nil
+	}
+	ext := strings.ToLower(filepath.Ext(path))
+	for _, ic := range imageConversions {
+		matches := false
+		for _, from := range ic.from {
+			matches = matches || ext == from
+		}
+		if !matches {
+			continue
+		}
+		for _, command := range ic.commands {
+			if _, err := exec.LookPath(command[0]); err != nil {
+				continue
+			}
+			out := strings.TrimSuffix(path, filepath.Ext(path)) + ic.to
+			if err := s.runConversion(ctx, command, path, ext, out, ic.to); err != nil {
+				return "", fmt.Errorf("error while converting %s to %s: %v", filepath.Base(path), ic.to, err)
+			}
+			return out, nil
+		}
+		s.infoLog.Printf("no converter installed for %s images; leaving %s as is", ext, filepath.Base(path))
+	}
+	return "", nil
+}
+
+// runConversion runs a command converting the image at path to out, in a working directory of its own holding only a
+// copy of the image, and inside of the sandbox and within the limits compilations are, since images are as untrusted
+// as templates and converters have had their share of vulnerabilities.
+func (s *Server) runConversion(ctx context.Context, command []string, path, from, out, to string) error {
+	dir, err := s.newWorkDir()
+	if err != nil {
+		return err
+	}
+	defer s.removeWorkDir(dir, false)
+	// Fixed names keep the converters from reading anything into the image's id, e.g. ImageMagick's format prefixes
+	in, converted := "input"+from, "output"+to
+	if err = copyFile(path, filepath.Join(dir, in)); err != nil {
+		return err
+	}
+	args := make([]string, len(command)-1)
+	for i, arg := range command[1:] {
+		switch arg {
+		case "IN":
+			arg = in
+		case "OUT":
+			arg = converted
+		}
+		args[i] = arg
+	}
+	timeout := s.timeout
+	if timeout <= 0 {
+		timeout = imageConversionTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	job := compile.Job{Dir: dir, Sandbox: s.sandbox, Limits: s.limits}
+	if output, err := job.Run(ctx, command[0], args...); err != nil {
+		return fmt.Errorf("%v: %s", err, output)
+	}
+	return os.Rename(filepath.Join(dir, converted), out)
+}
+
+// ingest finishes registering the file with the given id that was just written to path in the root directory:
+// any derived files (e.g. converted images) are created alongside it, large images are downscaled, and everything is sent to the db.
+// It returns the ids of the derived files.
+func (s *Server) ingest(ctx context.Context, id, path string) ([]string, error) {
+	// Whatever was read of the file before it was replaced is out of date
+	s.forgetSource(id)
+	paths := []string{path}
+	ids := []string{id}
+	converted, err := s.convertImage(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	if converted != "" {
+		paths = append(paths, converted)
+		ids = append(ids, id[:len(id)-len(filepath.Ext(id))]+filepath.Ext(converted))
+		s.infoLog.Printf("converted %s to %s", id, ids[len(ids)-1])
+	}
+	for _, p := range paths {
+		if _, err := s.optimizeImage(p); err != nil {
+			return nil, err
+		}
+	}
+	if s.db != nil {
+		for i, p := range paths {
+			f, err := os.Open(p)
+			if err == nil {
+				err = s.db.Store(ctx, ids[i], f)
+				f.Close()
+			}
+			if err != nil {
+				return nil, err
+			}
+			s.copies.add(ids[i])
+			s.infoLog.Printf("sent new file to database; successfully completed registration: %s", ids[i])
+		}
+	}
+	return ids[1:], nil
+}
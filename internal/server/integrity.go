@@ -0,0 +1,70 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// resourceRef is a reference to a registered resource, optionally pinned to the hash of its contents.
+// References take the form ID or ID@sha256:HEX_ENCODED_DIGEST.
+type resourceRef struct {
+	ID     string
+	Digest string
+}
+
+// MismatchError is returned when a resources contents don't match the hash it was pinned to.
+type MismatchError struct {
+	ID       string
+	Expected string
+	Actual   string
+}
+
+func (me *MismatchError) Error() string {
+	return fmt.Sprintf("resource %s has sha256 %s; expected %s", me.ID, me.Actual, me.Expected)
+}
+
+// parseResourceRef splits a reference into the id and digest it's pinned to, if any.
+// IDs may have @ in them (e.g. signature@2x.png), so only a trailing @sha256: starts a pin.
+func parseResourceRef(ref string) (resourceRef, error) {
+	i := strings.LastIndex(ref, "@sha256:")
+	if i < 0 {
+		return resourceRef{ID: ref}, checkName(ref)
+	}
+	rr := resourceRef{ID: ref[:i]}
+	if err := checkName(rr.ID); err != nil {
+		return rr, err
+	}
+	digest := ref[i+len("@sha256:"):]
+	if len(digest) != 2*sha256.Size {
+		return rr, fmt.Errorf("resource %s pinned with invalid sha256 digest: %s", rr.ID, digest)
+	}
+	if _, err := hex.DecodeString(digest); err != nil {
+		return rr, fmt.Errorf("resource %s pinned with invalid sha256 digest: %s", rr.ID, digest)
+	}
+	rr.Digest = strings.ToLower(digest)
+	return rr, nil
+}
+
+// place copies the file at src to dst, making sure what was copied has the digest the resource was pinned to, if any.
+// Pinned resources are copied rather than linked, so that the contents that were hashed are the ones compiled even if
+// the file at src is replaced in the meantime. If the digest doesn't match, dst is removed.
+func (rr resourceRef) place(src, dst string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = streamToFile(dst, io.TeeReader(f, h)); err != nil {
+		return err
+	}
+	if actual := hex.EncodeToString(h.Sum(nil)); actual != rr.Digest {
+		os.Remove(dst)
+		return &MismatchError{ID: rr.ID, Expected: rr.Digest, Actual: actual}
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseResourceRef(t *testing.T) {
+	digest := strings.Repeat("ab", sha256.Size)
+	tests := []struct {
+		ref    string
+		id     string
+		digest string
+		err    bool
+	}{
+		{ref: "logo.png", id: "logo.png"},
+		{ref: "images/logo.png", id: "images/logo.png"},
+		{ref: "signature@2x.png", id: "signature@2x.png"},
+		{ref: "logo.png@sha256:" + digest, id: "logo.png", digest: digest},
+		{ref: "logo.png@sha256:" + strings.ToUpper(digest), id: "logo.png", digest: digest},
+		{ref: "signature@2x.png@sha256:" + digest, id: "signature@2x.png", digest: digest},
+		{ref: "logo.png@sha256:", err: true},
+		{ref: "logo.png@sha256:abc", err: true},
+		{ref: "logo.png@sha256:" + digest + "00", err: true},
+		{ref: "logo.png@sha256:" + strings.Repeat("zz", sha256.Size), err: true},
+		{ref: "../logo.png@sha256:" + digest, err: true},
+		{ref: "../logo.png", err: true},
+	}
+	for _, tt := range tests {
+		rr, err := parseResourceRef(tt.ref)
+		if tt.err {
+			if err == nil {
+				t.Errorf("expected %q to be rejected", tt.ref)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("expected %q to be accepted, got: %v", tt.ref, err)
+			continue
+		}
+		if rr.ID != tt.id || rr.Digest != tt.digest {
+			t.Errorf("expected %q to be parsed to %s and %q, got %s and %q", tt.ref, tt.id, tt.digest, rr.ID, rr.Digest)
+		}
+	}
+}
+
+func TestResourceRefPlace(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "logo.png")
+	if err := ioutil.WriteFile(src, []byte("logo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte("logo"))
+	dst := filepath.Join(dir, "placed.png")
+	if err := (resourceRef{ID: "logo.png", Digest: hex.EncodeToString(sum[:])}).place(src, dst); err != nil {
+		t.Fatalf("expected resource matching its pin to be placed, got: %v", err)
+	}
+	// The placed copy must not change along with the registered file
+	if err := ioutil.WriteFile(src, []byte("evil"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(dst); err != nil || string(data) != "logo" {
+		t.Errorf("expected the verified contents to be placed, got %q (%v)", data, err)
+	}
+	dst = filepath.Join(dir, "mismatched.png")
+	err := (resourceRef{ID: "logo.png", Digest: hex.EncodeToString(sum[:])}).place(src, dst)
+	me, ok := err.(*MismatchError)
+	if !ok {
+		t.Fatalf("expected a *MismatchError, got %T: %v", err, err)
+	}
+	evil := sha256.Sum256([]byte("evil"))
+	if me.Actual != hex.EncodeToString(evil[:]) {
+		t.Errorf("expected the actual digest to be reported, got %s", me.Actual)
+	}
+	if _, err := os.Stat(dst); !os.IsNotExist(err) {
+		t.Errorf("expected mismatched resources to be removed, got: %v", err)
+	}
+}
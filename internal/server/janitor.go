@@ -0,0 +1,182 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// janitorGrace is how recently used a file may be and still be evicted; files in use by a compilation that's still
+// running are left alone, since removing them would break it.
+const janitorGrace = 10 * time.Minute
+
+// JanitorConfig configures evicting the templates and resources downloaded from the db from the root directory, so
+// that they don't pile up there forever.
+type JanitorConfig struct {
+	// MaxBytes is how large the downloaded files may grow to in total before the least recently used are evicted;
+	// zero leaves them unbounded.
+	MaxBytes int64
+	// MaxAge is how long a downloaded file may go unused before it's evicted; zero keeps files until MaxBytes is reached.
+	MaxAge time.Duration
+	// Interval is how often the root directory is swept. Defaults to a minute.
+	Interval time.Duration
+}
+
+type janitor struct {
+	maxBytes int64
+	maxAge   time.Duration
+	interval time.Duration
+	// used maps the ids of the files known to be copies of what's in the db to when they were last used
+	used map[string]time.Time
+	sync.Mutex
+}
+
+// setupJanitor starts sweeping the root directory in the background, if there's a budget to keep it in.
+// Only files that are copies of what's in the db are evicted, since they can always be downloaded again.
+func (s *Server) setupJanitor(cfg *JanitorConfig) error {
+	if cfg == nil || (cfg.MaxBytes <= 0 && cfg.MaxAge <= 0) {
+		return nil
+	}
+	if s.db == nil {
+		return errors.New("evicting files from the root directory needs a db to download them from again")
+	}
+	s.janitor = &janitor{maxBytes: cfg.MaxBytes, maxAge: cfg.MaxAge, interval: time.Minute, used: map[string]time.Time{}}
+	if cfg.Interval > 0 {
+		s.janitor.interval = cfg.Interval
+	}
+	go func() {
+		for range time.Tick(s.janitor.interval) {
+			s.sweepRoot(context.Background())
+		}
+	}()
+	return nil
+}
+
+// touch records that the file with the given id, a copy of what's in the db, was just used.
+func (j *janitor) touch(id string) {
+	if j == nil {
+		return
+	}
+	j.Lock()
+	j.used[id] = time.Now()
+	j.Unlock()
+}
+
+// forget stops keeping track of the file with the given id, once it's been evicted.
+func (j *janitor) forget(id string) {
+	j.Lock()
+	delete(j.used, id)
+	j.Unlock()
+}
+
+type rootFile struct {
+	id   string
+	size int64
+	used time.Time
+}
+
+// rootFiles returns the files in the root directory known to be copies of what's in the db: those used since the
+// server started, along with those the db lists if it can. Files used before the server started are taken to have
+// been last used when they were downloaded.
+func (s *Server) rootFiles(ctx context.Context) ([]rootFile, error) {
+	s.janitor.Lock()
+	used := make(map[string]time.Time, len(s.janitor.used))
+	for id, t := range s.janitor.used {
+		used[id] = t
+	}
+	s.janitor.Unlock()
+	ids := make([]string, 0, len(used))
+	for id := range used {
+		ids = append(ids, id)
+	}
+	if lister, ok := s.db.(ListDB); ok {
+		listed, err := lister.List(ctx, "")
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, listed...)
+	}
+	var files []rootFile
+	seen := map[string]bool{}
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		fpath, err := joinName(s.rootDir, id)
+		if err != nil {
+			continue
+		}
+		info, err := os.Stat(fpath)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		f := rootFile{id: id, size: info.Size(), used: used[id]}
+		if f.used.IsZero() {
+			f.used = info.ModTime()
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// sweepRoot evicts the files that have gone unused for longer than the max age, then the least recently used until
+// the rest fit in the max size, keeping the in-memory caches consistent with what's left on disk.
+func (s *Server) sweepRoot(ctx context.Context) {
+	files, err := s.rootFiles(ctx)
+	if err != nil {
+		s.errLog.Printf("error while sweeping root directory: %v", err)
+		return
+	}
+	sort.Slice(files, func(i, k int) bool {
+		return files[i].used.Before(files[k].used)
+	})
+	var total int64
+	for _, f := range files {
+		total += f.size
+	}
+	now := time.Now()
+	var evicted int
+	var freed int64
+	for _, f := range files {
+		expired := s.janitor.maxAge > 0 && now.Sub(f.used) > s.janitor.maxAge
+		over := s.janitor.maxBytes > 0 && total > s.janitor.maxBytes
+		if !expired && !over {
+			// Files are sorted from least to most recently used, so none of the rest are either
+			break
+		}
+		if now.Sub(f.used) < janitorGrace {
+			break
+		}
+		if err := s.evictFile(f.id); err != nil {
+			s.errLog.Printf("error while evicting %s from root directory: %v", f.id, err)
+			continue
+		}
+		evicted++
+		freed += f.size
+		total -= f.size
+	}
+	if evicted > 0 {
+		s.infoLog.Printf("evicted %d files (%d bytes) from root directory", evicted, freed)
+	}
+	if s.janitor.maxBytes > 0 && total > s.janitor.maxBytes {
+		s.errLog.Printf("root directory holds %d bytes of recently used files, over its budget of %d", total, s.janitor.maxBytes)
+	}
+}
+
+// evictFile removes the file with the given id from the root directory, along with whatever's cached in memory for
+// it, whether it's a template or a resource.
+func (s *Server) evictFile(id string) error {
+	if _, err := s.evictTemplate(id); err != nil {
+		return err
+	}
+	if _, err := s.evictResource(id); err != nil {
+		return err
+	}
+	s.janitor.forget(id)
+	// The janitor only evicts files it knows to be copies of what's in the db, see rootFiles
+	return s.removeCopy(id)
+}
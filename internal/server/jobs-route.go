@@ -0,0 +1,190 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// sseHeartbeat is how often a comment is sent to those following a job while nothing's happening to it, so that
+// proxies don't close the connection for being idle.
+const sseHeartbeat = 15 * time.Second
+
+// handleAsync lets clients have h handle their request in the background by setting the async query parameter,
+// responding straight away with the job doing so, whose status and result are then fetched from /jobs/{id}.
+// v2 requests are handled in the background unless the async parameter is false, or they mustn't persist anything.
+func (s *Server) handleAsync(h http.HandlerFunc) http.HandlerFunc {
+	s.apiSchema("asyncJob", asyncJob{})
+	return func(w http.ResponseWriter, r *http.Request) {
+		param := r.URL.Query().Get("async")
+		async := apiVersion(r) > 1
+		if param != "" {
+			async, _ = strconv.ParseBool(param)
+		}
+		if !async {
+			h(w, r)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			s.fail(w, r, CodeBadRequest, err.Error(), http.StatusBadRequest)
+			return
+		}
+		r.Body.Close()
+		// Results of jobs are kept until they're fetched, which requests that mustn't persist anything can't allow
+		var persist struct {
+			NoPersist bool `json:"no_persist"`
+		}
+		req := body
+		if ct := r.Header.Get("Content-Type"); isForm(ct) {
+			req = formRequest(ct, body)
+		}
+		json.Unmarshal(req, &persist)
+		if s.noPersist || persist.NoPersist {
+			if param == "" {
+				r.Body = ioutil.NopCloser(bytes.NewReader(body))
+				h(w, r)
+				return
+			}
+			s.fail(w, r, CodeBadRequest, "requests that mustn't persist anything can't be asynchronous", http.StatusBadRequest)
+			return
+		}
+		cb, err := s.jobs.callbackFor(r)
+		if err != nil {
+			s.fail(w, r, CodeBadRequest, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// The job carries on after the client that created it disconnects
+		jr := r.Clone(detachedContext{r.Context()})
+		q := jr.URL.Query()
+		for _, param := range []string{"async", "callback", "callback_pdf"} {
+			q.Del(param)
+		}
+		jr.URL.RawQuery = q.Encode()
+		jr.Body = ioutil.NopCloser(bytes.NewReader(body))
+		job := s.submit(h, jr, cb)
+		if job == nil {
+			s.fail(w, r, CodeQueueFull, "too many jobs are waiting to be run", http.StatusServiceUnavailable)
+			return
+		}
+		s.infoLog.Printf("queued job: %s", job.ID)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", apiPrefix(r)+"/jobs/"+job.ID)
+		s.respond(w, job, http.StatusAccepted)
+	}
+}
+
+// jobVisible returns whether the client authenticated as p may see the job: admins (and everyone, if requests aren't
+// authenticated) see every job, while others only see those of their tenant.
+func jobVisible(p *principal, job *asyncJob) bool {
+	return p == nil || p.can(PermAdmin) || job.tenant == p.tenant
+}
+
+// jobFor returns the job the request is for, responding with an error and returning nil if there isn't one.
+func (s *Server) jobFor(w http.ResponseWriter, r *http.Request) *asyncJob {
+	id := mux.Vars(r)["id"]
+	job := s.jobs.get(id)
+	// Jobs of other tenants are treated as if they don't exist
+	if job != nil && !jobVisible(principalFrom(r.Context()), job) {
+		job = nil
+	}
+	if job == nil {
+		s.fail(w, r, CodeNotFound, "no job with id "+id, http.StatusNotFound)
+	}
+	return job
+}
+
+func (s *Server) handleJobGet() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		job := s.jobFor(w, r)
+		if job == nil {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		s.respond(w, job, http.StatusOK)
+	}
+}
+
+func (s *Server) handleJobPDF() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		job := s.jobFor(w, r)
+		if job == nil {
+			return
+		}
+		if job.PDF == "" {
+			s.fail(w, r, CodeConflict, "job "+job.ID+" is "+job.Status+" and has no PDF", http.StatusConflict)
+			return
+		}
+		data, err := ioutil.ReadFile(s.jobs.path(job.ID))
+		if err != nil {
+			s.errLog.Println(err)
+			s.fail(w, r, CodeStorageUnavailable, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Header().Set("X-Latte-SHA256", job.SHA256)
+		w.Header().Set("X-Latte-Pages", strconv.Itoa(job.Pages))
+		s.respond(w, data, http.StatusOK)
+	}
+}
+
+// handleJobEvents streams the status of the job, every time it changes, and the lines its compiler writes as Server-Sent Events,
+// until the job has finished. Clients reconnecting with a Last-Event-ID header pick up where they left off.
+func (s *Server) handleJobEvents() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		job := s.jobFor(w, r)
+		if job == nil {
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			s.fail(w, r, CodeInternal, "streaming responses isn't supported", http.StatusInternalServerError)
+			return
+		}
+		last, _ := strconv.Atoi(r.Header.Get("Last-Event-ID"))
+		events, ch := s.jobs.follow(job.ID, last)
+		if ch != nil {
+			defer s.jobs.unfollow(job.ID, ch)
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		// Keeps proxies like nginx from buffering the stream
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		var b bytes.Buffer
+		for _, e := range events {
+			writeEvent(&b, e)
+		}
+		heartbeat := time.NewTicker(sseHeartbeat)
+		defer heartbeat.Stop()
+		for {
+			if _, err := w.Write(b.Bytes()); err != nil {
+				return
+			}
+			flusher.Flush()
+			if ch == nil {
+				return
+			}
+			b.Reset()
+			select {
+			case e, ok := <-ch:
+				if !ok {
+					// The job has finished, or the client fell too far behind and has to reconnect
+					return
+				}
+				writeEvent(&b, e)
+			case <-heartbeat.C:
+				b.WriteString(": keepalive\n\n")
+			case <-r.Context().Done():
+				return
+			case <-s.draining.stop.Done():
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,317 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// JobsConfig configures the jobs run for asynchronous requests.
+type JobsConfig struct {
+	// Workers is how many jobs are run at once. Defaults to the number of CPUs.
+	Workers int
+	// Queue is how many jobs may wait to be run before new ones are turned away. Defaults to 1000.
+	Queue int
+	// Expiry is how long jobs, and their results, are kept for after being created. Defaults to 24 hours.
+	Expiry time.Duration
+	// Callbacks lists the URLs the status of finished jobs may be sent to; a URL is allowed if it starts with one of them.
+	Callbacks []string
+	// CallbackSecret signs callbacks, if set, so that receivers can tell they came from LaTTe.
+	CallbackSecret string
+	// CallbackRetries is how many more times delivering a callback is attempted after it fails. Defaults to 5.
+	CallbackRetries int
+}
+
+// Statuses of asynchronous jobs.
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+)
+
+// asyncJob is a request being handled in the background, and the status of it.
+type asyncJob struct {
+	ID        string     `json:"id"`
+	Status    string     `json:"status"`
+	RequestID string     `json:"request_id,omitempty"`
+	Created   time.Time  `json:"created"`
+	Started   *time.Time `json:"started,omitempty"`
+	Finished  *time.Time `json:"finished,omitempty"`
+	// Error is the error response the job failed with
+	Error *apiError `json:"error,omitempty"`
+	// Result is the JSON response of jobs that didn't respond with a PDF, e.g. ones that sent it to a sink
+	Result interface{} `json:"result,omitempty"`
+	// SHA256, Size and Pages describe the PDF of jobs that are done, which is downloaded from PDF
+	SHA256 string `json:"sha256,omitempty"`
+	Size   int    `json:"size,omitempty"`
+	Pages  int    `json:"pages,omitempty"`
+	PDF    string `json:"pdf,omitempty"`
+	// Callback is where the status of the job is sent once it's finished, if anywhere
+	Callback *jobCallback `json:"callback,omitempty"`
+	// Dispatched is where the compilation of the job was dispatched to, if it was, and how it's going
+	Dispatched *dispatchStatus `json:"dispatched,omitempty"`
+
+	tenant string
+	// prefix is the path prefix of the API version the job was created with, which links to its PDF keep to
+	prefix string
+}
+
+// jobs holds the asynchronous jobs, and the PDFs of those that are done in a directory.
+type jobs struct {
+	dir    string
+	expiry time.Duration
+	queue  chan func()
+	jobs   map[string]*asyncJob
+	// callbacks are the allowed prefixes of callback URLs
+	callbacks       []string
+	callbackSecret  []byte
+	callbackRetries int
+	client          *http.Client
+	// feeds hold the events of the jobs that are being followed, or whose compiler output is kept for those who will be
+	feeds map[string]*jobFeed
+	sync.RWMutex
+}
+
+// detachedContext keeps the values of the context of the request that created a job, without being cancelled along with it.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+// setupJobs starts the workers that run asynchronous jobs, and expires jobs once they're old enough.
+func (s *Server) setupJobs(cfg *JobsConfig) error {
+	if cfg == nil {
+		cfg = &JobsConfig{}
+	}
+	if cfg.Workers <= 0 {
+		cfg.Workers = runtime.NumCPU()
+	}
+	if cfg.Queue <= 0 {
+		cfg.Queue = 1000
+	}
+	if cfg.Expiry <= 0 {
+		cfg.Expiry = 24 * time.Hour
+	}
+	dir := filepath.Join(s.rootDir, "jobs")
+	// Jobs don't outlive the server, so neither do their PDFs
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	s.jobs = &jobs{dir: dir, expiry: cfg.Expiry, queue: make(chan func(), cfg.Queue), jobs: map[string]*asyncJob{}}
+	if err := s.jobs.setupCallbacks(cfg); err != nil {
+		return err
+	}
+	for i := 0; i < cfg.Workers; i++ {
+		go func() {
+			for run := range s.jobs.queue {
+				run()
+			}
+		}()
+	}
+	go func() {
+		for range time.Tick(time.Minute) {
+			if _, err := s.jobs.expire(context.Background(), time.Now().Add(-s.jobs.expiry)); err != nil {
+				s.errLog.Printf("error while expiring jobs: %v", err)
+			}
+		}
+	}()
+	s.retain(RetainJobs, s.jobs)
+	return nil
+}
+
+// submit queues h to handle r in the background, returning the job doing so, whose status is sent to cb once it's finished.
+// It returns nil if the queue is full.
+func (s *Server) submit(h http.HandlerFunc, r *http.Request, cb *jobCallback) *asyncJob {
+	b := make([]byte, 16)
+	rand.Read(b)
+	job := &asyncJob{ID: hex.EncodeToString(b), Status: jobQueued, RequestID: requestID(r), Created: time.Now().UTC(), Callback: cb}
+	if p := principalFrom(r.Context()); p != nil {
+		job.tenant = p.tenant
+	}
+	job.prefix = apiPrefix(r)
+	r = r.WithContext(context.WithValue(r.Context(), asyncJobKey{}, job.ID))
+	s.jobs.Lock()
+	s.jobs.jobs[job.ID] = job
+	s.jobs.Unlock()
+	run := func() {
+		s.jobs.update(job.ID, func(j *asyncJob) {
+			now := time.Now().UTC()
+			j.Status, j.Started = jobRunning, &now
+		})
+		rb := &responseBuffer{header: http.Header{}}
+		h(rb, r)
+		s.finish(job.ID, rb)
+		s.draining.jobs.Done()
+		// Callbacks are retried for a while, which shouldn't hold up other jobs
+		go s.notify(job.ID)
+	}
+	s.draining.jobs.Add(1)
+	select {
+	case s.jobs.queue <- run:
+		return job
+	default:
+		s.draining.jobs.Done()
+		s.jobs.Lock()
+		delete(s.jobs.jobs, job.ID)
+		s.jobs.Unlock()
+		return nil
+	}
+}
+
+// finish records the response a job was handled with, keeping the PDF it responded with, if any.
+func (s *Server) finish(id string, rb *responseBuffer) {
+	var err error
+	var result interface{}
+	pdfPath := s.jobs.path(id)
+	ok := rb.code == http.StatusOK
+	switch {
+	case !ok:
+	case rb.header.Get("Content-Type") == "application/pdf":
+		err = ioutil.WriteFile(pdfPath, rb.body.Bytes(), 0644)
+	default:
+		err = json.Unmarshal(rb.body.Bytes(), &result)
+	}
+	s.jobs.update(id, func(j *asyncJob) {
+		now := time.Now().UTC()
+		j.Finished = &now
+		switch {
+		case err != nil:
+			s.errLog.Printf("error while keeping result of job %s: %v", id, err)
+			j.Status = jobFailed
+			j.Error = jobError(CodeInternal, err.Error(), http.StatusInternalServerError)
+		case !ok:
+			j.Status = jobFailed
+			j.Error = &apiError{}
+			if json.Unmarshal(rb.body.Bytes(), j.Error) != nil {
+				j.Error = jobError(CodeInternal, string(bytes.TrimSpace(rb.body.Bytes())), rb.code)
+			}
+		case result != nil:
+			j.Status, j.Result = jobDone, result
+		default:
+			j.Status = jobDone
+			j.SHA256 = rb.header.Get("X-Latte-SHA256")
+			j.Size = rb.body.Len()
+			j.Pages, _ = strconv.Atoi(rb.header.Get("X-Latte-Pages"))
+			j.PDF = j.prefix + "/jobs/" + j.ID + "/pdf"
+		}
+	})
+}
+
+// jobError returns the problem details of an error a job failed with, outside of any response.
+func jobError(code, msg string, status int) *apiError {
+	return &apiError{Type: errorTypePrefix + code, Title: titles[code], Status: status, Detail: msg, Code: code}
+}
+
+func (js *jobs) path(id string) string {
+	return filepath.Join(js.dir, id+".pdf")
+}
+
+// update changes the job with the given id, if it still exists, and lets those following it know.
+func (js *jobs) update(id string, change func(j *asyncJob)) {
+	js.Lock()
+	defer js.Unlock()
+	if j, ok := js.jobs[id]; ok {
+		change(j)
+		js.publish(j)
+	}
+}
+
+// dispatchStatus is where the compilation of a job was dispatched to (e.g. a Kubernetes Job), and its status there.
+type dispatchStatus struct {
+	Kind   string `json:"kind"`
+	Name   string `json:"name"`
+	Status string `json:"status"`
+}
+
+// jobDispatched records where the compilation of the asynchronous job handling the request with the given context
+// was dispatched to, and how it's going; it does nothing for requests not handled by asynchronous jobs.
+func (s *Server) jobDispatched(ctx context.Context, status *dispatchStatus) {
+	if id, ok := ctx.Value(asyncJobKey{}).(string); ok && s.jobs != nil {
+		s.jobs.update(id, func(j *asyncJob) {
+			j.Dispatched = status
+		})
+	}
+}
+
+// get returns a copy of the job with the given id, or nil if there isn't one.
+func (js *jobs) get(id string) *asyncJob {
+	js.RLock()
+	defer js.RUnlock()
+	j, ok := js.jobs[id]
+	if !ok {
+		return nil
+	}
+	return j.copy()
+}
+
+// list returns copies of the jobs for which keep returns true, oldest first.
+func (js *jobs) list(keep func(j *asyncJob) bool) []*asyncJob {
+	js.RLock()
+	defer js.RUnlock()
+	list := []*asyncJob{}
+	for _, j := range js.jobs {
+		if keep(j) {
+			list = append(list, j.copy())
+		}
+	}
+	sort.Slice(list, func(i, k int) bool { return list[i].Created.Before(list[k].Created) })
+	return list
+}
+
+func (j *asyncJob) copy() *asyncJob {
+	job := *j
+	if j.Callback != nil {
+		cb := *j.Callback
+		job.Callback = &cb
+	}
+	return &job
+}
+
+// remove deletes the jobs for which drop returns true, along with their PDFs; jobs still waiting or running are left alone.
+func (js *jobs) remove(drop func(j *asyncJob) bool) (int, error) {
+	js.Lock()
+	var dropped []string
+	for id, j := range js.jobs {
+		if j.Finished != nil && drop(j) {
+			dropped = append(dropped, id)
+			delete(js.jobs, id)
+		}
+	}
+	js.Unlock()
+	for _, id := range dropped {
+		if err := os.Remove(js.path(id)); err != nil && !os.IsNotExist(err) {
+			return len(dropped), err
+		}
+	}
+	return len(dropped), nil
+}
+
+func (js *jobs) expire(ctx context.Context, cutoff time.Time) (int, error) {
+	return js.remove(func(j *asyncJob) bool {
+		return j.Created.Before(cutoff)
+	})
+}
+
+func (js *jobs) erase(ctx context.Context, tenant, sha256 string) (int, error) {
+	return js.remove(func(j *asyncJob) bool {
+		return (tenant != "" && j.tenant == tenant) || (sha256 != "" && j.SHA256 == sha256)
+	})
+}
@@ -0,0 +1,420 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"unicode/utf8"
+)
+
+// BodyError is returned when a JSON body streamed by streamResources isn't valid JSON, or its resources aren't what
+// they should be.
+type BodyError struct {
+	msg string
+}
+
+func (e *BodyError) Error() string {
+	return e.msg
+}
+
+// jsonScanner reads a JSON document a token at a time, without holding more than one small token in memory, so that
+// large strings (i.e. base64 encoded files) can be streamed out of it.
+type jsonScanner struct {
+	r *bufio.Reader
+}
+
+// next returns the next byte that isn't whitespace.
+func (sc *jsonScanner) next() (byte, error) {
+	for {
+		c, err := sc.r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		switch c {
+		case ' ', '\t', '\r', '\n':
+		default:
+			return c, nil
+		}
+	}
+}
+
+func (sc *jsonScanner) expect(want byte) error {
+	c, err := sc.next()
+	if err == nil && c != want {
+		err = &BodyError{msg: fmt.Sprintf("invalid character %q, expected %q", c, want)}
+	}
+	return err
+}
+
+// rawString copies the rest of a string, whose opening quote has been read, into buf as it is, escapes and all.
+func (sc *jsonScanner) rawString(buf *bytes.Buffer) error {
+	buf.WriteByte('"')
+	for escaped := false; ; {
+		c, err := sc.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		buf.WriteByte(c)
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '"':
+			return nil
+		}
+	}
+}
+
+// key reads the key of an object member, and the colon after it.
+func (sc *jsonScanner) key() (string, []byte, error) {
+	var raw bytes.Buffer
+	if err := sc.expect('"'); err != nil {
+		return "", nil, err
+	}
+	if err := sc.rawString(&raw); err != nil {
+		return "", nil, err
+	}
+	var key string
+	if err := json.Unmarshal(raw.Bytes(), &key); err != nil {
+		return "", nil, err
+	}
+	return key, raw.Bytes(), sc.expect(':')
+}
+
+// raw copies the next value into buf as it is; it's checked for being valid JSON once it's decoded.
+func (sc *jsonScanner) raw(buf *bytes.Buffer) error {
+	c, err := sc.next()
+	if err != nil {
+		return err
+	}
+	if c == '"' {
+		return sc.rawString(buf)
+	}
+	if c != '{' && c != '[' {
+		// Literals and numbers end at whatever comes after them
+		for {
+			buf.WriteByte(c)
+			if c, err = sc.r.ReadByte(); err != nil {
+				return err
+			}
+			switch c {
+			case ',', '}', ']', ' ', '\t', '\r', '\n':
+				return sc.r.UnreadByte()
+			}
+		}
+	}
+	buf.WriteByte(c)
+	for depth := 1; depth > 0; {
+		if c, err = sc.r.ReadByte(); err != nil {
+			return err
+		}
+		switch c {
+		case '"':
+			if err = sc.rawString(buf); err != nil {
+				return err
+			}
+			continue
+		case '{', '[':
+			depth++
+		case '}', ']':
+			depth--
+		}
+		buf.WriteByte(c)
+	}
+	return nil
+}
+
+// more reads what comes after a member of an object, returning whether there's another one.
+func (sc *jsonScanner) more() (bool, error) {
+	c, err := sc.next()
+	switch {
+	case err != nil:
+		return false, err
+	case c == ',':
+		return true, nil
+	case c == '}':
+		return false, nil
+	}
+	return false, &BodyError{msg: fmt.Sprintf("invalid character %q after object member", c)}
+}
+
+// object calls member with the key of each of the members of the object that's next, after which member must have
+// read its value. It returns false for null, which is treated as an empty object.
+func (sc *jsonScanner) object(member func(key string, raw []byte) error) (bool, error) {
+	c, err := sc.next()
+	if err != nil {
+		return false, err
+	}
+	if c == 'n' {
+		var rest [3]byte
+		if _, err = io.ReadFull(sc.r, rest[:]); err == nil && string(rest[:]) != "ull" {
+			err = &BodyError{msg: "invalid literal, expected null"}
+		}
+		return false, err
+	}
+	if c != '{' {
+		return false, &BodyError{msg: fmt.Sprintf("invalid character %q, expected an object", c)}
+	}
+	if c, err = sc.next(); err != nil || c == '}' {
+		return true, err
+	}
+	sc.r.UnreadByte()
+	for more := true; more; {
+		key, raw, err := sc.key()
+		if err == nil {
+			err = member(key, raw)
+		}
+		if err == nil {
+			more, err = sc.more()
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// stringReader reads the unescaped contents of the string that's next, hitting io.EOF at its closing quote.
+type stringReader struct {
+	sc   *jsonScanner
+	done bool
+	// pending holds what's left of an escaped character that didn't fit in the last read
+	pending []byte
+}
+
+func (sc *jsonScanner) str() (*stringReader, error) {
+	return &stringReader{sc: sc}, sc.expect('"')
+}
+
+func (sr *stringReader) Read(p []byte) (int, error) {
+	n := copy(p, sr.pending)
+	sr.pending = sr.pending[n:]
+	for n < len(p) && !sr.done {
+		// Runs of plain characters, which base64 is made of, are copied straight out of the buffer
+		if buf, _ := sr.sc.r.Peek(sr.sc.r.Buffered()); len(buf) > 0 {
+			i := 0
+			for i < len(buf) && n+i < len(p) && buf[i] != '"' && buf[i] != '\\' && buf[i] >= ' ' {
+				i++
+			}
+			if i > 0 {
+				n += copy(p[n:], buf[:i])
+				sr.sc.r.Discard(i)
+				continue
+			}
+		}
+		c, err := sr.sc.r.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return n, err
+		}
+		switch {
+		case c == '"':
+			sr.done = true
+		case c == '\\':
+			r, err := sr.escape()
+			if err != nil {
+				return n, err
+			}
+			var b [utf8.UTFMax]byte
+			m := copy(p[n:], b[:utf8.EncodeRune(b[:], r)])
+			sr.pending = append(sr.pending, b[m:utf8.RuneLen(r)]...)
+			n += m
+		case c < ' ':
+			return n, &BodyError{msg: "invalid control character in string"}
+		default:
+			p[n] = c
+			n++
+		}
+	}
+	if n == 0 && sr.done {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+func (sr *stringReader) escape() (rune, error) {
+	c, err := sr.sc.r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	switch c {
+	case '"', '\\', '/':
+		return rune(c), nil
+	case 'b':
+		return '\b', nil
+	case 'f':
+		return '\f', nil
+	case 'n':
+		return '\n', nil
+	case 'r':
+		return '\r', nil
+	case 't':
+		return '\t', nil
+	case 'u':
+		var hex [4]byte
+		if _, err = io.ReadFull(sr.sc.r, hex[:]); err != nil {
+			return 0, err
+		}
+		r, err := strconv.ParseUint(string(hex[:]), 16, 16)
+		if err != nil {
+			return 0, &BodyError{msg: "invalid escape in string"}
+		}
+		// Surrogate pairs can't be part of base64, so they're not worth putting back together
+		return rune(r), nil
+	}
+	return 0, &BodyError{msg: fmt.Sprintf("invalid escape %q in string", c)}
+}
+
+// streamResources reads a JSON body to generate a PDF, decoding and decompressing the files of its top level resources
+// object into dir as they're read, rather than holding them in memory. It returns the rest of the body to be decoded
+// as usual, along with the paths of the files written. Resources larger than max bytes, and more than count of them,
+// fail with a *TooLargeError, unless they're not positive.
+func streamResources(body io.Reader, dir string, max int64, count int) ([]byte, []string, error) {
+	sc := &jsonScanner{r: bufio.NewReaderSize(body, streamBufSize)}
+	var rest bytes.Buffer
+	var paths []string
+	if _, err := sc.next(); err != nil {
+		// Nothing was sent at all
+		return nil, nil, err
+	}
+	sc.r.UnreadByte()
+	rest.WriteByte('{')
+	found, err := sc.object(func(key string, raw []byte) error {
+		if key != "resources" {
+			if rest.Len() > 1 {
+				rest.WriteByte(',')
+			}
+			rest.Write(raw)
+			rest.WriteByte(':')
+			return sc.raw(&rest)
+		}
+		_, err := sc.object(func(name string, _ []byte) error {
+			if count > 0 && len(paths) >= count {
+				return &TooLargeError{msg: fmt.Sprintf("can't send more than %d resources", count)}
+			}
+			// Names are relative to the working directory, and so can't climb out of it
+			path, err := joinName(dir, name)
+			if err != nil {
+				return err
+			}
+			if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+			paths = append(paths, path)
+			return sc.resource(path, max)
+		})
+		return err
+	})
+	switch {
+	case err == io.EOF:
+		err = &BodyError{msg: "unexpected end of JSON input"}
+	case err == nil && !found:
+		err = &BodyError{msg: "body must be an object"}
+	}
+	if err != nil {
+		return nil, paths, err
+	}
+	if _, err = sc.next(); err != io.EOF {
+		return nil, paths, &BodyError{msg: "invalid data after top-level object"}
+	}
+	rest.WriteByte('}')
+	return rest.Bytes(), paths, nil
+}
+
+// resource writes the resource that's next, either a base64 encoded string or an object holding that and its
+// encoding, to path.
+func (sc *jsonScanner) resource(path string, max int64) error {
+	c, err := sc.next()
+	if err != nil {
+		return err
+	}
+	sc.r.UnreadByte()
+	if c == '"' {
+		sr, err := sc.str()
+		if err == nil {
+			err = writeDecoded(path, base64.NewDecoder(base64.StdEncoding, sr), "", max)
+		}
+		return drain(sr, err)
+	}
+	// The data may come before its encoding, in which case it's only decompressed once the encoding is known
+	var encoding, encoded string
+	seen := false
+	defer func() {
+		if encoded != "" {
+			os.Remove(encoded)
+		}
+	}()
+	_, err = sc.object(func(key string, _ []byte) error {
+		switch key {
+		case "encoding":
+			sr, err := sc.str()
+			if err != nil {
+				return err
+			}
+			b, err := ioutil.ReadAll(sr)
+			encoding, seen = string(b), true
+			return err
+		case "data":
+			sr, err := sc.str()
+			if err != nil {
+				return err
+			}
+			src := base64.NewDecoder(base64.StdEncoding, sr)
+			if seen {
+				return drain(sr, writeDecoded(path, src, encoding, max))
+			}
+			f, err := ioutil.TempFile(filepath.Dir(path), ".resource-")
+			if err != nil {
+				return err
+			}
+			encoded = f.Name()
+			_, err = stream(f, src)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			return err
+		}
+		var skipped bytes.Buffer
+		return sc.raw(&skipped)
+	})
+	if err != nil || encoded == "" {
+		if _, serr := os.Stat(path); err == nil && os.IsNotExist(serr) {
+			// Resources without any data are empty
+			err = writeDecoded(path, bytes.NewReader(nil), "", max)
+		}
+		return err
+	}
+	f, err := os.Open(encoded)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return writeDecoded(path, f, encoding, max)
+}
+
+// drain reads what's left of a string whose reading was stopped by err, or whose reader stopped reading early
+// (e.g. a decompressor at the end of its stream), so that the scanner carries on after it.
+func drain(sr *stringReader, err error) error {
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(ioutil.Discard, sr)
+	return err
+}
+
+// isEncodingError returns whether err is about a file not being valid base64.
+func isEncodingError(err error) bool {
+	var corrupt base64.CorruptInputError
+	return errors.As(err, &corrupt)
+}
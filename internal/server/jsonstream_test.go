@@ -0,0 +1,157 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func gzipped(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(data)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestStreamResources(t *testing.T) {
+	b64 := base64.StdEncoding.EncodeToString
+	// Large enough to span several of the scanner's buffers
+	large := make([]byte, 3*streamBufSize+17)
+	rand.New(rand.NewSource(1)).Read(large)
+	files := map[string][]byte{
+		"logo.png":           []byte("\x89PNG logo"),
+		"images/photo.jpg":   large,
+		"gzip-first.txt":     []byte("encoding before data"),
+		"gzip-last.txt":      []byte("encoding after data"),
+		"escaped.txt":        {0xff, 0xef, 0xbf, 0xfb, 0xff},
+		"empty.txt":          {},
+		"signature@2x.png":   []byte("at sign"),
+		"braces{[\"]}.tex":   []byte("odd name"),
+		"sections/terms.tex": []byte(`\section{Terms}`),
+	}
+	// Slashes may be escaped in JSON strings, and are common in base64
+	escaped := strings.Replace(b64(files["escaped.txt"]), "/", `\/`, -1)
+	body := `{
+		"template": "aGk=",
+		"details": {"name": "A \"quoted\" } brace", "items": [1, 2.5, {"x": [true, null]}], "empty": {}},
+		"resources": {
+			"logo.png": "` + b64(files["logo.png"]) + `",
+			"images/photo.jpg": "` + b64(large) + `",
+			"gzip-first.txt": {"encoding": "gzip", "data": "` + b64(gzipped(t, files["gzip-first.txt"])) + `"},
+			"gzip-last.txt": {"data": "` + b64(gzipped(t, files["gzip-last.txt"])) + `", "encoding": "gzip", "extra": [1, {"a": "}"}]},
+			"escaped.txt": "` + escaped + `",
+			"empty.txt": {},
+			"signature@2x.png": "` + b64(files["signature@2x.png"]) + `",
+			"braces{[\"]}.tex": "` + b64(files["braces{[\"]}.tex"]) + `",
+			"sections/terms.tex": "` + b64(files["sections/terms.tex"]) + `"
+		},
+		"delimiters": {"left": "<<", "right": ">>"},
+		"n": -1.5e3,
+		"ok": false
+	}`
+
+	dir := t.TempDir()
+	rest, paths, err := streamResources(strings.NewReader(body), dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != len(files) {
+		t.Errorf("expected %d resources to be written, got %d", len(files), len(paths))
+	}
+	for name, want := range files {
+		got, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: expected %d bytes to be written as sent, got %d different ones", name, len(want), len(got))
+		}
+	}
+
+	var gotRest, wantRest map[string]interface{}
+	if err := json.Unmarshal(rest, &gotRest); err != nil {
+		t.Fatalf("expected the rest of the body to be valid JSON, got %s: %v", rest, err)
+	}
+	if err := json.Unmarshal([]byte(body), &wantRest); err != nil {
+		t.Fatal(err)
+	}
+	delete(wantRest, "resources")
+	if !reflect.DeepEqual(gotRest, wantRest) {
+		t.Errorf("expected the rest of the body to be %v, got %v", wantRest, gotRest)
+	}
+}
+
+func TestStreamResourcesErrors(t *testing.T) {
+	data := base64.StdEncoding.EncodeToString([]byte("0123456789"))
+	tests := []struct {
+		name  string
+		body  string
+		max   int64
+		count int
+		check func(error) bool
+	}{
+		{name: "empty", body: "", check: func(err error) bool { return err != nil }},
+		{name: "not an object", body: `["a"]`, check: isBodyError},
+		{name: "null", body: `null`, check: isBodyError},
+		{name: "truncated", body: `{"template": "aGk=", "resources": {"a.png": "` + data, check: func(err error) bool { return err != nil }},
+		{name: "truncated object", body: `{"template": "aGk="`, check: isBodyError},
+		{name: "trailing data", body: `{"template": "aGk="} {}`, check: isBodyError},
+		{name: "missing colon", body: `{"template" "aGk="}`, check: isBodyError},
+		{name: "missing comma", body: `{"resources": {"a.png": "` + data + `" "b.png": "` + data + `"}}`, check: isBodyError},
+		{name: "bad escape", body: `{"resources": {"a.png": "\q"}}`, check: isBodyError},
+		{name: "control character", body: "{\"resources\": {\"a.png\": \"ab\ncd\"}}", check: isBodyError},
+		{name: "climbs out", body: `{"resources": {"../a.png": "` + data + `"}}`, check: func(err error) bool { _, ok := err.(*NameError); return ok }},
+		{name: "absolute", body: `{"resources": {"/etc/a.png": "` + data + `"}}`, check: func(err error) bool { _, ok := err.(*NameError); return ok }},
+		{name: "not base64", body: `{"resources": {"a.png": "not base64!"}}`, check: isEncodingError},
+		{name: "unknown encoding", body: `{"resources": {"a.png": {"encoding": "br", "data": "` + data + `"}}}`, check: func(err error) bool { return err != nil }},
+		{name: "too large", body: `{"resources": {"a.png": "` + data + `"}}`, max: 5, check: isTooLarge},
+		{name: "too many", body: `{"resources": {"a.png": "` + data + `", "b.png": "` + data + `"}}`, count: 1, check: isTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := streamResources(strings.NewReader(tt.body), t.TempDir(), tt.max, tt.count)
+			if !tt.check(err) {
+				t.Fatalf("unexpected error %T: %v", err, err)
+			}
+		})
+	}
+}
+
+func TestStreamResourcesLimits(t *testing.T) {
+	data := base64.StdEncoding.EncodeToString([]byte("0123456789"))
+	body := `{"resources": {"a.png": "` + data + `", "b.png": "` + data + `"}, "template": "aGk="}`
+	rest, paths, err := streamResources(strings.NewReader(body), t.TempDir(), 10, 2)
+	if err != nil {
+		t.Fatalf("expected resources right at the limits to be accepted, got: %v", err)
+	}
+	if len(paths) != 2 || string(rest) != `{"template":"aGk="}` {
+		t.Fatalf("unexpected result %v %s", paths, rest)
+	}
+	// A null resources object is no resources at all
+	rest, paths, err = streamResources(strings.NewReader(`{"resources": null}`), t.TempDir(), 0, 0)
+	if err != nil || len(paths) != 0 || string(rest) != "{}" {
+		t.Fatalf("unexpected result %v %s: %v", paths, rest, err)
+	}
+}
+
+func isBodyError(err error) bool {
+	_, ok := err.(*BodyError)
+	return ok
+}
+
+func isTooLarge(err error) bool {
+	_, ok := err.(*TooLargeError)
+	return ok
+}
@@ -0,0 +1,407 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JWTConfig configures validating JWT access tokens, e.g. those issued by an OpenID Connect provider, against the
+// provider's published signing keys, without asking the provider about every token.
+type JWTConfig struct {
+	// JWKSURL is where the provider publishes its signing keys as a JSON Web Key Set; if it's empty, the one advertised
+	// by Issuer's discovery document is used.
+	JWKSURL string
+	// Issuer, if set, must be the iss claim of every token.
+	Issuer string
+	// Audience, if set, must be one of the aud claims of every token.
+	Audience string
+	// TenantClaim is the claim holding the tenant a token belongs to, if any.
+	TenantClaim string
+	// Scopes maps scopes to the permissions and roles they grant, as with OAuthConfig.Scopes.
+	Scopes map[string][]string
+}
+
+const (
+	// jwtLeeway is how far clocks may be off when checking when a token expires or becomes valid.
+	jwtLeeway = time.Minute
+	// jwksTTL is how long a fetched key set is used for before it's fetched again.
+	jwksTTL = time.Hour
+	// jwksMinRefresh is how long to wait between fetching the key set because a token was signed with an unknown key,
+	// so that tokens made up by anyone can't be used to flood the provider.
+	jwksMinRefresh = 30 * time.Second
+)
+
+// jwtVerifier authenticates requests by checking the signatures and claims of their JWTs.
+type jwtVerifier struct {
+	cfg    JWTConfig
+	roles  map[string][]string
+	client *http.Client
+	keys   map[string]crypto.PublicKey
+	// fetched is when the keys were last fetched, and attempted when they last were tried to be, whether that worked or not
+	fetched   time.Time
+	attempted time.Time
+	// refreshing is the fetch of the key set in progress, if any
+	refreshing *jwksRefresh
+	sync.Mutex
+}
+
+// jwksRefresh is a fetch of the key set, which requests needing it wait on.
+type jwksRefresh struct {
+	done chan struct{}
+	err  error
+}
+
+func newJWTVerifier(ctx context.Context, cfg *JWTConfig, roles map[string][]string) (*jwtVerifier, error) {
+	v := &jwtVerifier{cfg: *cfg, roles: roles, client: &http.Client{Timeout: 10 * time.Second}}
+	if v.cfg.JWKSURL == "" {
+		if cfg.Issuer == "" {
+			return nil, errors.New("jwt needs either an issuer or a jwks url")
+		}
+		doc, err := discover(ctx, v.client, cfg.Issuer)
+		if err != nil {
+			return nil, err
+		}
+		if doc.JWKSURI == "" {
+			return nil, fmt.Errorf("%s does not advertise a jwks uri", cfg.Issuer)
+		}
+		v.cfg.JWKSURL = doc.JWKSURI
+	}
+	// The keys are fetched up front so that a bad URL is noticed on startup
+	keys, err := v.fetchKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	v.keys, v.fetched = keys, time.Now()
+	v.attempted = v.fetched
+	return v, nil
+}
+
+// jwk is a JSON Web Key; only the members of RSA and elliptic curve public keys are decoded.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// publicKey returns the key, or an error if it isn't a public RSA or elliptic curve key.
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	b64 := base64.RawURLEncoding
+	switch k.Kty {
+	case "RSA":
+		n, err := b64.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := b64.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("invalid rsa exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := b64.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := b64.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("point is not on the curve")
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+}
+
+// fetchKeys fetches the key set, skipping keys that aren't for signatures or whose type isn't supported.
+func (v *jwtVerifier) fetchKeys(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", v.cfg.JWKSURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error while fetching %s: %v", v.cfg.JWKSURL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error while fetching %s: %s", v.cfg.JWKSURL, resp.Status)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("error while decoding %s: %v", v.cfg.JWKSURL, err)
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if key, err := k.publicKey(); err == nil {
+			keys[k.Kid] = key
+		}
+	}
+	return keys, nil
+}
+
+// key returns the key with the given ID, fetching the key set again if it's stale or the key isn't in it, unless it
+// was tried to be fetched recently. The lock isn't held while fetching, so a slow provider only holds up
+// requests signed with keys that aren't known yet; known keys are kept being used while a stale key set is fetched.
+func (v *jwtVerifier) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	v.Lock()
+	key, ok := v.lookup(kid)
+	// Fetches are never tried more often than jwksMinRefresh, so that neither made up tokens nor a provider that's down
+	// have every request fetch the key set
+	due := time.Since(v.attempted) > jwksMinRefresh
+	var r *jwksRefresh
+	switch {
+	case ok && due && time.Since(v.fetched) > jwksTTL:
+		v.refresh()
+	case !ok && (due || v.refreshing != nil):
+		r = v.refresh()
+	}
+	v.Unlock()
+	if r != nil {
+		select {
+		case <-r.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if r.err != nil {
+			return nil, r.err
+		}
+		v.Lock()
+		key, ok = v.lookup(kid)
+		v.Unlock()
+	}
+	if !ok {
+		return nil, &AuthError{reason: fmt.Sprintf("token is signed with an unknown key %q", kid)}
+	}
+	return key, nil
+}
+
+// lookup returns the key with the given ID, if it's known; it must be called while holding the lock.
+func (v *jwtVerifier) lookup(kid string) (crypto.PublicKey, bool) {
+	key, ok := v.keys[kid]
+	if !ok && kid == "" && len(v.keys) == 1 {
+		// Tokens without a key ID can only be told apart from others if there's a single key
+		for _, key = range v.keys {
+			ok = true
+		}
+	}
+	return key, ok
+}
+
+// refresh starts fetching the key set again, unless it's already being fetched, returning the fetch; it must be called
+// while holding the lock. The fetch isn't tied to any request, so that requests going away don't fail the others waiting on it.
+func (v *jwtVerifier) refresh() *jwksRefresh {
+	if v.refreshing != nil {
+		return v.refreshing
+	}
+	r := &jwksRefresh{done: make(chan struct{})}
+	v.refreshing, v.attempted = r, time.Now()
+	go func() {
+		keys, err := v.fetchKeys(context.Background())
+		v.Lock()
+		// Keys that are still around are kept being used while the provider can't be reached
+		if err == nil {
+			v.keys, v.fetched = keys, time.Now()
+		}
+		r.err = err
+		v.refreshing = nil
+		v.Unlock()
+		close(r.done)
+	}()
+	return r
+}
+
+// verifyJWS checks the JWS signature of a token, signed with the given algorithm, over its signed part.
+func verifyJWS(alg string, key crypto.PublicKey, signed, sig []byte) error {
+	var hash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported algorithm %s", alg)
+	}
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+	switch alg[:2] {
+	case "RS", "PS":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("%s needs an rsa key", alg)
+		}
+		if alg[0] == 'P' {
+			return rsa.VerifyPSS(pub, hash, digest, sig, nil)
+		}
+		return rsa.VerifyPKCS1v15(pub, hash, digest, sig)
+	case "ES":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("%s needs an elliptic curve key", alg)
+		}
+		// The signature is r and s, each as long as the curve's order
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return errors.New("signature has the wrong length")
+		}
+		r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return errors.New("signature does not match")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported algorithm %s", alg)
+}
+
+// audience is the aud claim, which is either a single audience or a list of them.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(a))
+}
+
+func (v *jwtVerifier) authenticate(ctx context.Context, token string) (*principal, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, &AuthError{reason: "token is not a jwt"}
+	}
+	b64 := base64.RawURLEncoding
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if data, err := b64.DecodeString(parts[0]); err != nil || json.Unmarshal(data, &header) != nil {
+		return nil, &AuthError{reason: "token has an invalid header"}
+	}
+	// Only asymmetric algorithms are accepted, which rules out unsigned tokens and tokens "signed" with a public key as an HMAC secret
+	if len(header.Alg) != 5 || (header.Alg[:2] != "RS" && header.Alg[:2] != "PS" && header.Alg[:2] != "ES") {
+		return nil, &AuthError{reason: fmt.Sprintf("token is signed with an unsupported algorithm %q", header.Alg)}
+	}
+	sig, err := b64.DecodeString(parts[2])
+	if err != nil {
+		return nil, &AuthError{reason: "token has an invalid signature"}
+	}
+	key, err := v.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err = verifyJWS(header.Alg, key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, &AuthError{reason: "token has an invalid signature"}
+	}
+
+	payload, err := b64.DecodeString(parts[1])
+	if err != nil {
+		return nil, &AuthError{reason: "token has invalid claims"}
+	}
+	var claims struct {
+		Issuer    string      `json:"iss"`
+		Subject   string      `json:"sub"`
+		Audience  audience    `json:"aud"`
+		Expires   *int64      `json:"exp"`
+		NotBefore *int64      `json:"nbf"`
+		Scope     string      `json:"scope"`
+		Scp       interface{} `json:"scp"`
+		ClientID  string      `json:"client_id"`
+		AZP       string      `json:"azp"`
+	}
+	var all map[string]interface{}
+	if json.Unmarshal(payload, &claims) != nil || json.Unmarshal(payload, &all) != nil {
+		return nil, &AuthError{reason: "token has invalid claims"}
+	}
+	now := time.Now()
+	switch {
+	case claims.Expires == nil:
+		return nil, &AuthError{reason: "token does not expire"}
+	case now.After(time.Unix(*claims.Expires, 0).Add(jwtLeeway)):
+		return nil, &AuthError{reason: "token has expired"}
+	case claims.NotBefore != nil && now.Before(time.Unix(*claims.NotBefore, 0).Add(-jwtLeeway)):
+		return nil, &AuthError{reason: "token is not valid yet"}
+	case v.cfg.Issuer != "" && strings.TrimSuffix(claims.Issuer, "/") != strings.TrimSuffix(v.cfg.Issuer, "/"):
+		return nil, &AuthError{reason: fmt.Sprintf("token was issued by %q", claims.Issuer)}
+	}
+	if v.cfg.Audience != "" {
+		found := false
+		for _, aud := range claims.Audience {
+			found = found || aud == v.cfg.Audience
+		}
+		if !found {
+			return nil, &AuthError{reason: "token is not meant for this audience"}
+		}
+	}
+
+	// Providers put scopes in either a space separated scope claim or an scp claim, which may be a list
+	scopes := strings.Fields(claims.Scope)
+	switch scp := claims.Scp.(type) {
+	case string:
+		scopes = append(scopes, strings.Fields(scp)...)
+	case []interface{}:
+		for _, s := range scp {
+			if s, ok := s.(string); ok {
+				scopes = append(scopes, s)
+			}
+		}
+	}
+	subject := claims.Subject
+	for _, id := range []string{claims.ClientID, claims.AZP} {
+		if subject == "" {
+			subject = id
+		}
+	}
+	roles, perms := scopePermissions(v.cfg.Scopes, v.roles, scopes)
+	p := &principal{subject: subject, roles: roles, permissions: perms}
+	if v.cfg.TenantClaim != "" {
+		if tenant, ok := all[v.cfg.TenantClaim].(string); ok {
+			p.tenant = tenant
+		}
+	}
+	return p, nil
+}
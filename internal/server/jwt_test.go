@@ -0,0 +1,307 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// jwks serves a key set, counting how many times it's been fetched.
+type jwks struct {
+	keys    []jwk
+	fetches int32
+	// block, if set, holds up fetches until it's closed
+	block chan struct{}
+	sync.Mutex
+}
+
+func (j *jwks) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt32(&j.fetches, 1)
+	j.Lock()
+	block := j.block
+	keys := j.keys
+	j.Unlock()
+	if block != nil {
+		<-block
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+}
+
+func (j *jwks) add(k jwk) {
+	j.Lock()
+	defer j.Unlock()
+	j.keys = append(j.keys, k)
+}
+
+func rsaJWK(kid string, key *rsa.PublicKey) jwk {
+	b64 := base64.RawURLEncoding
+	return jwk{Kty: "RSA", Kid: kid, Use: "sig", N: b64.EncodeToString(key.N.Bytes()), E: b64.EncodeToString(big.NewInt(int64(key.E)).Bytes())}
+}
+
+func ecJWK(kid string, key *ecdsa.PublicKey) jwk {
+	b64 := base64.RawURLEncoding
+	return jwk{Kty: "EC", Kid: kid, Crv: "P-256", X: b64.EncodeToString(key.X.Bytes()), Y: b64.EncodeToString(key.Y.Bytes())}
+}
+
+// makeJWT returns a token with the given header and claims, signed by sign.
+func makeJWT(t *testing.T, header, claims map[string]interface{}, sign func(signed []byte) []byte) string {
+	t.Helper()
+	b64 := base64.RawURLEncoding
+	h, err := json.Marshal(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := b64.EncodeToString(h) + "." + b64.EncodeToString(c)
+	return signed + "." + b64.EncodeToString(sign([]byte(signed)))
+}
+
+func signRS256(t *testing.T, key *rsa.PrivateKey) func([]byte) []byte {
+	return func(signed []byte) []byte {
+		digest := sha256.Sum256(signed)
+		sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sig
+	}
+}
+
+func signPS256(t *testing.T, key *rsa.PrivateKey) func([]byte) []byte {
+	return func(signed []byte) []byte {
+		digest := sha256.Sum256(signed)
+		sig, err := rsa.SignPSS(rand.Reader, key, crypto.SHA256, digest[:], nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sig
+	}
+}
+
+func signES256(t *testing.T, key *ecdsa.PrivateKey) func([]byte) []byte {
+	return func(signed []byte) []byte {
+		digest := sha256.Sum256(signed)
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig := make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+		return sig
+	}
+}
+
+func signHS256(secret []byte) func([]byte) []byte {
+	return func(signed []byte) []byte {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(signed)
+		return mac.Sum(nil)
+	}
+}
+
+func unsigned([]byte) []byte {
+	return nil
+}
+
+func TestJWTAuthenticate(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := &jwks{keys: []jwk{rsaJWK("rsa", &rsaKey.PublicKey), ecJWK("ec", &ecKey.PublicKey)}}
+	srv := httptest.NewServer(set)
+	defer srv.Close()
+	cfg := &JWTConfig{JWKSURL: srv.URL, Issuer: "https://issuer.example.com/", Audience: "latte", Scopes: map[string][]string{"docs": {PermGenerate}}}
+	v, err := newJWTVerifier(context.Background(), cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaDER, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	claims := func(changes map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss":   "https://issuer.example.com",
+			"sub":   "alice",
+			"aud":   []string{"other", "latte"},
+			"exp":   now.Add(time.Hour).Unix(),
+			"scope": "docs",
+		}
+		for k, v := range changes {
+			if v == nil {
+				delete(c, k)
+				continue
+			}
+			c[k] = v
+		}
+		return c
+	}
+	tests := []struct {
+		name   string
+		header map[string]interface{}
+		claims map[string]interface{}
+		sign   func([]byte) []byte
+		// err is part of the error expected, if any
+		err string
+	}{
+		{"rs256", map[string]interface{}{"alg": "RS256", "kid": "rsa"}, claims(nil), signRS256(t, rsaKey), ""},
+		{"ps256", map[string]interface{}{"alg": "PS256", "kid": "rsa"}, claims(nil), signPS256(t, rsaKey), ""},
+		{"es256", map[string]interface{}{"alg": "ES256", "kid": "ec"}, claims(nil), signES256(t, ecKey), ""},
+		{"single audience", map[string]interface{}{"alg": "RS256", "kid": "rsa"}, claims(map[string]interface{}{"aud": "latte"}), signRS256(t, rsaKey), ""},
+		{"alg none", map[string]interface{}{"alg": "none", "kid": "rsa"}, claims(nil), unsigned, "unsupported algorithm"},
+		{"hs256 with the public key as secret", map[string]interface{}{"alg": "HS256", "kid": "rsa"}, claims(nil), signHS256(rsaDER), "unsupported algorithm"},
+		{"rs256 with an ec key", map[string]interface{}{"alg": "RS256", "kid": "ec"}, claims(nil), signES256(t, ecKey), "invalid signature"},
+		{"signed by someone else", map[string]interface{}{"alg": "ES256", "kid": "ec"}, claims(nil), signES256(t, mustECKey(t)), "invalid signature"},
+		{"expired", map[string]interface{}{"alg": "RS256", "kid": "rsa"}, claims(map[string]interface{}{"exp": now.Add(-time.Hour).Unix()}), signRS256(t, rsaKey), "expired"},
+		{"expired within leeway", map[string]interface{}{"alg": "RS256", "kid": "rsa"}, claims(map[string]interface{}{"exp": now.Add(-jwtLeeway / 2).Unix()}), signRS256(t, rsaKey), ""},
+		{"no expiry", map[string]interface{}{"alg": "RS256", "kid": "rsa"}, claims(map[string]interface{}{"exp": nil}), signRS256(t, rsaKey), "does not expire"},
+		{"not yet valid", map[string]interface{}{"alg": "RS256", "kid": "rsa"}, claims(map[string]interface{}{"nbf": now.Add(time.Hour).Unix()}), signRS256(t, rsaKey), "not valid yet"},
+		{"wrong audience", map[string]interface{}{"alg": "RS256", "kid": "rsa"}, claims(map[string]interface{}{"aud": "billing"}), signRS256(t, rsaKey), "audience"},
+		{"no audience", map[string]interface{}{"alg": "RS256", "kid": "rsa"}, claims(map[string]interface{}{"aud": nil}), signRS256(t, rsaKey), "audience"},
+		{"wrong issuer", map[string]interface{}{"alg": "RS256", "kid": "rsa"}, claims(map[string]interface{}{"iss": "https://evil.example.com"}), signRS256(t, rsaKey), "issued by"},
+		{"unknown kid", map[string]interface{}{"alg": "RS256", "kid": "nope"}, claims(nil), signRS256(t, rsaKey), "unknown key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := makeJWT(t, tt.header, tt.claims, tt.sign)
+			p, err := v.authenticate(context.Background(), token)
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("expected token to be accepted, got: %v", err)
+				}
+				if p.subject != "alice" || !p.can(PermGenerate) {
+					t.Fatalf("unexpected principal: %+v", p)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("expected token to be rejected with %q", tt.err)
+			}
+			if _, ok := err.(*AuthError); !ok {
+				t.Fatalf("expected an *AuthError, got %T: %v", err, err)
+			}
+			if !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("expected error containing %q, got: %v", tt.err, err)
+			}
+		})
+	}
+
+	for _, token := range []string{"", "a.b", "not.a.jwt", "!!.!!.!!"} {
+		if _, err := v.authenticate(context.Background(), token); err == nil {
+			t.Errorf("expected malformed token %q to be rejected", token)
+		}
+	}
+}
+
+func mustECKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestJWTUnknownKeyRefetch(t *testing.T) {
+	key := mustECKey(t)
+	set := &jwks{}
+	srv := httptest.NewServer(set)
+	defer srv.Close()
+	v, err := newJWTVerifier(context.Background(), &JWTConfig{JWKSURL: srv.URL}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := makeJWT(t, map[string]interface{}{"alg": "ES256", "kid": "new"}, map[string]interface{}{"sub": "bob", "exp": time.Now().Add(time.Hour).Unix()}, signES256(t, key))
+
+	// The key set was fetched on startup, so tokens signed with unknown keys don't have it fetched again right away
+	set.add(ecJWK("new", &key.PublicKey))
+	for i := 0; i < 10; i++ {
+		if _, err := v.authenticate(context.Background(), token); err == nil {
+			t.Fatal("expected token signed with an unknown key to be rejected")
+		}
+	}
+	if n := atomic.LoadInt32(&set.fetches); n != 1 {
+		t.Fatalf("expected the key set to be fetched once, got %d", n)
+	}
+
+	// Once it hasn't been tried to be fetched in a while, an unknown key has it fetched, once for every request waiting on it
+	v.Lock()
+	v.attempted = time.Now().Add(-2 * jwksMinRefresh)
+	v.Unlock()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := v.authenticate(context.Background(), token); err != nil {
+				t.Errorf("expected token to be accepted once its key was fetched, got: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&set.fetches); n != 2 {
+		t.Fatalf("expected the key set to be fetched twice, got %d", n)
+	}
+}
+
+func TestJWTStaleKeysDontBlock(t *testing.T) {
+	key := mustECKey(t)
+	set := &jwks{keys: []jwk{ecJWK("ec", &key.PublicKey)}}
+	srv := httptest.NewServer(set)
+	defer srv.Close()
+	v, err := newJWTVerifier(context.Background(), &JWTConfig{JWKSURL: srv.URL}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := makeJWT(t, map[string]interface{}{"alg": "ES256", "kid": "ec"}, map[string]interface{}{"sub": "bob", "exp": time.Now().Add(time.Hour).Unix()}, signES256(t, key))
+
+	block := make(chan struct{})
+	defer close(block)
+	set.Lock()
+	set.block = block
+	set.Unlock()
+	v.Lock()
+	v.fetched = time.Now().Add(-2 * jwksTTL)
+	v.attempted = v.fetched
+	v.Unlock()
+	done := make(chan error, 1)
+	go func() {
+		_, err := v.authenticate(context.Background(), token)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("expected token signed with a known key to be accepted, got: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("verifying a token signed with a known key waited on the key set being fetched")
+	}
+}
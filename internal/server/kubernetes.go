@@ -0,0 +1,337 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/raphaelreyna/latte/internal/compile"
+)
+
+// Where pods find the credentials of their service account, and the API server.
+const (
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	// kubePollInterval is how often dispatched Jobs are checked on
+	kubePollInterval = time.Second
+	// kubeJobTTL is how long finished Jobs (and their pods, and logs) are kept around for, for debugging
+	kubeJobTTL = 10 * time.Minute
+)
+
+// KubernetesConfig configures dispatching each compilation to a Kubernetes Job of its own, for bursty workloads that
+// are better spread over a cluster than compiled by LaTTe itself. The root directory must be on a volume shared with
+// the Jobs' pods, which compile the templates LaTTe fills in and leave the PDFs there for LaTTe to pick up.
+type KubernetesConfig struct {
+	// Image is the image the Jobs run, which has both the latte binary and the TeX installation (or Typst).
+	Image string
+	// Command runs a dispatched compilation in the image, given its working directory. Defaults to latte run-dispatched.
+	Command []string
+	// Namespace is where the Jobs are created; defaults to the namespace LaTTe runs in, or default.
+	Namespace string
+	// Volume is the PersistentVolumeClaim holding the root directory, which is mounted in the Jobs' pods at the same path.
+	Volume string
+	// Requests and Limits are the resources (e.g. cpu=500m, memory=1Gi) requested for, and limiting, each compilation.
+	Requests map[string]string
+	Limits   map[string]string
+	// APIServer is the URL of the Kubernetes API; defaults to the one of the cluster LaTTe runs in, which is
+	// authenticated to with LaTTe's service account. Other API servers (e.g. kubectl proxy) aren't authenticated to.
+	APIServer string
+}
+
+// kubernetes dispatches compilations to Kubernetes Jobs.
+type kubernetes struct {
+	cfg       KubernetesConfig
+	root      string
+	api       string
+	tokenFile string
+	client    *http.Client
+}
+
+// setupKubernetes has every compilation dispatched to a Kubernetes Job, if configured to.
+func (s *Server) setupKubernetes(cfg *KubernetesConfig) error {
+	if cfg == nil || cfg.Image == "" {
+		return nil
+	}
+	if cfg.Volume == "" {
+		return errors.New("dispatching compilations to kubernetes needs the volume holding the root directory")
+	}
+	if s.sandbox != nil {
+		// The Jobs' pods are the sandbox
+		return errors.New("compilations dispatched to kubernetes can't be run in a sandbox")
+	}
+	if s.limits.Cgroup != "" {
+		// Their pods are limited by Kubernetes instead
+		return errors.New("compilations dispatched to kubernetes can't be limited by a cgroup")
+	}
+	root, err := filepath.Abs(s.rootDir)
+	if err != nil {
+		return err
+	}
+	k := &kubernetes{cfg: *cfg, root: root, api: cfg.APIServer, client: &http.Client{Timeout: 30 * time.Second}}
+	if len(k.cfg.Command) == 0 {
+		k.cfg.Command = []string{"latte", "run-dispatched"}
+	}
+	if k.api == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" {
+			return errors.New("not running in a kubernetes cluster, and no kubernetes api server given")
+		}
+		k.api = "https://" + host + ":" + port
+		k.tokenFile = filepath.Join(serviceAccountDir, "token")
+		ca, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return errors.New("invalid kubernetes ca certificate")
+		}
+		k.client.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	}
+	if k.cfg.Namespace == "" {
+		k.cfg.Namespace = "default"
+		if ns, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, "namespace")); err == nil {
+			k.cfg.Namespace = strings.TrimSpace(string(ns))
+		}
+	}
+	s.kube = k
+	for name, ts := range s.typesetters {
+		s.typesetters[name] = &dispatcher{s: s, local: ts}
+	}
+	for name, ts := range s.engines {
+		s.engines[name] = &dispatcher{s: s, local: ts}
+	}
+	return nil
+}
+
+// kubeJob is the part of a Kubernetes Job LaTTe looks at.
+type kubeJob struct {
+	Metadata struct {
+		Name string `json:"name"`
+	} `json:"metadata"`
+	Status struct {
+		Active     int `json:"active"`
+		Succeeded  int `json:"succeeded"`
+		Failed     int `json:"failed"`
+		Conditions []struct {
+			Type    string `json:"type"`
+			Status  string `json:"status"`
+			Reason  string `json:"reason"`
+			Message string `json:"message"`
+		} `json:"conditions"`
+	} `json:"status"`
+}
+
+// do sends a request to the Kubernetes API, decoding the JSON response into out if it's given.
+func (k *kubernetes) do(ctx context.Context, method, path string, body, out interface{}) error {
+	var rb io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		rb = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(k.api, "/")+path, rb)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	// Service account tokens are rotated, so they're read for every request
+	if k.tokenFile != "" {
+		token, err := ioutil.ReadFile(k.tokenFile)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		var status struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(resp.Body).Decode(&status)
+		return fmt.Errorf("kubernetes api responded to %s %s with %s: %s", method, path, resp.Status, status.Message)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (k *kubernetes) jobsPath() string {
+	return "/apis/batch/v1/namespaces/" + url.PathEscape(k.cfg.Namespace) + "/jobs"
+}
+
+// create creates a Job running the compilation dispatched to dir, returning its name.
+func (k *kubernetes) create(ctx context.Context, dir string) (string, error) {
+	labels := map[string]string{"app.kubernetes.io/managed-by": "latte", "app.kubernetes.io/component": "compile"}
+	resources := map[string]interface{}{}
+	if len(k.cfg.Requests) > 0 {
+		resources["requests"] = k.cfg.Requests
+	}
+	if len(k.cfg.Limits) > 0 {
+		resources["limits"] = k.cfg.Limits
+	}
+	spec := map[string]interface{}{
+		// Failed compilations fail the same way every time
+		"backoffLimit":            0,
+		"ttlSecondsAfterFinished": int(kubeJobTTL / time.Second),
+		"template": map[string]interface{}{
+			"metadata": map[string]interface{}{"labels": labels},
+			"spec": map[string]interface{}{
+				"restartPolicy":                "Never",
+				"automountServiceAccountToken": false,
+				"enableServiceLinks":           false,
+				"containers": []interface{}{map[string]interface{}{
+					"name":         "compile",
+					"image":        k.cfg.Image,
+					"command":      append(append([]string{}, k.cfg.Command...), dir),
+					"workingDir":   dir,
+					"resources":    resources,
+					"volumeMounts": []interface{}{map[string]interface{}{"name": "root", "mountPath": k.root}},
+				}},
+				"volumes": []interface{}{map[string]interface{}{
+					"name":                  "root",
+					"persistentVolumeClaim": map[string]interface{}{"claimName": k.cfg.Volume},
+				}},
+			},
+		},
+	}
+	// Jobs outliving the compilation they're for (e.g. because LaTTe went away) are stopped by Kubernetes
+	if deadline, ok := ctx.Deadline(); ok {
+		spec["activeDeadlineSeconds"] = int(time.Until(deadline)/time.Second) + 1
+	}
+	job := map[string]interface{}{
+		"apiVersion": "batch/v1",
+		"kind":       "Job",
+		"metadata":   map[string]interface{}{"generateName": "latte-compile-", "labels": labels},
+		"spec":       spec,
+	}
+	var created kubeJob
+	if err := k.do(ctx, "POST", k.jobsPath(), job, &created); err != nil {
+		return "", err
+	}
+	return created.Metadata.Name, nil
+}
+
+// get returns the Job with the given name.
+func (k *kubernetes) get(ctx context.Context, name string) (*kubeJob, error) {
+	var job kubeJob
+	return &job, k.do(ctx, "GET", k.jobsPath()+"/"+url.PathEscape(name), nil, &job)
+}
+
+// remove deletes the Job with the given name, along with its pods.
+func (k *kubernetes) remove(name string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	body := map[string]interface{}{"apiVersion": "v1", "kind": "DeleteOptions", "propagationPolicy": "Background"}
+	return k.do(ctx, "DELETE", k.jobsPath()+"/"+url.PathEscape(name), body, nil)
+}
+
+// wait waits for the Job with the given name to finish, calling status whenever its status changes.
+func (k *kubernetes) wait(ctx context.Context, name string, status func(string)) error {
+	last := ""
+	for {
+		job, err := k.get(ctx, name)
+		if err != nil {
+			return err
+		}
+		current := "pending"
+		switch {
+		case job.Status.Succeeded > 0:
+			current = "succeeded"
+		case job.Status.Failed > 0:
+			current = "failed"
+		case job.Status.Active > 0:
+			current = "running"
+		}
+		for _, c := range job.Status.Conditions {
+			if c.Type == "Failed" && c.Status == "True" {
+				current = "failed"
+				if c.Reason == "DeadlineExceeded" {
+					return context.DeadlineExceeded
+				}
+			}
+		}
+		if current != last {
+			status(current)
+			last = current
+		}
+		// Compilations that fail still leave their result behind, unless the pod itself failed
+		if current == "succeeded" || current == "failed" {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(kubePollInterval):
+		}
+	}
+}
+
+// dispatcher is a typesetter that dispatches its compilations to Kubernetes Jobs, which compile them with local.
+type dispatcher struct {
+	s     *Server
+	local compile.Typesetter
+}
+
+func (d *dispatcher) Engine() string {
+	return d.local.Engine()
+}
+
+// Render fills in the template of the job, and has a Kubernetes Job compile it.
+func (d *dispatcher) Render(ctx context.Context, job compile.Job) (*compile.Result, error) {
+	k := d.s.kube
+	start := time.Now()
+	res, err := compile.Dispatch(d.local, job)
+	if err != nil {
+		return res, err
+	}
+	// The pod finds the directory at the same path, whatever its working directory is
+	dir, err := filepath.Abs(job.Dir)
+	if err != nil {
+		return res, err
+	}
+	name, err := k.create(ctx, dir)
+	if err != nil {
+		res.Phases = append(res.Phases, compile.Phase{Name: "dispatch", Start: start, Duration: time.Since(start)})
+		return res, fmt.Errorf("error while dispatching compilation: %v", err)
+	}
+	defer func() {
+		if err := k.remove(name); err != nil {
+			d.s.errLog.Printf("error while deleting kubernetes job %s: %v", name, err)
+		}
+	}()
+	err = k.wait(ctx, name, func(status string) {
+		d.s.infoLog.Printf("kubernetes job %s for %s: %s", name, filepath.Base(job.Dir), status)
+		d.s.jobDispatched(ctx, &dispatchStatus{Kind: "kubernetes", Name: name, Status: status})
+	})
+	if err != nil {
+		res.Phases = append(res.Phases, compile.Phase{Name: "dispatch", Start: start, Duration: time.Since(start)})
+		return res, err
+	}
+	res, err = compile.DispatchResult(job.Dir)
+	if len(res.Phases) == 0 {
+		res.Phases = append(res.Phases, compile.Phase{Name: "dispatch", Start: start, Duration: time.Since(start)})
+	}
+	return res, err
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// libraryExts are the extensions of the files that may be added to the library.
+var libraryExts = map[string]bool{
+	".cls": true, ".sty": true, ".bst": true, ".clo": true,
+	".def": true, ".cfg": true, ".fd": true, ".tex": true,
+}
+
+func validLibraryName(name string) error {
+	if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		return fmt.Errorf("invalid library file name: %s", name)
+	}
+	if !libraryExts[filepath.Ext(name)] {
+		return fmt.Errorf("library files must be class, style or other TeX input files: %s", name)
+	}
+	return nil
+}
+
+// setupLibrary ensures the library directory exists.
+// Its path is made absolute since compilations are run from within their own working directories.
+func (s *Server) setupLibrary() error {
+	if s.libraryDir == "" {
+		s.libraryDir = filepath.Join(s.rootDir, "library")
+	}
+	var err error
+	if s.libraryDir, err = filepath.Abs(s.libraryDir); err != nil {
+		return err
+	}
+	return os.MkdirAll(s.libraryDir, 0755)
+}
+
+// libraryEnv adds the library directory to the front of TEXINPUTS so that its files are available to every compilation.
+// Any TEXINPUTS already in env (or in the servers own environment) is searched after the library, followed by the default TeX tree.
+func (s *Server) libraryEnv(env []string) []string {
+	texinputs := os.Getenv("TEXINPUTS")
+	out := make([]string, 0, len(env)+1)
+	for _, kv := range env {
+		if strings.HasPrefix(kv, "TEXINPUTS=") {
+			texinputs = strings.TrimPrefix(kv, "TEXINPUTS=")
+			continue
+		}
+		out = append(out, kv)
+	}
+	texinputs = strings.TrimSuffix(texinputs, ":")
+	if texinputs != "" {
+		texinputs += ":"
+	}
+	return append(out, "TEXINPUTS=.:"+s.libraryDir+"//:"+texinputs)
+}
+
+func (s *Server) handleLibraryList() http.HandlerFunc {
+	type file struct {
+		Name     string `json:"name"`
+		Size     int64  `json:"size"`
+		Modified string `json:"modified"`
+	}
+	type response struct {
+		Files []file `json:"files"`
+	}
+	s.apiSchema("libraryListResponse", response{})
+	return func(w http.ResponseWriter, r *http.Request) {
+		infos, err := ioutil.ReadDir(s.libraryDir)
+		if err != nil {
+			s.errLog.Println(err)
+			s.fail(w, r, CodeInternal, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		resp := response{Files: []file{}}
+		for _, info := range infos {
+			if !info.Mode().IsRegular() {
+				continue
+			}
+			resp.Files = append(resp.Files, file{
+				Name:     info.Name(),
+				Size:     info.Size(),
+				Modified: info.ModTime().UTC().Format(time.RFC3339),
+			})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		s.respond(w, &resp, http.StatusOK)
+	}
+}
+
+func (s *Server) handleLibraryPut() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["name"]
+		if err := validLibraryName(name); err != nil {
+			s.fail(w, r, CodeBadRequest, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// Write to a temporary file first so compilations never see a half written file
+		f, err := ioutil.TempFile(s.libraryDir, ".upload-")
+		if err != nil {
+			s.errLog.Println(err)
+			s.fail(w, r, CodeInternal, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		_, err = stream(f, r.Body)
+		r.Body.Close()
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = os.Rename(f.Name(), filepath.Join(s.libraryDir, name))
+		}
+		if err != nil {
+			os.Remove(f.Name())
+			s.errLog.Println(err)
+			s.fail(w, r, CodeInternal, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		s.infoLog.Printf("added file to library: %s", name)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *Server) handleLibraryDelete() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["name"]
+		if err := validLibraryName(name); err != nil {
+			s.fail(w, r, CodeBadRequest, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err := os.Remove(filepath.Join(s.libraryDir, name))
+		if os.IsNotExist(err) {
+			s.fail(w, r, CodeNotFound, fmt.Sprintf("library file %s not found", name), http.StatusNotFound)
+			return
+		} else if err != nil {
+			s.errLog.Println(err)
+			s.fail(w, r, CodeInternal, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		s.infoLog.Printf("removed file from library: %s", name)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// TooLargeError is returned when a request, or a file in it, is larger than the server allows.
+type TooLargeError struct {
+	msg string
+}
+
+func (e *TooLargeError) Error() string {
+	return e.msg
+}
+
+type bodyLimitKey struct{}
+
+// limitedBody is a request body that fails with a *TooLargeError once more than limit bytes have been read from it.
+type limitedBody struct {
+	io.ReadCloser
+	limit     int64
+	remaining int64
+	exceeded  bool
+}
+
+func (b *limitedBody) err() error {
+	return &TooLargeError{msg: fmt.Sprintf("request body is larger than %d bytes", b.limit)}
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.exceeded {
+		return 0, b.err()
+	}
+	// One byte more than what's left is read, so that a body of exactly limit bytes isn't mistaken for a larger one
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if int64(n) <= b.remaining {
+		b.remaining -= int64(n)
+		return n, err
+	}
+	n, b.remaining, b.exceeded = int(b.remaining), 0, true
+	return n, b.err()
+}
+
+// limitBodies wraps the handler so that the bodies of the requests it handles can't be larger than the servers limit.
+// Requests whose Content-Length is over the limit are turned away before they're read; the rest fail once they've
+// been read past it, with any error the handler responds with replaced by a 413 (see failWith).
+func (s *Server) limitBodies(h http.HandlerFunc) http.HandlerFunc {
+	if s.maxBodyBytes <= 0 {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > s.maxBodyBytes {
+			s.fail(w, r, CodeTooLarge, fmt.Sprintf("request body is larger than %d bytes", s.maxBodyBytes), http.StatusRequestEntityTooLarge)
+			return
+		}
+		body := &limitedBody{ReadCloser: r.Body, limit: s.maxBodyBytes, remaining: s.maxBodyBytes}
+		r = r.WithContext(context.WithValue(r.Context(), bodyLimitKey{}, body))
+		r.Body = body
+		h(w, r)
+	}
+}
+
+// bodyTooLarge returns the error a request failed with if its body was larger than the servers limit, or nil if it wasn't.
+func bodyTooLarge(r *http.Request) error {
+	if body, _ := r.Context().Value(bodyLimitKey{}).(*limitedBody); body != nil && body.exceeded {
+		return body.err()
+	}
+	return nil
+}
+
+// limitFile wraps the reader of a file sent in a request in a limitedFile, unless max isn't positive.
+func limitFile(r io.Reader, name string, max int64) io.Reader {
+	if max <= 0 {
+		return r
+	}
+	return &limitedFile{r: r, name: name, limit: max, remaining: max}
+}
+
+// limitedFile is a reader of a file sent in a request, e.g. a decompressed resource, that fails with a *TooLargeError
+// once more than limit bytes have been read from it.
+type limitedFile struct {
+	r         io.Reader
+	name      string
+	limit     int64
+	remaining int64
+}
+
+func (f *limitedFile) Read(p []byte) (int, error) {
+	if int64(len(p)) > f.remaining+1 {
+		p = p[:f.remaining+1]
+	}
+	n, err := f.r.Read(p)
+	if int64(n) > f.remaining {
+		return int(f.remaining), &TooLargeError{msg: fmt.Sprintf("%s is larger than %d bytes", f.name, f.limit)}
+	}
+	f.remaining -= int64(n)
+	return n, err
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// maxRsc is the largest a resource may be in these tests.
+const maxRsc = 1000
+
+// bomb returns a small gzip stream that decompresses to far more than maxRsc bytes.
+func bomb(t *testing.T) []byte {
+	t.Helper()
+	return gzipped(t, make([]byte, 1<<20))
+}
+
+// serve sends the request to the server, returning the response.
+func serve(s *Server, method, target string, body io.Reader, header http.Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, body)
+	for k, v := range header {
+		r.Header[k] = v
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+func TestTemplatesCreateLimit(t *testing.T) {
+	s := newTestServer(t, Config{MaxResourceBytes: maxRsc})
+	body, _ := json.Marshal(map[string]string{"id": "bomb.tex", "data": base64.StdEncoding.EncodeToString(bomb(t)), "encoding": "gzip"})
+	w := serve(s, "POST", "/templates", bytes.NewReader(body), http.Header{"Content-Type": {"application/json"}})
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected a 413, got %d: %s", w.Code, w.Body)
+	}
+	if _, err := os.Stat(filepath.Join(s.rootDir, "bomb.tex")); !os.IsNotExist(err) {
+		t.Error("expected nothing to be registered")
+	}
+}
+
+func TestTemplatesPutLimit(t *testing.T) {
+	s := newTestServer(t, Config{MaxResourceBytes: maxRsc})
+	w := serve(s, "PUT", "/templates/large.tex", strings.NewReader(strings.Repeat("x", maxRsc+1)), nil)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected a 413, got %d: %s", w.Code, w.Body)
+	}
+	w = serve(s, "PUT", "/templates/small.tex", strings.NewReader(strings.Repeat("x", maxRsc)), nil)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected templates right at the limit to be accepted, got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestResourcesPutLimit(t *testing.T) {
+	s := newTestServer(t, Config{MaxResourceBytes: maxRsc})
+	w := serve(s, "PUT", "/resources/large.png", strings.NewReader(strings.Repeat("x", maxRsc+1)), nil)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected a 413, got %d: %s", w.Code, w.Body)
+	}
+	if _, err := os.Stat(filepath.Join(s.rootDir, "large.png")); !os.IsNotExist(err) {
+		t.Error("expected nothing to be registered")
+	}
+}
+
+// startUpload starts a chunked upload of a resource, returning its id.
+func startUpload(t *testing.T, s *Server, id string) string {
+	t.Helper()
+	w := serve(s, "POST", "/uploads", strings.NewReader(`{"id": "`+id+`"}`), http.Header{"Content-Type": {"application/json"}})
+	var resp struct {
+		Upload string `json:"upload"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil || w.Code != http.StatusCreated {
+		t.Fatalf("error while starting upload (%d): %v", w.Code, err)
+	}
+	return resp.Upload
+}
+
+func TestUploadChunkLimit(t *testing.T) {
+	s := newTestServer(t, Config{MaxResourceBytes: maxRsc})
+	upload := startUpload(t, s, "bomb.png")
+	w := serve(s, "PUT", "/uploads/"+upload+"/chunks/1", bytes.NewReader(bomb(t)), http.Header{"Content-Encoding": {"gzip"}})
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected a compressed chunk larger than a resource may be to get a 413, got %d: %s", w.Code, w.Body)
+	}
+
+	// Chunks can't add up to more than a resource may be either
+	chunk := strings.Repeat("x", maxRsc/2)
+	for n, want := range []int{http.StatusNoContent, http.StatusNoContent, http.StatusRequestEntityTooLarge} {
+		w := serve(s, "PUT", "/uploads/"+upload+"/chunks/"+strconv.Itoa(n+1), strings.NewReader(chunk), nil)
+		if w.Code != want {
+			t.Fatalf("chunk %d: expected %d, got %d: %s", n+1, want, w.Code, w.Body)
+		}
+	}
+	// Replacing a chunk only counts it once
+	w = serve(s, "PUT", "/uploads/"+upload+"/chunks/2", strings.NewReader(chunk), nil)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected a chunk to be replaceable, got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestUploadCommitLimit(t *testing.T) {
+	s := newTestServer(t, Config{MaxResourceBytes: maxRsc})
+	upload := startUpload(t, s, "large.png")
+	// Chunks uploaded at the same time are each checked against what had been uploaded before them
+	up, _ := s.uploads.get(upload)
+	for _, n := range []string{"1", "2"} {
+		if err := ioutil.WriteFile(filepath.Join(up.dir, n), bytes.Repeat([]byte("x"), maxRsc), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w := serve(s, "POST", "/uploads/"+upload+"/commit", strings.NewReader(`{"chunks": 2}`), http.Header{"Content-Type": {"application/json"}})
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected a 413, got %d: %s", w.Code, w.Body)
+	}
+	if _, err := os.Stat(filepath.Join(s.rootDir, "large.png")); !os.IsNotExist(err) {
+		t.Error("expected nothing to be registered")
+	}
+}
@@ -0,0 +1,269 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// SMTPConfig configures the mail server generated PDFs are emailed through.
+type SMTPConfig struct {
+	// Addr is the host and port of the mail server, e.g. smtp.example.com:587.
+	Addr string
+	// Username and Password authenticate with the mail server, if set.
+	Username string
+	Password string
+	// From is the address emails are sent from.
+	From string
+	// TLS connects to the mail server over TLS (usually on port 465), instead of upgrading the connection with STARTTLS.
+	TLS bool
+}
+
+// emailDelivery emails a generated PDF to its recipients.
+type emailDelivery struct {
+	To  []string `json:"to,omitempty"`
+	Cc  []string `json:"cc,omitempty"`
+	Bcc []string `json:"bcc,omitempty"`
+	// ToField and CcField name fields of the details holding more recipients (an address or a list of them), e.g. for mail merge
+	ToField string `json:"to_field,omitempty"`
+	CcField string `json:"cc_field,omitempty"`
+	// Subject and Body are Go templates, executed against the details
+	Subject string `json:"subject"`
+	Body    string `json:"body,omitempty"`
+	// Filename is the name of the attached PDF; defaults to document.pdf
+	Filename string `json:"filename,omitempty"`
+}
+
+// DeliveryError is returned when a PDF can't be delivered because of how the delivery was asked for.
+type DeliveryError struct {
+	msg string
+}
+
+func (e *DeliveryError) Error() string {
+	return e.msg
+}
+
+// email is an email that's ready to be sent.
+type email struct {
+	to, cc, bcc []string
+	subject     string
+	body        string
+	filename    string
+}
+
+// prepare works out the recipients, subject and body of the email for the given details.
+// Errors are of type DeliveryError.
+func (d *emailDelivery) prepare(details map[string]interface{}) (*email, error) {
+	e := &email{filename: d.Filename}
+	if e.filename == "" {
+		e.filename = "document.pdf"
+	}
+	var err error
+	if e.to, err = recipients(d.To, details, d.ToField); err != nil {
+		return nil, err
+	}
+	if e.cc, err = recipients(d.Cc, details, d.CcField); err != nil {
+		return nil, err
+	}
+	if e.bcc, err = recipients(d.Bcc, details, ""); err != nil {
+		return nil, err
+	}
+	if len(e.to)+len(e.cc)+len(e.bcc) == 0 {
+		return nil, &DeliveryError{msg: "email has no recipients"}
+	}
+	if e.subject, err = executeText("subject", d.Subject, details); err != nil {
+		return nil, err
+	}
+	// Anything but a single line would let the details add headers of their own
+	if strings.ContainsAny(e.subject, "\r\n") {
+		return nil, &DeliveryError{msg: "email subject must be a single line"}
+	}
+	if e.body, err = executeText("body", d.Body, details); err != nil {
+		return nil, err
+	}
+	if strings.ContainsAny(e.filename, "\r\n\"") {
+		return nil, &DeliveryError{msg: fmt.Sprintf("invalid attachment name: %q", e.filename)}
+	}
+	return e, nil
+}
+
+// recipients returns the given addresses along with any held in the details field with the given name, checking that each is valid.
+func recipients(addrs []string, details map[string]interface{}, field string) ([]string, error) {
+	all := append([]string{}, addrs...)
+	if field != "" {
+		switch v := details[field].(type) {
+		case string:
+			all = append(all, v)
+		case []interface{}:
+			for _, addr := range v {
+				s, ok := addr.(string)
+				if !ok {
+					return nil, &DeliveryError{msg: fmt.Sprintf("details field %s must hold email addresses", field)}
+				}
+				all = append(all, s)
+			}
+		case nil:
+			return nil, &DeliveryError{msg: fmt.Sprintf("details have no field %s", field)}
+		default:
+			return nil, &DeliveryError{msg: fmt.Sprintf("details field %s must hold email addresses", field)}
+		}
+	}
+	for i, addr := range all {
+		a, err := mail.ParseAddress(addr)
+		if err != nil {
+			return nil, &DeliveryError{msg: fmt.Sprintf("invalid email address %q: %v", addr, err)}
+		}
+		all[i] = a.Address
+	}
+	return all, nil
+}
+
+func executeText(name, text string, details map[string]interface{}) (string, error) {
+	t, err := template.New(name).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return "", &DeliveryError{msg: fmt.Sprintf("invalid email %s: %v", name, err)}
+	}
+	var buf bytes.Buffer
+	if err = t.Execute(&buf, details); err != nil {
+		return "", &DeliveryError{msg: fmt.Sprintf("invalid email %s: %v", name, err)}
+	}
+	return buf.String(), nil
+}
+
+// message returns the email as a MIME message, with the PDF attached.
+func (e *email) message(from string, pdf []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	if len(e.to) > 0 {
+		fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(e.to, ", "))
+	}
+	if len(e.cc) > 0 {
+		fmt.Fprintf(&buf, "Cc: %s\r\n", strings.Join(e.cc, ", "))
+	}
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", e.subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", mw.Boundary())
+
+	part, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/plain; charset=utf-8"},
+		"Content-Transfer-Encoding": {"base64"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	writeBase64Lines(part, []byte(e.body))
+	part, err = mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"application/pdf"},
+		"Content-Transfer-Encoding": {"base64"},
+		"Content-Disposition":       {fmt.Sprintf(`attachment; filename="%s"`, e.filename)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	writeBase64Lines(part, pdf)
+	if err = mw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeBase64Lines writes data base64 encoded, broken into lines short enough for email.
+func writeBase64Lines(w io.Writer, data []byte) {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 76 {
+		w.Write([]byte(encoded[:76] + "\r\n"))
+		encoded = encoded[76:]
+	}
+	w.Write([]byte(encoded + "\r\n"))
+}
+
+// setupSMTP checks the mail server config, if there is one.
+func (s *Server) setupSMTP(cfg *SMTPConfig) error {
+	if cfg == nil || cfg.Addr == "" {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(cfg.Addr); err != nil {
+		return fmt.Errorf("invalid mail server address: %v", err)
+	}
+	if _, err := mail.ParseAddress(cfg.From); err != nil {
+		return fmt.Errorf("invalid address to send email from: %v", err)
+	}
+	s.smtp = cfg
+	return nil
+}
+
+// sendEmail emails the PDF through the configured mail server.
+func (s *Server) sendEmail(e *email, pdf []byte) error {
+	if s.smtp == nil {
+		return errors.New("email delivery isn't configured")
+	}
+	msg, err := e.message(s.smtp.From, pdf)
+	if err != nil {
+		return err
+	}
+	host, _, err := net.SplitHostPort(s.smtp.Addr)
+	if err != nil {
+		return err
+	}
+	var conn net.Conn
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	if s.smtp.TLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", s.smtp.Addr, &tls.Config{ServerName: host})
+	} else {
+		conn, err = dialer.Dial("tcp", s.smtp.Addr)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(time.Minute))
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok && !s.smtp.TLS {
+		if err = c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if s.smtp.Username != "" {
+		if err = c.Auth(smtp.PlainAuth("", s.smtp.Username, s.smtp.Password, host)); err != nil {
+			return err
+		}
+	}
+	from, _ := mail.ParseAddress(s.smtp.From)
+	if err = c.Mail(from.Address); err != nil {
+		return err
+	}
+	for _, rcpt := range append(append(append([]string{}, e.to...), e.cc...), e.bcc...) {
+		if err = c.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	wc, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = wc.Write(msg); err != nil {
+		return err
+	}
+	if err = wc.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// catalog maps language tags (e.g. "es" or "pt-br") to translations of the messages in error responses,
+// keyed by the English format string of the message.
+type catalog map[string]map[string]string
+
+var defaultCatalog = catalog{
+	"es": {
+		"details json with id %s not found":      "no se encontró el json de detalles con id %s",
+		"error while getting json file info":     "error al obtener la información del archivo json",
+		"error while writing json file to disk":  "error al escribir el archivo json en el disco",
+		"error while decoding json":              "error al decodificar el json",
+		"error while opening json file":          "error al abrir el archivo json",
+		"encountered an error":                   "se produjo un error",
+		"output uses fonts that aren't embedded": "el documento usa fuentes que no están incrustadas",
+		"error while converting colors":          "error al convertir los colores",
+		"error while attaching provenance":       "error al adjuntar la procedencia",
+		"error while generating pdf %s":          "error al generar el pdf %s",
+		"error while rendering pdf %s":           "error al renderizar el pdf %s",
+		"error while generating pdf":             "error al generar el pdf",
+		"error while emailing pdf":               "error al enviar el pdf por correo",
+		"error while sending pdf to %s":          "error al enviar el pdf a %s",
+		"error while rendering pages":            "error al renderizar las páginas",
+	},
+	"fr": {
+		"details json with id %s not found":      "json de détails avec l'id %s introuvable",
+		"error while getting json file info":     "erreur lors de la lecture des informations du fichier json",
+		"error while writing json file to disk":  "erreur lors de l'écriture du fichier json sur le disque",
+		"error while decoding json":              "erreur lors du décodage du json",
+		"error while opening json file":          "erreur lors de l'ouverture du fichier json",
+		"encountered an error":                   "une erreur s'est produite",
+		"output uses fonts that aren't embedded": "le document utilise des polices qui ne sont pas incorporées",
+		"error while converting colors":          "erreur lors de la conversion des couleurs",
+		"error while attaching provenance":       "erreur lors de l'ajout de la provenance",
+		"error while generating pdf %s":          "erreur lors de la génération du pdf %s",
+		"error while rendering pdf %s":           "erreur lors du rendu du pdf %s",
+		"error while generating pdf":             "erreur lors de la génération du pdf",
+		"error while emailing pdf":               "erreur lors de l'envoi du pdf par e-mail",
+		"error while sending pdf to %s":          "erreur lors de l'envoi du pdf vers %s",
+		"error while rendering pages":            "erreur lors du rendu des pages",
+	},
+	"de": {
+		"details json with id %s not found":      "Details-JSON mit der ID %s nicht gefunden",
+		"error while getting json file info":     "Fehler beim Abrufen der Informationen zur JSON-Datei",
+		"error while writing json file to disk":  "Fehler beim Schreiben der JSON-Datei auf die Festplatte",
+		"error while decoding json":              "Fehler beim Dekodieren des JSON",
+		"error while opening json file":          "Fehler beim Öffnen der JSON-Datei",
+		"encountered an error":                   "Es ist ein Fehler aufgetreten",
+		"output uses fonts that aren't embedded": "Die Ausgabe verwendet Schriftarten, die nicht eingebettet sind",
+		"error while converting colors":          "Fehler beim Konvertieren der Farben",
+		"error while attaching provenance":       "Fehler beim Anhängen der Herkunftsangaben",
+		"error while generating pdf %s":          "Fehler beim Erzeugen von PDF %s",
+		"error while rendering pdf %s":           "Fehler beim Rendern von PDF %s",
+		"error while generating pdf":             "Fehler beim Erzeugen des PDF",
+		"error while emailing pdf":               "Fehler beim Versenden des PDF per E-Mail",
+		"error while sending pdf to %s":          "Fehler beim Senden des PDF an %s",
+		"error while rendering pages":            "Fehler beim Rendern der Seiten",
+	},
+	"pt": {
+		"details json with id %s not found":      "json de detalhes com id %s não encontrado",
+		"error while getting json file info":     "erro ao obter as informações do arquivo json",
+		"error while writing json file to disk":  "erro ao gravar o arquivo json no disco",
+		"error while decoding json":              "erro ao decodificar o json",
+		"error while opening json file":          "erro ao abrir o arquivo json",
+		"encountered an error":                   "ocorreu um erro",
+		"output uses fonts that aren't embedded": "a saída usa fontes que não estão incorporadas",
+		"error while converting colors":          "erro ao converter as cores",
+		"error while attaching provenance":       "erro ao anexar a proveniência",
+		"error while generating pdf %s":          "erro ao gerar o pdf %s",
+		"error while rendering pdf %s":           "erro ao renderizar o pdf %s",
+		"error while generating pdf":             "erro ao gerar o pdf",
+		"error while emailing pdf":               "erro ao enviar o pdf por e-mail",
+		"error while sending pdf to %s":          "erro ao enviar o pdf para %s",
+		"error while rendering pages":            "erro ao renderizar as páginas",
+	},
+}
+
+// loadCatalog sets up the message catalog from the built in translations, along with any translations in dir.
+// Each file in dir is named after the language it holds the translations for (e.g. it.json or pt-BR.json), and holds a JSON
+// object mapping English messages to their translations; these take precedence over the built in ones.
+func (s *Server) loadCatalog(dir string) error {
+	c := catalog{}
+	s.catalog = c
+	for lang, msgs := range defaultCatalog {
+		c[lang] = map[string]string{}
+		for msg, translation := range msgs {
+			c[lang][msg] = translation
+		}
+	}
+	if dir == "" {
+		return nil
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		lang := strings.ToLower(strings.TrimSuffix(filepath.Base(file), ".json"))
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		var msgs map[string]string
+		if err = json.Unmarshal(data, &msgs); err != nil {
+			return fmt.Errorf("error while decoding messages in %s: %v", file, err)
+		}
+		if c[lang] == nil {
+			c[lang] = map[string]string{}
+		}
+		for msg, translation := range msgs {
+			c[lang][msg] = translation
+		}
+	}
+	return nil
+}
+
+// acceptedLanguages returns the language tags in the Accept-Language header, lower cased and most preferred first.
+func acceptedLanguages(header string) []string {
+	type lang struct {
+		tag string
+		q   float64
+	}
+	var langs []lang
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		l := lang{tag: strings.ToLower(strings.TrimSpace(fields[0])), q: 1}
+		for _, param := range fields[1:] {
+			if param = strings.TrimSpace(param); strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					l.q = q
+				}
+			}
+		}
+		if l.tag != "" && l.q > 0 {
+			langs = append(langs, l)
+		}
+	}
+	sort.SliceStable(langs, func(i, j int) bool { return langs[i].q > langs[j].q })
+	tags := make([]string, len(langs))
+	for i, l := range langs {
+		tags[i] = l.tag
+	}
+	return tags
+}
+
+// localize formats the message in the language the client prefers, falling back to English if there's no translation for it.
+func (s *Server) localize(r *http.Request, format string, args ...interface{}) string {
+	for _, tag := range acceptedLanguages(r.Header.Get("Accept-Language")) {
+		if tag == "en" || strings.HasPrefix(tag, "en-") || tag == "*" {
+			break
+		}
+		// Try the full tag first (e.g. pt-br), then just its language (pt)
+		for _, t := range []string{tag, strings.SplitN(tag, "-", 2)[0]} {
+			if translation, ok := s.catalog[t][format]; ok {
+				return fmt.Sprintf(translation, args...)
+			}
+		}
+	}
+	return fmt.Sprintf(format, args...)
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// writeMetric writes a single sample in the Prometheus text format.
+func writeMetric(b *strings.Builder, name string, labels map[string]string, value float64) {
+	b.WriteString(name)
+	if len(labels) > 0 {
+		var pairs []string
+		for k, v := range labels {
+			pairs = append(pairs, fmt.Sprintf("%s=%s", k, strconv.Quote(v)))
+		}
+		// Keep the output stable
+		sort.Strings(pairs)
+		b.WriteString("{" + strings.Join(pairs, ",") + "}")
+	}
+	b.WriteString(" " + strconv.FormatFloat(value, 'g', -1, 64) + "\n")
+}
+
+// handleMetrics serves metrics in the Prometheus text format.
+func (s *Server) handleMetrics() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var b strings.Builder
+		ms := s.tmplMetrics.snapshot()
+		b.WriteString("# HELP latte_template_compile_seconds How long compiling each template took.\n")
+		b.WriteString("# TYPE latte_template_compile_seconds histogram\n")
+		for _, m := range ms {
+			cumulative := 0
+			for i, n := range m.buckets {
+				cumulative += n
+				le := "+Inf"
+				if i < len(compileBuckets) {
+					le = strconv.FormatFloat(compileBuckets[i], 'g', -1, 64)
+				}
+				writeMetric(&b, "latte_template_compile_seconds_bucket", map[string]string{"template": m.Template, "le": le}, float64(cumulative))
+			}
+			writeMetric(&b, "latte_template_compile_seconds_sum", map[string]string{"template": m.Template}, m.TotalSeconds)
+			writeMetric(&b, "latte_template_compile_seconds_count", map[string]string{"template": m.Template}, float64(m.Compiles))
+		}
+		b.WriteString("# HELP latte_template_compile_failures_total How many times compiling each template failed.\n")
+		b.WriteString("# TYPE latte_template_compile_failures_total counter\n")
+		for _, m := range ms {
+			writeMetric(&b, "latte_template_compile_failures_total", map[string]string{"template": m.Template}, float64(m.Failures))
+		}
+		b.WriteString("# HELP latte_template_compile_passes_total How many times the engine was run to compile each template.\n")
+		b.WriteString("# TYPE latte_template_compile_passes_total counter\n")
+		for _, m := range ms {
+			writeMetric(&b, "latte_template_compile_passes_total", map[string]string{"template": m.Template}, float64(m.Passes))
+		}
+		s.writeServerMetrics(&b, ms)
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		s.respond(w, b.String(), http.StatusOK)
+	}
+}
+
+// writeServerMetrics writes the metrics of the server as a whole: its requests, its compilations across every template,
+// its queue, its caches and its disk usage.
+func (s *Server) writeServerMetrics(b *strings.Builder, ms []templateMetrics) {
+	c := s.counters()
+	b.WriteString("# HELP latte_requests_total How many API requests were handled.\n")
+	b.WriteString("# TYPE latte_requests_total counter\n")
+	writeMetric(b, "latte_requests_total", nil, float64(c.requests))
+	b.WriteString("# HELP latte_request_errors_total How many API requests were responded to with an error, by whose error it was (4xx for client, 5xx for server).\n")
+	b.WriteString("# TYPE latte_request_errors_total counter\n")
+	writeMetric(b, "latte_request_errors_total", map[string]string{"kind": "client"}, float64(c.clientErrors))
+	writeMetric(b, "latte_request_errors_total", map[string]string{"kind": "server"}, float64(c.serverErrors))
+
+	// The histogram of every compilation is the sum of those of each template
+	buckets := make([]int, len(compileBuckets)+1)
+	var sum float64
+	var compiles, failures int
+	for _, m := range ms {
+		for i, n := range m.buckets {
+			buckets[i] += n
+		}
+		sum += m.TotalSeconds
+		compiles += m.Compiles
+		failures += m.Failures
+	}
+	b.WriteString("# HELP latte_compile_seconds How long compiling took.\n")
+	b.WriteString("# TYPE latte_compile_seconds histogram\n")
+	cumulative := 0
+	for i, n := range buckets {
+		cumulative += n
+		le := "+Inf"
+		if i < len(compileBuckets) {
+			le = strconv.FormatFloat(compileBuckets[i], 'g', -1, 64)
+		}
+		writeMetric(b, "latte_compile_seconds_bucket", map[string]string{"le": le}, float64(cumulative))
+	}
+	writeMetric(b, "latte_compile_seconds_sum", nil, sum)
+	writeMetric(b, "latte_compile_seconds_count", nil, float64(compiles))
+	b.WriteString("# HELP latte_compile_failures_total How many compilations failed.\n")
+	b.WriteString("# TYPE latte_compile_failures_total counter\n")
+	writeMetric(b, "latte_compile_failures_total", nil, float64(failures))
+
+	b.WriteString("# HELP latte_compiles_in_progress How many compilations are running.\n")
+	b.WriteString("# TYPE latte_compiles_in_progress gauge\n")
+	writeMetric(b, "latte_compiles_in_progress", nil, float64(atomic.LoadInt64(&s.stats.compiling)))
+	b.WriteString("# HELP latte_compile_queue_depth How many compilations are waiting for a slot to run in.\n")
+	b.WriteString("# TYPE latte_compile_queue_depth gauge\n")
+	writeMetric(b, "latte_compile_queue_depth", nil, float64(s.pool.waiting()))
+
+	b.WriteString("# HELP latte_cache_hits_total How many cache lookups were hits, by cache.\n")
+	b.WriteString("# TYPE latte_cache_hits_total counter\n")
+	writeMetric(b, "latte_cache_hits_total", map[string]string{"cache": "templates"}, float64(c.tmplHits))
+	writeMetric(b, "latte_cache_hits_total", map[string]string{"cache": "resources"}, float64(c.rscHits))
+	b.WriteString("# HELP latte_cache_misses_total How many cache lookups were misses, by cache.\n")
+	b.WriteString("# TYPE latte_cache_misses_total counter\n")
+	writeMetric(b, "latte_cache_misses_total", map[string]string{"cache": "templates"}, float64(c.tmplMisses))
+	writeMetric(b, "latte_cache_misses_total", map[string]string{"cache": "resources"}, float64(c.rscMisses))
+
+	b.WriteString("# HELP latte_root_dir_bytes How much disk space the root directory takes up, including working directories.\n")
+	b.WriteString("# TYPE latte_root_dir_bytes gauge\n")
+	writeMetric(b, "latte_root_dir_bytes", nil, float64(atomic.LoadInt64(&s.stats.rootBytes)))
+	b.WriteString("# HELP latte_work_dir_bytes How much disk space the working directories of compilations take up.\n")
+	b.WriteString("# TYPE latte_work_dir_bytes gauge\n")
+	writeMetric(b, "latte_work_dir_bytes", nil, float64(atomic.LoadInt64(&s.stats.workBytes)))
+}
+
+func (s *Server) handleTemplateStats() http.HandlerFunc {
+	type response struct {
+		Templates []templateMetrics `json:"templates"`
+	}
+	s.apiSchema("templateStatsResponse", response{})
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		s.respond(w, &response{Templates: s.tmplMetrics.snapshot()}, http.StatusOK)
+	}
+}
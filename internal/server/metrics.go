@@ -0,0 +1,115 @@
+package server
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// compileBuckets are the upper bounds, in seconds, of the buckets of the compile duration histograms.
+var compileBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+const (
+	// defaultTemplateMetricsLimit is how many templates get metrics of their own by default
+	defaultTemplateMetricsLimit = 100
+	// otherTemplates is what templates are recorded as once the limit on how many get metrics of their own is reached
+	otherTemplates = "_other"
+	// inlineTemplates is what templates sent with requests, rather than registered, are recorded as
+	inlineTemplates = "_inline"
+)
+
+// templateMetrics describes how a template has been compiling.
+type templateMetrics struct {
+	Template    string  `json:"template"`
+	Compiles    int     `json:"compiles"`
+	Failures    int     `json:"failures"`
+	FailureRate float64 `json:"failure_rate"`
+	Passes      int     `json:"passes"`
+	// Durations are in seconds; P99Seconds is estimated from a histogram, so its only as precise as its buckets
+	TotalSeconds float64 `json:"total_seconds"`
+	MeanSeconds  float64 `json:"mean_seconds"`
+	P99Seconds   float64 `json:"p99_seconds"`
+	MaxSeconds   float64 `json:"max_seconds"`
+	// buckets counts the compiles that took at most the corresponding compileBuckets, plus one more bucket for those that took longer
+	buckets []int
+}
+
+type templatesMetrics struct {
+	t     map[string]*templateMetrics
+	limit int
+	sync.Mutex
+}
+
+func newTemplatesMetrics(limit int) *templatesMetrics {
+	if limit <= 0 {
+		limit = defaultTemplateMetricsLimit
+	}
+	return &templatesMetrics{t: map[string]*templateMetrics{}, limit: limit}
+}
+
+// record records a compilation of the template with the given id. Templates beyond the limit of those getting metrics
+// of their own are lumped together, so that registering lots of templates can't blow up the number of metrics.
+func (tm *templatesMetrics) record(id string, d time.Duration, passes int, failed bool) {
+	if id == "" {
+		id = inlineTemplates
+	}
+	tm.Lock()
+	defer tm.Unlock()
+	m, ok := tm.t[id]
+	if !ok && len(tm.t) >= tm.limit {
+		id = otherTemplates
+		m, ok = tm.t[id]
+	}
+	if !ok {
+		m = &templateMetrics{Template: id, buckets: make([]int, len(compileBuckets)+1)}
+		tm.t[id] = m
+	}
+	seconds := d.Seconds()
+	m.Compiles++
+	if failed {
+		m.Failures++
+	}
+	m.Passes += passes
+	m.TotalSeconds += seconds
+	m.MaxSeconds = math.Max(m.MaxSeconds, seconds)
+	m.buckets[sort.SearchFloat64s(compileBuckets, seconds)]++
+}
+
+// snapshot returns the metrics of every template, slowest (by p99) first.
+func (tm *templatesMetrics) snapshot() []templateMetrics {
+	tm.Lock()
+	ms := make([]templateMetrics, 0, len(tm.t))
+	for _, m := range tm.t {
+		c := *m
+		c.buckets = append([]int(nil), m.buckets...)
+		ms = append(ms, c)
+	}
+	tm.Unlock()
+	for i := range ms {
+		m := &ms[i]
+		m.FailureRate = float64(m.Failures) / float64(m.Compiles)
+		m.MeanSeconds = m.TotalSeconds / float64(m.Compiles)
+		m.P99Seconds = m.quantile(0.99)
+	}
+	sort.Slice(ms, func(i, j int) bool {
+		if ms[i].P99Seconds != ms[j].P99Seconds {
+			return ms[i].P99Seconds > ms[j].P99Seconds
+		}
+		return ms[i].Template < ms[j].Template
+	})
+	return ms
+}
+
+// quantile estimates the q-th quantile of the compile durations as the upper bound of the bucket its in.
+func (m *templateMetrics) quantile(q float64) float64 {
+	rank := int(math.Ceil(q * float64(m.Compiles)))
+	seen := 0
+	for i, n := range m.buckets {
+		seen += n
+		if seen >= rank && i < len(compileBuckets) {
+			return math.Min(compileBuckets[i], m.MaxSeconds)
+		}
+	}
+	return m.MaxSeconds
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OAuthConfig configures validating OAuth2 access tokens with an authorization server.
+type OAuthConfig struct {
+	// Issuer is the URL of an OpenID Connect provider, whose discovery document is used to find its introspection endpoint.
+	Issuer string
+	// IntrospectionURL is the token introspection (RFC 7662) endpoint; it overrides the one found through Issuer.
+	IntrospectionURL string
+	// ClientID and ClientSecret are the credentials LaTTe authenticates to the introspection endpoint with.
+	ClientID     string
+	ClientSecret string
+	// Scopes maps scopes to the permissions and roles they grant; scopes that aren't listed grant the permission or role
+	// they're named after if they're prefixed with "latte:", e.g. latte:generate grants PermGenerate.
+	Scopes map[string][]string
+}
+
+// introspectionTTL is the longest an introspection result is reused for, so that revoked tokens stop working reasonably quickly.
+const introspectionTTL = time.Minute
+
+type introspected struct {
+	p       *principal
+	err     error
+	expires time.Time
+}
+
+// introspector authenticates requests by asking the authorization server about their tokens.
+type introspector struct {
+	endpoint     string
+	clientID     string
+	clientSecret string
+	scopes       map[string][]string
+	roles        map[string][]string
+	client       *http.Client
+	cache        map[[sha256.Size]byte]introspected
+	sync.Mutex
+}
+
+// providerMetadata is what LaTTe uses of an OpenID Connect provider's discovery document.
+type providerMetadata struct {
+	IntrospectionEndpoint string `json:"introspection_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// discover fetches the discovery document of an OpenID Connect provider.
+func discover(ctx context.Context, client *http.Client, issuer string) (*providerMetadata, error) {
+	wellKnown := strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration"
+	req, err := http.NewRequestWithContext(ctx, "GET", wellKnown, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error while fetching %s: %v", wellKnown, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error while fetching %s: %s", wellKnown, resp.Status)
+	}
+	var doc providerMetadata
+	if err = json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("error while decoding %s: %v", wellKnown, err)
+	}
+	return &doc, nil
+}
+
+func newIntrospector(ctx context.Context, cfg *OAuthConfig, roles map[string][]string) (*introspector, error) {
+	i := &introspector{
+		endpoint:     cfg.IntrospectionURL,
+		clientID:     cfg.ClientID,
+		clientSecret: cfg.ClientSecret,
+		scopes:       cfg.Scopes,
+		roles:        roles,
+		client:       &http.Client{Timeout: 10 * time.Second},
+		cache:        map[[sha256.Size]byte]introspected{},
+	}
+	if i.endpoint == "" {
+		if cfg.Issuer == "" {
+			return nil, errors.New("oauth needs either an issuer or an introspection url")
+		}
+		doc, err := discover(ctx, i.client, cfg.Issuer)
+		if err != nil {
+			return nil, err
+		}
+		if doc.IntrospectionEndpoint == "" {
+			return nil, fmt.Errorf("%s does not advertise an introspection endpoint", cfg.Issuer)
+		}
+		i.endpoint = doc.IntrospectionEndpoint
+	}
+	return i, nil
+}
+
+func (i *introspector) authenticate(ctx context.Context, token string) (*principal, error) {
+	// Tokens are kept hashed so that a dump of the servers memory doesn't leak them
+	key := sha256.Sum256([]byte(token))
+	now := time.Now()
+	i.Lock()
+	cached, ok := i.cache[key]
+	if ok && now.After(cached.expires) {
+		delete(i.cache, key)
+		ok = false
+	}
+	i.Unlock()
+	if ok {
+		return cached.p, cached.err
+	}
+
+	form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+	req, err := http.NewRequestWithContext(ctx, "POST", i.endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if i.clientID != "" {
+		req.SetBasicAuth(url.QueryEscape(i.clientID), url.QueryEscape(i.clientSecret))
+	}
+	resp, err := i.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error while introspecting token: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error while introspecting token: %s", resp.Status)
+	}
+	var result struct {
+		Active   bool   `json:"active"`
+		Scope    string `json:"scope"`
+		Subject  string `json:"sub"`
+		ClientID string `json:"client_id"`
+		Expires  int64  `json:"exp"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("error while decoding introspection response: %v", err)
+	}
+
+	entry := introspected{expires: now.Add(introspectionTTL)}
+	if result.Expires > 0 && time.Unix(result.Expires, 0).Before(entry.expires) {
+		entry.expires = time.Unix(result.Expires, 0)
+	}
+	if !result.Active {
+		entry.err = &AuthError{reason: "token is not active"}
+	} else {
+		subject := result.Subject
+		if subject == "" {
+			subject = result.ClientID
+		}
+		roles, perms := scopePermissions(i.scopes, i.roles, strings.Fields(result.Scope))
+		entry.p = &principal{subject: subject, roles: roles, permissions: perms}
+	}
+	i.Lock()
+	// Drop anything that's expired so that the cache doesn't grow without bound
+	for k, v := range i.cache {
+		if now.After(v.expires) {
+			delete(i.cache, k)
+		}
+	}
+	i.cache[key] = entry
+	i.Unlock()
+	return entry.p, entry.err
+}
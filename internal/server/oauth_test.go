@@ -0,0 +1,155 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// introspectionServer answers introspection requests from the tokens it knows about, counting how many it's been sent.
+type introspectionServer struct {
+	t        *testing.T
+	tokens   map[string]map[string]interface{}
+	requests int32
+}
+
+func (is *introspectionServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/.well-known/openid-configuration" {
+		json.NewEncoder(w).Encode(&providerMetadata{IntrospectionEndpoint: "http://" + r.Host + "/introspect"})
+		return
+	}
+	atomic.AddInt32(&is.requests, 1)
+	if id, secret, ok := r.BasicAuth(); !ok || id != "latte" || secret != "s3cret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		is.t.Errorf("error while parsing introspection request: %v", err)
+	}
+	token := r.PostForm.Get("token")
+	if token == "broken" {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	result, ok := is.tokens[token]
+	if !ok {
+		result = map[string]interface{}{"active": false}
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+func TestIntrospection(t *testing.T) {
+	is := &introspectionServer{t: t, tokens: map[string]map[string]interface{}{
+		"alice":  {"active": true, "sub": "alice", "scope": "openid latte:generate"},
+		"client": {"active": true, "client_id": "ci", "scope": "docs"},
+		"editor": {"active": true, "sub": "eve", "scope": "latte:editor"},
+	}}
+	srv := httptest.NewServer(is)
+	defer srv.Close()
+	cfg := &OAuthConfig{Issuer: srv.URL, ClientID: "latte", ClientSecret: "s3cret", Scopes: map[string][]string{"docs": {PermRead}}}
+	roles := map[string][]string{"editor": {PermRead, PermRegister}}
+	i, err := newIntrospector(context.Background(), cfg, roles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i.endpoint != srv.URL+"/introspect" {
+		t.Fatalf("expected the introspection endpoint to be discovered, got %q", i.endpoint)
+	}
+
+	tests := []struct {
+		token   string
+		subject string
+		can     []string
+		cannot  []string
+		roles   []string
+		authErr bool
+		err     bool
+	}{
+		{token: "alice", subject: "alice", can: []string{PermGenerate}, cannot: []string{PermRead}},
+		{token: "client", subject: "ci", can: []string{PermRead}, cannot: []string{PermGenerate}},
+		{token: "editor", subject: "eve", can: []string{PermRead, PermRegister}, cannot: []string{PermGenerate}, roles: []string{"editor"}},
+		{token: "revoked", authErr: true},
+		{token: "broken", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.token, func(t *testing.T) {
+			p, err := i.authenticate(context.Background(), tt.token)
+			switch {
+			case tt.authErr:
+				if _, ok := err.(*AuthError); !ok {
+					t.Fatalf("expected an *AuthError, got %T: %v", err, err)
+				}
+				return
+			case tt.err:
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				if _, ok := err.(*AuthError); ok {
+					t.Fatalf("expected the authorization server failing not to be blamed on the token: %v", err)
+				}
+				return
+			case err != nil:
+				t.Fatalf("expected token to be accepted, got: %v", err)
+			}
+			if p.subject != tt.subject {
+				t.Errorf("expected subject %q, got %q", tt.subject, p.subject)
+			}
+			for _, perm := range tt.can {
+				if !p.can(perm) {
+					t.Errorf("expected token to grant %s", perm)
+				}
+			}
+			for _, perm := range tt.cannot {
+				if p.can(perm) {
+					t.Errorf("expected token not to grant %s", perm)
+				}
+			}
+			if len(p.roles) != len(tt.roles) || (len(tt.roles) > 0 && p.roles[0] != tt.roles[0]) {
+				t.Errorf("expected roles %v, got %v", tt.roles, p.roles)
+			}
+		})
+	}
+}
+
+func TestIntrospectionCache(t *testing.T) {
+	is := &introspectionServer{t: t, tokens: map[string]map[string]interface{}{
+		"alice":    {"active": true, "sub": "alice", "scope": "latte:generate"},
+		"expiring": {"active": true, "sub": "bob", "scope": "latte:generate", "exp": time.Now().Add(-time.Second).Unix()},
+	}}
+	srv := httptest.NewServer(is)
+	defer srv.Close()
+	i, err := newIntrospector(context.Background(), &OAuthConfig{IntrospectionURL: srv.URL, ClientID: "latte", ClientSecret: "s3cret"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range []string{"alice", "alice", "revoked", "revoked"} {
+		i.authenticate(context.Background(), token)
+	}
+	if n := atomic.LoadInt32(&is.requests); n != 2 {
+		t.Fatalf("expected results (active or not) to be reused, got %d requests", n)
+	}
+
+	// Results aren't reused past the expiry of the token
+	for _, token := range []string{"expiring", "expiring"} {
+		i.authenticate(context.Background(), token)
+	}
+	if n := atomic.LoadInt32(&is.requests); n != 4 {
+		t.Fatalf("expected results for expired tokens not to be reused, got %d requests", n)
+	}
+
+	// Results are only reused for so long, so that revoked tokens stop working
+	i.Lock()
+	for k, v := range i.cache {
+		v.expires = time.Now().Add(-time.Second)
+		i.cache[k] = v
+	}
+	i.Unlock()
+	delete(is.tokens, "alice")
+	if _, err := i.authenticate(context.Background(), "alice"); err == nil {
+		t.Fatal("expected revoked token to be rejected once its result expired")
+	}
+}
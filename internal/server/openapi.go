@@ -0,0 +1,617 @@
+package server
+
+import (
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// jsonSchemaer is implemented by types whose JSON form can't be derived from their Go type alone.
+type jsonSchemaer interface {
+	jsonSchema() map[string]interface{}
+}
+
+type apiSchemas struct {
+	s map[string]interface{}
+	sync.Mutex
+}
+
+// apiSchema records the JSON schema of a request or response type under the given name, for use in the OpenAPI document.
+// Handlers call this with their own types so that the document never drifts from what the handlers actually decode and encode.
+func (s *Server) apiSchema(name string, v interface{}) {
+	s.schemas.Lock()
+	s.schemas.s[name] = schemaOf(reflect.TypeOf(v))
+	s.schemas.Unlock()
+}
+
+func schemaOf(t reflect.Type) map[string]interface{} {
+	if t.Kind() == reflect.Ptr {
+		return schemaOf(t.Elem())
+	}
+	if t == reflect.TypeOf(time.Time{}) {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+	if t.Implements(reflect.TypeOf((*jsonSchemaer)(nil)).Elem()) {
+		return reflect.Zero(t).Interface().(jsonSchemaer).jsonSchema()
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": schemaOf(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaOf(t.Elem())}
+	case reflect.Struct:
+		props := map[string]interface{}{}
+		var required []string
+		addStructFields(t, props, &required)
+		schema := map[string]interface{}{"type": "object", "properties": props}
+		if len(required) > 0 {
+			schema["required"] = required
+		}
+		return schema
+	}
+	// interface{} and anything else we can't say much about
+	return map[string]interface{}{}
+}
+
+func addStructFields(t reflect.Type, props map[string]interface{}, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		if f.Anonymous && tag == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				addStructFields(ft, props, required)
+			}
+			continue
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		parts := strings.Split(tag, ",")
+		name := parts[0]
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = schemaOf(f.Type)
+		omitempty := false
+		for _, opt := range parts[1:] {
+			omitempty = omitempty || opt == "omitempty"
+		}
+		if !omitempty && f.Type.Kind() != reflect.Ptr && f.Type.Kind() != reflect.Map && f.Type.Kind() != reflect.Slice {
+			*required = append(*required, name)
+		}
+	}
+}
+
+func (ef encodedFile) jsonSchema() map[string]interface{} {
+	return map[string]interface{}{
+		"oneOf": []interface{}{
+			map[string]interface{}{"type": "string", "format": "byte"},
+			schemaOf(reflect.TypeOf(struct {
+				Data     string `json:"data"`
+				Encoding string `json:"encoding,omitempty"`
+			}{})),
+		},
+	}
+}
+
+// formFile is a file sent as a part of a multipart/form-data body.
+type formFile struct{}
+
+func (formFile) jsonSchema() map[string]interface{} {
+	return map[string]interface{}{"type": "string", "format": "binary"}
+}
+
+// apiOperation describes a single route in the OpenAPI document.
+type apiOperation struct {
+	method  string
+	path    string
+	summary string
+	// request is the name of the schema of the JSON request body, if any
+	request string
+	// rawRequest is the content type of a non-JSON request body, if any
+	rawRequest string
+	// form is the name of the schema of the multipart/form-data request body the JSON one may be sent as instead, if any
+	form string
+	// responses maps status codes to the names of the schemas of their JSON bodies; empty names mean there's no JSON body
+	responses map[string]string
+	// query parameters, mapped to their descriptions
+	query map[string]string
+	// produces is the content type of a non-JSON successful response, if any
+	produces string
+	// unversioned routes are served at the root rather than under each API version
+	unversioned bool
+}
+
+var apiOperations = []apiOperation{
+	{
+		method:  "POST",
+		path:    "/generate",
+		summary: "Generate a PDF from a template, details and resources",
+		request: "generateRequest",
+		form:    "generateForm",
+		query: map[string]string{
+			"tmpl":         "ID of a registered template",
+			"rsc":          "ID of a registered resource, optionally pinned as ID@sha256:HEX; may be repeated",
+			"dtls":         "ID of a registered details json file",
+			"dtls_url":     "URL the details are fetched from, if it's an allowed source",
+			"async":        "Whether to generate the PDF in the background, responding straight away with the job doing so",
+			"callback":     "URL the status of the asynchronous job is POSTed to once it's finished",
+			"callback_pdf": "Whether the callback carries the PDF itself, base64 encoded, rather than only where to download it from",
+			"output":       "What to respond with: pdf (the default); bundle, a zip (or multipart/mixed body, if accepted) of the PDF, the log, the aux file and the filled in template; png or jpeg, the pages rendered as images; or svg, the pages as SVGs",
+			"dpi":          "Resolution pages are rendered at when responding with images; defaults to 96",
+			"page":         "The only page rendered when responding with images, counting from 1; defaults to every page",
+		},
+		produces:  "application/pdf",
+		responses: map[string]string{"200": "", "202": "asyncJob", "400": "", "403": "", "409": "", "413": "", "422": "", "429": "", "500": "", "502": "", "503": "", "504": ""},
+	},
+	{
+		method:  "GET",
+		path:    "/generate/ws",
+		summary: "Open a WebSocket connection to generate PDFs over: each message sent is a generateRequest, answered with log messages as the compiler writes, then a done message followed by the PDF as a binary message, or an error message (see wsMessage)",
+		query: map[string]string{
+			"tmpl":         "ID of a registered template, used by every request sent",
+			"dtls":         "ID of a registered details json file, used by every request sent",
+			"access_token": "Bearer token or API key, for browsers, which can't send headers when opening WebSocket connections",
+		},
+		responses: map[string]string{"101": "", "400": "", "401": "", "403": ""},
+	},
+	{
+		method:    "POST",
+		path:      "/register",
+		summary:   "Register a template, resource or details file",
+		request:   "registerRequest",
+		responses: map[string]string{"200": "registerResponse", "400": "", "403": "", "409": "registerResponse", "413": "", "500": ""},
+	},
+	{
+		method:    "GET",
+		path:      "/templates",
+		summary:   "List the stored templates",
+		responses: map[string]string{"200": "templatesListResponse", "500": ""},
+	},
+	{
+		method:    "POST",
+		path:      "/templates",
+		summary:   "Create a template",
+		request:   "templatesCreateRequest",
+		responses: map[string]string{"201": "templatesCreateResponse", "400": "", "403": "", "409": "templatesCreateResponse", "500": ""},
+	},
+	{
+		method:    "GET",
+		path:      "/templates/{id}",
+		summary:   "Fetch the source of a template",
+		produces:  "text/plain",
+		responses: map[string]string{"200": "", "400": "", "403": "", "404": "", "500": ""},
+	},
+	{
+		method:     "PUT",
+		path:       "/templates/{id}",
+		summary:    "Create or replace a template",
+		rawRequest: "text/plain",
+		responses:  map[string]string{"201": "", "204": "", "400": "", "403": "", "500": ""},
+	},
+	{
+		method:    "DELETE",
+		path:      "/templates/{id}",
+		summary:   "Delete a template",
+		responses: map[string]string{"204": "", "400": "", "403": "", "404": "", "500": "", "501": ""},
+	},
+	{
+		method:    "GET",
+		path:      "/resources",
+		summary:   "List the stored resources, with their sizes and content types",
+		responses: map[string]string{"200": "resourcesListResponse", "500": ""},
+	},
+	{
+		method:     "PUT",
+		path:       "/resources/{id}",
+		summary:    "Create or replace a resource",
+		rawRequest: "application/octet-stream",
+		responses:  map[string]string{"200": "resourceFile", "201": "resourceFile", "400": "", "500": ""},
+	},
+	{
+		method:    "DELETE",
+		path:      "/resources/{id}",
+		summary:   "Delete a resource",
+		responses: map[string]string{"204": "", "400": "", "404": "", "500": "", "501": ""},
+	},
+	{
+		method:    "POST",
+		path:      "/uploads",
+		summary:   "Start a chunked upload of a resource",
+		request:   "uploadCreateRequest",
+		responses: map[string]string{"201": "uploadCreateResponse", "403": "", "409": "uploadCreateResponse"},
+	},
+	{
+		method:     "PUT",
+		path:       "/uploads/{upload}/chunks/{chunk}",
+		summary:    "Upload a numbered chunk; chunks are numbered from 1",
+		rawRequest: "application/octet-stream",
+		responses:  map[string]string{"204": "", "404": ""},
+	},
+	{
+		method:    "POST",
+		path:      "/uploads/{upload}/commit",
+		summary:   "Assemble the uploaded chunks and register the resource",
+		request:   "uploadCommitRequest",
+		responses: map[string]string{"200": "uploadCommitResponse", "400": "", "404": "", "409": ""},
+	},
+	{
+		method:    "DELETE",
+		path:      "/uploads/{upload}",
+		summary:   "Abandon a chunked upload",
+		responses: map[string]string{"204": "", "404": ""},
+	},
+	{
+		method:     "POST",
+		path:       "/bundles",
+		summary:    "Install a template bundle (a gzipped tarball with a manifest.yaml) along with everything it needs",
+		rawRequest: "application/gzip",
+		responses:  map[string]string{"200": "bundleResponse", "400": "", "403": "", "409": "", "500": ""},
+	},
+	{
+		method:    "GET",
+		path:      "/bundles/{template}",
+		summary:   "Get the manifest of the bundle a template was installed from",
+		responses: map[string]string{"200": "bundleManifest", "404": ""},
+	},
+	{
+		method:    "GET",
+		path:      "/bundles/{template}/archive",
+		summary:   "Download the installed version of a template as a bundle",
+		produces:  "application/gzip",
+		responses: map[string]string{"200": "", "403": "", "404": "", "500": ""},
+	},
+	{
+		method:    "POST",
+		path:      "/cache/warm",
+		summary:   "Fetch, parse and cache templates and resources",
+		request:   "cacheWarmRequest",
+		responses: map[string]string{"200": "cacheWarmResponse", "207": "cacheWarmResponse"},
+	},
+	{
+		method:    "GET",
+		path:      "/cache/stats",
+		summary:   "Statistics for the template, resource and on-disk caches",
+		responses: map[string]string{"200": "cacheStatsResponse"},
+	},
+	{
+		method:    "DELETE",
+		path:      "/cache",
+		summary:   "Evict everything from the caches",
+		responses: map[string]string{"204": ""},
+	},
+	{
+		method:    "DELETE",
+		path:      "/cache/templates/{id}",
+		summary:   "Evict a template from the caches",
+		responses: map[string]string{"200": "cacheEvictTemplateResponse"},
+	},
+	{
+		method:    "DELETE",
+		path:      "/cache/resources/{id}",
+		summary:   "Evict a resource from the caches",
+		responses: map[string]string{"200": "cacheEvictResourceResponse"},
+	},
+	{
+		method:    "GET",
+		path:      "/admin/cache",
+		summary:   "Statistics for the caches, along with the ids of what's cached in memory",
+		responses: map[string]string{"200": "adminCacheResponse", "403": ""},
+	},
+	{
+		method:    "DELETE",
+		path:      "/admin/cache",
+		summary:   "Evict everything from the caches",
+		responses: map[string]string{"204": "", "403": ""},
+	},
+	{
+		method:    "DELETE",
+		path:      "/admin/cache/templates/{id}",
+		summary:   "Evict a template from the caches, e.g. after it's changed in the database",
+		responses: map[string]string{"200": "cacheEvictTemplateResponse", "400": "", "403": ""},
+	},
+	{
+		method:    "DELETE",
+		path:      "/admin/cache/resources/{id}",
+		summary:   "Evict a resource from the caches, e.g. after it's changed in the database",
+		responses: map[string]string{"200": "cacheEvictResourceResponse", "400": "", "403": ""},
+	},
+	{
+		method:    "GET",
+		path:      "/library",
+		summary:   "List the class and style files available to every compilation",
+		responses: map[string]string{"200": "libraryListResponse"},
+	},
+	{
+		method:     "PUT",
+		path:       "/library/{name}",
+		summary:    "Add or replace a class or style file in the library",
+		rawRequest: "application/octet-stream",
+		responses:  map[string]string{"204": "", "400": ""},
+	},
+	{
+		method:    "DELETE",
+		path:      "/library/{name}",
+		summary:   "Remove a file from the library",
+		responses: map[string]string{"204": "", "404": ""},
+	},
+	{
+		method:    "POST",
+		path:      "/graphql",
+		summary:   "Query registered files, cached templates and resources, and cache statistics with GraphQL",
+		request:   "graphqlRequest",
+		responses: map[string]string{"200": "graphqlResponse", "400": "graphqlResponse"},
+	},
+	{
+		method:  "GET",
+		path:    "/graphql",
+		summary: "Query registered files, cached templates and resources, and cache statistics with GraphQL",
+		query: map[string]string{
+			"query":     "The GraphQL query",
+			"variables": "The variables of the query, as a JSON object",
+		},
+		responses: map[string]string{"200": "graphqlResponse", "400": "graphqlResponse"},
+	},
+	{
+		method:     "POST",
+		path:       "/check/accessibility",
+		summary:    "Check a PDF for missing tags, no document language, no title and images without alternate text",
+		rawRequest: "application/pdf",
+		responses:  map[string]string{"200": "accessibilityReport", "400": ""},
+	},
+	{
+		method:    "POST",
+		path:      "/validate",
+		summary:   "Check that a template parses, list the details it refers to and optionally fill it in with details, without compiling it",
+		request:   "validateRequest",
+		query:     map[string]string{"tmpl": "ID of a registered template to validate, if none is sent"},
+		responses: map[string]string{"200": "validateResponse", "400": "", "403": "", "500": ""},
+	},
+	{
+		method:    "POST",
+		path:      "/batch",
+		summary:   "Generate several named PDFs in parallel, returned together as a ZIP",
+		request:   "batchRequest",
+		produces:  "application/zip",
+		responses: map[string]string{"200": "", "400": "", "403": "", "409": "", "422": "", "429": "", "500": "", "502": "", "504": ""},
+	},
+	{
+		method:    "POST",
+		path:      "/diff",
+		summary:   "Compare two PDFs, or the PDFs generated by two /generate requests, page by page",
+		request:   "diffRequest",
+		responses: map[string]string{"200": "diffResponse", "400": "", "500": ""},
+	},
+	{
+		method:    "POST",
+		path:      "/profile",
+		summary:   "Time compiling a /generate request several times with cold caches, then with warm ones",
+		request:   "profileRequest",
+		responses: map[string]string{"200": "profileResponse", "400": "", "500": ""},
+	},
+	{
+		method:    "POST",
+		path:      "/erasure",
+		summary:   "Delete the stored records belonging to a tenant or document",
+		request:   "erasureRequest",
+		responses: map[string]string{"200": "erasureResponse", "400": "", "500": "erasureResponse"},
+	},
+	{
+		method:  "GET",
+		path:    "/usage",
+		summary: "How many PDFs each tenant and key generated, and the bytes and compiler CPU time that took",
+		query: map[string]string{
+			"from":   "Start of the period to report on, as an RFC 3339 time; rounded down to the hour",
+			"to":     "End of the period to report on, as an RFC 3339 time; defaults to now",
+			"tenant": "Only report on this tenant",
+			"key":    "Only report on this API key or token subject",
+			"format": "csv for a CSV report rather than JSON",
+		},
+		responses: map[string]string{"200": "usageReport", "400": ""},
+	},
+	{
+		method:  "GET",
+		path:    "/archive",
+		summary: "Search the archive of generated PDFs, newest first",
+		query: map[string]string{
+			"template":       "Only list documents generated with this template",
+			"tenant":         "Only list documents of this tenant",
+			"tag":            "Only list documents with this tag; may be repeated",
+			"sha256":         "Only list documents whose contents hash to this",
+			"details_sha256": "Only list documents generated from details that hash to this",
+			"from":           "Only list documents generated at or after this RFC 3339 time",
+			"to":             "Only list documents generated before this RFC 3339 time",
+			"offset":         "How many matching documents to skip",
+			"limit":          "How many documents to list; defaults to 50, at most 500",
+		},
+		responses: map[string]string{"200": "archiveListResponse", "400": "", "404": ""},
+	},
+	{
+		method:    "GET",
+		path:      "/archive/{id}",
+		summary:   "Download an archived PDF",
+		produces:  "application/pdf",
+		responses: map[string]string{"200": "", "404": "", "500": ""},
+	},
+	{
+		method:    "GET",
+		path:      "/jobs/{id}",
+		summary:   "Get the status of an asynchronous job, and its result once it's done",
+		responses: map[string]string{"200": "asyncJob", "404": ""},
+	},
+	{
+		method:    "GET",
+		path:      "/jobs/{id}/pdf",
+		summary:   "Download the PDF generated by an asynchronous job",
+		produces:  "application/pdf",
+		responses: map[string]string{"200": "", "404": "", "409": "", "500": ""},
+	},
+	{
+		method:    "GET",
+		path:      "/jobs/{id}/events",
+		summary:   "Follow an asynchronous job as Server-Sent Events: status events carry the job every time it changes, and log events the lines its compiler writes",
+		produces:  "text/event-stream",
+		responses: map[string]string{"200": "", "404": ""},
+	},
+	{
+		method:    "GET",
+		path:      "/stats/templates",
+		summary:   "Compile durations, passes and failure rates of each template, slowest first",
+		responses: map[string]string{"200": "templateStatsResponse"},
+	},
+	{
+		method:    "GET",
+		path:      "/stats",
+		summary:   "Request rates, error rates, queue depth and cache hit ratios over the last minute, 15 minutes and hour",
+		responses: map[string]string{"200": "statsResponse"},
+	},
+	{
+		method:      "GET",
+		path:        "/ping",
+		summary:     "Check that the server is up; responds with PONG",
+		responses:   map[string]string{"200": ""},
+		produces:    "text/plain",
+		unversioned: true,
+	},
+	{
+		method:      "GET",
+		path:        "/metrics",
+		summary:     "Per template compile durations, passes and failures in the Prometheus text format",
+		responses:   map[string]string{"200": ""},
+		produces:    "text/plain",
+		unversioned: true,
+	},
+}
+
+func schemaRef(name string) map[string]interface{} {
+	return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+}
+
+func (s *Server) openAPIDocument() map[string]interface{} {
+	paths := map[string]interface{}{}
+	for _, op := range apiOperations {
+		o := map[string]interface{}{"summary": op.summary}
+		var params []interface{}
+		for _, seg := range strings.Split(op.path, "/") {
+			if strings.HasPrefix(seg, "{") {
+				params = append(params, map[string]interface{}{
+					"name": strings.Trim(seg, "{}"), "in": "path", "required": true,
+					"schema": map[string]interface{}{"type": "string"},
+				})
+			}
+		}
+		for name, desc := range op.query {
+			params = append(params, map[string]interface{}{
+				"name": name, "in": "query", "description": desc,
+				"schema": map[string]interface{}{"type": "string"},
+			})
+		}
+		if len(params) > 0 {
+			o["parameters"] = params
+		}
+		if op.request != "" {
+			content := map[string]interface{}{
+				"application/json": map[string]interface{}{"schema": schemaRef(op.request)},
+			}
+			if op.form != "" {
+				// Parts holding JSON say so, the rest are files
+				content["multipart/form-data"] = map[string]interface{}{
+					"schema": schemaRef(op.form),
+					"encoding": map[string]interface{}{
+						"request": map[string]interface{}{"contentType": "application/json"},
+						"details": map[string]interface{}{"contentType": "application/json"},
+					},
+				}
+			}
+			o["requestBody"] = map[string]interface{}{"content": content}
+		} else if op.rawRequest != "" {
+			o["requestBody"] = map[string]interface{}{
+				"content": map[string]interface{}{
+					op.rawRequest: map[string]interface{}{"schema": map[string]interface{}{"type": "string", "format": "binary"}},
+				},
+			}
+		}
+		responses := map[string]interface{}{}
+		for code, name := range op.responses {
+			status, _ := strconv.Atoi(code)
+			resp := map[string]interface{}{"description": http.StatusText(status)}
+			switch {
+			case name != "":
+				resp["content"] = map[string]interface{}{
+					"application/json": map[string]interface{}{"schema": schemaRef(name)},
+				}
+			case op.produces != "" && code[0] == '2':
+				resp["content"] = map[string]interface{}{
+					op.produces: map[string]interface{}{"schema": map[string]interface{}{"type": "string", "format": "binary"}},
+				}
+			case code[0] == '4' || code[0] == '5':
+				// Every error is sent the same way; as problem details, except to v1 clients
+				resp["content"] = map[string]interface{}{
+					"application/json":         map[string]interface{}{"schema": schemaRef("apiError")},
+					"application/problem+json": map[string]interface{}{"schema": schemaRef("apiError")},
+				}
+			}
+			responses[code] = resp
+		}
+		o["responses"] = responses
+		item, ok := paths[op.path].(map[string]interface{})
+		if !ok {
+			item = map[string]interface{}{}
+			paths[op.path] = item
+			if op.unversioned {
+				item["servers"] = []interface{}{map[string]interface{}{"url": "/"}}
+			}
+		}
+		item[strings.ToLower(op.method)] = o
+	}
+
+	s.schemas.Lock()
+	schemas := map[string]interface{}{}
+	for name, schema := range s.schemas.s {
+		schemas[name] = schema
+	}
+	s.schemas.Unlock()
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":       "LaTTe",
+			"description": "Generate PDFs using LaTeX templates and JSON.",
+			"version":     "1",
+		},
+		"servers": []interface{}{
+			map[string]interface{}{"url": "/v1", "description": "The original API"},
+			map[string]interface{}{"url": "/v2"},
+		},
+		"paths":      paths,
+		"components": map[string]interface{}{"schemas": schemas},
+	}
+}
+
+func (s *Server) handleOpenAPI() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		s.respond(w, s.openAPIDocument(), http.StatusOK)
+	}
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// optimizeImage downscales the PNG or JPEG image at path, in place, so that neither of its sides is longer than the servers
+// max image dimension; JPEGs are also recompressed with the configured quality. It returns whether the image was rewritten.
+// CMYK images are left alone since re-encoding them would change their color space.
+func (s *Server) optimizeImage(path string) (bool, error) {
+	if s.imageMaxDim <= 0 {
+		return false, nil
+	}
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext != ".png" && ext != ".jpg" && ext != ".jpeg" {
+		return false, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	img, format, err := image.Decode(f)
+	f.Close()
+	if err != nil {
+		// Not something we know how to optimize; pdfLaTeX will complain about it if it's actually broken
+		return false, nil
+	}
+	if _, cmyk := img.(*image.CMYK); cmyk {
+		return false, nil
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= s.imageMaxDim && h <= s.imageMaxDim {
+		return false, nil
+	}
+	if w >= h {
+		w, h = s.imageMaxDim, h*s.imageMaxDim/w
+	} else {
+		w, h = w*s.imageMaxDim/h, s.imageMaxDim
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	resized := downscale(img, w, h)
+
+	tmp := path + ".optimized"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return false, err
+	}
+	switch format {
+	case "jpeg":
+		err = jpeg.Encode(out, resized, &jpeg.Options{Quality: s.imageQuality})
+	default:
+		err = png.Encode(out, resized)
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return false, err
+	}
+	s.infoLog.Printf("downscaled %s from %dx%d to %dx%d", filepath.Base(path), b.Dx(), b.Dy(), w, h)
+	return true, nil
+}
+
+// downscale shrinks src to w by h pixels by averaging the source pixels that fall into each destination pixel.
+func downscale(src image.Image, w, h int) image.Image {
+	b := src.Bounds()
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0 := b.Min.Y + y*b.Dy()/h
+		y1 := b.Min.Y + (y+1)*b.Dy()/h
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < w; x++ {
+			x0 := b.Min.X + x*b.Dx()/w
+			x1 := b.Min.X + (x+1)*b.Dx()/w
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					c := color.NRGBA64Model.Convert(src.At(sx, sy)).(color.NRGBA64)
+					r += uint64(c.R)
+					g += uint64(c.G)
+					bl += uint64(c.B)
+					a += uint64(c.A)
+					n++
+				}
+			}
+			dst.SetNRGBA(x, y, color.NRGBA{
+				R: uint8(r / n >> 8),
+				G: uint8(g / n >> 8),
+				B: uint8(bl / n >> 8),
+				A: uint8(a / n >> 8),
+			})
+		}
+	}
+	return dst
+}
@@ -0,0 +1,198 @@
+package server
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/raphaelreyna/latte/internal/compile"
+)
+
+// Output modes are what /generate responds with, chosen with its output query parameter.
+const (
+	outputPDF = "pdf"
+	// outputBundle is the PDF along with the log, the aux file and the filled in template, for debugging templates remotely.
+	outputBundle = "bundle"
+	// outputPNG and outputJPEG are the pages of the PDF rendered as images, for previewing them without a PDF viewer.
+	outputPNG  = "png"
+	outputJPEG = "jpeg"
+	// outputSVG is the pages of the PDF as SVGs, for embedding them inline in HTML.
+	outputSVG = "svg"
+)
+
+const (
+	// defaultImageDPI is the resolution pages are rendered at unless the request picks one.
+	defaultImageDPI = 96
+	// maxImageDPI bounds the resolution pages may be rendered at, since the size of the images grows with its square.
+	maxImageDPI = 600
+)
+
+// outputMode is what the query of a request to /generate says to respond with.
+type outputMode struct {
+	mode string
+	// dpi is the resolution pages are rendered at, for images
+	dpi int
+	// page is the only page rendered, counting from 1, or 0 for every page
+	page int
+}
+
+// parseOutputMode reads the output mode from the query of a request to /generate.
+func parseOutputMode(q url.Values) (*outputMode, error) {
+	om := &outputMode{mode: q.Get("output"), dpi: defaultImageDPI}
+	switch om.mode {
+	case "", outputPDF, outputBundle:
+		return om, nil
+	case "jpg":
+		om.mode = outputJPEG
+	case outputPNG, outputJPEG, outputSVG:
+	default:
+		return nil, fmt.Errorf("unknown output: %s", om.mode)
+	}
+	if dpi := q.Get("dpi"); dpi != "" {
+		var err error
+		if om.dpi, err = strconv.Atoi(dpi); err != nil || om.dpi <= 0 || om.dpi > maxImageDPI {
+			return nil, fmt.Errorf("dpi must be between 1 and %d", maxImageDPI)
+		}
+	}
+	if page := q.Get("page"); page != "" {
+		var err error
+		if om.page, err = strconv.Atoi(page); err != nil || om.page <= 0 {
+			return nil, fmt.Errorf("invalid page: %s", page)
+		}
+	}
+	return om, nil
+}
+
+// outputFile is a file sent in a response holding several.
+type outputFile struct {
+	name        string
+	contentType string
+	data        []byte
+}
+
+// debugFiles returns the files a bundle of the compilation in dir is made of: the pdf, the log (or the compilers
+// output, for compilers that don't keep one), the aux file and the filled in template; those that weren't written are left out.
+func debugFiles(dir string, res *compile.Result, output []byte) []outputFile {
+	files := []outputFile{{name: "document.pdf", contentType: "application/pdf", data: output}}
+	jn := filepath.Base(dir)
+	log, err := ioutil.ReadFile(filepath.Join(dir, jn+".log"))
+	if err != nil {
+		log = []byte(res.Output)
+	}
+	files = append(files, outputFile{name: "document.log", contentType: "text/plain; charset=utf-8", data: log})
+	if aux, err := ioutil.ReadFile(filepath.Join(dir, jn+".aux")); err == nil {
+		files = append(files, outputFile{name: "document.aux", contentType: "text/plain; charset=utf-8", data: aux})
+	}
+	if res.Source != "" {
+		if src, err := ioutil.ReadFile(filepath.Join(dir, res.Source)); err == nil {
+			files = append(files, outputFile{name: "document" + filepath.Ext(res.Source), contentType: "text/plain; charset=utf-8", data: src})
+		}
+	}
+	return files
+}
+
+// sendImages responds with the pages of the PDF in dir rendered as images (or SVGs), as asked for by om: a single image if only one
+// page was asked for, or the document only has one, otherwise every page in a zip (or multipart/mixed body, if the client accepts it).
+func (s *Server) sendImages(w http.ResponseWriter, r *http.Request, dir string, res *compile.Result, om *outputMode, pages int) {
+	if om.page > pages {
+		s.fail(w, r, CodeBadRequest, fmt.Sprintf("page %d is past the end of the %d page document", om.page, pages), http.StatusBadRequest)
+		return
+	}
+	var paths []string
+	var err error
+	contentType := "image/" + om.mode
+	if om.mode == outputSVG {
+		paths, err = renderSVG(r.Context(), filepath.Join(dir, res.PDF), dir, om.page)
+		contentType = "image/svg+xml"
+	} else {
+		paths, err = renderPages(r.Context(), filepath.Join(dir, res.PDF), dir, om.mode, om.dpi, om.page, om.page)
+	}
+	if err != nil {
+		er := &apiError{Code: CodePostprocessFailed, Error: s.localize(r, "error while rendering pages"), Data: err.Error()}
+		payload := s.failWith(w, r, er, http.StatusInternalServerError)
+		s.errLog.Printf("%s", payload)
+		return
+	}
+	var files []outputFile
+	for i, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			s.errLog.Println(err)
+			s.fail(w, r, CodeInternal, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		page := om.page
+		if page == 0 {
+			page = i + 1
+		}
+		files = append(files, outputFile{name: fmt.Sprintf("page-%04d.%s", page, om.mode), contentType: contentType, data: data})
+	}
+	if len(files) == 1 {
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(files[0].data)))
+		s.respond(w, files[0].data, http.StatusOK)
+		return
+	}
+	s.sendFiles(w, r, "pages.zip", files)
+}
+
+// sendFiles responds with the files as a zip with the given name, or as a multipart/mixed body if the client accepts it.
+func (s *Server) sendFiles(w http.ResponseWriter, r *http.Request, name string, files []outputFile) {
+	var body bytes.Buffer
+	var contentType string
+	if strings.Contains(r.Header.Get("Accept"), "multipart/mixed") {
+		mw := multipart.NewWriter(&body)
+		for _, f := range files {
+			h := textproto.MIMEHeader{}
+			h.Set("Content-Type", f.contentType)
+			h.Set("Content-Disposition", `attachment; filename="`+f.name+`"`)
+			part, err := mw.CreatePart(h)
+			if err == nil {
+				_, err = part.Write(f.data)
+			}
+			if err != nil {
+				s.errLog.Println(err)
+				s.fail(w, r, CodeInternal, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		if err := mw.Close(); err != nil {
+			s.errLog.Println(err)
+			s.fail(w, r, CodeInternal, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		contentType = "multipart/mixed; boundary=" + mw.Boundary()
+	} else {
+		zw := zip.NewWriter(&body)
+		for _, f := range files {
+			zf, err := zw.Create(f.name)
+			if err == nil {
+				_, err = io.Copy(zf, bytes.NewReader(f.data))
+			}
+			if err != nil {
+				s.errLog.Println(err)
+				s.fail(w, r, CodeInternal, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		if err := zw.Close(); err != nil {
+			s.errLog.Println(err)
+			s.fail(w, r, CodeInternal, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		contentType = "application/zip"
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(body.Len()))
+	s.respond(w, body.Bytes(), http.StatusOK)
+}
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// NameError is returned when the name or id of a file given in a request could lead outside of the directory it's
+// meant to be in, e.g. ../../etc/cron.d/x.
+type NameError struct {
+	Name string
+}
+
+func (e *NameError) Error() string {
+	return fmt.Sprintf("invalid file name: %q", e.Name)
+}
+
+// checkName makes sure name is a relative, slash separated path that stays inside of whatever directory it's joined to,
+// e.g. logo.png or images/logo.png. Absolute paths, paths with .. elements, paths that aren't in their cleanest form
+// (e.g. ./logo.png or images//logo.png) and names with backslashes or control characters in them are rejected.
+func checkName(name string) error {
+	if name == "" || name == "." || path.IsAbs(name) || path.Clean(name) != name || name == ".." || strings.HasPrefix(name, "../") {
+		return &NameError{Name: name}
+	}
+	for _, c := range name {
+		// Backslashes separate paths on Windows, and so could be used to climb out of the directory there
+		if c == '\\' || c < ' ' || c == 0x7f {
+			return &NameError{Name: name}
+		}
+	}
+	return nil
+}
+
+// joinName returns the path of the file with the given name in dir, once checkName has made sure it stays inside of dir.
+func joinName(dir, name string) (string, error) {
+	if err := checkName(name); err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, filepath.FromSlash(name)), nil
+}
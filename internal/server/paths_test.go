@@ -0,0 +1,97 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckName(t *testing.T) {
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"logo.png", true},
+		{"images/logo.png", true},
+		{"sections/terms.tex", true},
+		{"..logo.png", true},
+		{"signature@2x.png", true},
+		{"", false},
+		{".", false},
+		{"..", false},
+		{"../logo.png", false},
+		{"images/../../logo.png", false},
+		{"/etc/passwd", false},
+		{"./logo.png", false},
+		{"images//logo.png", false},
+		{"images/", false},
+		{`..\logo.png`, false},
+		{"logo\x00.png", false},
+		{"logo\n.png", false},
+		{"logo\x7f.png", false},
+	}
+	for _, tt := range tests {
+		err := checkName(tt.name)
+		if tt.ok && err != nil {
+			t.Errorf("expected %q to be accepted, got: %v", tt.name, err)
+		}
+		if !tt.ok {
+			if _, ok := err.(*NameError); !ok {
+				t.Errorf("expected %q to be rejected with a *NameError, got: %v", tt.name, err)
+			}
+		}
+	}
+}
+
+func TestJoinName(t *testing.T) {
+	dir := filepath.Join("srv", "latte")
+	p, err := joinName(dir, "images/logo.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(dir, "images", "logo.png"); p != want {
+		t.Errorf("expected %s, got %s", want, p)
+	}
+	if _, err := joinName(dir, "../../etc/cron.d/x"); err == nil {
+		t.Error("expected names leading outside of the directory to be rejected")
+	}
+}
+
+func TestNestedResourceID(t *testing.T) {
+	// A stand-in for pdflatex that only writes a pdf if the resource was placed where the template expects it
+	engine := filepath.Join(t.TempDir(), "pdflatex")
+	script := "#!/bin/sh\nfor a; do case $a in -jobname=*) jn=${a#-jobname=};; esac; done\n" +
+		"test -f images/logo.png && printf '%%PDF-1.4\\n%%%%EOF\\n' > $jn.pdf\n"
+	if err := ioutil.WriteFile(engine, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	l := log.New(ioutil.Discard, "", 0)
+	s, err := NewServer(t.TempDir(), engine, nil, l, l, Config{Cache: CacheConfig{TmplSize: 5, RscSize: 5}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := http.Header{"Content-Type": {"application/json"}}
+	for _, body := range []string{`{"id":"images/logo.png","data":"aGk="}`, `{"id":"doc.tex","data":"aGk="}`} {
+		if w := serve(s, "POST", "/register", bytes.NewReader([]byte(body)), header); w.Code != http.StatusOK {
+			t.Fatalf("expected %s to be registered, got %d: %s", body, w.Code, w.Body)
+		}
+	}
+	if _, err := ioutil.ReadFile(filepath.Join(s.rootDir, "images", "logo.png")); err != nil {
+		t.Fatal(err)
+	}
+	w := serve(s, "POST", "/generate?tmpl=doc.tex&rsc=images/logo.png", nil, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected a 200, got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestTexDependenciesSkipsInvalidNames(t *testing.T) {
+	src := []byte(`\input{sections/terms}\input{\jobname.aux}\include{../secret}\input{/etc/passwd}`)
+	deps := texDependencies(src)
+	if len(deps) != 1 || deps[0] != "sections/terms" {
+		t.Errorf("expected only sections/terms, got %q", deps)
+	}
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Strategies for placing resources from the root directory into a working directory.
+// Each strategy falls back to the ones after it if it fails (e.g. when the root and working directories are on different mounts).
+const (
+	PlaceSymlink  = "symlink"
+	PlaceHardlink = "hardlink"
+	PlaceCopy     = "copy"
+)
+
+var placementStrategies = []string{PlaceSymlink, PlaceHardlink, PlaceCopy}
+
+func (s *Server) setPlacement(strategy string) error {
+	strategy = strings.ToLower(strategy)
+	if strategy == "" {
+		s.placement = PlaceSymlink
+		return nil
+	}
+	for _, ps := range placementStrategies {
+		if ps == strategy {
+			s.placement = strategy
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown resource placement strategy: %s", strategy)
+}
+
+// placeResource places the file at src at dst using the servers placement strategy, falling back to the next strategy on failure.
+func (s *Server) placeResource(src, dst string) error {
+	var err error
+	fallback := false
+	for _, ps := range placementStrategies {
+		if ps == s.placement {
+			fallback = true
+		}
+		if !fallback {
+			continue
+		}
+		switch ps {
+		case PlaceSymlink:
+			err = os.Symlink(src, dst)
+		case PlaceHardlink:
+			err = os.Link(src, dst)
+		case PlaceCopy:
+			err = copyFile(src, dst)
+		}
+		if err == nil {
+			return nil
+		}
+		s.infoLog.Printf("couldn't %s %s into working directory, falling back: %v", ps, src, err)
+	}
+	return err
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	_, err = streamToFile(dst, in)
+	return err
+}
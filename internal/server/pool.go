@@ -0,0 +1,89 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+// defaultMaxQueued is how many compilations may wait for a slot when the number of concurrent compilations is limited,
+// unless configured otherwise.
+const defaultMaxQueued = 100
+
+// errPoolFull is returned when a compilation can't even wait for a slot because too many already are.
+var errPoolFull = errors.New("too many compilations are waiting to be run")
+
+// compilePool limits how many compilations run at once, queueing the rest.
+type compilePool struct {
+	slots     chan struct{}
+	maxQueued int
+	queued    int
+	// average is a moving average of how long compilations hold their slot for, used to tell clients when to retry
+	average time.Duration
+	sync.Mutex
+}
+
+// asyncJobKey marks the contexts of requests handled by asynchronous jobs, which wait for a slot however long the queue is.
+type asyncJobKey struct{}
+
+func (s *Server) setupPool(maxConcurrent, maxQueued int) {
+	if maxConcurrent <= 0 {
+		return
+	}
+	if maxQueued <= 0 {
+		maxQueued = defaultMaxQueued
+	}
+	s.pool = &compilePool{slots: make(chan struct{}, maxConcurrent), maxQueued: maxQueued, average: time.Second}
+}
+
+// acquire waits for a slot to compile in, returning the function that releases it.
+// It returns errPoolFull if the queue is full, unless bounded is false, and the contexts error if it's done before a slot frees up.
+func (p *compilePool) acquire(ctx context.Context, bounded bool) (func(), error) {
+	if p == nil {
+		return func() {}, nil
+	}
+	p.Lock()
+	if bounded && p.queued >= p.maxQueued {
+		p.Unlock()
+		return nil, errPoolFull
+	}
+	p.queued++
+	p.Unlock()
+	defer func() {
+		p.Lock()
+		p.queued--
+		p.Unlock()
+	}()
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	start := time.Now()
+	return func() {
+		<-p.slots
+		p.Lock()
+		p.average = (p.average*7 + time.Since(start)) / 8
+		p.Unlock()
+	}, nil
+}
+
+// waiting returns how many compilations are waiting for a slot.
+func (p *compilePool) waiting() int {
+	if p == nil {
+		return 0
+	}
+	p.Lock()
+	defer p.Unlock()
+	return p.queued
+}
+
+// retryAfter estimates how many seconds it'll take for the queue to drain.
+func (p *compilePool) retryAfter() int {
+	p.Lock()
+	defer p.Unlock()
+	drain := p.average.Seconds() * float64(p.queued) / float64(cap(p.slots))
+	return int(math.Max(1, math.Ceil(drain)))
+}
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxProfileRuns bounds how many times a profile may compile its payload in each cache state.
+const maxProfileRuns = 20
+
+// profileRun is a single compilation done while profiling.
+type profileRun struct {
+	Milliseconds float64 `json:"ms"`
+	// Phases maps the phases of the compilation to how long they took, in milliseconds
+	Phases map[string]float64 `json:"phases"`
+	// Cache is whether the template was already parsed and cached in memory; either hit or miss
+	Cache string `json:"cache"`
+}
+
+// profileSummary sums up the runs done in one cache state.
+type profileSummary struct {
+	Runs   []profileRun       `json:"runs"`
+	MinMS  float64            `json:"min_ms"`
+	MeanMS float64            `json:"mean_ms"`
+	MaxMS  float64            `json:"max_ms"`
+	Phases map[string]float64 `json:"phases_mean_ms"`
+}
+
+func (ps *profileSummary) add(run profileRun) {
+	if len(ps.Runs) == 0 || run.Milliseconds < ps.MinMS {
+		ps.MinMS = run.Milliseconds
+	}
+	if run.Milliseconds > ps.MaxMS {
+		ps.MaxMS = run.Milliseconds
+	}
+	n := float64(len(ps.Runs))
+	ps.MeanMS = (ps.MeanMS*n + run.Milliseconds) / (n + 1)
+	for phase, ms := range run.Phases {
+		ps.Phases[phase] = (ps.Phases[phase]*n + ms) / (n + 1)
+	}
+	ps.Runs = append(ps.Runs, run)
+}
+
+// parseServerTiming parses the phases out of a Server-Timing header, mapping them to their durations in milliseconds.
+func parseServerTiming(header string) map[string]float64 {
+	phases := map[string]float64{}
+	for _, metric := range strings.Split(header, ",") {
+		parts := strings.Split(strings.TrimSpace(metric), ";")
+		for _, param := range parts[1:] {
+			if d := strings.TrimPrefix(strings.TrimSpace(param), "dur="); d != param {
+				if ms, err := strconv.ParseFloat(d, 64); err == nil {
+					phases[parts[0]] = ms
+				}
+			}
+		}
+	}
+	return phases
+}
+
+// evictProfiled evicts the template and resources that a /generate request uses from the caches, so that the next time
+// its compiled is as if it were the first.
+func (s *Server) evictProfiled(body []byte, q url.Values) error {
+	var inline struct {
+		Template   string      `json:"template"`
+		Delimiters *delimiters `json:"delimiters"`
+	}
+	if err := json.Unmarshal(body, &inline); err == nil && inline.Template != "" {
+		if src, err := base64.StdEncoding.DecodeString(inline.Template); err == nil {
+			delims := defaultDelims
+			if inline.Delimiters != nil {
+				delims = *inline.Delimiters
+			}
+			s.tmpls.Lock()
+			s.tmpls.t.Remove(templateKey(sourceHash(src), delims))
+			s.tmpls.Unlock()
+		}
+	}
+	if id := q.Get("tmpl"); id != "" {
+		if _, err := s.evictTemplate(id); err != nil {
+			return err
+		}
+	}
+	for _, ref := range q["rsc"] {
+		if rr, err := parseResourceRef(ref); err == nil {
+			if _, err := s.evictResource(rr.ID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Server) handleProfile() http.HandlerFunc {
+	type request struct {
+		// Generate is a /generate request body, and Query the query string of its URL (e.g. "tmpl=ID&dtls=ID")
+		Generate map[string]interface{} `json:"generate,omitempty"`
+		Query    string                 `json:"query,omitempty"`
+		// Runs is how many times the payload is compiled with cold caches, and then with warm ones; defaults to 3
+		Runs int `json:"runs,omitempty"`
+	}
+	type response struct {
+		// Cold runs have the template and resources evicted from the caches beforehand, warm ones don't
+		Cold profileSummary `json:"cold"`
+		Warm profileSummary `json:"warm"`
+	}
+	generate := s.handleGenerate()
+	s.apiSchema("profileRequest", request{})
+	s.apiSchema("profileResponse", response{})
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req request
+		if err := s.decode(r.Body, &req); err != nil {
+			msg := "error while parsing json body: " + err.Error()
+			s.errLog.Println(msg)
+			s.fail(w, r, CodeInvalidJSON, msg, http.StatusBadRequest)
+			return
+		}
+		r.Body.Close()
+		if req.Runs <= 0 {
+			req.Runs = 3
+		}
+		if req.Runs > maxProfileRuns {
+			s.fail(w, r, CodeBadRequest, "can't do more than "+strconv.Itoa(maxProfileRuns)+" runs", http.StatusBadRequest)
+			return
+		}
+		body, err := json.Marshal(req.Generate)
+		if err != nil {
+			s.fail(w, r, CodeBadRequest, err.Error(), http.StatusBadRequest)
+			return
+		}
+		q, err := url.ParseQuery(req.Query)
+		if err != nil {
+			s.fail(w, r, CodeBadRequest, "invalid query: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp := response{
+			Cold: profileSummary{Runs: []profileRun{}, Phases: map[string]float64{}},
+			Warm: profileSummary{Runs: []profileRun{}, Phases: map[string]float64{}},
+		}
+		for _, summary := range []*profileSummary{&resp.Cold, &resp.Warm} {
+			for i := 0; i < req.Runs; i++ {
+				if summary == &resp.Cold {
+					if err := s.evictProfiled(body, q); err != nil {
+						s.errLog.Println(err)
+						s.fail(w, r, CodeInternal, err.Error(), http.StatusInternalServerError)
+						return
+					}
+				}
+				gr := r.Clone(r.Context())
+				gr.URL = &url.URL{Path: "/generate", RawQuery: req.Query}
+				gr.Header = http.Header{"Content-Type": {"application/json"}}
+				gr.Body = ioutil.NopCloser(bytes.NewReader(body))
+				gr.ContentLength = int64(len(body))
+				rb := &responseBuffer{header: http.Header{}}
+				start := time.Now()
+				generate(rb, gr)
+				elapsed := time.Since(start)
+				if rb.code != http.StatusOK {
+					er := apiError{
+						Code:  errorCode(rb.body.Bytes(), CodeCompileFailed),
+						Error: s.localize(r, "error while generating pdf"),
+						Data:  rb.body.String(),
+					}
+					s.failWith(w, r, &er, rb.code)
+					return
+				}
+				summary.add(profileRun{
+					Milliseconds: float64(elapsed.Microseconds()) / 1000,
+					Phases:       parseServerTiming(rb.header.Get("Server-Timing")),
+					Cache:        rb.header.Get("X-Latte-Cache"),
+				})
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		s.respond(w, &resp, http.StatusOK)
+	}
+}
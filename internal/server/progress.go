@@ -0,0 +1,191 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+)
+
+const (
+	// jobLogBacklog is how many lines of compiler output are kept for each running job, for those who start following it late
+	jobLogBacklog = 1000
+	// jobLogMaxLine is how long a line of compiler output sent to followers (or WebSocket clients) can be; longer ones are split
+	jobLogMaxLine = 4096
+	// followerBuffer is how many events can be waiting to be sent to a follower before it's dropped for falling behind
+	followerBuffer = 256
+)
+
+// Kinds of the events sent to those following a job.
+const (
+	eventStatus = "status"
+	eventLog    = "log"
+)
+
+// jobEvent is something that happened to an asynchronous job: its status changing, or its compiler writing a line of output.
+type jobEvent struct {
+	// id orders the events of a job, so that followers can pick up where they left off
+	id   int
+	kind string
+	data string
+}
+
+// jobFeed holds the events of a job that hasn't finished yet, and sends them to those following it.
+type jobFeed struct {
+	seq int
+	// backlog holds the latest lines of compiler output
+	backlog   []jobEvent
+	followers map[chan jobEvent]bool
+}
+
+// feed returns the feed of the job with the given id, creating it if it doesn't exist. Callers hold the lock.
+func (js *jobs) feed(id string) *jobFeed {
+	if js.feeds == nil {
+		js.feeds = map[string]*jobFeed{}
+	}
+	f, ok := js.feeds[id]
+	if !ok {
+		f = &jobFeed{followers: map[chan jobEvent]bool{}}
+		js.feeds[id] = f
+	}
+	return f
+}
+
+// send sends an event to everyone following the feed, dropping followers who've fallen too far behind; they can
+// follow it again from where they left off.
+func (f *jobFeed) send(kind, data string) jobEvent {
+	f.seq++
+	e := jobEvent{id: f.seq, kind: kind, data: data}
+	for ch := range f.followers {
+		select {
+		case ch <- e:
+		default:
+			delete(f.followers, ch)
+			close(ch)
+		}
+	}
+	return e
+}
+
+// publish sends the status of the job to its followers once it's changed, and ends the feed once it's finished.
+// Callers hold the lock.
+func (js *jobs) publish(j *asyncJob) {
+	f, ok := js.feeds[j.ID]
+	if !ok {
+		return
+	}
+	status, _ := json.Marshal(j)
+	f.send(eventStatus, string(status))
+	if j.Finished != nil {
+		for ch := range f.followers {
+			close(ch)
+		}
+		delete(js.feeds, j.ID)
+	}
+}
+
+// log sends a line of the compiler output of the job with the given id to its followers.
+func (js *jobs) log(id, line string) {
+	js.Lock()
+	defer js.Unlock()
+	if j, ok := js.jobs[id]; !ok || j.Finished != nil {
+		return
+	}
+	f := js.feed(id)
+	f.backlog = append(f.backlog, f.send(eventLog, line))
+	if len(f.backlog) > jobLogBacklog {
+		f.backlog = f.backlog[len(f.backlog)-jobLogBacklog:]
+	}
+}
+
+// follow returns the events of the job with the given id that came after the one with the id last (or all that are kept,
+// if it's zero), ending with its current status, along with the channel its next events are sent to until it's finished.
+// The channel is nil if the job has already finished, and unfollow must be called once the caller stops following it.
+func (js *jobs) follow(id string, last int) ([]jobEvent, chan jobEvent) {
+	js.Lock()
+	defer js.Unlock()
+	j, ok := js.jobs[id]
+	if !ok {
+		return nil, nil
+	}
+	status, _ := json.Marshal(j)
+	if j.Finished != nil {
+		return []jobEvent{{kind: eventStatus, data: string(status)}}, nil
+	}
+	f := js.feed(id)
+	var events []jobEvent
+	for _, e := range f.backlog {
+		if e.id > last {
+			events = append(events, e)
+		}
+	}
+	events = append(events, jobEvent{id: f.seq, kind: eventStatus, data: string(status)})
+	ch := make(chan jobEvent, followerBuffer)
+	f.followers[ch] = true
+	return events, ch
+}
+
+// unfollow stops sending the events of the job with the given id to ch.
+func (js *jobs) unfollow(id string, ch chan jobEvent) {
+	js.Lock()
+	defer js.Unlock()
+	if f, ok := js.feeds[id]; ok && f.followers[ch] {
+		delete(f.followers, ch)
+		close(ch)
+	}
+}
+
+// compileLogKey holds a function sent each line of the compiler output of a request's compilation as it's written, in the
+// contexts of requests whose client is following the compilation as it runs.
+type compileLogKey struct{}
+
+// lineLog is written the output of a compiler, which it sends on a line at a time.
+type lineLog struct {
+	send func(line string)
+	line []byte
+}
+
+func (l *lineLog) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			l.line = append(l.line, p...)
+			if len(l.line) >= jobLogMaxLine {
+				l.flush()
+			}
+			break
+		}
+		l.line = append(l.line, p[:i]...)
+		l.flush()
+		p = p[i+1:]
+	}
+	return n, nil
+}
+
+// flush sends whatever's been written since the last full line.
+func (l *lineLog) flush() {
+	for len(l.line) > 0 {
+		line := l.line
+		if len(line) > jobLogMaxLine {
+			line = line[:jobLogMaxLine]
+		}
+		l.send(string(bytes.TrimSuffix(line, []byte{'\r'})))
+		l.line = l.line[len(line):]
+	}
+	l.line = l.line[:0]
+}
+
+// writeEvent writes the event in the text/event-stream format.
+func writeEvent(b *bytes.Buffer, e jobEvent) {
+	if e.id > 0 {
+		b.WriteString("id: " + strconv.Itoa(e.id) + "\n")
+	}
+	b.WriteString("event: " + e.kind + "\n")
+	// Every line of the data needs a field of its own
+	for _, line := range bytes.Split([]byte(e.data), []byte{'\n'}) {
+		b.WriteString("data: ")
+		b.Write(line)
+		b.WriteByte('\n')
+	}
+	b.WriteByte('\n')
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Version is the version of LaTTe recorded in the provenance of generated PDFs.
+// It's meant to be set when building, e.g. -ldflags "-X github.com/raphaelreyna/latte/internal/server.Version=v0.11.0".
+var Version = "dev"
+
+// provenanceFile is the name the provenance record is attached to PDFs under.
+const provenanceFile = "latte-provenance.json"
+
+// provenance records how a PDF was made, so that a PDF found in the wild can be traced back to its inputs.
+type provenance struct {
+	Latte         string `json:"latte"`
+	Engine        string `json:"engine"`
+	EngineVersion string `json:"engine_version,omitempty"`
+	// Template and Details are the ids of the registered template and details used, if any
+	Template       string `json:"template,omitempty"`
+	TemplateSHA256 string `json:"template_sha256"`
+	Details        string `json:"details,omitempty"`
+	DetailsSHA256  string `json:"details_sha256"`
+	Created        string `json:"created"`
+}
+
+// engineVersion returns the first line of the compilers --version output, which is only looked up once per compiler.
+func (s *Server) engineVersion(engine string) string {
+	s.engineMu.Lock()
+	defer s.engineMu.Unlock()
+	if v, ok := s.engineVers[engine]; ok {
+		return v
+	}
+	out, err := exec.Command(engine, "--version").Output()
+	if err != nil {
+		s.errLog.Printf("error while getting version of %s: %v", engine, err)
+	}
+	line, _ := bufio.NewReader(bytes.NewReader(out)).ReadString('\n')
+	if s.engineVers == nil {
+		s.engineVers = map[string]string{}
+	}
+	s.engineVers[engine] = strings.TrimSpace(line)
+	return s.engineVers[engine]
+}
+
+// sourceDate returns the time that SOURCE_DATE_EPOCH is set to in env, or the current time if it isn't set.
+func sourceDate(env []string) time.Time {
+	for _, v := range env {
+		if strings.HasPrefix(v, "SOURCE_DATE_EPOCH=") {
+			if epoch, err := strconv.ParseInt(strings.TrimPrefix(v, "SOURCE_DATE_EPOCH="), 10, 64); err == nil {
+				return time.Unix(epoch, 0)
+			}
+		}
+	}
+	return time.Now()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// newProvenance creates the provenance record for a compilation, using SOURCE_DATE_EPOCH as the time it was made if its set.
+func (s *Server) newProvenance(engine, tmplID string, src []byte, dtlsID string, details map[string]interface{}, env []string) ([]byte, error) {
+	// Map keys are marshalled in order, so equal details always hash the same
+	dtls, err := json.Marshal(details)
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(&provenance{
+		Latte:          Version,
+		Engine:         engine,
+		EngineVersion:  s.engineVersion(engine),
+		Template:       tmplID,
+		TemplateSHA256: sha256Hex(src),
+		Details:        dtlsID,
+		DetailsSHA256:  sha256Hex(dtls),
+		Created:        sourceDate(env).UTC().Format(time.RFC3339),
+	}, "", "  ")
+}
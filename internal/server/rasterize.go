@@ -0,0 +1,47 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"sort"
+)
+
+// rasterize renders every page of the PDF at pdfPath into dir as a PNG at the given resolution, using Ghostscript.
+// It returns the paths of the rendered pages, in order.
+func rasterize(ctx context.Context, pdfPath, dir string, dpi int) ([]string, error) {
+	return renderPages(ctx, pdfPath, dir, outputPNG, dpi, 0, 0)
+}
+
+// renderPages renders the pages first through last (counting from 1) of the PDF at pdfPath into dir as images of the given
+// format, png or jpeg, at the given resolution, using Ghostscript; if first is 0, every page is rendered.
+// It returns the paths of the rendered pages, in order.
+func renderPages(ctx context.Context, pdfPath, dir, format string, dpi, first, last int) ([]string, error) {
+	if _, err := exec.LookPath(ghostscript); err != nil {
+		return nil, errors.New("ghostscript is required for rendering pages but is not installed")
+	}
+	device := "png16m"
+	if format == outputJPEG {
+		device = "jpeg"
+	}
+	base := filepath.Base(pdfPath)
+	base = base[:len(base)-len(filepath.Ext(base))]
+	out := filepath.Join(dir, base+"-page-%04d."+format)
+	args := []string{
+		"-dSAFER", "-dBATCH", "-dNOPAUSE", "-dQUIET",
+		"-sDEVICE=" + device, "-dTextAlphaBits=4", "-dGraphicsAlphaBits=4",
+		fmt.Sprintf("-r%d", dpi),
+	}
+	if first > 0 {
+		args = append(args, fmt.Sprintf("-dFirstPage=%d", first), fmt.Sprintf("-dLastPage=%d", last))
+	}
+	args = append(args, "-o", out, pdfPath)
+	if output, err := exec.CommandContext(ctx, ghostscript, args...).CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("error while rendering %s: %v: %s", filepath.Base(pdfPath), err, output)
+	}
+	pages, err := filepath.Glob(filepath.Join(dir, base+"-page-*."+format))
+	sort.Strings(pages)
+	return pages, err
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// defaultRoles are the roles that exist without being configured, mapped to the permissions they grant.
+var defaultRoles = map[string][]string{
+	"admin":           {PermAdmin},
+	"template-author": {PermGenerate, PermRegister, PermLibrary, PermCache, PermRead},
+	"renderer":        {PermGenerate},
+	"read-only":       {PermRead},
+}
+
+// RBACConfig configures roles and the API keys they're given to.
+// It's loaded from either a JSON file on disk or a JSON file registered in the db.
+type RBACConfig struct {
+	// File is the path of the JSON file.
+	File string
+	// ID is the id of the registered JSON file.
+	ID string
+}
+
+// rbacDocument is the JSON document roles and API keys are configured with.
+type rbacDocument struct {
+	// Roles defines additional roles, or redefines the default ones, as lists of permissions
+	Roles map[string][]string `json:"roles"`
+	// Keys maps API keys, or "sha256:" followed by the hex encoded hash of an API key, to who they belong to and their roles
+	Keys map[string]struct {
+		Name   string   `json:"name"`
+		Tenant string   `json:"tenant"`
+		Roles  []string `json:"roles"`
+	} `json:"keys"`
+}
+
+// rolePermissions returns the permissions granted by the roles.
+func (s *Server) rolePermissions(roles []string) (map[string]bool, error) {
+	perms := map[string]bool{}
+	for _, role := range roles {
+		granted, ok := s.roles[role]
+		if !ok {
+			return nil, fmt.Errorf("unknown role: %s", role)
+		}
+		for _, perm := range granted {
+			perms[perm] = true
+		}
+	}
+	return perms, nil
+}
+
+// keyring authenticates requests by their API key.
+type keyring struct {
+	// keys are kept hashed so that comparing them doesn't leak how much of a key was guessed correctly
+	keys map[[sha256.Size]byte]*principal
+}
+
+func (k *keyring) authenticate(ctx context.Context, key string) (*principal, error) {
+	if p, ok := k.keys[sha256.Sum256([]byte(key))]; ok {
+		return p, nil
+	}
+	return nil, &AuthError{reason: "unknown api key"}
+}
+
+// loadRBAC sets up the roles and, if they're configured, the keyring.
+func (s *Server) loadRBAC(ctx context.Context, cfg *RBACConfig) (*keyring, error) {
+	s.roles = map[string][]string{}
+	for role, perms := range defaultRoles {
+		s.roles[role] = perms
+	}
+	if cfg == nil || (cfg.File == "" && cfg.ID == "") {
+		return nil, nil
+	}
+	path := cfg.File
+	if path == "" {
+		s.rbacID = cfg.ID
+		path = filepath.Join(s.rootDir, cfg.ID)
+		if err := s.fetchToDisk(ctx, cfg.ID, path); err != nil {
+			return nil, err
+		}
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc rbacDocument
+	if err = json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("error while decoding roles and keys: %v", err)
+	}
+	valid := map[string]bool{}
+	for _, perm := range Permissions {
+		valid[perm] = true
+	}
+	for role, perms := range doc.Roles {
+		for _, perm := range perms {
+			if !valid[perm] {
+				return nil, fmt.Errorf("role %s has unknown permission: %s", role, perm)
+			}
+		}
+		s.roles[role] = perms
+	}
+	k := &keyring{keys: map[[sha256.Size]byte]*principal{}}
+	for key, owner := range doc.Keys {
+		perms, err := s.rolePermissions(owner.Roles)
+		if err != nil {
+			return nil, fmt.Errorf("error in key for %s: %v", owner.Name, err)
+		}
+		var hash [sha256.Size]byte
+		if strings.HasPrefix(key, "sha256:") {
+			h, err := hex.DecodeString(strings.TrimPrefix(key, "sha256:"))
+			if err != nil || len(h) != sha256.Size {
+				return nil, fmt.Errorf("invalid hash of key for %s", owner.Name)
+			}
+			copy(hash[:], h)
+		} else {
+			hash = sha256.Sum256([]byte(key))
+		}
+		k.keys[hash] = &principal{subject: owner.Name, tenant: owner.Tenant, roles: owner.Roles, permissions: perms}
+	}
+	return k, nil
+}
+
+// authenticators tries each of its authenticators in turn, returning the first principal one of them accepts.
+type authenticators []authenticator
+
+func (as authenticators) authenticate(ctx context.Context, token string) (*principal, error) {
+	var err error
+	for _, a := range as {
+		var p *principal
+		if p, err = a.authenticate(ctx, token); err == nil {
+			return p, nil
+		}
+		var ae *AuthError
+		if !errors.As(err, &ae) {
+			return nil, err
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,323 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RedisConfig configures keeping files in Redis, which suits small templates and details that are used a lot.
+type RedisConfig struct {
+	// URL is where Redis is, as redis://[:PASSWORD@]HOST[:PORT][/DB], or rediss:// to connect over TLS.
+	URL string
+	// Prefix is prepended to the ids of files to get their keys, e.g. latte:.
+	Prefix string
+	// TTLs maps patterns of file ids (as matched by path.Match, e.g. *.json or tmp-*) to how long files matching them
+	// are kept for; the first matching pattern wins, and files matching none are kept until they're deleted.
+	TTLs []RedisTTL
+}
+
+// RedisTTL is how long files whose ids match a pattern are kept for in Redis.
+type RedisTTL struct {
+	Pattern string
+	TTL     time.Duration
+}
+
+// redisPoolSize is how many idle connections to Redis are kept around.
+const redisPoolSize = 8
+
+// redisTimeout bounds each command sent to Redis, unless its context has an earlier deadline.
+const redisTimeout = 10 * time.Second
+
+// RedisDB is a DB that keeps files in Redis, speaking its protocol directly.
+type RedisDB struct {
+	addr     string
+	password string
+	db       int
+	tls      *tls.Config
+	prefix   string
+	ttls     []RedisTTL
+	idle     chan *redisConn
+}
+
+// RedisError is an error reply from Redis.
+type RedisError struct {
+	msg string
+}
+
+func (e *RedisError) Error() string {
+	return "redis: " + e.msg
+}
+
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// NewRedisDB returns a DB keeping files in the Redis at the configured URL; connections are made as they're needed.
+func NewRedisDB(cfg RedisConfig) (*RedisDB, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil || (u.Scheme != "redis" && u.Scheme != "rediss") || u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid redis url: %s", cfg.URL)
+	}
+	rdb := &RedisDB{addr: u.Host, prefix: cfg.Prefix, ttls: cfg.TTLs, idle: make(chan *redisConn, redisPoolSize)}
+	if u.Port() == "" {
+		rdb.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		rdb.password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if rdb.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("invalid redis database: %s", db)
+		}
+	}
+	if u.Scheme == "rediss" {
+		rdb.tls = &tls.Config{ServerName: u.Hostname()}
+	}
+	for _, t := range cfg.TTLs {
+		if _, err := path.Match(t.Pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid redis ttl pattern: %s", t.Pattern)
+		}
+	}
+	return rdb, nil
+}
+
+// Store sets the key of the file to its contents, replacing anything already there, with the TTL of the first pattern its id matches.
+func (rdb *RedisDB) Store(ctx context.Context, uid string, data io.Reader) error {
+	contents, err := ioutil.ReadAll(data)
+	if err != nil {
+		return err
+	}
+	args := []string{"SET", rdb.prefix + uid, string(contents)}
+	if ttl := rdb.ttl(uid); ttl > 0 {
+		args = append(args, "PX", strconv.FormatInt(int64(ttl/time.Millisecond), 10))
+	}
+	_, err = rdb.do(ctx, args...)
+	return err
+}
+
+// Fetch gets the contents of the file from its key.
+func (rdb *RedisDB) Fetch(ctx context.Context, uid string) (io.ReadCloser, error) {
+	reply, err := rdb.do(ctx, "GET", rdb.prefix+uid)
+	if err != nil {
+		return nil, err
+	}
+	if reply == nil {
+		return nil, &NotFoundError{}
+	}
+	data, ok := reply.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("redis: unexpected reply to GET: %v", reply)
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+// Ping checks that Redis can be reached, and that the password (if any) is accepted.
+func (rdb *RedisDB) Ping(ctx context.Context) error {
+	_, err := rdb.do(ctx, "PING")
+	return err
+}
+
+// List scans the keys starting with the prefix, returning the ids of the files they hold.
+func (rdb *RedisDB) List(ctx context.Context, prefix string) ([]string, error) {
+	// Glob characters in the prefix are matched literally
+	match := strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`).Replace(rdb.prefix+prefix) + "*"
+	var uids []string
+	cursor := "0"
+	for {
+		reply, err := rdb.do(ctx, "SCAN", cursor, "MATCH", match, "COUNT", "1000")
+		if err != nil {
+			return nil, err
+		}
+		page, ok := reply.([]interface{})
+		if !ok || len(page) != 2 {
+			return nil, fmt.Errorf("redis: unexpected reply to SCAN: %v", reply)
+		}
+		next, _ := page[0].([]byte)
+		keys, _ := page[1].([]interface{})
+		for _, key := range keys {
+			if k, ok := key.([]byte); ok {
+				uids = append(uids, strings.TrimPrefix(string(k), rdb.prefix))
+			}
+		}
+		// SCAN is done once it comes back around to the start
+		if cursor = string(next); cursor == "0" || cursor == "" {
+			return uids, nil
+		}
+	}
+}
+
+// ListSizes scans the keys starting with the prefix, returning the sizes of the files they hold. Redis doesn't list
+// sizes along with keys, so each key is asked for its length, which is still much cheaper than fetching it.
+func (rdb *RedisDB) ListSizes(ctx context.Context, prefix string) (map[string]int64, error) {
+	uids, err := rdb.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	sizes := make(map[string]int64, len(uids))
+	for _, uid := range uids {
+		reply, err := rdb.do(ctx, "STRLEN", rdb.prefix+uid)
+		if err != nil {
+			return nil, err
+		}
+		// Keys that expired since they were scanned have a length of zero
+		if n, _ := reply.(int64); n > 0 {
+			sizes[uid] = n
+		}
+	}
+	return sizes, nil
+}
+
+// Delete removes the key of the file.
+func (rdb *RedisDB) Delete(ctx context.Context, uid string) error {
+	reply, err := rdb.do(ctx, "DEL", rdb.prefix+uid)
+	if err != nil {
+		return err
+	}
+	if n, _ := reply.(int64); n == 0 {
+		return &NotFoundError{}
+	}
+	return nil
+}
+
+// ttl returns how long the file with the given id is kept for, or zero if it's kept until it's deleted.
+func (rdb *RedisDB) ttl(uid string) time.Duration {
+	for _, t := range rdb.ttls {
+		if ok, _ := path.Match(t.Pattern, uid); ok {
+			return t.TTL
+		}
+	}
+	return 0
+}
+
+// do sends a command over an idle connection (or a new one), returning its reply: nil, a []byte, an int64, a string
+// for simple replies, or a []interface{} of any of those. Error replies are returned as a *RedisError.
+func (rdb *RedisDB) do(ctx context.Context, args ...string) (interface{}, error) {
+	conn, err := rdb.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := conn.command(ctx, args...)
+	// Connections are only reused if they're still in a known state, which they are after error replies but not other errors
+	var re *RedisError
+	if err != nil && !errors.As(err, &re) {
+		conn.Close()
+		return nil, err
+	}
+	select {
+	case rdb.idle <- conn:
+	default:
+		conn.Close()
+	}
+	return reply, err
+}
+
+// conn returns an idle connection, or dials a new one, authenticating and selecting the database on it.
+func (rdb *RedisDB) conn(ctx context.Context) (*redisConn, error) {
+	select {
+	case conn := <-rdb.idle:
+		return conn, nil
+	default:
+	}
+	dialer := &net.Dialer{Timeout: redisTimeout}
+	var c net.Conn
+	var err error
+	if rdb.tls != nil {
+		c, err = (&tls.Dialer{NetDialer: dialer, Config: rdb.tls}).DialContext(ctx, "tcp", rdb.addr)
+	} else {
+		c, err = dialer.DialContext(ctx, "tcp", rdb.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn := &redisConn{Conn: c, r: bufio.NewReader(c)}
+	if rdb.password != "" {
+		if _, err = conn.command(ctx, "AUTH", rdb.password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if rdb.db != 0 {
+		if _, err = conn.command(ctx, "SELECT", strconv.Itoa(rdb.db)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// command writes the command as an array of bulk strings and reads its reply.
+func (conn *redisConn) command(ctx context.Context, args ...string) (interface{}, error) {
+	deadline := time.Now().Add(redisTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := conn.Write(b.Bytes()); err != nil {
+		return nil, err
+	}
+	return conn.reply()
+}
+
+func (conn *redisConn) reply() (interface{}, error) {
+	line, err := conn.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, &RedisError{msg: line[1:]}
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		data := make([]byte, n+2)
+		if _, err = io.ReadFull(conn.r, data); err != nil {
+			return nil, err
+		}
+		return data[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			// The rest of the array has to be read even if an item is an error, to keep the connection usable
+			var re *RedisError
+			if items[i], err = conn.reply(); errors.As(err, &re) {
+				items[i] = re
+			} else if err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply: %q", line)
+}
@@ -1,9 +1,7 @@
 package server
 
 import (
-	"encoding/base64"
-	"encoding/json"
-	"io/ioutil"
+	"io"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -13,20 +11,41 @@ func (s *Server) handleRegister() http.HandlerFunc {
 	type request struct {
 		ID   string `json:"id"`
 		Data string `json:"data"`
+		// Encoding is the compression applied to the file before it was base64 encoded, if any
+		Encoding string `json:"encoding,omitempty"`
 	}
 	type response struct {
 		ID string `json:"id"`
+		// Derived lists the ids of files created from the registered one, e.g. a PDF version of an SVG image
+		Derived []string `json:"derived,omitempty"`
 	}
+	s.apiSchema("registerRequest", request{})
+	s.apiSchema("registerResponse", response{})
 	return func(w http.ResponseWriter, r *http.Request) {
 		var req request
 		var err error
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		if err := s.decode(r.Body, &req); err != nil {
 			msg := "error while parsing json body: " + err.Error()
 			s.errLog.Println(msg)
-			s.respond(w, msg, http.StatusInternalServerError)
+			s.fail(w, r, CodeInvalidJSON, msg, http.StatusBadRequest)
 			return
 		}
 		r.Body.Close()
+		if err = checkName(req.ID); err != nil {
+			s.fail(w, r, CodeBadRequest, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = s.checkTemplateAccess(r.Context(), req.ID, aclModify)
+		switch err.(type) {
+		case nil:
+		case *ForbiddenError:
+			s.fail(w, r, CodeForbidden, err.Error(), http.StatusForbidden)
+			return
+		default:
+			s.errLog.Println(err)
+			s.fail(w, r, CodeInternal, err.Error(), http.StatusInternalServerError)
+			return
+		}
 
 		fpath := filepath.Join(s.rootDir, req.ID)
 		if _, err = os.Stat(fpath); err == nil {
@@ -34,8 +53,14 @@ func (s *Server) handleRegister() http.HandlerFunc {
 			s.respond(w, &response{ID: req.ID}, http.StatusConflict)
 			return
 		} else if os.IsNotExist(err) {
+			// Ids may name files in subdirectories
+			if err = os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
+				s.errLog.Println(err)
+				s.fail(w, r, CodeInternal, err.Error(), http.StatusInternalServerError)
+				return
+			}
 			if s.db != nil {
-				var datai interface{}
+				var datai io.ReadCloser
 				// If file not found in local disk, check db
 				datai, err = s.db.Fetch(r.Context(), req.ID)
 				switch err.(type) {
@@ -44,11 +69,11 @@ func (s *Server) handleRegister() http.HandlerFunc {
 				default:
 					if err != nil {
 						s.errLog.Println(err)
-						s.respond(w, err.Error(), http.StatusInternalServerError)
+						s.fail(w, r, CodeInternal, err.Error(), http.StatusInternalServerError)
 						return
 					} else if datai != nil {
 						go func() {
-							err = toDisk(datai, fpath)
+							err := toDisk(datai, fpath)
 							if err != nil {
 								s.errLog.Printf("error while creating file at %s: %v", fpath, err)
 								return
@@ -62,30 +87,32 @@ func (s *Server) handleRegister() http.HandlerFunc {
 				}
 			}
 			// File doesn't exist locally (or in db)
-			bytes, err := base64.StdEncoding.DecodeString(req.Data)
-			if err != nil {
-				s.errLog.Println(err)
-				s.respond(w, err.Error(), http.StatusInternalServerError)
+			ef := encodedFile{Data: req.Data, Encoding: req.Encoding}
+			err = ef.writeTo(fpath, s.maxRscBytes)
+			if _, ok := err.(*TooLargeError); ok {
+				s.fail(w, r, CodeTooLarge, err.Error(), http.StatusRequestEntityTooLarge)
+				return
+			}
+			if isEncodingError(err) {
+				s.fail(w, r, CodeInvalidEncoding, err.Error(), http.StatusBadRequest)
 				return
 			}
-			if err = ioutil.WriteFile(fpath, bytes, os.ModePerm); err != nil {
+			if err != nil {
 				s.errLog.Println(err)
-				s.respond(w, err.Error(), http.StatusInternalServerError)
+				s.fail(w, r, CodeInternal, err.Error(), http.StatusInternalServerError)
 				return
 			}
 			s.infoLog.Printf("wrote new file to local disk: %s", req.ID)
-			if s.db != nil {
-				if err = s.db.Store(r.Context(), req.ID, bytes); err != nil {
-					s.errLog.Println(err)
-					s.respond(w, err.Error(), http.StatusInternalServerError)
-					return
-				}
-				s.infoLog.Printf("sent new file to database; successfully completed registration: %s", req.ID)
+			derived, err := s.ingest(r.Context(), req.ID, fpath)
+			if err != nil {
+				s.errLog.Println(err)
+				s.fail(w, r, CodeInternal, err.Error(), http.StatusInternalServerError)
+				return
 			}
 			w.Header().Set("Content-Type", "application/json")
-			s.respond(w, &response{ID: req.ID}, http.StatusOK)
+			s.respond(w, &response{ID: req.ID, Derived: derived}, http.StatusOK)
 			return
 		}
-		s.respond(w, err.Error(), http.StatusInternalServerError)
+		s.fail(w, r, CodeInternal, err.Error(), http.StatusInternalServerError)
 	}
 }
@@ -0,0 +1,182 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/hashicorp/golang-lru"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// RemoteDetailsConfig configures fetching details from the URLs requests refer to with dtls_url.
+type RemoteDetailsConfig struct {
+	// Sources lists the URLs details may be fetched from; a URL is allowed if it starts with the prefix of one of them.
+	Sources []RemoteSource
+	// Timeout bounds how long fetching details may take. Defaults to 10 seconds.
+	Timeout time.Duration
+	// CacheTTL is how long fetched details are reused for; zero disables caching.
+	CacheTTL time.Duration
+}
+
+// RemoteSource is a prefix of the URLs details may be fetched from.
+type RemoteSource struct {
+	// Prefix is the start of the allowed URLs, e.g. https://data.example.com/orders/.
+	Prefix string
+	// Authorization is sent as the Authorization header when fetching from the source, if set.
+	Authorization string
+}
+
+// maxRemoteDetailsBytes bounds the size of details fetched from a URL.
+const maxRemoteDetailsBytes = 32 << 20
+
+// remoteDetailsCacheSize is how many fetched details are kept around, when caching them.
+const remoteDetailsCacheSize = 256
+
+// remoteDetails fetches details from the allowed sources.
+type remoteDetails struct {
+	sources []RemoteSource
+	ttl     time.Duration
+	cache   *lru.Cache
+	client  *http.Client
+}
+
+// fetchedDetails are details fetched from a URL, along with when they were fetched.
+type fetchedDetails struct {
+	data    []byte
+	fetched time.Time
+}
+
+// RemoteDetailsError is returned when details can't be fetched from a URL because of the URL itself, or what it served.
+type RemoteDetailsError struct {
+	msg string
+}
+
+func (e *RemoteDetailsError) Error() string {
+	return e.msg
+}
+
+func (s *Server) setupRemoteDetails(cfg *RemoteDetailsConfig) error {
+	if cfg == nil || len(cfg.Sources) == 0 {
+		return nil
+	}
+	for _, src := range cfg.Sources {
+		u, err := url.Parse(src.Prefix)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid details source: %s", src.Prefix)
+		}
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	rd := &remoteDetails{sources: cfg.Sources, ttl: cfg.CacheTTL}
+	rd.client = &http.Client{
+		Timeout: cfg.Timeout,
+		// Redirects can't lead anywhere that isn't allowed either
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 5 {
+				return errors.New("too many redirects")
+			}
+			if rd.source(req.URL.String()) == nil {
+				return &RemoteDetailsError{msg: "redirected to a URL details may not be fetched from: " + req.URL.String()}
+			}
+			return nil
+		},
+	}
+	if rd.ttl > 0 {
+		var err error
+		if rd.cache, err = lru.New(remoteDetailsCacheSize); err != nil {
+			return err
+		}
+	}
+	s.remoteDetails = rd
+	return nil
+}
+
+// source returns the source the URL belongs to, or nil if details may not be fetched from it.
+func (rd *remoteDetails) source(rawURL string) *RemoteSource {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.User != nil {
+		return nil
+	}
+	// Dot segments could otherwise climb out of a sources path
+	for _, segment := range strings.Split(u.Path, "/") {
+		if segment == ".." {
+			return nil
+		}
+	}
+	for i, src := range rd.sources {
+		prefix, _ := url.Parse(src.Prefix)
+		if u.Scheme == prefix.Scheme && u.Host == prefix.Host && strings.HasPrefix(u.Path, prefix.Path) {
+			return &rd.sources[i]
+		}
+	}
+	return nil
+}
+
+// fetch returns the details served at the given URL, reusing ones fetched recently if caching is enabled.
+// Errors caused by the URL or the details it served are of type RemoteDetailsError.
+func (rd *remoteDetails) fetch(ctx context.Context, rawURL string) (map[string]interface{}, error) {
+	src := rd.source(rawURL)
+	if src == nil {
+		return nil, &RemoteDetailsError{msg: "details may not be fetched from " + rawURL}
+	}
+	var data []byte
+	if rd.cache != nil {
+		if v, ok := rd.cache.Get(rawURL); ok {
+			if fd := v.(fetchedDetails); time.Since(fd.fetched) < rd.ttl {
+				data = fd.data
+			}
+		}
+	}
+	if data == nil {
+		req, err := http.NewRequestWithContext(ctx, "GET", rawURL, nil)
+		if err != nil {
+			return nil, &RemoteDetailsError{msg: err.Error()}
+		}
+		req.Header.Set("Accept", "application/json")
+		if src.Authorization != "" {
+			req.Header.Set("Authorization", src.Authorization)
+		}
+		resp, err := rd.client.Do(req)
+		if err != nil {
+			var rde *RemoteDetailsError
+			if errors.As(err, &rde) {
+				return nil, rde
+			}
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("GET %s: %s", rawURL, resp.Status)
+		}
+		if data, err = readLimited(resp.Body, maxRemoteDetailsBytes); err != nil {
+			return nil, err
+		}
+		if rd.cache != nil {
+			rd.cache.Add(rawURL, fetchedDetails{data: data, fetched: time.Now()})
+		}
+	}
+	var details map[string]interface{}
+	if err := json.Unmarshal(data, &details); err != nil {
+		return nil, &RemoteDetailsError{msg: fmt.Sprintf("%s didn't serve a JSON object: %v", rawURL, err)}
+	}
+	return details, nil
+}
+
+// readLimited reads all of r, failing if theres more than max bytes of it.
+func readLimited(r io.Reader, max int64) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > max {
+		return nil, &RemoteDetailsError{msg: fmt.Sprintf("details are larger than %d bytes", max)}
+	}
+	return data, nil
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+// requestIDHeader carries the ID of each request, so that a failed request can be matched up with LaTTe's logs.
+// Clients may set it themselves (e.g. to the ID their own tracing uses); otherwise one is made up.
+const requestIDHeader = "X-Request-ID"
+
+// requestIDPrefix is prepended to the ID of a request to get the URI identifying it in error responses.
+const requestIDPrefix = "urn:latte:request:"
+
+type requestIDKey struct{}
+
+// requestID returns the ID of the request, if it has one.
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// withRequestID makes sure the request has an ID, echoing it back in the response headers.
+func withRequestID(w http.ResponseWriter, r *http.Request) *http.Request {
+	id := r.Header.Get(requestIDHeader)
+	if !validRequestID(id) {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return r
+		}
+		id = hex.EncodeToString(b)
+	}
+	w.Header().Set(requestIDHeader, id)
+	return r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+}
+
+// validRequestID reports whether an ID sent by a client is safe to echo back and log.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
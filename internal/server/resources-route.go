@@ -0,0 +1,174 @@
+package server
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// resourceFile describes a registered resource.
+type resourceFile struct {
+	ID string `json:"id"`
+	// Size is -1 for resources only in a db that can't list how large they are without fetching them
+	Size        int64  `json:"size"`
+	ContentType string `json:"content_type"`
+	// Derived lists the ids of files created from the resource, e.g. a PDF version of an SVG image
+	Derived []string `json:"derived,omitempty"`
+}
+
+// validResourceID checks that id names a resource, rather than a template, details, a templates sidecar file or the roles and keys.
+func (s *Server) validResourceID(id string) error {
+	if id == "" || id != filepath.Base(id) || strings.HasPrefix(id, ".") {
+		return fmt.Errorf("invalid resource id: %s", id)
+	}
+	if templateExts[filepath.Ext(id)] {
+		return fmt.Errorf("templates are managed through /templates: %s", id)
+	}
+	if filepath.Ext(id) == ".json" || aclSubject(id) != id || (s.rbacID != "" && id == s.rbacID) {
+		return fmt.Errorf("not a resource: %s", id)
+	}
+	return nil
+}
+
+// describeResource returns the size and content type of the resource with the given id, which must be in the root directory.
+// The content type is guessed from the extension, or sniffed from the contents if the extension isn't well known.
+func (s *Server) describeResource(id string) (*resourceFile, error) {
+	f, err := os.Open(filepath.Join(s.rootDir, id))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	rf := &resourceFile{ID: id, Size: info.Size(), ContentType: mime.TypeByExtension(filepath.Ext(id))}
+	if rf.ContentType == "" {
+		head := make([]byte, 512)
+		n, err := io.ReadFull(f, head)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		rf.ContentType = http.DetectContentType(head[:n])
+	}
+	return rf, nil
+}
+
+// handleResourcesList lists the registered resources without fetching any from the db: those in the root directory
+// are described by describeResource, while the rest get their size from the db's listing and their type from their extension.
+func (s *Server) handleResourcesList() http.HandlerFunc {
+	type response struct {
+		Resources []resourceFile `json:"resources"`
+	}
+	s.apiSchema("resourcesListResponse", response{})
+	return func(w http.ResponseWriter, r *http.Request) {
+		sizes, err := s.listStoredSizes(r.Context(), s.validResourceID)
+		if err != nil {
+			s.errLog.Println(err)
+			s.fail(w, r, CodeStorageUnavailable, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		ids := make([]string, 0, len(sizes))
+		for id := range sizes {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		resp := response{Resources: []resourceFile{}}
+		for _, id := range ids {
+			rf, err := s.describeResource(id)
+			if os.IsNotExist(err) {
+				rf, err = &resourceFile{ID: id, Size: sizes[id], ContentType: mime.TypeByExtension(filepath.Ext(id))}, nil
+				if rf.ContentType == "" {
+					rf.ContentType = "application/octet-stream"
+				}
+			}
+			if err != nil {
+				s.errLog.Println(err)
+				s.fail(w, r, CodeStorageUnavailable, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			resp.Resources = append(resp.Resources, *rf)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		s.respond(w, &resp, http.StatusOK)
+	}
+}
+
+func (s *Server) handleResourcesPut() http.HandlerFunc {
+	s.apiSchema("resourceFile", resourceFile{})
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		if err := s.validResourceID(id); err != nil {
+			s.fail(w, r, CodeBadRequest, err.Error(), http.StatusBadRequest)
+			return
+		}
+		exists, err := s.storedExists(r.Context(), id)
+		if err == nil {
+			_, err = s.evictResource(id)
+		}
+		var derived []string
+		if err == nil {
+			derived, err = s.writeStored(r.Context(), id, r.Body)
+		}
+		r.Body.Close()
+		var rf *resourceFile
+		if err == nil {
+			rf, err = s.describeResource(id)
+		}
+		if _, ok := err.(*TooLargeError); ok {
+			s.fail(w, r, CodeTooLarge, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			s.errLog.Println(err)
+			s.fail(w, r, CodeStorageUnavailable, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		rf.Derived = derived
+		status := http.StatusOK
+		if exists {
+			s.infoLog.Printf("replaced resource: %s", id)
+		} else {
+			s.infoLog.Printf("created resource: %s", id)
+			status = http.StatusCreated
+		}
+		w.Header().Set("Content-Type", "application/json")
+		s.respond(w, rf, status)
+	}
+}
+
+func (s *Server) handleResourcesDelete() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		if err := s.validResourceID(id); err != nil {
+			s.fail(w, r, CodeBadRequest, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, deletable := s.db.(DeleteDB); s.db != nil && !deletable {
+			s.fail(w, r, CodeStorageUnavailable, "the database doesn't support deleting resources", http.StatusNotImplemented)
+			return
+		}
+		_, err := s.evictResource(id)
+		var found bool
+		if err == nil {
+			found, err = s.deleteStored(r.Context(), id)
+		}
+		if err != nil {
+			s.errLog.Println(err)
+			s.fail(w, r, CodeStorageUnavailable, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			s.fail(w, r, CodeNotFound, fmt.Sprintf("resource %s not found", id), http.StatusNotFound)
+			return
+		}
+		s.infoLog.Printf("deleted resource: %s", id)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,26 @@
+package server
+
+import (
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"testing"
+)
+
+func TestValidResourceIDHidesRBAC(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "access.keys"), []byte(`{}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	l := log.New(ioutil.Discard, "", 0)
+	s, err := NewServer(dir, "pdflatex", nil, l, l, Config{Cache: CacheConfig{TmplSize: 5, RscSize: 5}, RBAC: &RBACConfig{ID: "access.keys"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.validResourceID("access.keys"); err == nil {
+		t.Error("expected the roles and keys not to be a valid resource id")
+	}
+	if err := s.validResourceID("logo.png"); err != nil {
+		t.Errorf("expected logo.png to be a valid resource id, got: %v", err)
+	}
+}
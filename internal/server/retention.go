@@ -0,0 +1,171 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Categories of stored records that retention periods apply to.
+const (
+	RetainOutputs = "outputs"
+	RetainJobs    = "jobs"
+	RetainAudit   = "audit"
+)
+
+var retentionCategories = []string{RetainOutputs, RetainJobs, RetainAudit}
+
+// RetentionConfig configures how long stored records are kept for.
+type RetentionConfig struct {
+	// Periods maps categories of records to how long they're kept for; records in categories without one are kept indefinitely.
+	Periods map[string]time.Duration
+	// Interval is how often expired records are purged. Defaults to an hour.
+	Interval time.Duration
+}
+
+// recordStore is implemented by the subsystems that store records on behalf of clients, so that they can be purged.
+type recordStore interface {
+	// expire deletes the records stored before cutoff, returning how many were deleted.
+	expire(ctx context.Context, cutoff time.Time) (int, error)
+	// erase deletes the records belonging to tenant, or to the document whose contents hash to sha256 (hex encoded),
+	// returning how many were deleted. Either may be empty.
+	erase(ctx context.Context, tenant, sha256 string) (int, error)
+}
+
+type retention struct {
+	periods  map[string]time.Duration
+	interval time.Duration
+	stores   map[string]recordStore
+	sync.Mutex
+}
+
+// setupRetention validates the retention periods and starts purging expired records in the background, if there are any periods.
+func (s *Server) setupRetention(cfg *RetentionConfig) error {
+	s.retention = &retention{periods: map[string]time.Duration{}, interval: time.Hour, stores: map[string]recordStore{}}
+	if cfg == nil {
+		return nil
+	}
+	for category, period := range cfg.Periods {
+		known := false
+		for _, c := range retentionCategories {
+			known = known || c == category
+		}
+		if !known {
+			return fmt.Errorf("unknown retention category: %s", category)
+		}
+		if period <= 0 {
+			return fmt.Errorf("retention period for %s must be positive", category)
+		}
+		s.retention.periods[category] = period
+	}
+	if cfg.Interval > 0 {
+		s.retention.interval = cfg.Interval
+	}
+	if len(s.retention.periods) > 0 {
+		go func() {
+			for range time.Tick(s.retention.interval) {
+				s.purgeExpired(context.Background())
+			}
+		}()
+	}
+	return nil
+}
+
+// retain registers the store holding the records of a category, so that they're purged once they expire or are erased.
+func (s *Server) retain(category string, store recordStore) {
+	s.retention.Lock()
+	s.retention.stores[category] = store
+	s.retention.Unlock()
+}
+
+// registered returns the registered record stores, by category.
+func (rt *retention) registered() map[string]recordStore {
+	rt.Lock()
+	defer rt.Unlock()
+	stores := make(map[string]recordStore, len(rt.stores))
+	for category, store := range rt.stores {
+		stores[category] = store
+	}
+	return stores
+}
+
+// purgeExpired deletes the records that have outlived their categories retention period.
+func (s *Server) purgeExpired(ctx context.Context) {
+	now := time.Now()
+	for category, store := range s.retention.registered() {
+		period, ok := s.retention.periods[category]
+		if !ok {
+			continue
+		}
+		n, err := store.expire(ctx, now.Add(-period))
+		if err != nil {
+			s.errLog.Printf("error while purging expired %s: %v", category, err)
+		}
+		if n > 0 {
+			s.infoLog.Printf("purged %d expired %s", n, category)
+		}
+	}
+}
+
+// erase deletes the records belonging to tenant or to the document whose contents hash to sha256 from every category,
+// returning how many were deleted from each.
+func (s *Server) erase(ctx context.Context, tenant, sha256 string) (map[string]int, error) {
+	erased := map[string]int{}
+	stores := s.retention.registered()
+	categories := make([]string, 0, len(stores))
+	for category := range stores {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+	for _, category := range categories {
+		n, err := stores[category].erase(ctx, tenant, sha256)
+		erased[category] = n
+		if err != nil {
+			return erased, fmt.Errorf("error while erasing %s: %v", category, err)
+		}
+	}
+	return erased, nil
+}
+
+func (s *Server) handleErasure() http.HandlerFunc {
+	type request struct {
+		Tenant string `json:"tenant,omitempty"`
+		SHA256 string `json:"sha256,omitempty"`
+	}
+	type response struct {
+		// Erased maps categories to how many of their records were deleted
+		Erased map[string]int `json:"erased"`
+		Error  string         `json:"error,omitempty"`
+	}
+	s.apiSchema("erasureRequest", request{})
+	s.apiSchema("erasureResponse", response{})
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req request
+		if err := s.decode(r.Body, &req); err != nil {
+			msg := "error while parsing json body: " + err.Error()
+			s.errLog.Println(msg)
+			s.fail(w, r, CodeInvalidJSON, msg, http.StatusBadRequest)
+			return
+		}
+		r.Body.Close()
+		if req.Tenant == "" && req.SHA256 == "" {
+			s.fail(w, r, CodeBadRequest, "need a tenant or a sha256 to erase records of", http.StatusBadRequest)
+			return
+		}
+		erased, err := s.erase(r.Context(), req.Tenant, req.SHA256)
+		resp := response{Erased: erased}
+		code := http.StatusOK
+		if err != nil {
+			s.errLog.Println(err)
+			resp.Error = err.Error()
+			code = http.StatusInternalServerError
+		} else {
+			s.infoLog.Printf("erased records of tenant %q and document %q: %v", req.Tenant, req.SHA256, erased)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		s.respond(w, &resp, code)
+	}
+}
@@ -1,18 +1,83 @@
 package server
 
 import (
+	"fmt"
 	"github.com/gorilla/mux"
+	"net/http"
 )
 
 func (s *Server) routes() (*Server, error) {
 	// Create and set up http router
 	s.router = mux.NewRouter()
-	generateRoute, err := s.handleGenerate()
-	if err != nil {
-		return nil, err
+	s.versions = map[int]*mux.Router{}
+	for _, v := range apiVersions {
+		s.versions[v] = s.router.PathPrefix(fmt.Sprintf("/v%d", v)).Subrouter()
 	}
-	s.router.HandleFunc("/generate", generateRoute).Methods("POST")
-	s.router.HandleFunc("/register", s.handleRegister()).Methods("POST")
+	s.apiSchema("apiError", apiError{})
+	s.handle("/generate", s.handleAsync(s.handleGenerate()), "POST")
+	s.handle("/generate/ws", s.handleGenerateWS(), "GET")
+	s.handle("/register", s.handleRegister(), "POST")
+	s.handle("/uploads", s.handleUploadCreate(), "POST")
+	s.handle("/uploads/{upload}/chunks/{chunk}", s.handleUploadChunk(), "PUT")
+	s.handle("/uploads/{upload}/commit", s.handleUploadCommit(), "POST")
+	s.handle("/uploads/{upload}", s.handleUploadAbort(), "DELETE")
+	s.handle("/templates", s.handleTemplatesList(), "GET")
+	s.handle("/templates", s.handleTemplatesCreate(), "POST")
+	s.handle("/templates/{id}", s.handleTemplatesGet(), "GET")
+	s.handle("/templates/{id}", s.handleTemplatesPut(), "PUT")
+	s.handle("/templates/{id}", s.handleTemplatesDelete(), "DELETE")
+	s.handle("/resources", s.handleResourcesList(), "GET")
+	s.handle("/resources/{id}", s.handleResourcesPut(), "PUT")
+	s.handle("/resources/{id}", s.handleResourcesDelete(), "DELETE")
+	s.handle("/bundles", s.handleBundleInstall(), "POST")
+	s.handle("/bundles/{template}", s.handleBundleGet(), "GET")
+	s.handle("/bundles/{template}/archive", s.handleBundleArchive(), "GET")
+	s.handle("/cache/warm", s.handleCacheWarm(), "POST")
+	s.handle("/cache/stats", s.handleCacheStats(), "GET")
+	// /admin/cache is an alias of /cache, needing the same permissions; ids may contain slashes (e.g. sections/terms.tex)
+	for _, prefix := range []string{"/cache", "/admin/cache"} {
+		s.handle(prefix, s.handleCachePurge(), "DELETE")
+		s.handle(prefix+"/templates/{id:.+}", s.handleCacheEvictTemplate(), "DELETE")
+		s.handle(prefix+"/resources/{id:.+}", s.handleCacheEvictResource(), "DELETE")
+	}
+	s.handle("/admin/cache", s.handleAdminCache(), "GET")
+	s.handle("/library", s.handleLibraryList(), "GET")
+	s.handle("/library/{name}", s.handleLibraryPut(), "PUT")
+	s.handle("/library/{name}", s.handleLibraryDelete(), "DELETE")
+	s.handle("/graphql", s.handleGraphQL(), "GET", "POST")
+	s.handle("/check/accessibility", s.handleCheckAccessibility(), "POST")
+	s.handle("/validate", s.handleValidate(), "POST")
+	s.handle("/batch", s.handleBatch(), "POST")
+	s.handle("/diff", s.handleDiff(), "POST")
+	s.handle("/profile", s.handleProfile(), "POST")
+	s.handle("/erasure", s.handleErasure(), "POST")
+	s.handle("/usage", s.handleUsage(), "GET")
+	s.handle("/archive", s.handleArchiveList(), "GET")
+	s.handle("/archive/{id}", s.handleArchiveGet(), "GET")
+	s.handle("/jobs/{id}", s.handleJobGet(), "GET")
+	s.handle("/jobs/{id}/pdf", s.handleJobPDF(), "GET")
+	s.handle("/jobs/{id}/events", s.handleJobEvents(), "GET")
+	s.handle("/stats/templates", s.handleTemplateStats(), "GET")
+	s.handle("/stats", s.handleStats(), "GET")
+	// These routes aren't part of any version of the API
 	s.router.HandleFunc("/ping", s.handlePing()).Methods("GET")
+	s.router.HandleFunc("/openapi.json", s.handleOpenAPI()).Methods("GET")
+	s.router.HandleFunc("/metrics", s.handleMetrics()).Methods("GET")
+	s.router.PathPrefix("/admin/").Handler(s.handleUI("admin")).Methods("GET")
+	s.router.PathPrefix("/playground/").Handler(s.handleUI("playground")).Methods("GET")
+	if s.swaggerUI {
+		s.router.PathPrefix("/docs/").Handler(s.handleUI("docs")).Methods("GET")
+	}
 	return s, nil
 }
+
+// handle registers the handler under every API version, as well as unversioned (and deprecated) for older clients.
+// Requests must be authorized for the route if the server authenticates requests, and have a valid signature if they're signed.
+// Every request is counted towards the servers stats, traced if tracing is configured, and waited for on shutdown.
+func (s *Server) handle(path string, h http.HandlerFunc, methods ...string) {
+	h = s.trackRequests(s.traceRequests(path, s.countRequests(s.limitBodies(s.verifySignature(s.authorize(path, h))))))
+	for v, r := range s.versions {
+		r.HandleFunc(path, withAPIVersion(v, h)).Methods(methods...)
+	}
+	s.router.HandleFunc(path, s.deprecated(path, h)).Methods(methods...)
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"path"
+	"strings"
+)
+
+// S3Config configures storing templates, resources and details files as objects in an S3 (or S3 compatible, e.g. MinIO) bucket.
+type S3Config struct {
+	Bucket string
+	// Prefix is prepended to the ids of files to get the keys of their objects, e.g. latte/.
+	Prefix string
+}
+
+// S3DB is a DB that keeps files as objects in a bucket.
+type S3DB struct {
+	client *awsClient
+	bucket string
+	prefix string
+}
+
+// NewS3DB returns a DB keeping files in the configured bucket, reached with the given credentials.
+// The region defaults to us-east-1 when using an S3 compatible service, which usually doesn't care about it.
+func NewS3DB(aws AWSConfig, cfg S3Config) (*S3DB, error) {
+	if cfg.Bucket == "" {
+		return nil, errors.New("s3 database needs a bucket")
+	}
+	if aws.Region == "" && aws.S3Endpoint != "" {
+		aws.Region = "us-east-1"
+	}
+	if aws.Region == "" || aws.AccessKeyID == "" {
+		return nil, errors.New("s3 database needs AWS credentials and a region")
+	}
+	return &S3DB{client: newAWSClient(aws), bucket: cfg.Bucket, prefix: cfg.Prefix}, nil
+}
+
+// Store uploads the contents to the object of the file, replacing it if it exists.
+func (db *S3DB) Store(ctx context.Context, uid string, data io.Reader) error {
+	contentType := mime.TypeByExtension(path.Ext(uid))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	return db.client.putObject(ctx, db.bucket, db.prefix+uid, contentType, data)
+}
+
+// Fetch downloads the object of the file.
+func (db *S3DB) Fetch(ctx context.Context, uid string) (io.ReadCloser, error) {
+	data, err := db.client.getObject(ctx, db.bucket, db.prefix+uid)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+// Ping checks that the bucket can be listed, which needs it to exist and the credentials to be valid.
+func (db *S3DB) Ping(ctx context.Context) error {
+	_, err := db.client.do(ctx, "s3", "GET", db.listURL("", "", 1), nil, nil)
+	return err
+}
+
+// List returns the ids of the files whose id starts with prefix, going through every page of the listing.
+func (db *S3DB) List(ctx context.Context, prefix string) ([]string, error) {
+	var uids []string
+	err := db.listObjects(ctx, prefix, func(uid string, size int64) {
+		uids = append(uids, uid)
+	})
+	return uids, err
+}
+
+// ListSizes returns the sizes of the files whose id starts with prefix, which S3 lists along with their keys.
+func (db *S3DB) ListSizes(ctx context.Context, prefix string) (map[string]int64, error) {
+	sizes := map[string]int64{}
+	err := db.listObjects(ctx, prefix, func(uid string, size int64) {
+		sizes[uid] = size
+	})
+	return sizes, err
+}
+
+// listObjects calls found with the id and size of each file whose id starts with prefix, going through every page of the listing.
+func (db *S3DB) listObjects(ctx context.Context, prefix string, found func(uid string, size int64)) error {
+	token := ""
+	for {
+		data, err := db.client.do(ctx, "s3", "GET", db.listURL(db.prefix+prefix, token, 1000), nil, nil)
+		if err != nil {
+			return err
+		}
+		var result struct {
+			Contents []struct {
+				Key  string
+				Size int64
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		if err = xml.Unmarshal(data, &result); err != nil {
+			return fmt.Errorf("error while decoding s3 listing: %v", err)
+		}
+		for _, obj := range result.Contents {
+			found(strings.TrimPrefix(obj.Key, db.prefix), obj.Size)
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// Delete removes the object of the file. S3 doesn't say whether there was anything to delete, so the object is looked for first.
+func (db *S3DB) Delete(ctx context.Context, uid string) error {
+	u := db.client.s3URL(db.bucket, db.prefix+uid)
+	if _, err := db.client.do(ctx, "s3", "HEAD", u, nil, nil); err != nil {
+		return err
+	}
+	_, err := db.client.do(ctx, "s3", "DELETE", u, nil, nil)
+	return err
+}
+
+// listURL returns the URL of a page of the listing of the objects whose keys start with prefix.
+func (db *S3DB) listURL(prefix, token string, max int) string {
+	q := fmt.Sprintf("list-type=2&max-keys=%d", max)
+	if prefix != "" {
+		q += "&prefix=" + awsEscape(prefix, false)
+	}
+	if token != "" {
+		q += "&continuation-token=" + awsEscape(token, false)
+	}
+	return db.client.s3URL(db.bucket, "") + "?" + q
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/raphaelreyna/latte/internal/compile"
+)
+
+// SandboxConfig configures running compilations in a sandbox, for deployments compiling templates they don't trust.
+type SandboxConfig struct {
+	// Kind is the sandbox: bwrap or nsjail, which isolate compilations in namespaces of their own, docker, which runs
+	// them in containers, or user, which only runs them as another user.
+	Kind string
+	// Command is the bwrap, nsjail or docker binary, if it isn't on the PATH under its usual name.
+	Command string
+	// UID and GID are who the user sandbox runs compilations as.
+	UID, GID uint32
+	// ReadOnly are paths compilations can read besides the TeX installation and the library.
+	ReadOnly []string
+	// Image is the image the docker sandbox runs compilations in, which has the TeX installation.
+	Image string
+	// Network is the network the docker sandbox attaches containers to; defaults to none.
+	Network string
+}
+
+func (s *Server) setupSandbox(cfg *SandboxConfig) error {
+	if cfg == nil || cfg.Kind == "" {
+		return nil
+	}
+	readOnly := append([]string{s.libraryDir}, cfg.ReadOnly...)
+	switch strings.ToLower(cfg.Kind) {
+	case "bwrap", "bubblewrap":
+		s.sandbox = &compile.Bubblewrap{Command: cfg.Command, ReadOnly: readOnly}
+	case "nsjail":
+		s.sandbox = &compile.Nsjail{Command: cfg.Command, ReadOnly: readOnly}
+	case "docker":
+		if cfg.Image == "" {
+			return errors.New("the docker sandbox needs an image")
+		}
+		s.sandbox = &compile.Docker{Command: cfg.Command, Image: cfg.Image, Network: cfg.Network, ReadOnly: readOnly}
+	case "user":
+		if cfg.UID == 0 {
+			return errors.New("the user sandbox needs the uid of a user other than root")
+		}
+		s.sandbox = &compile.User{UID: cfg.UID, GID: cfg.GID}
+	default:
+		return fmt.Errorf("unknown sandbox: %s", cfg.Kind)
+	}
+	// Symlinked resources point outside of the working directory, where sandboxed compilations can't follow them,
+	// and hardlinked ones would let compilations change the registered files, so resources are copied in instead
+	s.placement = PlaceCopy
+	return nil
+}
@@ -0,0 +1,261 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// SecretsConfig configures where secrets referenced in details are resolved from.
+type SecretsConfig struct {
+	// VaultAddr is the address of a HashiCorp Vault server, e.g. https://vault.example.com:8200.
+	VaultAddr string
+	// VaultToken is the token LaTTe authenticates to Vault with, and VaultNamespace the namespace secrets are read from, if any.
+	VaultToken     string
+	VaultNamespace string
+	// VaultMounts lists the mounts of the key/value secrets engines secrets may be read from. Defaults to kv and secret.
+	VaultMounts []string
+	// Env lists the environment variables that may be used as secrets.
+	Env []string
+}
+
+// defaultVaultMounts are the mounts secrets may be read from if none are configured; where Vault mounts key/value engines by default.
+var defaultVaultMounts = []string{"kv", "secret"}
+
+// SecretError is returned when a secret reference can't be resolved because of the reference itself.
+type SecretError struct {
+	Ref    string
+	Reason string
+}
+
+func (e *SecretError) Error() string {
+	return fmt.Sprintf("secret %s: %s", e.Ref, e.Reason)
+}
+
+// secretRef returns the reference of a value of the form {"$secret": "REF"}.
+func secretRef(v interface{}) (string, bool) {
+	m, ok := v.(map[string]interface{})
+	if !ok || len(m) != 1 {
+		return "", false
+	}
+	ref, ok := m["$secret"].(string)
+	return ref, ok
+}
+
+// hasSecrets returns whether any of the values in v refer to secrets.
+func hasSecrets(v interface{}) bool {
+	if _, ok := secretRef(v); ok {
+		return true
+	}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for _, e := range v {
+			if hasSecrets(e) {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, e := range v {
+			if hasSecrets(e) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// templateSecrets loads the references of the secrets the template with the given id may be given.
+// These live in a registered JSON list named TEMPLATE_ID.secrets; templates without one may not be given any, since the
+// details that refer to secrets come from whoever renders the template, who mustn't pick which secrets it prints.
+func (s *Server) templateSecrets(ctx context.Context, id string) (map[string]bool, error) {
+	secretsID := id + ".secrets"
+	secretsPath := filepath.Join(s.rootDir, secretsID)
+	err := s.fetchToDisk(ctx, secretsID, secretsPath)
+	switch err.(type) {
+	case nil:
+	case *NotFoundError:
+		return map[string]bool{}, nil
+	default:
+		return nil, err
+	}
+	f, err := os.Open(secretsPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var refs []string
+	if err = json.NewDecoder(f).Decode(&refs); err != nil {
+		return nil, fmt.Errorf("error while decoding secrets for template %s: %v", id, err)
+	}
+	allowed := make(map[string]bool, len(refs))
+	for _, ref := range refs {
+		allowed[ref] = true
+	}
+	return allowed, nil
+}
+
+// resolveSecrets returns a copy of the details with every {"$secret": "REF"} value replaced by the secret it refers to.
+// References are either vault:MOUNT/PATH#FIELD for a field of a secret in Vault, or env:NAME for an allowed environment variable,
+// and must be among those allowed for the template being rendered, see templateSecrets.
+func (s *Server) resolveSecrets(ctx context.Context, details map[string]interface{}, allowed map[string]bool) (map[string]interface{}, error) {
+	resolved := map[string]string{}
+	var resolve func(v interface{}) (interface{}, error)
+	resolve = func(v interface{}) (interface{}, error) {
+		if ref, ok := secretRef(v); ok {
+			if secret, ok := resolved[ref]; ok {
+				return secret, nil
+			}
+			if !allowed[ref] {
+				return nil, &SecretError{Ref: ref, Reason: "not allowed for this template"}
+			}
+			secret, err := s.resolveSecret(ctx, ref)
+			resolved[ref] = secret
+			return secret, err
+		}
+		switch v := v.(type) {
+		case map[string]interface{}:
+			m := make(map[string]interface{}, len(v))
+			for k, e := range v {
+				var err error
+				if m[k], err = resolve(e); err != nil {
+					return nil, err
+				}
+			}
+			return m, nil
+		case []interface{}:
+			l := make([]interface{}, len(v))
+			for i, e := range v {
+				var err error
+				if l[i], err = resolve(e); err != nil {
+					return nil, err
+				}
+			}
+			return l, nil
+		}
+		return v, nil
+	}
+	out, err := resolve(details)
+	if err != nil {
+		return nil, err
+	}
+	return out.(map[string]interface{}), nil
+}
+
+func (s *Server) resolveSecret(ctx context.Context, ref string) (string, error) {
+	parts := strings.SplitN(ref, ":", 2)
+	if len(parts) != 2 {
+		return "", &SecretError{Ref: ref, Reason: "reference must be of the form vault:PATH#FIELD or env:NAME"}
+	}
+	switch parts[0] {
+	case "env":
+		if !s.secretEnv[parts[1]] {
+			return "", &SecretError{Ref: ref, Reason: "environment variable is not allowed to be used as a secret"}
+		}
+		return os.Getenv(parts[1]), nil
+	case "vault":
+		if s.secrets == nil || s.secrets.VaultAddr == "" {
+			return "", &SecretError{Ref: ref, Reason: "vault is not configured"}
+		}
+		pathField := strings.SplitN(parts[1], "#", 2)
+		if len(pathField) != 2 || pathField[1] == "" {
+			return "", &SecretError{Ref: ref, Reason: "vault references must name a field, e.g. vault:kv/docs#stamp_key"}
+		}
+		path, err := s.vaultPath(pathField[0])
+		if err != nil {
+			return "", &SecretError{Ref: ref, Reason: err.Error()}
+		}
+		return s.vaultSecret(ctx, ref, path, pathField[1])
+	}
+	return "", &SecretError{Ref: ref, Reason: "unknown secret source " + parts[0]}
+}
+
+// vaultPath checks that the path of a secret is within one of the allowed mounts, and can't lead anywhere else in
+// Vault's API (e.g. with .. elements, or a query string), returning it without leading or trailing slashes.
+func (s *Server) vaultPath(path string) (string, error) {
+	path = strings.Trim(path, "/")
+	segments := strings.Split(path, "/")
+	for _, seg := range segments {
+		if seg == "" || seg == "." || seg == ".." {
+			return "", errors.New("invalid vault path")
+		}
+		if strings.ContainsAny(seg, "?#%\\") {
+			return "", errors.New("invalid character in vault path")
+		}
+		for _, c := range seg {
+			if c < ' ' || c == 0x7f {
+				return "", errors.New("invalid character in vault path")
+			}
+		}
+	}
+	mounts := s.secrets.VaultMounts
+	if len(mounts) == 0 {
+		mounts = defaultVaultMounts
+	}
+	for _, mount := range mounts {
+		if segments[0] == strings.Trim(mount, "/") {
+			return path, nil
+		}
+	}
+	return "", errors.New("secrets can't be read from the vault mount " + segments[0])
+}
+
+// vaultSecret reads a field of a secret from Vault's key/value secrets engine.
+// Version 2 of the engine is tried first, falling back to version 1 if the secret isn't found there.
+func (s *Server) vaultSecret(ctx context.Context, ref, path, field string) (string, error) {
+	mount := strings.SplitN(path, "/", 2)
+	var urls []string
+	if len(mount) == 2 {
+		urls = append(urls, fmt.Sprintf("%s/v1/%s/data/%s", strings.TrimSuffix(s.secrets.VaultAddr, "/"), mount[0], mount[1]))
+	}
+	urls = append(urls, fmt.Sprintf("%s/v1/%s", strings.TrimSuffix(s.secrets.VaultAddr, "/"), path))
+	client := &http.Client{Timeout: 10 * time.Second}
+	for i, url := range urls {
+		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("X-Vault-Token", s.secrets.VaultToken)
+		if s.secrets.VaultNamespace != "" {
+			req.Header.Set("X-Vault-Namespace", s.secrets.VaultNamespace)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return "", fmt.Errorf("error while reading secret from vault: %v", err)
+		}
+		var body struct {
+			Data map[string]interface{} `json:"data"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		switch {
+		case resp.StatusCode == http.StatusNotFound && i < len(urls)-1:
+			continue
+		case resp.StatusCode == http.StatusNotFound:
+			return "", &SecretError{Ref: ref, Reason: "not found in vault"}
+		case resp.StatusCode != http.StatusOK:
+			return "", fmt.Errorf("error while reading secret from vault: %s", resp.Status)
+		case err != nil:
+			return "", fmt.Errorf("error while decoding secret from vault: %v", err)
+		}
+		data := body.Data
+		// Version 2 nests the secret under data, alongside its metadata
+		if nested, ok := data["data"].(map[string]interface{}); ok && i == 0 && len(urls) == 2 {
+			data = nested
+		}
+		value, ok := data[field]
+		if !ok {
+			return "", &SecretError{Ref: ref, Reason: "secret has no field " + field}
+		}
+		if str, ok := value.(string); ok {
+			return str, nil
+		}
+		return fmt.Sprint(value), nil
+	}
+	return "", &SecretError{Ref: ref, Reason: "not found in vault"}
+}
@@ -3,27 +3,226 @@ package server
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/gorilla/mux"
+	"github.com/raphaelreyna/latte/internal/compile"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	"sync"
+	"time"
 )
 
+// Config holds the optional settings of a Server.
+type Config struct {
+	Cache CacheConfig
+	// Placement is the strategy used to place resources into working directories; one of "symlink" (the default), "hardlink" or "copy".
+	Placement string
+	// Sunset is the HTTP date after which the unversioned routes will be removed, if one has been decided on.
+	Sunset string
+	// CompileEnv lists the environment variables requests and templates may set for the compiler.
+	// Defaults to TEXINPUTS, BSTINPUTS, SOURCE_DATE_EPOCH and max_print_line.
+	CompileEnv []string
+	// CompileTimeout bounds how long the compiler may run for each request; requests can ask for less, but not more.
+	// Zero leaves compilations unbounded, unless requests bound them themselves.
+	CompileTimeout time.Duration
+	// CompileCPU and CompileMemory bound the CPU time and bytes of memory each command compiling a request may use,
+	// killing it once it goes over them; zero leaves them unlimited. Cgroup, if set, is the cgroup v2 directory commands
+	// are each given a cgroup of their own in, which limits the memory they use more precisely (along with that of
+	// their children), and is needed to bound the CPUs they use at once with CompileCPUs. See compile.Limits.
+	CompileCPU    time.Duration
+	CompileMemory int64
+	CompileCPUs   float64
+	Cgroup        string
+	// MaxConcurrent limits how many compilations run at once; zero leaves them unlimited.
+	MaxConcurrent int
+	// MaxQueued is how many compilations may wait for one of the MaxConcurrent slots before requests are turned away. Defaults to 100.
+	MaxQueued int
+	// MaxBodyBytes bounds the size of request bodies, MaxResourceBytes the decoded size of each file sent in one, and
+	// MaxResources how many resources a /generate request may send; zero leaves them unlimited.
+	MaxBodyBytes     int64
+	MaxResourceBytes int64
+	MaxResources     int
+	// LibraryDir is the directory holding the class and style files available to every compilation.
+	// Defaults to the library directory under the root directory.
+	LibraryDir string
+	// NoImageConversion disables converting images that pdfLaTeX can't include (e.g. SVG, WebP, HEIC and TIFF) when they're received.
+	NoImageConversion bool
+	// ImageMaxDim is the length in pixels of the longest side a PNG or JPEG resource may have before its downscaled; zero disables downscaling.
+	ImageMaxDim int
+	// ImageQuality is the quality (1-100) downscaled JPEGs are saved with. Defaults to 85.
+	ImageQuality int
+	// RequireEmbeddedFonts fails every compilation whose output uses fonts that aren't embedded in it.
+	RequireEmbeddedFonts bool
+	// Deterministic makes every compilation reproducible, so that identical inputs produce byte-identical PDFs.
+	Deterministic bool
+	// Provenance attaches a record of how each PDF was made to it.
+	Provenance bool
+	// Rerun runs TeX again after every compilation until cross-references, tables of contents and the like are resolved.
+	Rerun bool
+	// MaxPasses bounds how many times TeX is run when rerunning; defaults to 5.
+	MaxPasses int
+	// Bibliography is the tool bibliographies are built with unless the request picks one: bibtex, biber or auto; see compile.Job.
+	// By default bibliographies are only built for requests that ask for it.
+	Bibliography string
+	// Bibtex and Biber are the commands bibliographies are built with; they default to bibtex and biber.
+	Bibtex string
+	Biber  string
+	// Makeindex and Makeglossaries are the commands indexes and glossaries are built with; they default to makeindex and makeglossaries.
+	Makeindex      string
+	Makeglossaries string
+	// ShellEscape lets templates compiled with TeX run commands with \write18, which is only safe if every template is trusted.
+	ShellEscape bool
+	// Sandbox, if set, runs compilations in a sandbox, so that templates can't read or change anything but their own files.
+	Sandbox *SandboxConfig
+	// Kubernetes, if set, dispatches each compilation to a Kubernetes Job of its own instead of running it on the server.
+	Kubernetes *KubernetesConfig
+	// SwaggerUI serves Swagger UI at /docs/ for browsing and trying out the API described by /openapi.json.
+	// The page loads Swagger UI itself from a CDN.
+	SwaggerUI bool
+	// WSOrigins lists the origins (e.g. https://editor.example.com) browsers may open WebSocket connections from, besides
+	// the server's own; "*" allows any.
+	WSOrigins []string
+	// MessagesDir holds translations of error messages, in addition to the built in ones; see loadCatalog.
+	MessagesDir string
+	// OAuth enables requiring an OAuth2 access token, granting the permissions the route needs, with every API request.
+	OAuth *OAuthConfig
+	// JWT enables requiring a JWT signed by an identity provider, granting the permissions the route needs, with every API request.
+	JWT *JWTConfig
+	// RBAC configures roles and enables requiring an API key, whose roles grant the permissions the route needs, with every API request.
+	RBAC *RBACConfig
+	// HMAC enables verifying the signatures of signed requests.
+	HMAC *HMACConfig
+	// Cleanup configures how working directories are removed once they're no longer needed.
+	Cleanup CleanupConfig
+	// NoPersist guarantees that nothing derived from a request to generate a PDF (its details, the filled in template, the PDF or
+	// the compilers log) is written outside of its working directory, and that the working directory is shredded before responding.
+	NoPersist bool
+	// Janitor, if set, evicts templates and resources downloaded from the db from the root directory once they've gone
+	// unused for too long or take up too much space.
+	Janitor *JanitorConfig
+	// Retention configures how long stored records are kept for.
+	Retention *RetentionConfig
+	// Strict rejects JSON request bodies with fields that aren't part of the API or values of the wrong type.
+	Strict bool
+	// SlowCompile is how long a compilation may take before its details are logged; zero disables logging slow compilations.
+	SlowCompile time.Duration
+	// TemplateMetricsLimit is how many templates get metrics of their own, the rest are lumped together. Defaults to 100.
+	TemplateMetricsLimit int
+	// Usage configures exporting how much each client has generated.
+	Usage UsageConfig
+	// Secrets configures where secrets referenced in details are resolved from.
+	Secrets *SecretsConfig
+	// RemoteDetails configures fetching details from URLs.
+	RemoteDetails *RemoteDetailsConfig
+	// Archive configures keeping every generated PDF, so that it can be found and downloaded again.
+	Archive *ArchiveConfig
+	// Jobs configures the jobs that handle asynchronous requests.
+	Jobs *JobsConfig
+	// Sinks names the places PDFs can be sent to instead of the response, each given as a URL; see setupSinks.
+	Sinks map[string]string
+	// GCS holds the HMAC key used to write to Google Cloud Storage sinks.
+	GCS AWSConfig
+	// SMTP configures the mail server PDFs can be emailed through.
+	SMTP *SMTPConfig
+	// Watch configures serving templates from a local directory, reloading them as they change.
+	Watch *WatchConfig
+	// Sync configures keeping templates in sync with an upstream registry.
+	Sync *SyncConfig
+	// Typst is the typst binary that templates ending in .typ are compiled with; defaults to typst.
+	Typst string
+	// Engines are the TeX engines (e.g. xelatex or lualatex) requests may pick by name, as commands or paths to them,
+	// besides the servers own command that's used by default.
+	Engines []string
+	// AWS holds the credentials used to reach S3 and SQS.
+	AWS AWSConfig
+	// Events configures rendering the details uploaded to S3.
+	Events *EventsConfig
+	// Tracing configures sending OpenTelemetry traces to a collector.
+	Tracing *TracingConfig
+}
+
+// ExposedHeaders lists the response headers that browsers should let cross-origin clients read.
+var ExposedHeaders = []string{
+	"X-Latte-SHA256", "X-Latte-Pages", "X-Latte-Unembedded-Fonts",
+	"X-Latte-Compile-Ms", "X-Latte-Engine", "X-Latte-Passes", "X-Latte-Cache", "X-Latte-Archive-ID", "Server-Timing", requestIDHeader,
+}
+
 type Server struct {
-	router     *mux.Router
-	rootDir    string
-	db         DB
-	cmd        string
-	errLog     *log.Logger
-	infoLog    *log.Logger
-	tCacheSize int
-	rCacheSize int
+	router        *mux.Router
+	rootDir       string
+	db            DB
+	cmd           string
+	errLog        *log.Logger
+	infoLog       *log.Logger
+	tCacheSize    int
+	rCacheSize    int
+	tMaxBytes     int
+	cachePolicy   string
+	tmpls         *templates
+	rscs          *resources
+	copies        *dbCopies
+	placement     string
+	uploads       *uploads
+	schemas       *apiSchemas
+	versions      map[int]*mux.Router
+	sunset        string
+	envAllowed    map[string]bool
+	timeout       time.Duration
+	pool          *compilePool
+	sandbox       compile.Sandbox
+	kube          *kubernetes
+	swaggerUI     bool
+	limits        compile.Limits
+	maxBodyBytes  int64
+	maxRscBytes   int64
+	maxResources  int
+	libraryDir    string
+	convertImages bool
+	imageMaxDim   int
+	imageQuality  int
+	requireFonts  bool
+	deterministic bool
+	provenance    bool
+	rerun         bool
+	maxPasses     int
+	bibliography  string
+	typesetters   map[string]compile.Typesetter
+	engines       map[string]compile.Typesetter
+	engineMu      sync.Mutex
+	engineVers    map[string]string
+	catalog       catalog
+	auth          authenticator
+	roles         map[string][]string
+	rbacID        string
+	signatures    *signatures
+	secrets       *SecretsConfig
+	secretEnv     map[string]bool
+	wsOrigins     map[string]bool
+	noPersist     bool
+	retention     *retention
+	cleanup       *cleanup
+	janitor       *janitor
+	usage         *usage
+	tmplMetrics   *templatesMetrics
+	stats         *stats
+	slowCompile   time.Duration
+	strict        bool
+	bundles       sync.Mutex
+	aws           *awsClient
+	smtp          *SMTPConfig
+	remoteDetails *remoteDetails
+	sinks         map[string]sink
+	archive       *archive
+	jobs          *jobs
+	tracer        *tracer
+	draining      *draining
 }
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	s.router.ServeHTTP(w, r)
+	s.router.ServeHTTP(w, withRequestID(w, r))
 }
 
 func (s *Server) respond(w http.ResponseWriter, payload interface{}, code int) []byte {
@@ -58,7 +257,7 @@ func (s *Server) respond(w http.ResponseWriter, payload interface{}, code int) [
 	}
 }
 
-func NewServer(root, cmd string, db DB, err, info *log.Logger, tCacheSize, rCacheSize int) (*Server, error) {
+func NewServer(root, cmd string, db DB, err, info *log.Logger, cfg Config) (*Server, error) {
 	// Ping db to ensure connection
 	if db != nil {
 		if err := db.Ping(context.Background()); err != nil {
@@ -67,12 +266,84 @@ func NewServer(root, cmd string, db DB, err, info *log.Logger, tCacheSize, rCach
 		info.Println("successfully connected to database")
 	}
 	s := &Server{
-		rootDir:    root,
-		db:         db,
-		errLog:     err,
-		infoLog:    info,
-		tCacheSize: tCacheSize,
-		rCacheSize: rCacheSize,
+		rootDir:       root,
+		db:            db,
+		errLog:        err,
+		infoLog:       info,
+		tCacheSize:    cfg.Cache.TmplSize,
+		rCacheSize:    cfg.Cache.RscSize,
+		tMaxBytes:     cfg.Cache.TmplMaxBytes,
+		cachePolicy:   cfg.Cache.Policy,
+		sunset:        cfg.Sunset,
+		envAllowed:    map[string]bool{},
+		timeout:       cfg.CompileTimeout,
+		limits:        compile.Limits{CPU: cfg.CompileCPU, Memory: cfg.CompileMemory, CPUs: cfg.CompileCPUs, Cgroup: cfg.Cgroup},
+		maxBodyBytes:  cfg.MaxBodyBytes,
+		maxRscBytes:   cfg.MaxResourceBytes,
+		maxResources:  cfg.MaxResources,
+		libraryDir:    cfg.LibraryDir,
+		convertImages: !cfg.NoImageConversion,
+		imageMaxDim:   cfg.ImageMaxDim,
+		imageQuality:  cfg.ImageQuality,
+		requireFonts:  cfg.RequireEmbeddedFonts,
+		deterministic: cfg.Deterministic,
+		provenance:    cfg.Provenance,
+		rerun:         cfg.Rerun,
+		maxPasses:     cfg.MaxPasses,
+		bibliography:  cfg.Bibliography,
+		secrets:       cfg.Secrets,
+		secretEnv:     map[string]bool{},
+		wsOrigins:     map[string]bool{},
+		noPersist:     cfg.NoPersist,
+		tmplMetrics:   newTemplatesMetrics(cfg.TemplateMetricsLimit),
+		slowCompile:   cfg.SlowCompile,
+		strict:        cfg.Strict,
+		swaggerUI:     cfg.SwaggerUI,
+		aws:           newAWSClient(cfg.AWS),
+		uploads:       &uploads{u: map[string]*upload{}},
+		schemas:       &apiSchemas{s: map[string]interface{}{}},
+	}
+	s.setupPool(cfg.MaxConcurrent, cfg.MaxQueued)
+	if s.imageQuality <= 0 || s.imageQuality > 100 {
+		s.imageQuality = 85
+	}
+	if s.maxPasses <= 0 {
+		s.maxPasses = 5
+	}
+	if !validBibliography(s.bibliography) {
+		return nil, fmt.Errorf("unknown bibliography tool: %s", s.bibliography)
+	}
+	if cfg.CompileEnv == nil {
+		cfg.CompileEnv = defaultCompileEnv
+	}
+	for _, name := range cfg.CompileEnv {
+		s.envAllowed[name] = true
+	}
+	if cfg.Secrets != nil {
+		for _, name := range cfg.Secrets.Env {
+			s.secretEnv[name] = true
+		}
+	}
+	for _, origin := range cfg.WSOrigins {
+		s.wsOrigins[normalizeOrigin(origin)] = true
+	}
+	if err := s.setPlacement(cfg.Placement); err != nil {
+		return nil, err
+	}
+	if err := s.loadCatalog(cfg.MessagesDir); err != nil {
+		return nil, err
+	}
+	if err := s.loadHMAC(cfg.HMAC); err != nil {
+		return nil, err
+	}
+	if err := s.setupRetention(cfg.Retention); err != nil {
+		return nil, err
+	}
+	if err := s.setupUsage(cfg.Usage); err != nil {
+		return nil, err
+	}
+	if err := s.setupTracing(cfg.Tracing); err != nil {
+		return nil, err
 	}
 	// Ensure root directory exists
 	if _, err := os.Stat(root); os.IsNotExist(err) {
@@ -83,5 +354,69 @@ func NewServer(root, cmd string, db DB, err, info *log.Logger, tCacheSize, rCach
 		return nil, err
 	}
 	s.cmd = cmd
+	s.typesetters = map[string]compile.Typesetter{
+		"tex":   &compile.TeX{Command: cmd, Bibtex: cfg.Bibtex, Biber: cfg.Biber, Makeindex: cfg.Makeindex, Makeglossaries: cfg.Makeglossaries, ShellEscape: cfg.ShellEscape},
+		"typst": &compile.Typst{Command: cfg.Typst},
+	}
+	s.setupEngines(cfg.Engines)
+	if err := s.setupCleanup(cfg.Cleanup); err != nil {
+		return nil, err
+	}
+	if err := s.newCaches(); err != nil {
+		return nil, err
+	}
+	if err := s.setupJanitor(cfg.Janitor); err != nil {
+		return nil, err
+	}
+	s.setupStats()
+	s.draining = newDraining()
+	if err := s.setupLibrary(); err != nil {
+		return nil, err
+	}
+	if err := s.setupSandbox(cfg.Sandbox); err != nil {
+		return nil, err
+	}
+	_, docker := s.sandbox.(*compile.Docker)
+	if _, user := s.sandbox.(*compile.User); user && s.limits.Cgroup != "" {
+		// Commands move themselves into their cgroups, which unprivileged users aren't allowed to do
+		return nil, errors.New("compilations run by the user sandbox can't be limited by a cgroup")
+	} else if docker && s.limits.Cgroup != "" {
+		// Containers are limited by docker, which gives each of them a cgroup of its own
+		return nil, errors.New("compilations run by the docker sandbox can't be limited by a cgroup")
+	} else if !docker {
+		if err := s.limits.Check(); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.setupKubernetes(cfg.Kubernetes); err != nil {
+		return nil, err
+	}
+	if err := s.setupAuth(context.Background(), cfg.RBAC, cfg.JWT, cfg.OAuth); err != nil {
+		return nil, err
+	}
+	if err := s.setupRemoteDetails(cfg.RemoteDetails); err != nil {
+		return nil, err
+	}
+	if err := s.setupArchive(cfg.Archive); err != nil {
+		return nil, err
+	}
+	if err := s.setupJobs(cfg.Jobs); err != nil {
+		return nil, err
+	}
+	if err := s.setupSinks(cfg.Sinks, cfg.GCS); err != nil {
+		return nil, err
+	}
+	if err := s.setupSMTP(cfg.SMTP); err != nil {
+		return nil, err
+	}
+	if err := s.setupWatch(cfg.Watch); err != nil {
+		return nil, err
+	}
+	if err := s.setupSync(cfg.Sync); err != nil {
+		return nil, err
+	}
+	if err := s.setupEvents(cfg.Events); err != nil {
+		return nil, err
+	}
 	return s.routes()
 }
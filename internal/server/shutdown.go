@@ -0,0 +1,101 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// shutdownGrace is how long requests are given to respond once their compilations have been killed on shutdown.
+const shutdownGrace = 5 * time.Second
+
+// draining keeps track of the work that's in flight, so that it can be finished (or, failing that, stopped) on shutdown.
+type draining struct {
+	// requests are the API requests being handled, and jobs the asynchronous jobs that are queued or running
+	requests sync.WaitGroup
+	jobs     sync.WaitGroup
+	// stop is cancelled once the server gives up on waiting for work to finish, killing the compilations still running
+	stop   context.Context
+	cancel context.CancelFunc
+}
+
+func newDraining() *draining {
+	d := &draining{}
+	d.stop, d.cancel = context.WithCancel(context.Background())
+	return d
+}
+
+// trackRequests wraps the handler so that the requests it's handling are waited for on shutdown.
+func (s *Server) trackRequests(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.draining.requests.Add(1)
+		defer s.draining.requests.Done()
+		h(w, r)
+	}
+}
+
+// compileContext returns a context for a compilation that's cancelled along with ctx, or once the server gives up on
+// waiting for compilations to finish on shutdown, along with the function releasing it once the compilation is done.
+func (s *Server) compileContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-s.draining.stop.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// wait waits for wg until ctx is done, returning whether it finished waiting.
+func wait(ctx context.Context, wg *sync.WaitGroup) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Shutdown finishes the work in flight once the server has stopped accepting requests (e.g. with http.Server.Shutdown):
+// it waits for requests and asynchronous jobs (queued ones included) to finish until ctx is done, killing the compilations
+// still running after that. Once they've stopped, any spans not yet sent are sent, and every working directory is removed.
+// It returns ctx's error if it had to kill compilations.
+func (s *Server) Shutdown(ctx context.Context) error {
+	var err error
+	if !wait(ctx, &s.draining.jobs) || !wait(ctx, &s.draining.requests) {
+		err = ctx.Err()
+		s.errLog.Printf("killing the compilations still running: %v", err)
+		s.draining.cancel()
+		grace, cancel := context.WithTimeout(context.Background(), shutdownGrace)
+		defer cancel()
+		if !wait(grace, &s.draining.requests) {
+			s.errLog.Println("gave up on waiting for requests to finish")
+		}
+	}
+	if s.tracer != nil {
+		if ferr := s.tracer.flush(context.Background()); ferr != nil {
+			s.errLog.Printf("error while sending spans: %v", ferr)
+		}
+	}
+	// Directories queued for removal are removed now, rather than in the background, along with any that weren't queued
+	for queued := true; queued; {
+		select {
+		case dir := <-s.cleanup.queue:
+			if rerr := s.removeDir(dir, s.cleanup.shred); rerr != nil {
+				s.errLog.Printf("giving up on removing %s: %v", dir, rerr)
+			}
+		default:
+			queued = false
+		}
+	}
+	s.removeOrphans()
+	return err
+}
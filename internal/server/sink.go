@@ -0,0 +1,201 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// sink is somewhere generated PDFs can be sent instead of the response body.
+type sink interface {
+	// write stores the PDF under the given name, returning where it ended up
+	write(ctx context.Context, name string, pdf []byte) (string, error)
+}
+
+// outputOptions sends the PDF to a sink; the response then only says where it went.
+type outputOptions struct {
+	// Sink is the name of one of the servers sinks
+	Sink string `json:"sink"`
+	// Name is what the PDF is stored as, relative to the sinks location; defaults to its SHA-256 hash with a .pdf extension
+	Name string `json:"name,omitempty"`
+}
+
+// outputResult is the response sent when a PDF was sent to a sink.
+type outputResult struct {
+	Sink     string `json:"sink"`
+	Location string `json:"location"`
+	SHA256   string `json:"sha256"`
+	Size     int    `json:"size"`
+	Pages    int    `json:"pages"`
+}
+
+// setupSinks sets up the sinks PDFs can be sent to, each given as a URL:
+//
+//	s3://BUCKET/PREFIX        objects in S3 (or an S3 compatible service)
+//	gs://BUCKET/PREFIX        objects in Google Cloud Storage, through its S3 compatible API
+//	db://PREFIX               files in the db, e.g. to be used as resources
+//	file:///DIR               files in a local directory
+//	https://HOST/PATH         a webhook, receiving the PDF in a POST request
+func (s *Server) setupSinks(sinks map[string]string, gcs AWSConfig) error {
+	s.sinks = map[string]sink{}
+	for name, raw := range sinks {
+		u, err := url.Parse(raw)
+		if err != nil {
+			return fmt.Errorf("invalid sink %s: %v", name, err)
+		}
+		prefix := strings.TrimPrefix(u.Path, "/")
+		switch u.Scheme {
+		case "s3":
+			if s.aws.cfg.Region == "" || s.aws.cfg.AccessKeyID == "" {
+				return fmt.Errorf("sink %s needs AWS credentials and a region", name)
+			}
+			s.sinks[name] = &objectSink{client: s.aws, scheme: "s3", bucket: u.Host, prefix: prefix}
+		case "gs":
+			if gcs.AccessKeyID == "" {
+				return fmt.Errorf("sink %s needs a Cloud Storage HMAC key", name)
+			}
+			if gcs.S3Endpoint == "" {
+				gcs.S3Endpoint = "https://storage.googleapis.com"
+			}
+			if gcs.Region == "" {
+				gcs.Region = "auto"
+			}
+			s.sinks[name] = &objectSink{client: newAWSClient(gcs), scheme: "gs", bucket: u.Host, prefix: prefix}
+		case "db":
+			if s.db == nil {
+				return fmt.Errorf("sink %s needs a database", name)
+			}
+			s.sinks[name] = &dbSink{db: s.db, prefix: path.Join(u.Host, prefix)}
+		case "file":
+			if err = os.MkdirAll(u.Path, 0755); err != nil {
+				return err
+			}
+			s.sinks[name] = &dirSink{dir: u.Path}
+		case "http", "https":
+			s.sinks[name] = &webhookSink{url: raw, client: &http.Client{Timeout: time.Minute}}
+		default:
+			return fmt.Errorf("unsupported sink %s: %s", name, raw)
+		}
+	}
+	return nil
+}
+
+// sendOutput sends the PDF to the sink the options name.
+// Errors caused by the options are of type DeliveryError.
+func (s *Server) sendOutput(ctx context.Context, opts *outputOptions, pdf []byte) (*outputResult, error) {
+	snk, ok := s.sinks[opts.Sink]
+	if !ok {
+		return nil, &DeliveryError{msg: "no such sink: " + opts.Sink}
+	}
+	res := &outputResult{Sink: opts.Sink, SHA256: sha256Hex(pdf), Size: len(pdf)}
+	name := opts.Name
+	if name == "" {
+		name = res.SHA256 + ".pdf"
+	}
+	// Names are relative to the sink, and so can't climb out of it
+	if name != path.Clean(name) || path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+		return nil, &DeliveryError{msg: fmt.Sprintf("invalid output name: %q", name)}
+	}
+	var err error
+	if res.Location, err = snk.write(ctx, name, pdf); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// objectSink stores PDFs as objects in a bucket.
+type objectSink struct {
+	client *awsClient
+	scheme string
+	bucket string
+	prefix string
+}
+
+func (o *objectSink) write(ctx context.Context, name string, pdf []byte) (string, error) {
+	key := path.Join(o.prefix, name)
+	if err := o.client.putObject(ctx, o.bucket, key, "application/pdf", bytes.NewReader(pdf)); err != nil {
+		return "", err
+	}
+	return o.scheme + "://" + o.bucket + "/" + key, nil
+}
+
+// dbSink stores PDFs in the db.
+type dbSink struct {
+	db     DB
+	prefix string
+}
+
+func (d *dbSink) write(ctx context.Context, name string, pdf []byte) (string, error) {
+	id := path.Join(d.prefix, name)
+	if err := d.db.Store(ctx, id, bytes.NewReader(pdf)); err != nil {
+		return "", err
+	}
+	return "db://" + id, nil
+}
+
+// dirSink writes PDFs to a local directory.
+type dirSink struct {
+	dir string
+}
+
+func (d *dirSink) write(ctx context.Context, name string, pdf []byte) (string, error) {
+	fpath := filepath.Join(d.dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
+		return "", err
+	}
+	// Written next to where it belongs and then moved into place, so that whatever watches the directory never sees half a PDF
+	tmp, err := ioutil.TempFile(filepath.Dir(fpath), ".latte-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(pdf)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), fpath)
+	}
+	if err != nil {
+		return "", err
+	}
+	return "file://" + filepath.ToSlash(fpath), nil
+}
+
+// webhookSink POSTs PDFs to a URL, with their name in the X-Latte-Name header.
+// The location is taken from the Location header of the response, if it has one.
+type webhookSink struct {
+	url    string
+	client *http.Client
+}
+
+func (wh *webhookSink) write(ctx context.Context, name string, pdf []byte) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", wh.url, bytes.NewReader(pdf))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/pdf")
+	req.Header.Set("X-Latte-Name", name)
+	req.Header.Set("X-Latte-SHA256", sha256Hex(pdf))
+	resp, err := wh.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return "", errors.New("POST " + wh.url + ": " + resp.Status)
+	}
+	if loc := resp.Header.Get("Location"); loc != "" {
+		return loc, nil
+	}
+	return wh.url, nil
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/raphaelreyna/latte/internal/compile"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// slowCompile is the entry logged for a compilation that took longer than the slow compile threshold.
+type slowCompile struct {
+	Template string  `json:"template"`
+	Seconds  float64 `json:"seconds"`
+	Failed   bool    `json:"failed"`
+	// DetailsBytes is the size of the details as JSON, DetailsKeys how many top level keys they have
+	DetailsBytes int `json:"details_bytes"`
+	DetailsKeys  int `json:"details_keys"`
+	// Resources is how many files were placed in the working directory for the compilation
+	Resources int `json:"resources"`
+	Passes    int `json:"passes"`
+	// Phases maps the phases of the compilation to how long they took, in milliseconds
+	Phases map[string]float64 `json:"phases"`
+}
+
+// logSlowCompile logs the details of a compilation in dir if it took longer than the slow compile threshold, much like a databases slow query log.
+func (s *Server) logSlowCompile(tmplID string, details map[string]interface{}, dir string, res *compile.Result, failed bool) {
+	var total time.Duration
+	for _, p := range res.Phases {
+		total += p.Duration
+	}
+	if s.slowCompile <= 0 || total < s.slowCompile {
+		return
+	}
+	if tmplID == "" {
+		tmplID = inlineTemplates
+	}
+	entry := slowCompile{
+		Template: tmplID,
+		Seconds:  total.Seconds(),
+		Failed:   failed,
+		Passes:   res.Passes(),
+		Phases:   map[string]float64{},
+	}
+	if data, err := json.Marshal(details); err == nil {
+		entry.DetailsBytes = len(data)
+	}
+	entry.DetailsKeys = len(details)
+	// Everything the compiler made is named after the working directory
+	if infos, err := ioutil.ReadDir(dir); err == nil {
+		for _, info := range infos {
+			if !strings.HasPrefix(info.Name(), filepath.Base(dir)+".") {
+				entry.Resources++
+			}
+		}
+	}
+	for _, p := range res.Phases {
+		entry.Phases[p.Name] = float64(p.Duration.Microseconds()) / 1000
+	}
+	data, err := json.Marshal(&entry)
+	if err != nil {
+		s.errLog.Println(err)
+		return
+	}
+	s.infoLog.Printf("slow compile: %s", data)
+}
@@ -0,0 +1,228 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// statsInterval is how often the counters are sampled, and so the precision of the windows stats are computed over
+	statsInterval = 10 * time.Second
+	// statsWindow is the longest window stats are computed over
+	statsWindow = time.Hour
+)
+
+// statsWindows are the windows stats are computed over, by name.
+var statsWindows = []struct {
+	name string
+	d    time.Duration
+}{{"1m", time.Minute}, {"15m", 15 * time.Minute}, {"1h", time.Hour}}
+
+// counters are cumulative counts since the server started.
+type counters struct {
+	requests     uint64
+	clientErrors uint64
+	serverErrors uint64
+	tmplHits     uint64
+	tmplMisses   uint64
+	rscHits      uint64
+	rscMisses    uint64
+}
+
+type sample struct {
+	at time.Time
+	c  counters
+}
+
+// stats keeps track of requests, and samples them along with the caches counters so that they can be reported over rolling windows.
+type stats struct {
+	requests     uint64
+	clientErrors uint64
+	serverErrors uint64
+	// compiling is how many compilations are in progress
+	compiling int64
+	// rootBytes is how much space the root directory took up when last sampled, and workBytes how much of it went to working directories
+	rootBytes int64
+	workBytes int64
+	// samples is a ring buffer of the counters, oldest first starting at next
+	samples []sample
+	next    int
+	sync.Mutex
+}
+
+// setupStats starts sampling the counters in the background.
+func (s *Server) setupStats() {
+	s.stats = &stats{}
+	s.sampleStats()
+	go func() {
+		for range time.Tick(statsInterval) {
+			s.sampleStats()
+		}
+	}()
+}
+
+func (s *Server) counters() counters {
+	c := counters{
+		requests:     atomic.LoadUint64(&s.stats.requests),
+		clientErrors: atomic.LoadUint64(&s.stats.clientErrors),
+		serverErrors: atomic.LoadUint64(&s.stats.serverErrors),
+	}
+	s.tmpls.Lock()
+	c.tmplHits, c.tmplMisses = s.tmpls.hits, s.tmpls.misses
+	s.tmpls.Unlock()
+	s.rscs.Lock()
+	c.rscHits, c.rscMisses = s.rscs.hits, s.rscs.misses
+	s.rscs.Unlock()
+	return c
+}
+
+func (s *Server) sampleStats() {
+	root, work := diskUsage(s.rootDir)
+	atomic.StoreInt64(&s.stats.rootBytes, root)
+	atomic.StoreInt64(&s.stats.workBytes, work)
+	smp := sample{at: time.Now(), c: s.counters()}
+	st := s.stats
+	st.Lock()
+	defer st.Unlock()
+	if n := int(statsWindow/statsInterval) + 1; len(st.samples) < n {
+		st.samples = append(st.samples, smp)
+		return
+	}
+	st.samples[st.next] = smp
+	st.next = (st.next + 1) % len(st.samples)
+}
+
+// diskUsage returns how many bytes the files under the root directory take up, and how many of those are in working directories.
+func diskUsage(root string) (int64, int64) {
+	var total, work int64
+	filepath.Walk(root, func(fpath string, info os.FileInfo, err error) error {
+		// Working directories come and go while the directory is walked
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		total += info.Size()
+		if rel, err := filepath.Rel(root, fpath); err == nil && strings.HasPrefix(rel, workDirPrefix) {
+			work += info.Size()
+		}
+		return nil
+	})
+	return total, work
+}
+
+// since returns the newest sample taken at least d ago, or the oldest one if the server hasn't been up that long.
+func (st *stats) since(d time.Duration) sample {
+	st.Lock()
+	defer st.Unlock()
+	cutoff := time.Now().Add(-d)
+	oldest := st.samples[st.next%len(st.samples)]
+	found := oldest
+	for i := range st.samples {
+		smp := st.samples[(st.next+i)%len(st.samples)]
+		if smp.at.After(cutoff) {
+			break
+		}
+		found = smp
+	}
+	return found
+}
+
+// countRequests wraps the handler so that the requests it handles, and the errors it responds with, are counted.
+func (s *Server) countRequests(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sr := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h(sr, r)
+		atomic.AddUint64(&s.stats.requests, 1)
+		switch {
+		case sr.status >= 500:
+			atomic.AddUint64(&s.stats.serverErrors, 1)
+		case sr.status >= 400:
+			atomic.AddUint64(&s.stats.clientErrors, 1)
+		}
+	}
+}
+
+// statusRecorder records the status code a handler responds with.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(code int) {
+	sr.status = code
+	sr.ResponseWriter.WriteHeader(code)
+}
+
+func (sr *statusRecorder) Flush() {
+	if f, ok := sr.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack lets handlers take over the connection, e.g. for WebSockets.
+func (sr *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := sr.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("taking over connections isn't supported")
+	}
+	sr.status = http.StatusSwitchingProtocols
+	return hj.Hijack()
+}
+
+func ratio(n, total uint64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(n) / float64(total)
+}
+
+func (s *Server) handleStats() http.HandlerFunc {
+	type window struct {
+		// Seconds is how long the window actually covers, which is less than its name suggests if the server hasn't been up that long
+		Seconds float64 `json:"seconds"`
+		// Requests is how many API requests were handled, RequestRate how many per second
+		Requests    uint64  `json:"requests"`
+		RequestRate float64 `json:"request_rate"`
+		// ErrorRate and ClientErrorRate are the fractions of requests responded to with 5xx and 4xx statuses
+		ErrorRate       float64 `json:"error_rate"`
+		ClientErrorRate float64 `json:"client_error_rate"`
+		// TemplateHitRatio and ResourceHitRatio are the fractions of lookups that were cache hits
+		TemplateHitRatio float64 `json:"template_hit_ratio"`
+		ResourceHitRatio float64 `json:"resource_hit_ratio"`
+	}
+	type response struct {
+		// QueueDepth is how many compilations are in progress, and Queued how many are waiting for a slot to do so
+		QueueDepth int64             `json:"queue_depth"`
+		Queued     int               `json:"queued"`
+		Windows    map[string]window `json:"windows"`
+	}
+	s.apiSchema("statsResponse", response{})
+	return func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		current := s.counters()
+		resp := response{QueueDepth: atomic.LoadInt64(&s.stats.compiling), Queued: s.pool.waiting(), Windows: map[string]window{}}
+		for _, sw := range statsWindows {
+			then := s.stats.since(sw.d)
+			win := window{Seconds: now.Sub(then.at).Seconds(), Requests: current.requests - then.c.requests}
+			if win.Seconds > 0 {
+				win.RequestRate = float64(win.Requests) / win.Seconds
+			}
+			win.ErrorRate = ratio(current.serverErrors-then.c.serverErrors, win.Requests)
+			win.ClientErrorRate = ratio(current.clientErrors-then.c.clientErrors, win.Requests)
+			hits, misses := current.tmplHits-then.c.tmplHits, current.tmplMisses-then.c.tmplMisses
+			win.TemplateHitRatio = ratio(hits, hits+misses)
+			hits, misses = current.rscHits-then.c.rscHits, current.rscMisses-then.c.rscMisses
+			win.ResourceHitRatio = ratio(hits, hits+misses)
+			resp.Windows[sw.name] = win
+		}
+		w.Header().Set("Content-Type", "application/json")
+		s.respond(w, &resp, http.StatusOK)
+	}
+}
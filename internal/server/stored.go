@@ -0,0 +1,152 @@
+package server
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// listStored returns the ids of the registered files in the root directory and the db (if it can list what it holds)
+// that valid doesn't reject, sorted.
+func (s *Server) listStored(ctx context.Context, valid func(id string) error) ([]string, error) {
+	found := map[string]bool{}
+	infos, err := ioutil.ReadDir(s.rootDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range infos {
+		if info.Mode().IsRegular() && valid(info.Name()) == nil {
+			found[info.Name()] = true
+		}
+	}
+	if lister, ok := s.db.(ListDB); ok {
+		ids, err := lister.List(ctx, "")
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			if valid(id) == nil {
+				found[id] = true
+			}
+		}
+	}
+	ids := make([]string, 0, len(found))
+	for id := range found {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// listStoredSizes is like listStored, but also returns how large each file is, by id. The sizes of files in the root
+// directory are looked at there, and those of the rest come from the db's listing without fetching them; they're -1 if
+// the db can list what it holds but not how large it is.
+func (s *Server) listStoredSizes(ctx context.Context, valid func(id string) error) (map[string]int64, error) {
+	sizes := map[string]int64{}
+	switch db := s.db.(type) {
+	case SizeDB:
+		dbSizes, err := db.ListSizes(ctx, "")
+		if err != nil {
+			return nil, err
+		}
+		for id, size := range dbSizes {
+			if valid(id) == nil {
+				sizes[id] = size
+			}
+		}
+	case ListDB:
+		ids, err := db.List(ctx, "")
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			if valid(id) == nil {
+				sizes[id] = -1
+			}
+		}
+	}
+	infos, err := ioutil.ReadDir(s.rootDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range infos {
+		if info.Mode().IsRegular() && valid(info.Name()) == nil {
+			sizes[info.Name()] = info.Size()
+		}
+	}
+	return sizes, nil
+}
+
+// storedExists returns whether a file with the given id is registered, either in the root directory or the db.
+func (s *Server) storedExists(ctx context.Context, id string) (bool, error) {
+	if _, err := os.Stat(filepath.Join(s.rootDir, id)); err == nil {
+		return true, nil
+	} else if !os.IsNotExist(err) {
+		return false, err
+	}
+	if s.db == nil {
+		return false, nil
+	}
+	data, err := s.db.Fetch(ctx, id)
+	switch err.(type) {
+	case nil:
+		data.Close()
+		return true, nil
+	case *NotFoundError:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// writeStored registers src under the given id, replacing whatever was registered under it, and sends it to the db.
+// Callers evict whatever was cached for the file being replaced first. It returns the ids of any files derived from it,
+// or a *TooLargeError if src is larger than a resource may be.
+func (s *Server) writeStored(ctx context.Context, id string, src io.Reader) ([]string, error) {
+	// Write to a temporary file first so requests never see half a file
+	f, err := ioutil.TempFile(s.rootDir, ".stored-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	_, err = stream(f, limitFile(src, id, s.maxRscBytes))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	fpath := filepath.Join(s.rootDir, id)
+	if err = os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
+		return nil, err
+	}
+	if err = os.Rename(f.Name(), fpath); err != nil {
+		return nil, err
+	}
+	s.janitor.touch(id)
+	return s.ingest(ctx, id, fpath)
+}
+
+// deleteStored deletes the registered file with the given id from the root directory and the db, returning whether it existed.
+// Callers make sure the db can delete files, and evict whatever was cached for the file first.
+func (s *Server) deleteStored(ctx context.Context, id string) (bool, error) {
+	err := os.Remove(filepath.Join(s.rootDir, id))
+	found := err == nil
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	if deleter, ok := s.db.(DeleteDB); ok {
+		err = deleter.Delete(ctx, id)
+		switch err.(type) {
+		case nil:
+			found = true
+		case *NotFoundError:
+		default:
+			return found, err
+		}
+	}
+	return found, nil
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// streamBufSize is the size of the buffers used to stream uploads to disk.
+// Memory used while streaming a file is bounded by this, no matter how large the file is.
+const streamBufSize = 32 * 1024
+
+var streamBufs = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, streamBufSize)
+		return &b
+	},
+}
+
+// stream copies src into dst using one of the pooled buffers.
+func stream(dst io.Writer, src io.Reader) (int64, error) {
+	bp := streamBufs.Get().(*[]byte)
+	defer streamBufs.Put(bp)
+	// Hide any ReaderFrom / WriterTo so io.CopyBuffer is forced to use our buffer
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, *bp)
+}
+
+// streamToFile streams src into a temporary file next to path, which then replaces the file at path; if streaming fails,
+// e.g. because the client or the db went away, the temporary file is removed and whatever was at path is left alone.
+// Files are never seen half written, whether by those checking that a file is on local disk before using it, or by
+// those writing the same file at the same time.
+func streamToFile(path string, src io.Reader) (int64, error) {
+	// Temporary files are hidden, and only left behind if the server dies while writing them
+	f, err := ioutil.TempFile(filepath.Dir(path), ".latte-tmp-"+filepath.Base(path)+"-")
+	if err != nil {
+		return 0, err
+	}
+	n, err := stream(f, src)
+	if err == nil {
+		// Temporary files are only readable by their owner, unlike those made with os.Create
+		err = f.Chmod(0644)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return n, err
+}
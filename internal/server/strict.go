@@ -0,0 +1,147 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// StrictError is returned when decoding a JSON request body in strict mode fails, listing the offending fields.
+type StrictError struct {
+	// Unknown lists the fields the request had that aren't part of the API, Invalid those whose values are of the wrong type
+	Unknown []string
+	Invalid []string
+	err     error
+}
+
+func (e *StrictError) Error() string {
+	var problems []string
+	if len(e.Unknown) > 0 {
+		problems = append(problems, "unknown fields: "+strings.Join(e.Unknown, ", "))
+	}
+	if len(e.Invalid) > 0 {
+		problems = append(problems, "fields with invalid values: "+strings.Join(e.Invalid, ", "))
+	}
+	if len(problems) == 0 {
+		return "invalid json body: " + e.err.Error()
+	}
+	return strings.Join(problems, "; ")
+}
+
+// decode decodes the JSON in r into v. In strict mode, bodies with fields that v doesn't have or values of the wrong type
+// are rejected with a *StrictError, so that client bugs like misspelled fields are caught rather than silently ignored.
+// Empty bodies result in io.EOF either way.
+func (s *Server) decode(r io.Reader, v interface{}) error {
+	if !s.strict {
+		if err := json.NewDecoder(r).Decode(v); err != nil {
+			return err
+		}
+		return drainBody(r)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return io.EOF
+	}
+	var unknown []string
+	var raw interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return &StrictError{err: err}
+	}
+	unknownFields(raw, reflect.TypeOf(v), "", &unknown)
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return &StrictError{Unknown: unknown}
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			return &StrictError{Invalid: []string{typeErr.Field}, err: err}
+		}
+		return &StrictError{err: err}
+	}
+	return nil
+}
+
+func isStrictError(err error) bool {
+	_, ok := err.(*StrictError)
+	return ok
+}
+
+// unknownFields appends the paths (e.g. delimiters.lft) of the fields in the decoded JSON value raw that t doesn't have to unknown.
+func unknownFields(raw interface{}, t reflect.Type, prefix string, unknown *[]string) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if reflect.PtrTo(t).Implements(reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()) {
+		return
+	}
+	switch t.Kind() {
+	case reflect.Slice, reflect.Array:
+		if items, ok := raw.([]interface{}); ok {
+			for _, item := range items {
+				unknownFields(item, t.Elem(), prefix+"[]", unknown)
+			}
+		}
+	case reflect.Struct:
+		obj, ok := raw.(map[string]interface{})
+		if !ok {
+			return
+		}
+		fields := map[string]reflect.Type{}
+		jsonFields(t, fields)
+		for key, value := range obj {
+			var ft reflect.Type
+			// encoding/json matches field names case insensitively
+			for name, typ := range fields {
+				if strings.EqualFold(name, key) {
+					ft = typ
+					break
+				}
+			}
+			if ft == nil {
+				*unknown = append(*unknown, prefix+key)
+				continue
+			}
+			unknownFields(value, ft, prefix+key+".", unknown)
+		}
+	}
+}
+
+// jsonFields maps the names of the JSON fields of the struct type t to their types, including those of embedded structs.
+func jsonFields(t reflect.Type, fields map[string]reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				jsonFields(ft, fields)
+				continue
+			}
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields[name] = f.Type
+	}
+}
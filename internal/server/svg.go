@@ -0,0 +1,52 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"sort"
+)
+
+const (
+	pdf2svg = "pdf2svg"
+	dvisvgm = "dvisvgm"
+)
+
+// renderSVG renders the given page (counting from 1) of the PDF at pdfPath into dir as an SVG, or every page if page is 0.
+// It uses pdf2svg if it's installed, falling back to dvisvgm, which turns glyphs into paths so that the SVGs don't depend on any fonts.
+// It returns the paths of the rendered pages, in order.
+func renderSVG(ctx context.Context, pdfPath, dir string, page int) ([]string, error) {
+	base := filepath.Base(pdfPath)
+	base = base[:len(base)-len(filepath.Ext(base))]
+	var cmd *exec.Cmd
+	switch {
+	case hasCommand(pdf2svg):
+		if page > 0 {
+			cmd = exec.CommandContext(ctx, pdf2svg, pdfPath, filepath.Join(dir, fmt.Sprintf("%s-page-%04d.svg", base, page)), fmt.Sprint(page))
+		} else {
+			cmd = exec.CommandContext(ctx, pdf2svg, pdfPath, filepath.Join(dir, base+"-page-%04d.svg"), "all")
+		}
+	case hasCommand(dvisvgm):
+		pages := "1-"
+		if page > 0 {
+			pages = fmt.Sprint(page)
+		}
+		cmd = exec.CommandContext(ctx, dvisvgm, "--pdf", "--no-fonts", "--page="+pages, "--output="+filepath.Join(dir, base+"-page-%4p.svg"), pdfPath)
+	default:
+		return nil, errors.New("pdf2svg or dvisvgm is required for rendering pages as SVG but neither is installed")
+	}
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("error while rendering %s: %v: %s", filepath.Base(pdfPath), err, output)
+	}
+	pages, err := filepath.Glob(filepath.Join(dir, base+"-page-*.svg"))
+	sort.Strings(pages)
+	return pages, err
+}
+
+// hasCommand returns whether the named command is installed.
+func hasCommand(name string) bool {
+	_, err := exec.LookPath(name)
+	return err == nil
+}
@@ -0,0 +1,253 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// SyncConfig configures keeping templates in sync with the bundles published to an upstream registry.
+type SyncConfig struct {
+	// Upstream is either the URL of another LaTTe instance (e.g. https://latte.example.com),
+	// or an OCI registry and the repository templates are published under, e.g. oci://registry.example.com/templates.
+	Upstream string
+	// Token is sent as a bearer token with every request made to the upstream registry, if set.
+	Token string
+	// Templates maps the ids of the templates to sync to the version they're pinned to; templates that aren't pinned follow the latest version.
+	Templates map[string]string
+	// Interval is how often the upstream registry is checked for new versions. Defaults to 5 minutes.
+	Interval time.Duration
+}
+
+// registry is somewhere bundles are published to.
+type registry interface {
+	// latest returns the latest version of the template with the given id
+	latest(ctx context.Context, id string) (string, error)
+	// fetch returns the bundle of the given version of the template with the given id
+	fetch(ctx context.Context, id, version string) (io.ReadCloser, error)
+}
+
+// setupSync starts syncing templates from the upstream registry, if one was configured.
+func (s *Server) setupSync(cfg *SyncConfig) error {
+	if cfg == nil || cfg.Upstream == "" {
+		return nil
+	}
+	u, err := url.Parse(cfg.Upstream)
+	if err != nil {
+		return fmt.Errorf("invalid upstream registry: %v", err)
+	}
+	client := &http.Client{Timeout: time.Minute}
+	var reg registry
+	switch u.Scheme {
+	case "http", "https":
+		reg = &latteRegistry{url: strings.TrimSuffix(cfg.Upstream, "/"), token: cfg.Token, client: client}
+	case "oci":
+		reg = &ociRegistry{host: u.Host, repo: strings.Trim(u.Path, "/"), token: cfg.Token, client: client}
+	default:
+		return fmt.Errorf("unsupported upstream registry: %s", cfg.Upstream)
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = 5 * time.Minute
+	}
+	go func() {
+		s.syncTemplates(reg, cfg.Templates)
+		for range time.Tick(cfg.Interval) {
+			s.syncTemplates(reg, cfg.Templates)
+		}
+	}()
+	return nil
+}
+
+func (s *Server) syncTemplates(reg registry, templates map[string]string) {
+	for id, version := range templates {
+		if err := s.syncTemplate(context.Background(), reg, id, version); err != nil {
+			s.errLog.Printf("error while syncing template %s: %v", id, err)
+		}
+	}
+}
+
+// syncTemplate installs the given version of the template from the registry, or the latest one if version is empty, unless its already installed.
+func (s *Server) syncTemplate(ctx context.Context, reg registry, id, version string) error {
+	var err error
+	if version == "" {
+		if version, err = reg.latest(ctx, id); err != nil {
+			return err
+		}
+	}
+	installed, err := s.installedBundle(ctx, id)
+	if err != nil {
+		return err
+	}
+	if installed != nil && installed.Version == version {
+		return nil
+	}
+	rc, err := reg.fetch(ctx, id, version)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	dir, err := ioutil.TempDir(s.rootDir, bundleDirPrefix)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	m, err := extractBundle(rc, dir)
+	if err != nil {
+		return err
+	}
+	if m.Template != id || m.Version != version {
+		return fmt.Errorf("expected version %s of template %s; got version %s of template %s", version, id, m.Version, m.Template)
+	}
+	files, err := m.files(dir)
+	if err != nil {
+		return err
+	}
+	s.bundles.Lock()
+	defer s.bundles.Unlock()
+	if _, err = s.installBundle(ctx, m, files, dir); err != nil {
+		return err
+	}
+	s.infoLog.Printf("synced template %s to version %s", id, version)
+	return nil
+}
+
+// registryGet makes a GET request for the given URL, returning the response if it was successful.
+func registryGet(ctx context.Context, client *http.Client, u, token string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+	return resp, nil
+}
+
+// latteRegistry is another LaTTe instance, serving the bundles installed on it.
+type latteRegistry struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+func (l *latteRegistry) latest(ctx context.Context, id string) (string, error) {
+	resp, err := registryGet(ctx, l.client, l.url+"/v1/bundles/"+url.PathEscape(id), l.token, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var m bundleManifest
+	if err = json.NewDecoder(resp.Body).Decode(&m); err != nil {
+		return "", err
+	}
+	return m.Version, nil
+}
+
+func (l *latteRegistry) fetch(ctx context.Context, id, version string) (io.ReadCloser, error) {
+	// Only the installed version is served, which is checked against the one wanted once its been extracted
+	resp, err := registryGet(ctx, l.client, l.url+"/v1/bundles/"+url.PathEscape(id)+"/archive", l.token, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// ociRegistry is an OCI distribution registry, with each template published to its own repository under repo, tagged by version.
+// The bundle is the first layer of the image manifest.
+type ociRegistry struct {
+	host   string
+	repo   string
+	token  string
+	client *http.Client
+}
+
+// ociManifestType is the media type of the image manifests bundles are published with.
+const ociManifestType = "application/vnd.oci.image.manifest.v1+json"
+
+func (o *ociRegistry) repository(id string) string {
+	if o.repo == "" {
+		return id
+	}
+	return o.repo + "/" + id
+}
+
+// latest returns the tag "latest" points at, which is expected to be the version it was also tagged with.
+func (o *ociRegistry) latest(ctx context.Context, id string) (string, error) {
+	digest, err := o.manifest(ctx, id, "latest")
+	if err != nil {
+		return "", err
+	}
+	resp, err := registryGet(ctx, o.client, "https://"+o.host+"/v2/"+o.repository(id)+"/tags/list", o.token, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var tags struct {
+		Tags []string `json:"tags"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&tags); err != nil {
+		return "", err
+	}
+	for _, tag := range tags.Tags {
+		if tag == "latest" {
+			continue
+		}
+		if d, err := o.manifest(ctx, id, tag); err == nil && d == digest {
+			return tag, nil
+		}
+	}
+	return "", fmt.Errorf("no version of template %s is tagged as latest", id)
+}
+
+// manifest returns the digest of the bundle layer of the image with the given tag.
+func (o *ociRegistry) manifest(ctx context.Context, id, tag string) (string, error) {
+	u := "https://" + o.host + "/v2/" + o.repository(id) + "/manifests/" + url.PathEscape(tag)
+	resp, err := registryGet(ctx, o.client, u, o.token, http.Header{"Accept": {ociManifestType}})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var manifest struct {
+		Layers []struct {
+			Digest string `json:"digest"`
+		} `json:"layers"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&manifest); err != nil {
+		return "", err
+	}
+	if len(manifest.Layers) == 0 {
+		return "", errors.New("image has no layers")
+	}
+	return manifest.Layers[0].Digest, nil
+}
+
+func (o *ociRegistry) fetch(ctx context.Context, id, version string) (io.ReadCloser, error) {
+	digest, err := o.manifest(ctx, id, version)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := registryGet(ctx, o.client, "https://"+o.host+"/v2/"+o.repository(id)+"/blobs/"+digest, o.token, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
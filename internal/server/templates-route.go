@@ -0,0 +1,232 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// templateExts are the extensions of the files managed as templates, rather than resources.
+var templateExts = map[string]bool{".tex": true, ".typ": true}
+
+func validTemplateID(id string) error {
+	if id == "" || id != filepath.Base(id) || strings.HasPrefix(id, ".") {
+		return fmt.Errorf("invalid template id: %s", id)
+	}
+	if !templateExts[filepath.Ext(id)] {
+		return fmt.Errorf("templates must be .tex or .typ files: %s", id)
+	}
+	return nil
+}
+
+// checkTemplateRequest validates the id of the template the request is for, and that the client may perform the action on it.
+// It responds with the appropriate error and returns false if either isn't the case.
+func (s *Server) checkTemplateRequest(w http.ResponseWriter, r *http.Request, id, action string) bool {
+	if err := validTemplateID(id); err != nil {
+		s.fail(w, r, CodeBadRequest, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	err := s.checkTemplateAccess(r.Context(), id, action)
+	switch err.(type) {
+	case nil:
+		return true
+	case *ForbiddenError:
+		s.fail(w, r, CodeForbidden, err.Error(), http.StatusForbidden)
+	default:
+		s.errLog.Println(err)
+		s.fail(w, r, CodeStorageUnavailable, err.Error(), http.StatusInternalServerError)
+	}
+	return false
+}
+
+func (s *Server) handleTemplatesList() http.HandlerFunc {
+	type response struct {
+		Templates []string `json:"templates"`
+	}
+	s.apiSchema("templatesListResponse", response{})
+	return func(w http.ResponseWriter, r *http.Request) {
+		ids, err := s.listStored(r.Context(), validTemplateID)
+		if err != nil {
+			s.errLog.Println(err)
+			s.fail(w, r, CodeStorageUnavailable, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// Clients only get to see the templates they may render
+		resp := response{Templates: []string{}}
+		for _, id := range ids {
+			err = s.checkTemplateAccess(r.Context(), id, aclRender)
+			switch err.(type) {
+			case nil:
+				resp.Templates = append(resp.Templates, id)
+			case *ForbiddenError:
+			default:
+				s.errLog.Println(err)
+				s.fail(w, r, CodeStorageUnavailable, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		s.respond(w, &resp, http.StatusOK)
+	}
+}
+
+func (s *Server) handleTemplatesCreate() http.HandlerFunc {
+	type request struct {
+		ID   string `json:"id"`
+		Data string `json:"data"`
+		// Encoding is the compression applied to the template before it was base64 encoded, if any
+		Encoding string `json:"encoding,omitempty"`
+	}
+	type response struct {
+		ID string `json:"id"`
+	}
+	s.apiSchema("templatesCreateRequest", request{})
+	s.apiSchema("templatesCreateResponse", response{})
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req request
+		if err := s.decode(r.Body, &req); err != nil {
+			s.fail(w, r, CodeInvalidJSON, "error while parsing json body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		r.Body.Close()
+		if !s.checkTemplateRequest(w, r, req.ID, aclModify) {
+			return
+		}
+		raw, err := base64.StdEncoding.DecodeString(req.Data)
+		if err != nil {
+			s.fail(w, r, CodeInvalidEncoding, err.Error(), http.StatusBadRequest)
+			return
+		}
+		src, err := decompress(req.Encoding, bytes.NewReader(raw))
+		if err != nil {
+			s.fail(w, r, CodeInvalidEncoding, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer src.Close()
+		exists, err := s.storedExists(r.Context(), req.ID)
+		if err != nil {
+			s.errLog.Println(err)
+			s.fail(w, r, CodeStorageUnavailable, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if exists {
+			w.Header().Set("Content-Type", "application/json")
+			s.respond(w, &response{ID: req.ID}, http.StatusConflict)
+			return
+		}
+		if _, err = s.evictTemplate(req.ID); err == nil {
+			_, err = s.writeStored(r.Context(), req.ID, src)
+		}
+		if _, ok := err.(*TooLargeError); ok {
+			s.fail(w, r, CodeTooLarge, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			s.errLog.Println(err)
+			s.fail(w, r, CodeStorageUnavailable, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		s.infoLog.Printf("created template: %s", req.ID)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", "/templates/"+req.ID)
+		s.respond(w, &response{ID: req.ID}, http.StatusCreated)
+	}
+}
+
+func (s *Server) handleTemplatesGet() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		if !s.checkTemplateRequest(w, r, id, aclRender) {
+			return
+		}
+		fpath := filepath.Join(s.rootDir, id)
+		err := s.fetchToDisk(r.Context(), id, fpath)
+		switch err.(type) {
+		case nil:
+		case *NotFoundError:
+			s.fail(w, r, CodeNotFound, fmt.Sprintf("template %s not found", id), http.StatusNotFound)
+			return
+		default:
+			s.errLog.Println(err)
+			s.fail(w, r, CodeStorageUnavailable, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		src, err := ioutil.ReadFile(fpath)
+		if err != nil {
+			s.errLog.Println(err)
+			s.fail(w, r, CodeInternal, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("X-Latte-SHA256", sha256Hex(src))
+		s.respond(w, src, http.StatusOK)
+	}
+}
+
+func (s *Server) handleTemplatesPut() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		if !s.checkTemplateRequest(w, r, id, aclModify) {
+			return
+		}
+		exists, err := s.storedExists(r.Context(), id)
+		if err == nil {
+			_, err = s.evictTemplate(id)
+		}
+		if err == nil {
+			_, err = s.writeStored(r.Context(), id, r.Body)
+		}
+		r.Body.Close()
+		if _, ok := err.(*TooLargeError); ok {
+			s.fail(w, r, CodeTooLarge, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			s.errLog.Println(err)
+			s.fail(w, r, CodeStorageUnavailable, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if exists {
+			s.infoLog.Printf("replaced template: %s", id)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		s.infoLog.Printf("created template: %s", id)
+		w.Header().Set("Location", "/templates/"+id)
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+func (s *Server) handleTemplatesDelete() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		if !s.checkTemplateRequest(w, r, id, aclModify) {
+			return
+		}
+		if _, deletable := s.db.(DeleteDB); s.db != nil && !deletable {
+			s.fail(w, r, CodeStorageUnavailable, "the database doesn't support deleting templates", http.StatusNotImplemented)
+			return
+		}
+		_, err := s.evictTemplate(id)
+		var found bool
+		if err == nil {
+			found, err = s.deleteStored(r.Context(), id)
+		}
+		if err != nil {
+			s.errLog.Println(err)
+			s.fail(w, r, CodeStorageUnavailable, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			s.fail(w, r, CodeNotFound, fmt.Sprintf("template %s not found", id), http.StatusNotFound)
+			return
+		}
+		s.infoLog.Printf("deleted template: %s", id)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,17 @@
+package server
+
+import (
+	"fmt"
+	"github.com/raphaelreyna/latte/internal/compile"
+	"strings"
+)
+
+// serverTiming formats the phases of a compilation as the value of a Server-Timing header, with durations in milliseconds,
+// e.g. template;dur=1.2, pass1;dur=812.5, postprocess;dur=30.1
+func serverTiming(phases []compile.Phase) string {
+	metrics := make([]string, len(phases))
+	for i, p := range phases {
+		metrics[i] = fmt.Sprintf("%s;dur=%.1f", p.Name, float64(p.Duration.Microseconds())/1000)
+	}
+	return strings.Join(metrics, ", ")
+}
@@ -0,0 +1,292 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/raphaelreyna/latte/internal/compile"
+)
+
+// TracingConfig configures sending OpenTelemetry spans of the requests LaTTe handles, the files it fetches from storage
+// and the compilations it runs, to a collector over OTLP/HTTP.
+type TracingConfig struct {
+	// Endpoint is the URL spans are POSTed to as OTLP/JSON, e.g. http://collector:4318/v1/traces.
+	Endpoint string
+	// Headers are sent along with every export, e.g. to authenticate with the collector.
+	Headers map[string]string
+	// ServiceName is what LaTTe is called in traces; defaults to latte.
+	ServiceName string
+	// Interval is how often spans are sent; defaults to 5 seconds.
+	Interval time.Duration
+}
+
+const (
+	// traceparentHeader carries the W3C trace context of the caller, which requests' spans are made children of.
+	traceparentHeader = "traceparent"
+	// maxQueuedSpans bounds how many spans are kept waiting to be sent; spans ended while the queue is full are dropped.
+	maxQueuedSpans = 4096
+	// OTLP span kinds and status codes
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanStatusError  = 2
+)
+
+// tracer collects spans and sends them to the collector in the background.
+type tracer struct {
+	cfg    TracingConfig
+	client *http.Client
+	queue  []*span
+	sync.Mutex
+}
+
+// span is a timed operation within a trace.
+type span struct {
+	tracer   *tracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+	end      time.Time
+	attrs    map[string]interface{}
+	err      string
+}
+
+type spanKey struct{}
+
+func (s *Server) setupTracing(cfg *TracingConfig) error {
+	if cfg == nil || cfg.Endpoint == "" {
+		return nil
+	}
+	if cfg.ServiceName == "" {
+		cfg.ServiceName = "latte"
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = 5 * time.Second
+	}
+	t := &tracer{cfg: *cfg, client: &http.Client{Timeout: 10 * time.Second}}
+	s.tracer = t
+	go func() {
+		for range time.Tick(cfg.Interval) {
+			if err := t.flush(context.Background()); err != nil {
+				s.errLog.Printf("error while sending spans: %v", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// startSpan starts a span named name as a child of the span in ctx, if there is one, returning the context it's in.
+// Spans are only recorded if tracing is configured; otherwise the returned span is nil, which is safe to use.
+func (s *Server) startSpan(ctx context.Context, name string) (context.Context, *span) {
+	if s.tracer == nil {
+		return ctx, nil
+	}
+	parent, _ := ctx.Value(spanKey{}).(*span)
+	if parent == nil {
+		// The caller asked that this trace not be recorded
+		if ctx.Value(spanKey{}) != nil {
+			return ctx, nil
+		}
+	}
+	sp := &span{tracer: s.tracer, name: name, kind: spanKindInternal, start: time.Now(), attrs: map[string]interface{}{}}
+	if parent != nil {
+		sp.traceID, sp.parentID = parent.traceID, parent.spanID
+	} else {
+		rand.Read(sp.traceID[:])
+	}
+	rand.Read(sp.spanID[:])
+	return context.WithValue(ctx, spanKey{}, sp), sp
+}
+
+// tracePhases records the phases of a compilation, e.g. each run of the engine, as spans under the one in ctx.
+func (s *Server) tracePhases(ctx context.Context, phases []compile.Phase) {
+	for _, phase := range phases {
+		_, sp := s.startSpan(ctx, phase.Name)
+		if sp == nil {
+			return
+		}
+		sp.start = phase.Start
+		sp.finishAt(phase.Start.Add(phase.Duration))
+	}
+}
+
+// parseTraceparent returns the trace and span IDs in a W3C traceparent header, along with whether the caller is recording the trace.
+func parseTraceparent(header string) (traceID [16]byte, spanID [8]byte, sampled bool, ok bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil || traceID == [16]byte{} {
+		return
+	}
+	if _, err := hex.Decode(spanID[:], []byte(parts[2])); err != nil || spanID == [8]byte{} {
+		return
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return
+	}
+	return traceID, spanID, flags&1 == 1, true
+}
+
+// traceRequests wraps the handler for the route at path so that each request it handles is recorded as a server span,
+// continuing the trace of the caller if it sent a traceparent header.
+func (s *Server) traceRequests(path string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.tracer == nil {
+			h(w, r)
+			return
+		}
+		ctx := r.Context()
+		if traceID, spanID, sampled, ok := parseTraceparent(r.Header.Get(traceparentHeader)); ok {
+			if !sampled {
+				// A nil span marks the trace as one that isn't recorded, so that none of its children are either
+				h(w, r.WithContext(context.WithValue(ctx, spanKey{}, (*span)(nil))))
+				return
+			}
+			ctx = context.WithValue(ctx, spanKey{}, &span{traceID: traceID, spanID: spanID})
+		}
+		ctx, sp := s.startSpan(ctx, r.Method+" "+path)
+		sp.kind = spanKindServer
+		sp.set("http.method", r.Method)
+		sp.set("http.route", path)
+		if id := requestID(r); id != "" {
+			sp.set("latte.request_id", id)
+		}
+		sr := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h(sr, r.WithContext(ctx))
+		sp.set("http.status_code", sr.status)
+		if sr.status >= 500 {
+			sp.fail(fmt.Errorf("%d %s", sr.status, http.StatusText(sr.status)))
+		}
+		sp.finish()
+	}
+}
+
+// set sets an attribute of the span.
+func (sp *span) set(key string, value interface{}) {
+	if sp != nil {
+		sp.attrs[key] = value
+	}
+}
+
+// fail marks the span as having failed with err, if it isn't nil.
+func (sp *span) fail(err error) {
+	if sp != nil && err != nil {
+		sp.err = err.Error()
+	}
+}
+
+// finish ends the span, queueing it to be sent.
+func (sp *span) finish() {
+	sp.finishAt(time.Now())
+}
+
+// finishAt ends the span at the given time, for spans of things that were timed without being traced.
+func (sp *span) finishAt(end time.Time) {
+	if sp == nil {
+		return
+	}
+	sp.end = end
+	t := sp.tracer
+	t.Lock()
+	defer t.Unlock()
+	if len(t.queue) < maxQueuedSpans {
+		t.queue = append(t.queue, sp)
+	}
+}
+
+// flush sends the queued spans to the collector as OTLP/JSON.
+func (t *tracer) flush(ctx context.Context) error {
+	t.Lock()
+	spans := t.queue
+	t.queue = nil
+	t.Unlock()
+	if len(spans) == 0 {
+		return nil
+	}
+	type keyValue struct {
+		Key   string                 `json:"key"`
+		Value map[string]interface{} `json:"value"`
+	}
+	value := func(v interface{}) map[string]interface{} {
+		switch v := v.(type) {
+		case int:
+			return map[string]interface{}{"intValue": strconv.Itoa(v)}
+		case int64:
+			return map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+		case bool:
+			return map[string]interface{}{"boolValue": v}
+		default:
+			return map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+	}
+	var otlpSpans []map[string]interface{}
+	for _, sp := range spans {
+		attrs := []keyValue{}
+		for k, v := range sp.attrs {
+			attrs = append(attrs, keyValue{Key: k, Value: value(v)})
+		}
+		o := map[string]interface{}{
+			"traceId":           hex.EncodeToString(sp.traceID[:]),
+			"spanId":            hex.EncodeToString(sp.spanID[:]),
+			"name":              sp.name,
+			"kind":              sp.kind,
+			"startTimeUnixNano": strconv.FormatInt(sp.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(sp.end.UnixNano(), 10),
+			"attributes":        attrs,
+		}
+		if sp.parentID != [8]byte{} {
+			o["parentSpanId"] = hex.EncodeToString(sp.parentID[:])
+		}
+		if sp.err != "" {
+			o["status"] = map[string]interface{}{"code": spanStatusError, "message": sp.err}
+		}
+		otlpSpans = append(otlpSpans, o)
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []keyValue{{Key: "service.name", Value: value(t.cfg.ServiceName)}},
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": "github.com/raphaelreyna/latte"},
+				"spans": otlpSpans,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.cfg.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("collector responded with %s: %s", resp.Status, msg)
+	}
+	return nil
+}
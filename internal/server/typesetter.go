@@ -0,0 +1,58 @@
+package server
+
+import (
+	"fmt"
+	"github.com/raphaelreyna/latte/internal/compile"
+	"path"
+	"path/filepath"
+)
+
+// setupEngines allows requests to pick any of the given TeX engines, as well as the default one, by their names (e.g. xelatex for /usr/bin/xelatex).
+func (s *Server) setupEngines(commands []string) {
+	def := s.typesetters["tex"]
+	s.engines = map[string]compile.Typesetter{filepath.Base(def.Engine()): def}
+	for _, command := range commands {
+		if _, ok := s.engines[filepath.Base(command)]; !ok {
+			// Every engine builds bibliographies with the same tools
+			tex := *def.(*compile.TeX)
+			tex.Command = command
+			s.engines[filepath.Base(command)] = &tex
+		}
+	}
+}
+
+// validBibliography returns whether tool is one bibliographies can be built with, or empty for not building them.
+func validBibliography(tool string) bool {
+	switch tool {
+	case "", "bibtex", "biber", "auto":
+		return true
+	}
+	return false
+}
+
+// typesetterFor returns the typesetter the template is compiled with: the one named, if any,
+// otherwise Typst for templates ending in .typ and TeX for everything else.
+// TeX templates are compiled with the named engine, if any, otherwise the default one.
+func (s *Server) typesetterFor(tmplID, name, engine string) (compile.Typesetter, error) {
+	if name == "" {
+		name = "tex"
+		if path.Ext(tmplID) == ".typ" {
+			name = "typst"
+		}
+	}
+	if engine != "" {
+		if name != "tex" {
+			return nil, fmt.Errorf("engine can only be picked for tex templates, not %s ones", name)
+		}
+		ts, ok := s.engines[engine]
+		if !ok {
+			return nil, fmt.Errorf("engine not allowed: %s", engine)
+		}
+		return ts, nil
+	}
+	ts, ok := s.typesetters[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown typesetter: %s", name)
+	}
+	return ts, nil
+}
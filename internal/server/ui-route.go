@@ -0,0 +1,20 @@
+package server
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+//go:embed admin playground docs
+var uiFiles embed.FS
+
+// handleUI serves one of the embedded single page apps (e.g. the admin UI), which are built on top of the rest of the API.
+func (s *Server) handleUI(name string) http.Handler {
+	files, err := fs.Sub(uiFiles, name)
+	if err != nil {
+		// The UI directories are embedded at compile time, so this can't happen
+		panic(err)
+	}
+	return http.StripPrefix("/"+name+"/", http.FileServer(http.FS(files)))
+}
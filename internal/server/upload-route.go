@@ -0,0 +1,369 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/gorilla/mux"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// upload is a resource being uploaded in numbered chunks, each of which is stored as its own file in dir until the upload is committed.
+type upload struct {
+	rscID string
+	dir   string
+	sync.Mutex
+}
+
+type uploads struct {
+	u map[string]*upload
+	sync.Mutex
+}
+
+func (u *uploads) get(id string) (*upload, bool) {
+	u.Lock()
+	defer u.Unlock()
+	up, ok := u.u[id]
+	return up, ok
+}
+
+func (u *uploads) remove(id string) {
+	u.Lock()
+	delete(u.u, id)
+	u.Unlock()
+}
+
+// chunks returns the chunk numbers that have been uploaded so far, in order.
+func (up *upload) chunks() ([]int, error) {
+	infos, err := ioutil.ReadDir(up.dir)
+	if err != nil {
+		return nil, err
+	}
+	var nums []int
+	for _, info := range infos {
+		if n, err := strconv.Atoi(info.Name()); err == nil {
+			nums = append(nums, n)
+		}
+	}
+	sort.Ints(nums)
+	return nums, nil
+}
+
+// size returns the total size of the chunks uploaded so far, leaving out the chunk with the given number.
+func (up *upload) size(except int) (int64, error) {
+	infos, err := ioutil.ReadDir(up.dir)
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, info := range infos {
+		if n, err := strconv.Atoi(info.Name()); err == nil && n != except {
+			total += info.Size()
+		}
+	}
+	return total, nil
+}
+
+// rscExists checks if a resource has already been registered, either on local disk or in the db.
+func (s *Server) rscExists(r *http.Request, id string) (bool, error) {
+	if _, err := os.Stat(filepath.Join(s.rootDir, id)); err == nil {
+		return true, nil
+	} else if !os.IsNotExist(err) {
+		return false, err
+	}
+	if s.db == nil {
+		return false, nil
+	}
+	data, err := s.db.Fetch(r.Context(), id)
+	switch err.(type) {
+	case nil:
+		data.Close()
+		return true, nil
+	case *NotFoundError:
+		return false, nil
+	}
+	return false, err
+}
+
+func (s *Server) handleUploadCreate() http.HandlerFunc {
+	type request struct {
+		ID string `json:"id"`
+	}
+	type response struct {
+		ID     string `json:"id"`
+		Upload string `json:"upload"`
+	}
+	s.apiSchema("uploadCreateRequest", request{})
+	s.apiSchema("uploadCreateResponse", response{})
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req request
+		if err := s.decode(r.Body, &req); err != nil {
+			msg := "error while parsing json body: " + err.Error()
+			s.errLog.Println(msg)
+			s.fail(w, r, CodeInvalidJSON, msg, http.StatusBadRequest)
+			return
+		}
+		r.Body.Close()
+		if req.ID == "" {
+			s.fail(w, r, CodeBadRequest, "no resource id provided", http.StatusBadRequest)
+			return
+		}
+		if err := checkName(req.ID); err != nil {
+			s.fail(w, r, CodeBadRequest, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err := s.checkTemplateAccess(r.Context(), req.ID, aclModify)
+		switch err.(type) {
+		case nil:
+		case *ForbiddenError:
+			s.fail(w, r, CodeForbidden, err.Error(), http.StatusForbidden)
+			return
+		default:
+			s.errLog.Println(err)
+			s.fail(w, r, CodeInternal, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		exists, err := s.rscExists(r, req.ID)
+		if err != nil {
+			s.errLog.Println(err)
+			s.fail(w, r, CodeInternal, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if exists {
+			w.Header().Set("Content-Type", "application/json")
+			s.respond(w, &response{ID: req.ID}, http.StatusConflict)
+			return
+		}
+		dir, err := ioutil.TempDir(s.rootDir, uploadDirPrefix)
+		if err != nil {
+			s.errLog.Println(err)
+			s.fail(w, r, CodeInternal, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		up := &upload{rscID: req.ID, dir: dir}
+		uploadID := filepath.Base(dir)
+		s.uploads.Lock()
+		s.uploads.u[uploadID] = up
+		s.uploads.Unlock()
+		s.infoLog.Printf("started chunked upload %s for resource: %s", uploadID, req.ID)
+		w.Header().Set("Content-Type", "application/json")
+		s.respond(w, &response{ID: req.ID, Upload: uploadID}, http.StatusCreated)
+	}
+}
+
+func (s *Server) handleUploadChunk() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		up, ok := s.uploads.get(vars["upload"])
+		if !ok {
+			s.fail(w, r, CodeNotFound, fmt.Sprintf("upload %s not found", vars["upload"]), http.StatusNotFound)
+			return
+		}
+		n, err := strconv.Atoi(vars["chunk"])
+		if err != nil || n < 1 {
+			s.fail(w, r, CodeBadRequest, "chunk numbers must be positive integers", http.StatusBadRequest)
+			return
+		}
+		// Chunks can't add up to more than a resource may be, once decompressed
+		var uploaded int64
+		if s.maxRscBytes > 0 {
+			if uploaded, err = up.size(n); err != nil {
+				s.errLog.Println(err)
+				s.fail(w, r, CodeInternal, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if uploaded > s.maxRscBytes {
+				uploaded = s.maxRscBytes
+			}
+		}
+		// Chunks are written to a temporary file first so that a failed upload never leaves a partial chunk behind
+		f, err := ioutil.TempFile(up.dir, "partial-")
+		if err != nil {
+			s.errLog.Println(err)
+			s.fail(w, r, CodeInternal, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// Chunks may be sent compressed, in which case they're stored decompressed
+		body, err := decompress(r.Header.Get("Content-Encoding"), r.Body)
+		if err == nil {
+			var src io.Reader = body
+			if s.maxRscBytes > 0 {
+				src = &limitedFile{r: body, name: up.rscID, limit: s.maxRscBytes, remaining: s.maxRscBytes - uploaded}
+			}
+			_, err = stream(f, src)
+			body.Close()
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		r.Body.Close()
+		if err == nil {
+			err = os.Rename(f.Name(), filepath.Join(up.dir, strconv.Itoa(n)))
+		}
+		if _, ok := err.(*TooLargeError); ok {
+			os.Remove(f.Name())
+			s.fail(w, r, CodeTooLarge, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			os.Remove(f.Name())
+			s.errLog.Println(err)
+			s.fail(w, r, CodeInternal, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *Server) handleUploadCommit() http.HandlerFunc {
+	type request struct {
+		// Chunks is the number of chunks the resource was split into; chunks are numbered from 1.
+		Chunks int `json:"chunks"`
+		// SHA256 is the optional hex encoded hash the assembled resource is expected to have.
+		SHA256 string `json:"sha256,omitempty"`
+	}
+	type response struct {
+		ID      string   `json:"id"`
+		SHA256  string   `json:"sha256"`
+		Size    int64    `json:"size"`
+		Derived []string `json:"derived,omitempty"`
+	}
+	s.apiSchema("uploadCommitRequest", request{})
+	s.apiSchema("uploadCommitResponse", response{})
+	return func(w http.ResponseWriter, r *http.Request) {
+		uploadID := mux.Vars(r)["upload"]
+		up, ok := s.uploads.get(uploadID)
+		if !ok {
+			s.fail(w, r, CodeNotFound, fmt.Sprintf("upload %s not found", uploadID), http.StatusNotFound)
+			return
+		}
+		var req request
+		if err := s.decode(r.Body, &req); err != nil {
+			msg := "error while parsing json body: " + err.Error()
+			s.errLog.Println(msg)
+			s.fail(w, r, CodeInvalidJSON, msg, http.StatusBadRequest)
+			return
+		}
+		r.Body.Close()
+		up.Lock()
+		defer up.Unlock()
+		nums, err := up.chunks()
+		if err != nil {
+			s.errLog.Println(err)
+			s.fail(w, r, CodeInternal, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for i, n := range nums {
+			if n != i+1 {
+				s.fail(w, r, CodeBadRequest, fmt.Sprintf("missing chunk %d", i+1), http.StatusBadRequest)
+				return
+			}
+		}
+		if len(nums) == 0 || (req.Chunks > 0 && len(nums) != req.Chunks) {
+			msg := fmt.Sprintf("received %d chunks; expected %d", len(nums), req.Chunks)
+			s.fail(w, r, CodeBadRequest, msg, http.StatusBadRequest)
+			return
+		}
+
+		if s.maxRscBytes > 0 {
+			size, err := up.size(0)
+			if err != nil {
+				s.errLog.Println(err)
+				s.fail(w, r, CodeInternal, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if size > s.maxRscBytes {
+				msg := fmt.Sprintf("%s is larger than %d bytes", up.rscID, s.maxRscBytes)
+				s.fail(w, r, CodeTooLarge, msg, http.StatusRequestEntityTooLarge)
+				return
+			}
+		}
+
+		// Assemble the chunks, hashing them along the way
+		assembled, err := ioutil.TempFile(up.dir, "assembled-")
+		if err != nil {
+			s.errLog.Println(err)
+			s.fail(w, r, CodeInternal, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		h := sha256.New()
+		var size int64
+		for _, n := range nums {
+			var written int64
+			written, err = appendFile(io.MultiWriter(assembled, h), filepath.Join(up.dir, strconv.Itoa(n)))
+			size += written
+			if err != nil {
+				break
+			}
+		}
+		if cerr := assembled.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			s.errLog.Println(err)
+			s.fail(w, r, CodeInternal, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		resp := response{ID: up.rscID, SHA256: hex.EncodeToString(h.Sum(nil)), Size: size}
+		if req.SHA256 != "" && req.SHA256 != resp.SHA256 {
+			err = &MismatchError{ID: up.rscID, Expected: req.SHA256, Actual: resp.SHA256}
+			s.fail(w, r, CodeConflict, err.Error(), http.StatusConflict)
+			return
+		}
+
+		fpath := filepath.Join(s.rootDir, up.rscID)
+		if err = os.Rename(assembled.Name(), fpath); err != nil {
+			s.errLog.Println(err)
+			s.fail(w, r, CodeInternal, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		s.infoLog.Printf("wrote new file to local disk: %s", up.rscID)
+		if resp.Derived, err = s.ingest(r.Context(), up.rscID, fpath); err != nil {
+			s.errLog.Println(err)
+			s.fail(w, r, CodeInternal, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		s.uploads.remove(uploadID)
+		if err = os.RemoveAll(up.dir); err != nil {
+			s.errLog.Println(err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		s.respond(w, &resp, http.StatusOK)
+	}
+}
+
+func (s *Server) handleUploadAbort() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		uploadID := mux.Vars(r)["upload"]
+		up, ok := s.uploads.get(uploadID)
+		if !ok {
+			s.fail(w, r, CodeNotFound, fmt.Sprintf("upload %s not found", uploadID), http.StatusNotFound)
+			return
+		}
+		s.uploads.remove(uploadID)
+		up.Lock()
+		defer up.Unlock()
+		if err := os.RemoveAll(up.dir); err != nil {
+			s.errLog.Println(err)
+			s.fail(w, r, CodeInternal, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func appendFile(w io.Writer, path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return stream(w, f)
+}
@@ -0,0 +1,234 @@
+package server
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// usageBucket is the granularity usage is recorded at, and so the precision of the time ranges it can be reported for.
+const usageBucket = time.Hour
+
+// UsageConfig configures periodically exporting how much each client has generated.
+type UsageConfig struct {
+	// ExportDir is the directory usage reports are written to; usage isn't exported if its empty.
+	ExportDir string
+	// ExportInterval is how often usage is exported, each report covering the time since the previous one. Defaults to a day.
+	ExportInterval time.Duration
+	// ExportFormat is the format of the reports; either "csv" (the default) or "json".
+	ExportFormat string
+}
+
+// usageCounts is what a client consumed.
+type usageCounts struct {
+	// Requests is how many compilations were run, Failures how many of those failed
+	Requests int `json:"requests"`
+	Failures int `json:"failures"`
+	// Bytes is how many bytes of PDFs were generated
+	Bytes int64 `json:"bytes"`
+	// CPUSeconds is the CPU time the compiler used
+	CPUSeconds float64 `json:"cpu_seconds"`
+}
+
+// usageRow is what a client consumed over a period of time; clients are identified by their tenant and the key (or token subject) they used.
+type usageRow struct {
+	Tenant string `json:"tenant"`
+	Key    string `json:"key"`
+	usageCounts
+}
+
+type usageKey struct {
+	bucket int64
+	tenant string
+	key    string
+}
+
+type usage struct {
+	buckets map[usageKey]*usageCounts
+	sync.Mutex
+}
+
+// recordUsage records a compilation run for the client the request was authenticated as.
+// Requests aren't told apart by client if the server doesn't authenticate them.
+func (s *Server) recordUsage(ctx context.Context, bytes int, cpu time.Duration, failed bool) {
+	k := usageKey{bucket: time.Now().Truncate(usageBucket).Unix()}
+	if p := principalFrom(ctx); p != nil {
+		k.tenant, k.key = p.tenant, p.subject
+	}
+	s.usage.Lock()
+	defer s.usage.Unlock()
+	c, ok := s.usage.buckets[k]
+	if !ok {
+		c = &usageCounts{}
+		s.usage.buckets[k] = c
+	}
+	c.Requests++
+	if failed {
+		c.Failures++
+	}
+	c.Bytes += int64(bytes)
+	c.CPUSeconds += cpu.Seconds()
+}
+
+// report sums up the usage recorded in [from, to) for each client, optionally only for the given tenant and/or key.
+func (u *usage) report(from, to time.Time, tenant, key string) []usageRow {
+	u.Lock()
+	sums := map[usageKey]*usageCounts{}
+	for k, c := range u.buckets {
+		t := time.Unix(k.bucket, 0)
+		if t.Before(from.Truncate(usageBucket)) || !t.Before(to) {
+			continue
+		}
+		if (tenant != "" && k.tenant != tenant) || (key != "" && k.key != key) {
+			continue
+		}
+		client := usageKey{tenant: k.tenant, key: k.key}
+		sum, ok := sums[client]
+		if !ok {
+			sum = &usageCounts{}
+			sums[client] = sum
+		}
+		sum.Requests += c.Requests
+		sum.Failures += c.Failures
+		sum.Bytes += c.Bytes
+		sum.CPUSeconds += c.CPUSeconds
+	}
+	u.Unlock()
+	rows := make([]usageRow, 0, len(sums))
+	for k, sum := range sums {
+		rows = append(rows, usageRow{Tenant: k.tenant, Key: k.key, usageCounts: *sum})
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].Tenant != rows[j].Tenant {
+			return rows[i].Tenant < rows[j].Tenant
+		}
+		return rows[i].Key < rows[j].Key
+	})
+	return rows
+}
+
+// writeUsageCSV writes rows as CSV, with a header, each row stating the period it covers.
+func writeUsageCSV(w io.Writer, from, to time.Time, rows []usageRow) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"from", "to", "tenant", "key", "requests", "failures", "bytes", "cpu_seconds"})
+	for _, row := range rows {
+		cw.Write([]string{
+			from.UTC().Format(time.RFC3339), to.UTC().Format(time.RFC3339), row.Tenant, row.Key,
+			strconv.Itoa(row.Requests), strconv.Itoa(row.Failures),
+			strconv.FormatInt(row.Bytes, 10), strconv.FormatFloat(row.CPUSeconds, 'f', 3, 64),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// usageReport is the JSON form of the usage over a period of time.
+type usageReport struct {
+	From  time.Time  `json:"from"`
+	To    time.Time  `json:"to"`
+	Usage []usageRow `json:"usage"`
+}
+
+// setupUsage starts recording usage, and exporting it periodically if an export directory is configured.
+func (s *Server) setupUsage(cfg UsageConfig) error {
+	s.usage = &usage{buckets: map[usageKey]*usageCounts{}}
+	if cfg.ExportDir == "" {
+		return nil
+	}
+	switch cfg.ExportFormat {
+	case "":
+		cfg.ExportFormat = "csv"
+	case "csv", "json":
+	default:
+		return fmt.Errorf("unknown usage export format: %s", cfg.ExportFormat)
+	}
+	if cfg.ExportInterval <= 0 {
+		cfg.ExportInterval = 24 * time.Hour
+	}
+	if err := os.MkdirAll(cfg.ExportDir, 0755); err != nil {
+		return err
+	}
+	go func() {
+		from := time.Now().Truncate(usageBucket)
+		for range time.Tick(cfg.ExportInterval) {
+			// Only export whole buckets, so that no usage is reported twice
+			to := time.Now().Truncate(usageBucket)
+			if !to.After(from) {
+				continue
+			}
+			if err := s.exportUsage(cfg, from, to); err != nil {
+				s.errLog.Printf("error while exporting usage: %v", err)
+				continue
+			}
+			from = to
+		}
+	}()
+	return nil
+}
+
+// exportUsage writes the usage in [from, to) to a file in the export directory named after the period it covers.
+func (s *Server) exportUsage(cfg UsageConfig, from, to time.Time) error {
+	const stamp = "20060102T150405Z"
+	name := fmt.Sprintf("usage-%s-%s.%s", from.UTC().Format(stamp), to.UTC().Format(stamp), cfg.ExportFormat)
+	f, err := os.Create(filepath.Join(cfg.ExportDir, name))
+	if err != nil {
+		return err
+	}
+	rows := s.usage.report(from, to, "", "")
+	if cfg.ExportFormat == "json" {
+		err = json.NewEncoder(f).Encode(&usageReport{From: from, To: to, Usage: rows})
+	} else {
+		err = writeUsageCSV(f, from, to, rows)
+	}
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	if err == nil {
+		s.infoLog.Printf("exported usage to %s", name)
+	}
+	return err
+}
+
+func (s *Server) handleUsage() http.HandlerFunc {
+	s.apiSchema("usageReport", usageReport{})
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		var from time.Time
+		to := time.Now()
+		for param, t := range map[string]*time.Time{"from": &from, "to": &to} {
+			if v := q.Get(param); v != "" {
+				parsed, err := time.Parse(time.RFC3339, v)
+				if err != nil {
+					s.fail(w, r, CodeBadRequest, fmt.Sprintf("invalid %s time: %v", param, err), http.StatusBadRequest)
+					return
+				}
+				*t = parsed
+			}
+		}
+		tenant := q.Get("tenant")
+		// Clients that aren't admins only get to see their own tenants usage
+		if p := principalFrom(r.Context()); p != nil && !p.can(PermAdmin) {
+			tenant = p.tenant
+		}
+		rows := s.usage.report(from, to, tenant, q.Get("key"))
+		if q.Get("format") == "csv" {
+			w.Header().Set("Content-Type", "text/csv")
+			w.WriteHeader(http.StatusOK)
+			if err := writeUsageCSV(w, from, to, rows); err != nil {
+				s.errLog.Println(err)
+			}
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		s.respond(w, &usageReport{From: from, To: to, Usage: rows}, http.StatusOK)
+	}
+}
@@ -0,0 +1,256 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// templateProblem is an error found in a template, along with where it is.
+type templateProblem struct {
+	// Line and Column are where in the template the problem is, counting from 1; Column is left out if it isn't known
+	Line    int    `json:"line,omitempty"`
+	Column  int    `json:"column,omitempty"`
+	Message string `json:"message"`
+}
+
+// templateErrorPosition matches the position text/template prefixes its errors with, e.g. "template: name:12:5: ".
+var templateErrorPosition = regexp.MustCompile(`^template: [^:]*:(\d+)(?::(\d+))?: (.*)$`)
+
+// newTemplateProblem splits the position out of an error returned while parsing or executing a template.
+func newTemplateProblem(err error) *templateProblem {
+	msg := err.Error()
+	m := templateErrorPosition.FindStringSubmatch(msg)
+	if m == nil {
+		return &templateProblem{Message: msg}
+	}
+	p := &templateProblem{Message: m[3]}
+	p.Line, _ = strconv.Atoi(m[1])
+	p.Column, _ = strconv.Atoi(m[2])
+	return p
+}
+
+// templateVariables returns the paths of the details the template refers to, e.g. "customer.name", sorted.
+// Fields used inside range blocks are prefixed by what's ranged over and "[]", e.g. "items[].price".
+func templateVariables(t *template.Template) []string {
+	vars := map[string]bool{}
+	for _, tmpl := range t.Templates() {
+		if tmpl.Tree != nil {
+			collectVariables(tmpl.Tree.Root, "", vars)
+		}
+	}
+	var names []string
+	for name := range vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// collectVariables adds the paths of the details referred to under node to vars; dot is the path of what dot is set to.
+func collectVariables(node parse.Node, dot string, vars map[string]bool) {
+	join := func(prefix string, fields []string) string {
+		path := strings.Join(fields, ".")
+		if prefix == "" {
+			return path
+		}
+		return prefix + "." + path
+	}
+	// fieldOf returns the path of the details pipe evaluates to, if it's a plain field
+	fieldOf := func(pipe *parse.PipeNode) (string, bool) {
+		if pipe == nil || len(pipe.Cmds) != 1 || len(pipe.Cmds[0].Args) != 1 {
+			return "", false
+		}
+		switch arg := pipe.Cmds[0].Args[0].(type) {
+		case *parse.FieldNode:
+			return join(dot, arg.Ident), true
+		case *parse.VariableNode:
+			if len(arg.Ident) > 1 && arg.Ident[0] == "$" {
+				return join("", arg.Ident[1:]), true
+			}
+		case *parse.DotNode:
+			return dot, true
+		}
+		return "", false
+	}
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			collectVariables(child, dot, vars)
+		}
+	case *parse.ActionNode:
+		collectVariables(n.Pipe, dot, vars)
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+		for _, cmd := range n.Cmds {
+			collectVariables(cmd, dot, vars)
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			collectVariables(arg, dot, vars)
+		}
+	case *parse.FieldNode:
+		vars[join(dot, n.Ident)] = true
+	case *parse.VariableNode:
+		// Only fields of $, the details themselves, can be told apart; other variables could hold anything
+		if len(n.Ident) > 1 && n.Ident[0] == "$" {
+			vars[join("", n.Ident[1:])] = true
+		}
+	case *parse.ChainNode:
+		collectVariables(n.Node, dot, vars)
+	case *parse.IfNode:
+		collectVariables(n.Pipe, dot, vars)
+		collectVariables(n.List, dot, vars)
+		collectVariables(n.ElseList, dot, vars)
+	case *parse.RangeNode:
+		collectVariables(n.Pipe, dot, vars)
+		inner := dot
+		if path, ok := fieldOf(n.Pipe); ok {
+			inner = path + "[]"
+		}
+		collectVariables(n.List, inner, vars)
+		collectVariables(n.ElseList, dot, vars)
+	case *parse.WithNode:
+		collectVariables(n.Pipe, dot, vars)
+		inner := dot
+		if path, ok := fieldOf(n.Pipe); ok {
+			inner = path
+		}
+		collectVariables(n.List, inner, vars)
+		collectVariables(n.ElseList, dot, vars)
+	case *parse.TemplateNode:
+		collectVariables(n.Pipe, dot, vars)
+	}
+}
+
+// missingVariables returns those of the paths that aren't in details; paths into lists are only checked up to the list.
+func missingVariables(paths []string, details map[string]interface{}) []string {
+	var missing []string
+	for _, path := range paths {
+		var value interface{} = details
+		for _, field := range strings.Split(path, ".") {
+			if strings.HasSuffix(field, "[]") || field == "" {
+				break
+			}
+			obj, ok := value.(map[string]interface{})
+			if !ok {
+				break
+			}
+			if value, ok = obj[field]; !ok {
+				missing = append(missing, path)
+				break
+			}
+		}
+	}
+	return missing
+}
+
+func (s *Server) handleValidate() http.HandlerFunc {
+	type request struct {
+		// Template is a base64 encoded template; registered templates are validated with ?tmpl=ID instead
+		Template   string      `json:"template,omitempty"`
+		Delimiters *delimiters `json:"delimiters,omitempty"`
+		// Details, if sent, are used to fill in the template as a test
+		Details map[string]interface{} `json:"details,omitempty"`
+	}
+	type response struct {
+		// Valid is whether the template parsed and, if details were sent, could be filled in with them
+		Valid bool `json:"valid"`
+		// ParseError is why the template couldn't be parsed, if it couldn't
+		ParseError *templateProblem `json:"parse_error,omitempty"`
+		// Variables are the paths of the details the template refers to
+		Variables []string `json:"variables"`
+		// ExecutionError is why the template couldn't be filled in with the details, if it couldn't
+		ExecutionError *templateProblem `json:"execution_error,omitempty"`
+		// Missing are the variables that aren't in the details
+		Missing []string `json:"missing,omitempty"`
+		// Filled is the template filled in with the details
+		Filled string `json:"filled,omitempty"`
+	}
+	s.apiSchema("validateRequest", request{})
+	s.apiSchema("validateResponse", response{})
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req request
+		if err := s.decode(r.Body, &req); err != nil {
+			s.fail(w, r, CodeInvalidJSON, err.Error(), http.StatusBadRequest)
+			return
+		}
+		r.Body.Close()
+		delims := defaultDelims
+		if req.Delimiters != nil {
+			if req.Delimiters.Left == "" || req.Delimiters.Right == "" {
+				s.fail(w, r, CodeBadRequest, "only received one delimiter; need none or both", http.StatusBadRequest)
+				return
+			}
+			delims = *req.Delimiters
+		}
+		var src []byte
+		if req.Template != "" {
+			var err error
+			if src, err = base64.StdEncoding.DecodeString(req.Template); err != nil {
+				s.fail(w, r, CodeInvalidEncoding, err.Error(), http.StatusBadRequest)
+				return
+			}
+		} else if id := r.URL.Query().Get("tmpl"); id != "" {
+			if !s.checkTemplateRequest(w, r, id, aclRender) {
+				return
+			}
+			fpath := filepath.Join(s.rootDir, id)
+			err := s.fetchToDisk(r.Context(), id, fpath)
+			if err == nil {
+				src, err = ioutil.ReadFile(fpath)
+			}
+			switch err.(type) {
+			case nil:
+			case *NotFoundError:
+				s.fail(w, r, CodeMissingTemplate, fmt.Sprintf("template with id %s not found", id), http.StatusBadRequest)
+				return
+			default:
+				s.errLog.Println(err)
+				s.fail(w, r, CodeStorageUnavailable, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		} else {
+			s.fail(w, r, CodeMissingTemplate, "no template provided", http.StatusBadRequest)
+			return
+		}
+
+		// The template is parsed on its own rather than through the cache, since it's never compiled
+		resp := response{Variables: []string{}}
+		tmpl, err := template.New("").Delims(delims.Left, delims.Right).Parse(string(src))
+		if err != nil {
+			resp.ParseError = newTemplateProblem(err)
+			w.Header().Set("Content-Type", "application/json")
+			s.respond(w, &resp, http.StatusOK)
+			return
+		}
+		resp.Valid = true
+		resp.Variables = templateVariables(tmpl)
+		if req.Details != nil {
+			var filled bytes.Buffer
+			if err := tmpl.Execute(&filled, req.Details); err != nil {
+				resp.Valid = false
+				resp.ExecutionError = newTemplateProblem(err)
+			} else {
+				resp.Filled = filled.String()
+			}
+			resp.Missing = missingVariables(resp.Variables, req.Details)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		s.respond(w, &resp, http.StatusOK)
+	}
+}
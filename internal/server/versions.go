@@ -0,0 +1,50 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// apiVersions are the versions of the API that are served, each under its own path prefix (e.g. /v1/generate).
+// v1 is the API as it was before versioning was introduced; v2 is where behavior that would break v1 clients lands:
+// its errors are only problem details (see failWith), and it generates PDFs in the background unless asked not to (see handleAsync).
+var apiVersions = []int{1, 2}
+
+type apiVersionKey struct{}
+
+// apiVersion returns the version of the API the request was made against.
+// Requests made without a version prefix are treated as v1 requests.
+func apiVersion(r *http.Request) int {
+	if v, ok := r.Context().Value(apiVersionKey{}).(int); ok {
+		return v
+	}
+	return 1
+}
+
+// apiPrefix returns the path prefix of the version of the API the request was made against, or "" if it was made
+// against an unversioned route, so that the links sent back keep clients on the version they're using.
+func apiPrefix(r *http.Request) string {
+	if v, ok := r.Context().Value(apiVersionKey{}).(int); ok {
+		return fmt.Sprintf("/v%d", v)
+	}
+	return ""
+}
+
+func withAPIVersion(v int, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h(w, r.WithContext(context.WithValue(r.Context(), apiVersionKey{}, v)))
+	}
+}
+
+// deprecated marks responses to unversioned routes as deprecated, pointing clients at the v1 route that replaces them.
+func (s *Server) deprecated(path string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Add("Link", "</v1"+path+`>; rel="successor-version"`)
+		if s.sunset != "" {
+			w.Header().Set("Sunset", s.sunset)
+		}
+		h(w, r)
+	}
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGenerateVersions(t *testing.T) {
+	s := newTestServer(t, Config{})
+	header := http.Header{"Content-Type": {"application/json"}}
+
+	// v1 only generates in the background when asked to, failing with a plain JSON error otherwise
+	w := serve(s, "POST", "/v1/generate", strings.NewReader(`{}`), header)
+	if w.Code != http.StatusBadRequest || w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("expected v1 to fail with a JSON error straight away, got %d (%s): %s", w.Code, w.Header().Get("Content-Type"), w.Body)
+	}
+
+	// v2 generates in the background unless asked not to, or the request mustn't persist anything
+	w = serve(s, "POST", "/v2/generate", strings.NewReader(`{}`), header)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("expected v2 to queue a job, got %d: %s", w.Code, w.Body)
+	}
+	var job asyncJob
+	if err := json.Unmarshal(w.Body.Bytes(), &job); err != nil {
+		t.Fatal(err)
+	}
+	if loc := w.Header().Get("Location"); loc != "/v2/jobs/"+job.ID {
+		t.Errorf("expected the job to be located under /v2, got %s", loc)
+	}
+	for target, body := range map[string]string{"/v2/generate?async=false": `{}`, "/v2/generate": `{"no_persist": true}`} {
+		w = serve(s, "POST", target, strings.NewReader(body), header)
+		if w.Code != http.StatusBadRequest || w.Header().Get("Content-Type") != "application/problem+json" {
+			t.Errorf("expected %s %s to fail with problem details straight away, got %d (%s): %s", target, body, w.Code, w.Header().Get("Content-Type"), w.Body)
+		}
+	}
+
+	// Let the job finish before its server goes away
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if j := s.jobs.get(job.ID); j != nil && j.Finished != nil {
+			return
+		}
+	}
+	t.Error("the job didn't finish")
+}
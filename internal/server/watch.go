@@ -0,0 +1,183 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// WatchConfig configures serving the templates (and resources) kept in a local directory, e.g. a git checkout.
+type WatchConfig struct {
+	// Dir is the directory watched; files are registered under their path relative to it, e.g. invoices/invoice.tex.
+	Dir string
+	// Interval is how often the directory is checked for changes. Defaults to 2 seconds.
+	Interval time.Duration
+}
+
+// watchedFile is what a watched file looked like when it was last loaded.
+type watchedFile struct {
+	modTime time.Time
+	size    int64
+}
+
+// watcher keeps the root directory in sync with a watched directory.
+type watcher struct {
+	dir string
+	// files maps the ids of the files loaded from the watched directory to what they looked like when they were loaded
+	files map[string]watchedFile
+}
+
+// setupWatch loads the files in the watched directory, if one was configured, and starts watching it for changes.
+func (s *Server) setupWatch(cfg *WatchConfig) error {
+	if cfg == nil || cfg.Dir == "" {
+		return nil
+	}
+	dir, err := filepath.Abs(cfg.Dir)
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(dir); err != nil {
+		return err
+	} else if !info.IsDir() {
+		return &os.PathError{Op: "watch", Path: dir, Err: os.ErrInvalid}
+	}
+	// Copies are written to the root directory, which mustn't be watched in turn
+	root, err := filepath.Abs(s.rootDir)
+	if err != nil {
+		return err
+	}
+	if rel, err := filepath.Rel(dir, root); err == nil && (rel == "." || !strings.HasPrefix(rel, "..")) {
+		return fmt.Errorf("can't watch %s: the root directory %s is inside it", dir, root)
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = 2 * time.Second
+	}
+	w := &watcher{dir: dir, files: map[string]watchedFile{}}
+	// The first pass happens before serving any requests, so that every template is there from the start
+	if err := s.syncWatched(context.Background(), w); err != nil {
+		return err
+	}
+	go func() {
+		for range time.Tick(cfg.Interval) {
+			if err := s.syncWatched(context.Background(), w); err != nil {
+				s.errLog.Printf("error while checking %s for changes: %v", w.dir, err)
+			}
+		}
+	}()
+	return nil
+}
+
+// syncWatched loads the files in the watched directory that were added or changed since it was last checked, and unloads those that were removed.
+// Hidden files and directories (e.g. .git) are ignored.
+func (s *Server) syncWatched(ctx context.Context, w *watcher) error {
+	seen := map[string]bool{}
+	err := filepath.Walk(w.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(info.Name(), ".") && path != w.dir {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(w.dir, path)
+		if err != nil {
+			return err
+		}
+		id := filepath.ToSlash(rel)
+		seen[id] = true
+		current := watchedFile{modTime: info.ModTime(), size: info.Size()}
+		if prev, ok := w.files[id]; ok && prev == current {
+			return nil
+		}
+		// A file that fails to load (e.g. while its still being written) is retried on the next pass
+		if err := s.loadWatched(ctx, id, path); err != nil {
+			s.errLog.Printf("error while loading %s: %v", id, err)
+			return nil
+		}
+		w.files[id] = current
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for id := range w.files {
+		if seen[id] {
+			continue
+		}
+		if err := s.unloadWatched(id); err != nil {
+			s.errLog.Printf("error while unloading %s: %v", id, err)
+			continue
+		}
+		delete(w.files, id)
+	}
+	return nil
+}
+
+// loadWatched copies a watched file into the root directory, evicting whatever was cached for the version it replaces.
+func (s *Server) loadWatched(ctx context.Context, id, path string) error {
+	if err := s.evictWatched(id); err != nil {
+		return err
+	}
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	fpath := filepath.Join(s.rootDir, id)
+	if err = os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
+		return err
+	}
+	// The copy is moved into place once complete, so that requests never see half of it
+	tmp, err := ioutil.TempFile(filepath.Dir(fpath), ".watch-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, src)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), fpath)
+	}
+	if err != nil {
+		return err
+	}
+	if _, err = s.ingest(ctx, id, fpath); err != nil {
+		return err
+	}
+	s.infoLog.Printf("loaded %s from %s", id, path)
+	return nil
+}
+
+// unloadWatched removes a file that was deleted from the watched directory from the root directory and the caches.
+// Files also stored in the db stay there, and so can still be fetched from it.
+func (s *Server) unloadWatched(id string) error {
+	if err := s.evictWatched(id); err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(s.rootDir, id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	s.infoLog.Printf("unloaded %s", id)
+	return nil
+}
+
+// evictWatched evicts the file with the given id from both caches, since any watched file may be used as either a template or a resource.
+func (s *Server) evictWatched(id string) error {
+	if _, err := s.evictTemplate(id); err != nil {
+		return err
+	}
+	_, err := s.evictResource(id)
+	return err
+}
@@ -0,0 +1,262 @@
+package server
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Opcodes of WebSocket frames, see RFC 6455.
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+// Status codes WebSocket connections are closed with.
+const (
+	wsNormalClosure   = 1000
+	wsGoingAway       = 1001
+	wsProtocolError   = 1002
+	wsMessageTooLarge = 1009
+)
+
+const (
+	// wsAcceptGUID is appended to the key sent by clients to compute the key they're answered with
+	wsAcceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	// wsWriteTimeout is how long a client has to take a message before it's given up on
+	wsWriteTimeout = 30 * time.Second
+	// wsMaxMessage is how large a message clients can send, unless the server limits request bodies to less
+	wsMaxMessage = 32 << 20
+)
+
+// UpgradeError is returned when a request to open a WebSocket connection isn't a valid handshake.
+type UpgradeError struct {
+	msg string
+}
+
+func (e *UpgradeError) Error() string {
+	return e.msg
+}
+
+// errWSClosed is returned by wsConn.read once the client has closed the connection.
+var errWSClosed = errors.New("websocket connection closed")
+
+// wsConn is the server's end of a WebSocket connection; LaTTe only needs enough of the protocol to exchange whole messages.
+type wsConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	// mu keeps frames written from different goroutines from being interleaved
+	mu sync.Mutex
+}
+
+// headerHas returns whether the comma separated list in the header with the given name has the token in it.
+func headerHas(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// normalizeOrigin returns the origin as browsers send it, so that configured origins can be compared to them.
+func normalizeOrigin(origin string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(origin), "/"))
+}
+
+// checkOrigin returns whether the request to open a WebSocket connection may be answered. Browsers let any site open
+// connections to any server, sending along the cookies and credentials they have for it, so requests from browsers
+// are only answered if they come from the server's own origin or an allowed one (see Config.WSOrigins). Clients that
+// aren't browsers don't send an Origin header, and are always answered.
+func (s *Server) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if s.wsOrigins["*"] || s.wsOrigins[normalizeOrigin(origin)] {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+// upgradeWebSocket completes the opening handshake of a WebSocket connection, taking it over from the HTTP server.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	if !headerHas(r.Header, "Connection", "upgrade") || !headerHas(r.Header, "Upgrade", "websocket") {
+		return nil, &UpgradeError{msg: "not a websocket handshake"}
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		return nil, &UpgradeError{msg: "unsupported websocket version"}
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		return nil, &UpgradeError{msg: "missing websocket key"}
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, errors.New("taking over connections isn't supported")
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	// Deadlines the server set for the request don't apply to the connection
+	conn.SetDeadline(time.Time{})
+	sum := sha1.Sum([]byte(key + wsAcceptGUID))
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n")
+	rw.WriteString("Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, r: rw.Reader}, nil
+}
+
+// frame reads the next frame, unmasking its payload, which can't be longer than max bytes.
+func (c *wsConn) frame(max int64) (bool, byte, []byte, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(c.r, head[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin, op := head[0]&0x80 != 0, head[0]&0x0f
+	if head[0]&0x70 != 0 {
+		return false, 0, nil, c.fail(wsProtocolError, "unexpected reserved bits")
+	}
+	// Clients must mask everything they send
+	if head[1]&0x80 == 0 {
+		return false, 0, nil, c.fail(wsProtocolError, "unmasked frame")
+	}
+	n := int64(head[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		n = int64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		n = int64(binary.BigEndian.Uint64(ext[:]) & (1<<63 - 1))
+	}
+	if n > max {
+		return false, 0, nil, c.fail(wsMessageTooLarge, fmt.Sprintf("messages can't be larger than %d bytes", max))
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(c.r, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, op, payload, nil
+}
+
+// read returns the next text or binary message, no larger than max bytes, answering pings and closes along the way.
+// It returns errWSClosed once the client has closed the connection.
+func (c *wsConn) read(max int64) (byte, []byte, error) {
+	var op byte
+	var msg []byte
+	for {
+		fin, fop, payload, err := c.frame(max - int64(len(msg)))
+		if err != nil {
+			return 0, nil, err
+		}
+		switch fop {
+		case wsPing:
+			if err := c.write(wsPong, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			c.closeWith(wsNormalClosure, "")
+			return 0, nil, errWSClosed
+		case wsText, wsBinary:
+			if msg != nil {
+				return 0, nil, c.fail(wsProtocolError, "expected a continuation frame")
+			}
+			op, msg = fop, payload
+		case wsContinuation:
+			if msg == nil {
+				return 0, nil, c.fail(wsProtocolError, "unexpected continuation frame")
+			}
+			msg = append(msg, payload...)
+		default:
+			return 0, nil, c.fail(wsProtocolError, fmt.Sprintf("unknown opcode %d", fop))
+		}
+		if fin {
+			return op, msg, nil
+		}
+	}
+}
+
+// write sends a frame holding the whole payload.
+func (c *wsConn) write(op byte, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	head := make([]byte, 2, 10)
+	head[0] = 0x80 | op
+	switch n := len(payload); {
+	case n < 126:
+		head[1] = byte(n)
+	case n <= 0xffff:
+		head[1] = 126
+		head = append(head, 0, 0)
+		binary.BigEndian.PutUint16(head[2:], uint16(n))
+	default:
+		head[1] = 127
+		head = append(head, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(head[2:], uint64(n))
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	if _, err := c.conn.Write(head); err != nil {
+		return err
+	}
+	_, err := c.conn.Write(payload)
+	return err
+}
+
+// closeWith sends a close frame with the given status code and reason; the connection is closed once the client answers it.
+func (c *wsConn) closeWith(code uint16, reason string) error {
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, code)
+	return c.write(wsClose, append(payload, reason...))
+}
+
+// fail closes the connection because the client broke the protocol, returning the error describing how.
+func (c *wsConn) fail(code uint16, reason string) error {
+	c.closeWith(code, reason)
+	return errors.New("websocket protocol error: " + reason)
+}
+
+func (c *wsConn) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,284 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// wsFrame is a frame sent by the server, as the client sees it.
+type wsFrame struct {
+	op      byte
+	payload []byte
+}
+
+// wsPipe returns the server's end of a connection, along with a function that sends frames as a client would, and
+// the frames the server sends back.
+func wsPipe(t *testing.T) (*wsConn, func(...[]byte), <-chan wsFrame) {
+	t.Helper()
+	server, client := net.Pipe()
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+	frames := make(chan wsFrame, 16)
+	go func() {
+		defer close(frames)
+		r := bufio.NewReader(client)
+		for {
+			var head [2]byte
+			if _, err := io.ReadFull(r, head[:]); err != nil {
+				return
+			}
+			n := int64(head[1] & 0x7f)
+			switch n {
+			case 126:
+				var ext [2]byte
+				io.ReadFull(r, ext[:])
+				n = int64(binary.BigEndian.Uint16(ext[:]))
+			case 127:
+				var ext [8]byte
+				io.ReadFull(r, ext[:])
+				n = int64(binary.BigEndian.Uint64(ext[:]))
+			}
+			payload := make([]byte, n)
+			if _, err := io.ReadFull(r, payload); err != nil {
+				return
+			}
+			frames <- wsFrame{op: head[0] & 0x0f, payload: payload}
+		}
+	}()
+	send := func(frames ...[]byte) {
+		go func() {
+			for _, f := range frames {
+				if _, err := client.Write(f); err != nil {
+					return
+				}
+			}
+		}()
+	}
+	return &wsConn{conn: server, r: bufio.NewReader(server)}, send, frames
+}
+
+// clientFrame encodes a frame the way clients send them, masked.
+func clientFrame(fin bool, op byte, payload []byte) []byte {
+	var buf bytes.Buffer
+	b := op
+	if fin {
+		b |= 0x80
+	}
+	buf.WriteByte(b)
+	switch n := len(payload); {
+	case n < 126:
+		buf.WriteByte(0x80 | byte(n))
+	case n <= 0xffff:
+		buf.WriteByte(0x80 | 126)
+		binary.Write(&buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(0x80 | 127)
+		binary.Write(&buf, binary.BigEndian, uint64(n))
+	}
+	mask := [4]byte{0x12, 0x34, 0x56, 0x78}
+	buf.Write(mask[:])
+	for i, c := range payload {
+		buf.WriteByte(c ^ mask[i%4])
+	}
+	return buf.Bytes()
+}
+
+func closeCode(f wsFrame) uint16 {
+	if f.op != wsClose || len(f.payload) < 2 {
+		return 0
+	}
+	return binary.BigEndian.Uint16(f.payload)
+}
+
+func TestWSConnRead(t *testing.T) {
+	c, send, frames := wsPipe(t)
+	large := bytes.Repeat([]byte("x"), 70000)
+	send(
+		clientFrame(true, wsText, []byte(`{"template": "aGk="}`)),
+		// Messages may be split across frames, with control frames in between
+		clientFrame(false, wsText, []byte("hello, ")),
+		clientFrame(true, wsPing, []byte("ping")),
+		clientFrame(false, wsContinuation, []byte("wor")),
+		clientFrame(true, wsContinuation, []byte("ld")),
+		clientFrame(true, wsBinary, large),
+		clientFrame(true, wsClose, nil),
+	)
+	for _, want := range []struct {
+		op  byte
+		msg []byte
+	}{{wsText, []byte(`{"template": "aGk="}`)}, {wsText, []byte("hello, world")}, {wsBinary, large}} {
+		op, msg, err := c.read(1 << 20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if op != want.op || !bytes.Equal(msg, want.msg) {
+			t.Fatalf("expected message %d of %d bytes, got %d of %d bytes", want.op, len(want.msg), op, len(msg))
+		}
+	}
+	if f := <-frames; f.op != wsPong || string(f.payload) != "ping" {
+		t.Fatalf("expected ping to be answered with a pong, got %d %q", f.op, f.payload)
+	}
+	if _, _, err := c.read(1 << 20); err != errWSClosed {
+		t.Fatalf("expected errWSClosed once the client closed the connection, got: %v", err)
+	}
+	if f := <-frames; closeCode(f) != wsNormalClosure {
+		t.Fatalf("expected close to be answered, got %d %v", f.op, f.payload)
+	}
+}
+
+func TestWSConnReadErrors(t *testing.T) {
+	unmasked := clientFrame(true, wsText, []byte("hi"))
+	unmasked[1] &^= 0x80
+	unmasked = append(unmasked[:2], []byte("hi")...)
+	reserved := clientFrame(true, wsText, []byte("hi"))
+	reserved[0] |= 0x40
+	tests := []struct {
+		name   string
+		frames [][]byte
+		code   uint16
+	}{
+		{"unmasked", [][]byte{unmasked}, wsProtocolError},
+		{"reserved bits", [][]byte{reserved}, wsProtocolError},
+		{"unknown opcode", [][]byte{clientFrame(true, 0x3, nil)}, wsProtocolError},
+		{"unexpected continuation", [][]byte{clientFrame(true, wsContinuation, []byte("hi"))}, wsProtocolError},
+		{"interleaved messages", [][]byte{clientFrame(false, wsText, []byte("a")), clientFrame(true, wsText, []byte("b"))}, wsProtocolError},
+		{"too large", [][]byte{clientFrame(true, wsText, make([]byte, 200))}, wsMessageTooLarge},
+		{"too large once continued", [][]byte{clientFrame(false, wsText, make([]byte, 60)), clientFrame(true, wsContinuation, make([]byte, 60))}, wsMessageTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, send, frames := wsPipe(t)
+			send(tt.frames...)
+			if _, _, err := c.read(100); err == nil || err == errWSClosed {
+				t.Fatalf("expected a protocol error, got: %v", err)
+			}
+			if f := <-frames; closeCode(f) != tt.code {
+				t.Fatalf("expected the connection to be closed with %d, got %d %q", tt.code, f.op, f.payload)
+			}
+		})
+	}
+}
+
+func TestWSConnWrite(t *testing.T) {
+	for _, n := range []int{0, 125, 126, 0xffff, 0x10000} {
+		c, _, frames := wsPipe(t)
+		payload := bytes.Repeat([]byte{'p'}, n)
+		go c.write(wsBinary, payload)
+		if f := <-frames; f.op != wsBinary || !bytes.Equal(f.payload, payload) {
+			t.Fatalf("expected a frame of %d bytes to be sent whole, got %d of %d bytes", n, f.op, len(f.payload))
+		}
+	}
+}
+
+func TestUpgradeWebSocket(t *testing.T) {
+	upgraded := make(chan *wsConn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgradeWebSocket(w, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		upgraded <- c
+	}))
+	defer srv.Close()
+	conn, err := net.Dial("tcp", strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// The example handshake from RFC 6455
+	io.WriteString(conn, "GET /generate/ws HTTP/1.1\r\nHost: latte\r\nUpgrade: websocket\r\nConnection: keep-alive, Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected a 101, got %d", resp.StatusCode)
+	}
+	if accept := resp.Header.Get("Sec-WebSocket-Accept"); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("unexpected Sec-WebSocket-Accept %q", accept)
+	}
+	c := <-upgraded
+	defer c.Close()
+	conn.Write(clientFrame(true, wsText, []byte("hi")))
+	if _, msg, err := c.read(100); err != nil || string(msg) != "hi" {
+		t.Fatalf("expected to read what the client sent once upgraded, got %q: %v", msg, err)
+	}
+}
+
+func TestUpgradeWebSocketInvalid(t *testing.T) {
+	valid := http.Header{
+		"Connection":            {"Upgrade"},
+		"Upgrade":               {"websocket"},
+		"Sec-Websocket-Version": {"13"},
+		"Sec-Websocket-Key":     {"dGhlIHNhbXBsZSBub25jZQ=="},
+	}
+	tests := []struct {
+		name   string
+		header string
+		value  string
+	}{
+		{"not an upgrade", "Connection", "keep-alive"},
+		{"not websocket", "Upgrade", "h2c"},
+		{"old version", "Sec-Websocket-Version", "8"},
+		{"no key", "Sec-Websocket-Key", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/generate/ws", nil)
+			for k, v := range valid {
+				r.Header[k] = v
+			}
+			r.Header.Set(tt.header, tt.value)
+			w := httptest.NewRecorder()
+			_, err := upgradeWebSocket(w, r)
+			if _, ok := err.(*UpgradeError); !ok {
+				t.Fatalf("expected an *UpgradeError, got %T: %v", err, err)
+			}
+			if tt.header == "Sec-Websocket-Version" && w.Header().Get("Sec-WebSocket-Version") != "13" {
+				t.Error("expected the supported version to be advertised")
+			}
+		})
+	}
+}
+
+func TestCheckOrigin(t *testing.T) {
+	s := newTestServer(t, Config{WSOrigins: []string{"https://Editor.example.com/"}})
+	tests := []struct {
+		origin string
+		ok     bool
+	}{
+		{"", true},
+		{"https://latte.example.com", true},
+		{"http://LATTE.example.com", true},
+		{"https://editor.example.com", true},
+		{"https://evil.example.com", false},
+		{"https://latte.example.com.evil.com", false},
+		{"null", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "http://latte.example.com/generate/ws", nil)
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		if ok := s.checkOrigin(r); ok != tt.ok {
+			t.Errorf("origin %q: expected %v, got %v", tt.origin, tt.ok, ok)
+		}
+	}
+	anyOrigin := newTestServer(t, Config{WSOrigins: []string{"*"}})
+	r := httptest.NewRequest("GET", "http://latte.example.com/generate/ws", nil)
+	r.Header.Set("Origin", "https://evil.example.com")
+	if !anyOrigin.checkOrigin(r) {
+		t.Error("expected * to allow any origin")
+	}
+}